@@ -2,6 +2,7 @@
 package file
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -20,6 +21,7 @@ type LSFlags struct {
 	Recursive bool // Recursive listing
 	Human     bool // Human-readable sizes
 	Type      bool // Show type indicators
+	Inode     bool // Show inode numbers
 }
 
 // ParseLSFlags parses command-line flags for ls.
@@ -41,6 +43,7 @@ Options:
 	recursive := fs.Bool("R", false, "Recursively list directories")
 	human := fs.Bool("h", false, "Human-readable sizes")
 	typeFlag := fs.Bool("p", false, "Append / indicator to directories")
+	inode := fs.Bool("i", false, "Show inode numbers")
 
 	if err := fs.Parse(args); err != nil {
 		return nil, nil, err
@@ -55,6 +58,7 @@ Options:
 		Recursive: *recursive,
 		Human:     *human,
 		Type:      *typeFlag,
+		Inode:     *inode,
 	}
 
 	return flags, fs.Args(), nil
@@ -205,6 +209,10 @@ func listDirectory(fs vfs.FileSystem, path string, showAll bool, flags *LSFlags)
 			if flags.Type && entry.IsDir() {
 				name += "/"
 			}
+			if flags.Inode {
+				info, _ := entry.Info()
+				name = formatInode(info) + name
+			}
 			names = append(names, name)
 		}
 		fmt.Println(strings.Join(names, "  "))
@@ -244,6 +252,10 @@ func listRecursive(fs vfs.FileSystem, path string, showAll bool, flags *LSFlags)
 				if flags.Type && entry.IsDir() {
 					name += "/"
 				}
+				if flags.Inode {
+					info, _ := entry.Info()
+					name = formatInode(info) + name
+				}
 				names = append(names, name)
 			}
 			fmt.Println(strings.Join(names, "  "))
@@ -260,13 +272,27 @@ func formatLongEntry(info vfs.FileInfo, flags *LSFlags) string {
 	modTime := info.ModTime.Format("Jan 02 15:04")
 	size := info.Size
 
+	var prefix string
+	if flags.Inode {
+		prefix = formatInode(info)
+	}
+
 	if flags.Human {
-		return fmt.Sprintf("%s %6s %6s %s %s %s",
-			mode, "-", "-", modTime, FormatSize(size), info.Name)
+		return fmt.Sprintf("%s%s %6s %6s %s %s %s",
+			prefix, mode, "-", "-", modTime, FormatSize(size), info.Name)
 	}
 
-	return fmt.Sprintf("%s %6d %6d %s %s",
-		mode, info.Size, info.Size, modTime, info.Name)
+	return fmt.Sprintf("%s%s %6d %6d %s %s",
+		prefix, mode, info.Size, info.Size, modTime, info.Name)
+}
+
+// formatInode formats an inode number column, or "?" if the filesystem
+// does not report one.
+func formatInode(info vfs.FileInfo) string {
+	if st, ok := vfs.StatOf(info); ok {
+		return fmt.Sprintf("%d ", st.Ino)
+	}
+	return "? "
 }
 
 // Cat concatenates files and writes to stdout.
@@ -419,6 +445,88 @@ func copyDirectory(fs vfs.FileSystem, src, dst string) error {
 	return nil
 }
 
+// CopyArchive copies src to dst the way cp -a does. Directories are copied
+// recursively, symlinks are recreated rather than followed, and modes,
+// owners and times are preserved where the filesystem allows it. Files
+// that are hard links to each other under src stay linked under dst.
+func CopyArchive(fs vfs.FileSystem, src, dst string) error {
+	return copyArchive(fs, src, dst, make(map[uint64]string))
+}
+
+// copyArchive copies src to dst, recording in links the copy made for
+// each inode with several links.
+func copyArchive(fs vfs.FileSystem, src, dst string, links map[uint64]string) error {
+	info, err := fs.Lstat(src)
+	if err != nil {
+		return fmt.Errorf("cannot stat '%s': %v", src, err)
+	}
+	st, hasStat := vfs.StatOf(info)
+
+	switch {
+	case info.Mode&os.ModeSymlink != 0:
+		target, err := fs.Readlink(src)
+		if err != nil {
+			return fmt.Errorf("cannot read link '%s': %v", src, err)
+		}
+		if err := fs.Symlink(target, dst); err != nil {
+			return fmt.Errorf("cannot create '%s': %v", dst, err)
+		}
+		// Metadata calls would follow the link
+		return nil
+
+	case info.IsDir:
+		if err := fs.MkdirAll(dst, 0700); err != nil {
+			return fmt.Errorf("cannot create directory '%s': %v", dst, err)
+		}
+		entries, err := fs.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := copyArchive(fs, vfs.Join(src, entry.Name()), vfs.Join(dst, entry.Name()), links); err != nil {
+				return err
+			}
+		}
+
+	default:
+		if hasStat && st.Nlink > 1 {
+			if first, ok := links[st.Ino]; ok {
+				if err := fs.Link(first, dst); err != nil {
+					return fmt.Errorf("cannot link '%s': %v", dst, err)
+				}
+				return nil
+			}
+			links[st.Ino] = dst
+		}
+		if err := copyFile(fs, src, dst); err != nil {
+			return err
+		}
+	}
+
+	return preserveMetadata(fs, dst, info, st)
+}
+
+// preserveMetadata gives dst the mode, owner and times of info. Like cp,
+// it does not fail when the caller may not give the file away.
+func preserveMetadata(fs vfs.FileSystem, dst string, info vfs.FileInfo, st *vfs.Stat) error {
+	if st != nil {
+		if err := fs.Chown(dst, st.Uid, st.Gid); err != nil && !errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("cannot preserve ownership of '%s': %v", dst, err)
+		}
+	}
+	if err := fs.Chmod(dst, info.Mode&(os.ModePerm|os.ModeSticky|os.ModeSetuid|os.ModeSetgid)); err != nil {
+		return fmt.Errorf("cannot preserve mode of '%s': %v", dst, err)
+	}
+	atime := info.ModTime
+	if st != nil && !st.Atime.IsZero() {
+		atime = st.Atime
+	}
+	if err := fs.Chtimes(dst, atime, info.ModTime); err != nil {
+		return fmt.Errorf("cannot preserve times of '%s': %v", dst, err)
+	}
+	return nil
+}
+
 // Move moves or renames files and directories.
 func Move(fs vfs.FileSystem, src, dst string) error {
 	return fs.Rename(src, dst)
@@ -3,6 +3,10 @@ package file
 import (
 	"os"
 	"testing"
+	"time"
+
+	"webos/pkg/vfs"
+	"webos/pkg/vfs/memfs"
 )
 
 func TestFormatSize(t *testing.T) {
@@ -75,3 +79,47 @@ func TestParseLSFlagsDefaults(t *testing.T) {
 		t.Errorf("Args = %v, want []", args)
 	}
 }
+
+func TestCopyArchive(t *testing.T) {
+	fs := memfs.New()
+	fs.MkdirAll("/src/dir", 0750)
+	fs.WriteFile("/src/dir/a", []byte("hello"), 0600)
+	fs.Link("/src/dir/a", "/src/b")
+	fs.Symlink("dir/a", "/src/link")
+	fs.Chown("/src/dir/a", 1000, 100)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fs.Chtimes("/src/dir", mtime, mtime)
+
+	if err := CopyArchive(fs, "/src", "/dst"); err != nil {
+		t.Fatalf("CopyArchive returned error: %v", err)
+	}
+
+	a, err := fs.Stat("/dst/dir/a")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	b, err := fs.Stat("/dst/b")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	sa, _ := vfs.StatOf(a)
+	sb, _ := vfs.StatOf(b)
+	if sa.Ino != sb.Ino || sa.Nlink != 2 {
+		t.Errorf("Copied links have inodes %d and %d with %d links, expected one inode with 2", sa.Ino, sb.Ino, sa.Nlink)
+	}
+	if a.Mode.Perm() != 0600 || sa.Uid != 1000 || sa.Gid != 100 {
+		t.Errorf("Copy has mode %v and owner %d:%d", a.Mode, sa.Uid, sa.Gid)
+	}
+
+	if target, err := fs.Readlink("/dst/link"); err != nil || target != "dir/a" {
+		t.Errorf("Readlink = %q, %v, expected dir/a", target, err)
+	}
+
+	dir, err := fs.Stat("/dst/dir")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if dir.Mode.Perm() != 0750 || !dir.ModTime.Equal(mtime) {
+		t.Errorf("Copied directory has mode %v and mtime %v", dir.Mode, dir.ModTime)
+	}
+}
@@ -8,7 +8,13 @@ import (
 	"os"
 	"os/user"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+
+	"webos/pkg/vfs"
+	"webos/pkg/vfs/procfs"
 )
 
 // PSFlags holds command-line flags for ps.
@@ -17,6 +23,11 @@ type PSFlags struct {
 	Full     bool   // Full command line
 	NoHeader bool   // No header
 	SortBy   string // Sort by field
+
+	// Proc is a procfs filesystem to list processes from. Processes in it
+	// have no owner, so all of them are listed. The host is simulated
+	// when it is nil.
+	Proc vfs.FileSystem
 }
 
 // ParsePSFlags parses command-line flags for ps.
@@ -59,6 +70,22 @@ func PS(flags *PSFlags, writer io.Writer) error {
 		}
 	}
 
+	if flags.Proc != nil {
+		processes, err := ReadProcesses(flags.Proc, flags.Full)
+		if err != nil {
+			return err
+		}
+		for _, p := range processes {
+			if flags.Full {
+				fmt.Fprintf(writer, "%s %5d %5d  0 -    ?   %s %s\n",
+					p.UID, p.PID, p.PPID, p.Time, p.Cmd)
+			} else {
+				fmt.Fprintf(writer, "%6d ?   %s %s\n", p.PID, p.Time, p.Cmd)
+			}
+		}
+		return nil
+	}
+
 	// Get current user
 	currentUser, _ := user.Current()
 	uid := currentUser.Uid
@@ -103,10 +130,86 @@ type ProcessInfo struct {
 	Time string
 }
 
+// ReadProcesses lists the processes in a procfs filesystem, ordered by PID.
+// With full set, Cmd holds the whole command line rather than the command.
+func ReadProcesses(proc vfs.FileSystem, full bool) ([]ProcessInfo, error) {
+	entries, err := proc.ReadDir("/")
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []ProcessInfo
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		// Processes may exit while being listed
+		stat, err := proc.ReadFile(fmt.Sprintf("/%d/stat", pid))
+		if err != nil {
+			continue
+		}
+		info, ok := parseProcStat(stat)
+		if !ok {
+			continue
+		}
+
+		if full {
+			cmdline, err := proc.ReadFile(fmt.Sprintf("/%d/cmdline", pid))
+			if err == nil && len(cmdline) > 0 {
+				info.Cmd = strings.Join(strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00"), " ")
+			}
+		}
+		processes = append(processes, info)
+	}
+
+	sort.Slice(processes, func(i, j int) bool {
+		return processes[i].PID < processes[j].PID
+	})
+	return processes, nil
+}
+
+// parseProcStat parses a procfs stat line: pid, command in parentheses,
+// state, parent pid, priority and CPU ticks, followed by other fields.
+func parseProcStat(data []byte) (ProcessInfo, bool) {
+	line := string(data)
+	open := strings.IndexByte(line, '(')
+	end := strings.LastIndexByte(line, ')')
+	if open < 0 || end < open {
+		return ProcessInfo{}, false
+	}
+
+	fields := strings.Fields(line[end+1:])
+	pid, err := strconv.Atoi(strings.TrimSpace(line[:open]))
+	if err != nil || len(fields) < 4 {
+		return ProcessInfo{}, false
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	ticks, _ := strconv.ParseInt(fields[3], 10, 64)
+
+	seconds := ticks / procfs.ClockTicks
+	return ProcessInfo{
+		PID:  pid,
+		PPID: ppid,
+		UID:  "-",
+		TTY:  "?",
+		Cmd:  line[open+1 : end],
+		Time: fmt.Sprintf("%d:%02d", seconds/60, seconds%60),
+	}, true
+}
+
 // DFFlags holds command-line flags for df.
 type DFFlags struct {
 	Human bool   // Human-readable sizes
 	Type  string // Filter by filesystem type
+	Mount string // Where Quota's filesystem is mounted, "/" if empty
+
+	// Quota reports space on a filesystem with quotas, one line for each
+	// user and group with a block limit, named like "user:1000" and sized
+	// by the hard limit, or the soft limit if there is none. The host is
+	// simulated when it is nil.
+	Quota *vfs.Quota
 }
 
 // ParseDFFlags parses command-line flags for df.
@@ -138,11 +241,16 @@ func DF(flags *DFFlags, writer io.Writer) error {
 		fmt.Fprintln(writer, "Filesystem     1K-blocks    Used Available Use% Mounted on")
 	}
 
-	// Simulate filesystem info
-	fsInfo := []FSInfo{
-		{Filesystem: "/dev/sda1", Total: 48838668, Used: 25482340, Available: 23356328, UsePct: 52, Mount: "/"},
-		{Filesystem: "/dev/sda2", Total: 97663000, Used: 45000000, Available: 52663000, UsePct: 46, Mount: "/home"},
-		{Filesystem: "tmpfs", Total: 1024000, Used: 102400, Available: 921600, UsePct: 10, Mount: "/tmp"},
+	var fsInfo []FSInfo
+	if flags.Quota != nil {
+		fsInfo = quotaFSInfo(flags.Quota, flags.Mount)
+	} else {
+		// Simulate filesystem info
+		fsInfo = []FSInfo{
+			{Filesystem: "/dev/sda1", Total: 48838668, Used: 25482340, Available: 23356328, UsePct: 52, Mount: "/"},
+			{Filesystem: "/dev/sda2", Total: 97663000, Used: 45000000, Available: 52663000, UsePct: 46, Mount: "/home"},
+			{Filesystem: "tmpfs", Total: 1024000, Used: 102400, Available: 921600, UsePct: 10, Mount: "/tmp"},
+		}
 	}
 
 	for _, fs := range fsInfo {
@@ -162,6 +270,37 @@ func DF(flags *DFFlags, writer io.Writer) error {
 	return nil
 }
 
+// quotaFSInfo returns a line of df output for each user and group with a
+// block limit in q, in 1K blocks.
+func quotaFSInfo(q *vfs.Quota, mount string) []FSInfo {
+	if mount == "" {
+		mount = "/"
+	}
+
+	var fsInfo []FSInfo
+	for _, r := range q.Report() {
+		limit := r.BlockHard
+		if limit == 0 {
+			limit = r.BlockSoft
+		}
+		if limit == 0 {
+			continue
+		}
+
+		total := limit * vfs.QuotaBlockSize / 1024
+		used := r.Blocks * vfs.QuotaBlockSize / 1024
+		fsInfo = append(fsInfo, FSInfo{
+			Filesystem: fmt.Sprintf("%s:%d", r.Kind, r.ID),
+			Total:      total,
+			Used:       used,
+			Available:  max(total-used, 0),
+			UsePct:     int(min(used*100/total, 100)),
+			Mount:      mount,
+		})
+	}
+	return fsInfo
+}
+
 // FSInfo holds filesystem information.
 type FSInfo struct {
 	Filesystem string
@@ -177,6 +316,16 @@ type DUFlags struct {
 	Human    bool // Human-readable sizes
 	Summary  bool // Only show total
 	MaxDepth int  // Maximum depth
+
+	// FS is the filesystem to measure. Files with several hard links are
+	// counted once, under the first name found. Sizes are simulated when
+	// it and Quota are nil.
+	FS vfs.FileSystem
+
+	// Quota, when set, gives the sizes instead of walking FS: each path
+	// is the blocks charged beneath it, with hard links counted once.
+	// Subdirectories are listed from FS if it is set.
+	Quota *vfs.Quota
 }
 
 // ParseDUFlags parses command-line flags for du.
@@ -209,18 +358,110 @@ func DU(paths []string, flags *DUFlags, writer io.Writer) error {
 		paths = []string{"."}
 	}
 
+	if flags.Quota != nil {
+		for _, path := range paths {
+			if err := quotaDiskUsage(path, 0, flags, writer); err != nil {
+				return fmt.Errorf("du: %s: %v", path, err)
+			}
+		}
+		return nil
+	}
+
+	if flags.FS != nil {
+		seen := make(map[uint64]bool)
+		for _, path := range paths {
+			if _, err := diskUsage(flags.FS, path, 0, flags, seen, writer); err != nil {
+				return fmt.Errorf("du: %s: %v", path, err)
+			}
+		}
+		return nil
+	}
+
 	for _, path := range paths {
-		size := estimateSize(path)
-		if flags.Human {
-			fmt.Fprintf(writer, "%6dM\t%s\n", size/1024/1024, path)
-		} else {
-			fmt.Fprintf(writer, "%d\t%s\n", size, path)
+		printUsage(writer, estimateSize(path), path, flags)
+	}
+
+	return nil
+}
+
+// diskUsage returns the size of everything under path and prints the
+// directories within the requested depth. Inodes already in seen are
+// skipped, so hard links are counted once.
+func diskUsage(fs vfs.FileSystem, path string, depth int, flags *DUFlags, seen map[uint64]bool, writer io.Writer) (int64, error) {
+	info, err := fs.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	if !info.IsDir {
+		if st, ok := vfs.StatOf(info); ok && st.Nlink > 1 {
+			if seen[st.Ino] {
+				return 0, nil
+			}
+			seen[st.Ino] = true
+		}
+		if depth == 0 {
+			printUsage(writer, info.Size, path, flags)
+		}
+		return info.Size, nil
+	}
+
+	entries, err := fs.ReadDir(path)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, entry := range entries {
+		n, err := diskUsage(fs, vfs.Join(path, entry.Name()), depth+1, flags, seen, writer)
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+
+	if depth == 0 || (!flags.Summary && (flags.MaxDepth < 0 || depth <= flags.MaxDepth)) {
+		printUsage(writer, size, path, flags)
+	}
+	return size, nil
+}
+
+// quotaDiskUsage prints the size charged to path and, within the requested
+// depth, to the directories beneath it.
+func quotaDiskUsage(path string, depth int, flags *DUFlags, writer io.Writer) error {
+	if flags.FS != nil && !flags.Summary && (flags.MaxDepth < 0 || depth < flags.MaxDepth) {
+		info, err := flags.FS.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir {
+			entries, err := flags.FS.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if entry.IsDir() {
+					if err := quotaDiskUsage(vfs.Join(path, entry.Name()), depth+1, flags, writer); err != nil {
+						return err
+					}
+				}
+			}
 		}
 	}
 
+	blocks, _ := flags.Quota.Usage(path)
+	printUsage(writer, blocks*vfs.QuotaBlockSize, path, flags)
 	return nil
 }
 
+// printUsage prints one line of du output.
+func printUsage(writer io.Writer, size int64, path string, flags *DUFlags) {
+	if flags.Human {
+		fmt.Fprintf(writer, "%6dM\t%s\n", size/1024/1024, path)
+	} else {
+		fmt.Fprintf(writer, "%d\t%s\n", size, path)
+	}
+}
+
 // estimateSize estimates the size of a path.
 func estimateSize(path string) int64 {
 	// Simplified estimation
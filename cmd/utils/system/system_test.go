@@ -3,7 +3,13 @@ package system
 import (
 	"bytes"
 	"os"
+	"strings"
 	"testing"
+
+	"webos/pkg/process"
+	"webos/pkg/vfs"
+	"webos/pkg/vfs/memfs"
+	"webos/pkg/vfs/procfs"
 )
 
 func TestParsePSFlags(t *testing.T) {
@@ -44,6 +50,26 @@ func TestPS(t *testing.T) {
 	}
 }
 
+func TestPSFromProc(t *testing.T) {
+	pm := process.NewProcessManager(nil)
+	pm.CreateProcess(&process.CreateConfig{Command: "init"})
+	pm.CreateProcess(&process.CreateConfig{Command: "sh", Args: []string{"-l"}})
+
+	flags := &PSFlags{NoHeader: true, Full: true, Proc: procfs.New(pm)}
+	var buf bytes.Buffer
+	if err := PS(flags, &buf); err != nil {
+		t.Fatalf("PS returned error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("PS listed %d processes, expected 2: %q", len(lines), buf.String())
+	}
+	if !strings.HasSuffix(lines[0], " init") || !strings.HasSuffix(lines[1], " sh -l") {
+		t.Errorf("PS output is %q", buf.String())
+	}
+}
+
 func TestParseDFFlags(t *testing.T) {
 	flags, err := ParseDFFlags([]string{"-h"})
 	if err != nil {
@@ -94,6 +120,79 @@ func TestDU(t *testing.T) {
 	}
 }
 
+func TestDUHardLinks(t *testing.T) {
+	fs := memfs.New()
+	fs.MkdirAll("/data/sub", 0755)
+	fs.WriteFile("/data/a", make([]byte, 100), 0644)
+	fs.WriteFile("/data/sub/b", make([]byte, 10), 0644)
+	if err := fs.Link("/data/sub/b", "/data/sub/c"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	flags := &DUFlags{MaxDepth: -1, FS: fs}
+	var buf bytes.Buffer
+	if err := DU([]string{"/data"}, flags, &buf); err != nil {
+		t.Fatalf("DU returned error: %v", err)
+	}
+	if want := "10\t/data/sub\n110\t/data\n"; buf.String() != want {
+		t.Errorf("DU output is %q, expected %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	flags.Summary = true
+	if err := DU([]string{"/data/sub"}, flags, &buf); err != nil {
+		t.Fatalf("DU returned error: %v", err)
+	}
+	if want := "10\t/data/sub\n"; buf.String() != want {
+		t.Errorf("DU -s output is %q, expected %q", buf.String(), want)
+	}
+}
+
+func TestDFQuota(t *testing.T) {
+	fs := memfs.New()
+	fs.Mkdir("/home", 0777)
+	q, err := vfs.NewQuota(fs)
+	if err != nil {
+		t.Fatalf("NewQuota failed: %v", err)
+	}
+	q.SetLimits(vfs.QuotaUser, 1000, vfs.QuotaLimits{BlockHard: 100})
+	q.FS(1000, 100).WriteFile("/home/file", make([]byte, 25*vfs.QuotaBlockSize), 0644)
+
+	var buf bytes.Buffer
+	if err := DF(&DFFlags{Quota: q, Mount: "/home"}, &buf); err != nil {
+		t.Fatalf("DF returned error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("DF output is %q, expected a header and one line", buf.String())
+	}
+	if fields := strings.Fields(lines[1]); strings.Join(fields, " ") != "user:1000 100 25 75 25% /home" {
+		t.Errorf("DF line is %q", lines[1])
+	}
+}
+
+func TestDUQuota(t *testing.T) {
+	fs := memfs.New()
+	fs.MkdirAll("/data/sub", 0777)
+	q, err := vfs.NewQuota(fs)
+	if err != nil {
+		t.Fatalf("NewQuota failed: %v", err)
+	}
+	qfs := q.FS(1000, 100)
+	qfs.WriteFile("/data/a", make([]byte, 2*vfs.QuotaBlockSize), 0644)
+	qfs.WriteFile("/data/sub/b", make([]byte, 10), 0644)
+	qfs.Link("/data/sub/b", "/data/sub/c")
+
+	var buf bytes.Buffer
+	flags := &DUFlags{MaxDepth: -1, FS: fs, Quota: q}
+	if err := DU([]string{"/data"}, flags, &buf); err != nil {
+		t.Fatalf("DU returned error: %v", err)
+	}
+	if want := "1024\t/data/sub\n3072\t/data\n"; buf.String() != want {
+		t.Errorf("DU output is %q, expected %q", buf.String(), want)
+	}
+}
+
 func TestParseUnameFlags(t *testing.T) {
 	flags, err := ParseUnameFlags([]string{"-a"})
 	if err != nil {
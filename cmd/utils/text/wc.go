@@ -2,11 +2,15 @@ package text
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+
+	"webos/pkg/vfs"
 )
 
 // WCFlags holds command-line flags for wc.
@@ -220,8 +224,15 @@ func Tail(reader io.Reader, flags *TailFlags, writer io.Writer) error {
 
 // tailBytes prints last N bytes from input.
 func tailBytes(reader io.Reader, n int, writer io.Writer) error {
-	// Seek to near end if possible
-	return nil
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	if len(data) > n {
+		data = data[len(data)-n:]
+	}
+	_, err = writer.Write(data)
+	return err
 }
 
 // TailFile prints last N lines/bytes from a file.
@@ -234,3 +245,71 @@ func TailFile(path string, flags *TailFlags) error {
 
 	return Tail(file, flags, os.Stdout)
 }
+
+// TailFollow prints the end of a file in fs like Tail and then, like
+// tail -f, prints data appended to it until stop is closed. A file that
+// shrinks or is recreated is printed again from the start. Changes are
+// picked up with a vfs.Watcher, so fs must implement vfs.Notifier.
+func TailFollow(fs vfs.FileSystem, path string, flags *TailFlags, writer io.Writer, stop <-chan struct{}) error {
+	w, err := vfs.NewWatcher(fs)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := w.Add(path, false); err != nil {
+		return err
+	}
+
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := Tail(bytes.NewReader(data), flags, writer); err != nil {
+		return err
+	}
+	offset := int64(len(data))
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Path != vfs.Clean(path) || ev.Op&(vfs.OpCreate|vfs.OpWrite) == 0 {
+				continue
+			}
+			if ev.Op&vfs.OpCreate != 0 {
+				offset = 0
+			}
+			if offset, err = copyAppended(fs, path, offset, writer); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// copyAppended writes the contents of path from offset on and returns the
+// new end. A file shorter than offset was truncated and is copied whole.
+func copyAppended(fs vfs.FileSystem, path string, offset int64, writer io.Writer) (int64, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return offset, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return offset, err
+	}
+	if info.Size < offset {
+		offset = 0
+	}
+
+	n, err := io.Copy(writer, io.NewSectionReader(file, offset, info.Size-offset))
+	return offset + n, err
+}
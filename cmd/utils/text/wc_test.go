@@ -1,8 +1,14 @@
 package text
 
 import (
+	"bytes"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"webos/pkg/vfs"
+	"webos/pkg/vfs/memfs"
 )
 
 func TestParseWCFlags(t *testing.T) {
@@ -114,3 +120,69 @@ func TestParseCutFlags(t *testing.T) {
 		t.Errorf("Args = %v, want [file.txt]", args)
 	}
 }
+
+func TestTailBytes(t *testing.T) {
+	var out bytes.Buffer
+	if err := Tail(strings.NewReader("hello world"), &TailFlags{Bytes: 5}, &out); err != nil {
+		t.Fatalf("Tail failed: %v", err)
+	}
+	if out.String() != "world" {
+		t.Errorf("Tail -c 5 = %q", out.String())
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for a writer and a polling reader.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTailFollow(t *testing.T) {
+	fs := memfs.New()
+	fs.WriteFile("/log", []byte("one\ntwo\nthree\n"), 0644)
+
+	var out syncBuffer
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- TailFollow(fs, "/log", &TailFlags{Lines: 2}, &out, stop)
+	}()
+
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for out.String() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("output %q, expected %q", out.String(), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor("two\nthree\n")
+
+	file, _ := fs.OpenFile("/log", vfs.O_WRONLY|vfs.O_APPEND, 0)
+	file.Write([]byte("four\n"))
+	file.Close()
+	waitFor("two\nthree\nfour\n")
+
+	// A truncated file is followed from its new start
+	fs.WriteFile("/log", []byte("fresh\n"), 0644)
+	waitFor("two\nthree\nfour\nfresh\n")
+
+	close(stop)
+	if err := <-done; err != nil {
+		t.Errorf("TailFollow returned %v", err)
+	}
+}
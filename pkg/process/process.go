@@ -258,6 +258,63 @@ func NewProcess(pid int, parentPID int, command string, args []string) *Process
 	}
 }
 
+// ProcessInfo is a copy of a process's state taken at one moment.
+type ProcessInfo struct {
+	PID         int
+	ParentPID   int
+	State       ProcessState
+	ExitCode    int
+	CreatedAt   time.Time
+	StartedAt   time.Time
+	FinishedAt  time.Time
+	Command     string
+	Args        []string
+	Env         []string
+	Cwd         string
+	Priority    Priority
+	Limits      *ResourceLimits
+	Files       []File
+	CPUUsage    time.Duration
+	MemoryUsage int64
+}
+
+// Info atomically copies the process state.
+func (p *Process) Info() ProcessInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	files := make([]File, len(p.Files))
+	for i, f := range p.Files {
+		files[i] = *f
+		files[i].Data = append([]byte(nil), f.Data...)
+	}
+
+	var limits *ResourceLimits
+	if p.Limits != nil {
+		copied := *p.Limits
+		limits = &copied
+	}
+
+	return ProcessInfo{
+		PID:         p.PID,
+		ParentPID:   p.ParentPID,
+		State:       p.State,
+		ExitCode:    p.ExitCode,
+		CreatedAt:   p.CreatedAt,
+		StartedAt:   p.StartedAt,
+		FinishedAt:  p.FinishedAt,
+		Command:     p.Command,
+		Args:        append([]string(nil), p.Args...),
+		Env:         append([]string(nil), p.Env...),
+		Cwd:         p.Cwd,
+		Priority:    p.Priority,
+		Limits:      limits,
+		Files:       files,
+		CPUUsage:    p.CPUUsage,
+		MemoryUsage: p.MemoryUsage,
+	}
+}
+
 // SetState atomically sets the process state.
 func (p *Process) SetState(state ProcessState) {
 	p.mu.Lock()
@@ -22,12 +22,13 @@ type PTY struct {
 	closed bool
 }
 
-// Pipe represents one side of a PTY.
+// Pipe represents one side of a PTY. Data written to the master is read
+// from the slave, as keyboard input is by the program on the terminal, and
+// data written to the slave is read from the master.
 type Pipe struct {
 	pty       *PTY
 	isMaster  bool
 	readBuf   bytes.Buffer
-	writeBuf  bytes.Buffer
 	readCond  *sync.Cond
 	writeCond *sync.Cond
 }
@@ -77,17 +78,23 @@ func (p *PTY) Terminal() *Terminal {
 // Close closes the PTY.
 func (p *PTY) Close() error {
 	p.mu.Lock()
-	defer p.mu.Unlock()
-
 	if p.closed {
+		p.mu.Unlock()
 		return nil
 	}
 	p.closed = true
-
-	p.master.readCond.Broadcast()
-	p.master.writeCond.Broadcast()
-	p.slave.readCond.Broadcast()
-	p.slave.writeCond.Broadcast()
+	p.mu.Unlock()
+
+	// Wake blocked readers and writers, taking their locks so that none
+	// can miss the wakeup between checking closed and waiting
+	for _, cond := range []*sync.Cond{
+		p.master.readCond, p.master.writeCond,
+		p.slave.readCond, p.slave.writeCond,
+	} {
+		cond.L.Lock()
+		cond.Broadcast()
+		cond.L.Unlock()
+	}
 
 	return nil
 }
@@ -138,17 +145,18 @@ func (p *Pipe) Write(data []byte) (int, error) {
 
 		// For master: writes go to slave (terminal input)
 		// For slave: writes go to master (terminal output)
+		peer := p.pty.master
 		if p.isMaster {
 			// Master writes to terminal (simulating process output)
 			p.pty.term.Write(data)
-			p.pty.slave.readCond.Broadcast()
-		} else {
-			// Slave writes are stored for master to read
-			n, _ := p.writeBuf.Write(data)
-			p.pty.master.readCond.Broadcast()
-			return n, nil
+			peer = p.pty.slave
 		}
 
+		peer.readCond.L.Lock()
+		peer.readBuf.Write(data)
+		peer.readCond.Broadcast()
+		peer.readCond.L.Unlock()
+
 		return len(data), nil
 	}
 }
@@ -347,6 +347,30 @@ func TestPTY(t *testing.T) {
 	}
 }
 
+func TestPTYPipes(t *testing.T) {
+	pty, err := NewPTY(80, 24)
+	if err != nil {
+		t.Fatalf("failed to create PTY: %v", err)
+	}
+	defer pty.Close()
+
+	buf := make([]byte, 16)
+
+	// Input written to the master is read by the slave
+	pty.Master().Write([]byte("ls\n"))
+	n, err := pty.Slave().Read(buf)
+	if err != nil || string(buf[:n]) != "ls\n" {
+		t.Errorf("slave read %q, %v, want %q", buf[:n], err, "ls\n")
+	}
+
+	// Output written to the slave is read by the master
+	pty.Slave().Write([]byte("file.txt\n"))
+	n, err = pty.Master().Read(buf)
+	if err != nil || string(buf[:n]) != "file.txt\n" {
+		t.Errorf("master read %q, %v, want %q", buf[:n], err, "file.txt\n")
+	}
+}
+
 func TestPTYSizes(t *testing.T) {
 	pty, err := NewPTY(80, 24)
 	if err != nil {
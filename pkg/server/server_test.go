@@ -10,6 +10,9 @@ import (
 	"path/filepath"
 	"testing"
 	"time"
+
+	vfs "webos/pkg/vfs"
+	"webos/pkg/vfs/memfs"
 )
 
 func TestServer_New(t *testing.T) {
@@ -279,6 +282,35 @@ func TestStaticFileHandler_ServeHTTP_MethodNotAllowed(t *testing.T) {
 	}
 }
 
+func TestStaticFileHandler_ServeHTTP_VFS(t *testing.T) {
+	fs := memfs.New()
+	fs.MkdirAll("/docs", 0755)
+	fs.WriteFile("/docs/index.html", []byte("<h1>docs</h1>"), 0644)
+
+	handler := NewStaticFileHandlerFS(vfs.HTTPFileSystem(fs))
+
+	req := httptest.NewRequest(http.MethodGet, "/docs/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if w.Body.String() != "<h1>docs</h1>" {
+		t.Errorf("expected index file, got %q", w.Body.String())
+	}
+	if w.Header().Get("ETag") == "" {
+		t.Error("expected an ETag")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/docs/missing.html", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
 func TestFileServer(t *testing.T) {
 	handler := FileServer("./static")
 	if handler == nil {
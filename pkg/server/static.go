@@ -7,10 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -19,6 +21,7 @@ import (
 // StaticFileHandler handles static file serving with caching and MIME types.
 type StaticFileHandler struct {
 	dir            string
+	fs             http.FileSystem
 	cacheControl   string
 	indexFiles     []string
 	useETag        bool
@@ -28,8 +31,17 @@ type StaticFileHandler struct {
 
 // NewStaticFileHandler creates a new static file handler.
 func NewStaticFileHandler(dir string) *StaticFileHandler {
+	h := NewStaticFileHandlerFS(http.Dir(dir))
+	h.dir = dir
+	return h
+}
+
+// NewStaticFileHandlerFS creates a static file handler serving from fsys,
+// such as http.FS of an embed.FS or vfs.HTTPFileSystem of a virtual
+// filesystem.
+func NewStaticFileHandlerFS(fsys http.FileSystem) *StaticFileHandler {
 	return &StaticFileHandler{
-		dir:            dir,
+		fs:             fsys,
 		cacheControl:   "public, max-age=3600",
 		indexFiles:     []string{"index.html", "index.htm"},
 		useETag:        true,
@@ -65,12 +77,12 @@ func (h *StaticFileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	path := filepath.Join(h.dir, filepath.Clean(r.URL.Path))
+	name := path.Clean("/" + r.URL.Path)
 
 	// Check if path is a directory
-	fi, err := os.Stat(path)
+	fi, err := h.stat(name)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			http.Error(w, "Not Found", http.StatusNotFound)
 			return
 		}
@@ -81,8 +93,8 @@ func (h *StaticFileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if fi.IsDir() {
 		// Try to serve index file
 		for _, indexFile := range h.indexFiles {
-			indexPath := filepath.Join(path, indexFile)
-			if fi, err := os.Stat(indexPath); err == nil && !fi.IsDir() {
+			indexPath := path.Join(name, indexFile)
+			if fi, err := h.stat(indexPath); err == nil && !fi.IsDir() {
 				h.serveFile(w, r, indexPath)
 				return
 			}
@@ -92,14 +104,24 @@ func (h *StaticFileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.serveFile(w, r, path)
+	h.serveFile(w, r, name)
+}
+
+// stat describes the file at name.
+func (h *StaticFileHandler) stat(name string) (fs.FileInfo, error) {
+	file, err := h.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Stat()
 }
 
 // serveFile serves a single file with proper headers and caching.
-func (h *StaticFileHandler) serveFile(w http.ResponseWriter, r *http.Request, path string) {
-	file, err := os.Open(path)
+func (h *StaticFileHandler) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	file, err := h.fs.Open(name)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			http.Error(w, "Not Found", http.StatusNotFound)
 			return
 		}
@@ -125,7 +147,7 @@ func (h *StaticFileHandler) serveFile(w http.ResponseWriter, r *http.Request, pa
 	}
 
 	// Set content type
-	contentType := mime.TypeByExtension(filepath.Ext(path))
+	contentType := mime.TypeByExtension(path.Ext(name))
 	if contentType == "" {
 		contentType = "application/octet-stream"
 	}
@@ -139,7 +161,7 @@ func (h *StaticFileHandler) serveFile(w http.ResponseWriter, r *http.Request, pa
 
 	// Generate ETag
 	if h.useETag {
-		hash := h.fileHash(path)
+		hash := h.fileHash(file)
 		etag := fmt.Sprintf(`"%s"`, hash)
 		w.Header().Set("ETag", etag)
 
@@ -163,7 +185,7 @@ func (h *StaticFileHandler) serveFile(w http.ResponseWriter, r *http.Request, pa
 }
 
 // serveRange handles HTTP range requests.
-func (h *StaticFileHandler) serveRange(w http.ResponseWriter, r *http.Request, file *os.File, fi os.FileInfo, ranges string, contentType string) {
+func (h *StaticFileHandler) serveRange(w http.ResponseWriter, r *http.Request, file http.File, fi os.FileInfo, ranges string, contentType string) {
 	parts := strings.SplitN(ranges, "=", 2)
 	if len(parts) != 2 || parts[0] != "bytes" {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
@@ -218,14 +240,15 @@ func parseRangeBounds(parts []string, size int64) (int64, int64) {
 	return start, end
 }
 
-// fileHash computes a hash of the file for ETag.
-func (h *StaticFileHandler) fileHash(path string) string {
-	data, err := os.ReadFile(path)
-	if err != nil {
+// fileHash computes a hash of the file for ETag, leaving the file at its
+// start.
+func (h *StaticFileHandler) fileHash(file http.File) string {
+	hash := sha256.New()
+	_, err := io.Copy(hash, file)
+	if _, seekErr := file.Seek(0, io.SeekStart); err != nil || seekErr != nil {
 		return ""
 	}
-	hash := sha256.Sum256(data)
-	return hex.EncodeToString(hash[:8])
+	return hex.EncodeToString(hash.Sum(nil)[:8])
 }
 
 // MimeTypes maps file extensions to MIME types.
@@ -387,6 +387,22 @@ func GetInfo(device BlockDevice) DeviceInfo {
 	case *ReadOnlyDevice:
 		info.Type = "readonly"
 		info.ReadOnly = true
+	case *IntegrityBlockDevice:
+		info.Type = "integrity"
+	case *LogicalVolume:
+		info.Type = "volume"
+	case *TieredBlockDevice:
+		info.Type = "tiered"
+	case *EncryptedBlockDevice:
+		info.Type = "encrypted"
+	case *DedupBlockDevice:
+		info.Type = "dedup"
+	case *JournaledBlockDevice:
+		info.Type = "journaled"
+	case *ImageBlockDevice:
+		info.Type = "image"
+	case *MeteredBlockDevice:
+		info.Type = "metered"
 	default:
 		info.Type = "unknown"
 	}
@@ -469,74 +485,6 @@ func ValidateChecksum(data []byte, expected uint32) bool {
 	return CalculateChecksum(data) == expected
 }
 
-// TieredBlockDevice provides multiple storage tiers (e.g., SSD, HDD).
-type TieredBlockDevice struct {
-	tiers   []BlockDevice
-	cutoffs []uint64 // Block counts for each tier
-}
-
-// NewTieredBlockDevice creates a tiered storage device.
-func NewTieredBlockDevice(tiers []BlockDevice, cutoffs []uint64) *TieredBlockDevice {
-	return &TieredBlockDevice{
-		tiers:   tiers,
-		cutoffs: cutoffs,
-	}
-}
-
-// Read selects the appropriate tier and reads the block.
-func (d *TieredBlockDevice) Read(block uint64, data []byte) error {
-	device := d.selectDevice(block)
-	return device.Read(block, data)
-}
-
-// Write writes to the fastest tier.
-func (d *TieredBlockDevice) Write(block uint64, data []byte) error {
-	return d.tiers[0].Write(block, data)
-}
-
-// selectDevice chooses the appropriate storage tier.
-func (d *TieredBlockDevice) selectDevice(block uint64) BlockDevice {
-	for i, cutoff := range d.cutoffs {
-		if block < cutoff {
-			return d.tiers[i]
-		}
-	}
-	// Default to last tier
-	return d.tiers[len(d.tiers)-1]
-}
-
-// BlockSize returns the first tier's block size.
-func (d *TieredBlockDevice) BlockSize() int {
-	return d.tiers[0].BlockSize()
-}
-
-// BlockCount returns the total capacity across all tiers.
-func (d *TieredBlockDevice) BlockCount() uint64 {
-	var total uint64
-	for _, tier := range d.tiers {
-		total += tier.BlockCount()
-	}
-	return total
-}
-
-// Flush flushes all tiers.
-func (d *TieredBlockDevice) Flush() error {
-	for _, tier := range d.tiers {
-		if err := tier.Flush(); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-// Close closes all tiers.
-func (d *TieredBlockDevice) Close() error {
-	for _, tier := range d.tiers {
-		tier.Close()
-	}
-	return nil
-}
-
 // BlockIterator iterates over blocks in a device.
 type BlockIterator struct {
 	device    BlockDevice
@@ -573,71 +521,6 @@ func (it *BlockIterator) Write(data []byte) error {
 	return it.device.Write(it.current, data)
 }
 
-// EncryptedBlockDevice wraps a BlockDevice with encryption.
-type EncryptedBlockDevice struct {
-	device BlockDevice
-	cipher []byte // Simplified key storage
-}
-
-// NewEncryptedBlockDevice creates an encrypted wrapper.
-func NewEncryptedBlockDevice(device BlockDevice, key []byte) *EncryptedBlockDevice {
-	return &EncryptedBlockDevice{
-		device: device,
-		cipher: key,
-	}
-}
-
-// encrypt applies XOR encryption (simplified - use AES in production).
-func (d *EncryptedBlockDevice) encrypt(data []byte) error {
-	for i := range data {
-		data[i] ^= d.cipher[i%len(d.cipher)]
-	}
-	return nil
-}
-
-// decrypt reverses encryption.
-func (d *EncryptedBlockDevice) decrypt(data []byte) error {
-	return d.encrypt(data) // XOR is its own inverse
-}
-
-// Read reads and decrypts a block.
-func (d *EncryptedBlockDevice) Read(block uint64, data []byte) error {
-	if err := d.device.Read(block, data); err != nil {
-		return err
-	}
-	return d.decrypt(data)
-}
-
-// Write encrypts and writes a block.
-func (d *EncryptedBlockDevice) Write(block uint64, data []byte) error {
-	encrypted := make([]byte, len(data))
-	copy(encrypted, data)
-	if err := d.encrypt(encrypted); err != nil {
-		return err
-	}
-	return d.device.Write(block, encrypted)
-}
-
-// BlockSize returns the underlying device's block size.
-func (d *EncryptedBlockDevice) BlockSize() int {
-	return d.device.BlockSize()
-}
-
-// BlockCount returns the underlying device's block count.
-func (d *EncryptedBlockDevice) BlockCount() uint64 {
-	return d.device.BlockCount()
-}
-
-// Flush forwards to the underlying device.
-func (d *EncryptedBlockDevice) Flush() error {
-	return d.device.Flush()
-}
-
-// Close forwards to the underlying device.
-func (d *EncryptedBlockDevice) Close() error {
-	return d.device.Close()
-}
-
 // CompressedBlockDevice wraps a BlockDevice with compression.
 type CompressedBlockDevice struct {
 	device  BlockDevice
@@ -43,6 +43,7 @@ type BlockCache struct {
 	lruList   *list.List     // For LRU/FIFO
 	lfuFreq   map[uint64]int // Frequency counts for LFU
 	dirty     map[uint64]bool
+	accesses  map[uint64]uint64 // Per-block access counts, kept across evictions
 	hitCount  uint64
 	missCount uint64
 	closed    bool
@@ -69,6 +70,7 @@ func NewBlockCache(device BlockDevice, policy CachePolicy, maxSize int) *BlockCa
 		lruList:   list.New(),
 		lfuFreq:   make(map[uint64]int),
 		dirty:     make(map[uint64]bool),
+		accesses:  make(map[uint64]uint64),
 		hitCount:  0,
 		missCount: 0,
 	}
@@ -92,6 +94,8 @@ func (c *BlockCache) Read(block uint64, data []byte) error {
 		return ErrCacheClosed
 	}
 
+	c.accesses[block]++
+
 	// Check if block is in cache
 	if elem, ok := c.cache[block]; ok {
 		entry := elem.Value.(*CacheEntry)
@@ -139,6 +143,8 @@ func (c *BlockCache) Write(block uint64, data []byte) error {
 		return ErrCacheClosed
 	}
 
+	c.accesses[block]++
+
 	// Update or add to cache
 	if elem, ok := c.cache[block]; ok {
 		entry := elem.Value.(*CacheEntry)
@@ -375,6 +381,36 @@ func (c *BlockCache) Stats() CacheStats {
 		HitCount:    c.hitCount,
 		MissCount:   c.missCount,
 		HitRate:     hitRate,
+		Tracked:     len(c.accesses),
+	}
+}
+
+// AccessCounts returns a copy of the per-block access counts. Unlike the LFU
+// frequencies, the counts survive eviction, so they describe the whole
+// workload rather than only the cached working set.
+func (c *BlockCache) AccessCounts() map[uint64]uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	counts := make(map[uint64]uint64, len(c.accesses))
+	for block, count := range c.accesses {
+		counts[block] = count
+	}
+	return counts
+}
+
+// DecayAccessCounts halves every access count and forgets blocks that reach
+// zero, so that recent accesses outweigh old ones.
+func (c *BlockCache) DecayAccessCounts() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for block, count := range c.accesses {
+		if count <= 1 {
+			delete(c.accesses, block)
+		} else {
+			c.accesses[block] = count / 2
+		}
 	}
 }
 
@@ -386,6 +422,7 @@ type CacheStats struct {
 	HitCount    uint64
 	MissCount   uint64
 	HitRate     float64
+	Tracked     int // Blocks with recorded access counts
 }
 
 // BlockSize returns the underlying device's block size.
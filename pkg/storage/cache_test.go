@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// CacheStatsDetailed is serialized by callers; its keys are the Go field
+// names.
+func TestCacheStatsJSON(t *testing.T) {
+	cache := NewBlockCache(newMemoryDevice(t, 8, 512), CachePolicyLRU, 4)
+	data, err := json.Marshal(cache.GetDetailedStats())
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	var fields map[string]any
+	json.Unmarshal(data, &fields)
+	for _, key := range []string{"Entries", "HitRate", "Tracked", "Policy", "DeviceType", "TotalBlocks", "MemoryUsage"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("key %q missing from %s", key, data)
+		}
+	}
+}
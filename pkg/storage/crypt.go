@@ -0,0 +1,632 @@
+/*
+Package storage provides block storage abstraction with caching,
+write-ahead logging, RAID support, and snapshot management.
+*/
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Encryption errors
+var (
+	ErrNotEncrypted      = errors.New("device has no encryption header")
+	ErrInvalidPassphrase = errors.New("no key slot matches passphrase")
+	ErrNoFreeKeySlot     = errors.New("all key slots are in use")
+	ErrLastKeySlot       = errors.New("cannot remove the last key slot")
+	ErrInvalidKeySlot    = errors.New("invalid key slot")
+	ErrInvalidKey        = errors.New("invalid encryption key")
+	ErrHeaderCorrupted   = errors.New("encryption header is corrupted")
+)
+
+// Encryption header layout. The header occupies the first blocks of the
+// underlying device and holds the volume master key wrapped once per
+// passphrase, so passphrases can change without re-encrypting data.
+//
+// Two copies of the header are stored one after the other, each with a
+// sequence number and a SHA-256 checksum. Updates rewrite the copies in
+// turn with a flush after each, and the valid copy with the highest
+// sequence number wins, so a crash during a key slot change leaves either
+// the old or the new slots intact.
+const (
+	encMagic        = "WEBOSENC"
+	encVersion      = 2
+	encSeqOffset    = 22
+	encSumOffset    = 30
+	encKeySlots     = 8
+	encMasterKeyLen = 64 // AES-256-XTS: two 256-bit keys
+	encSaltLen      = 32
+	encNonceLen     = 12
+	encSealedLen    = encMasterKeyLen + 16 // Master key plus GCM tag
+	encSlotOffset   = 64
+	encSlotSize     = 160
+	encHeaderSize   = encSlotOffset + encKeySlots*encSlotSize
+
+	// DefaultKDFIterations is the PBKDF2-SHA256 iteration count used for
+	// new key slots.
+	DefaultKDFIterations = 200000
+)
+
+// kdfIterations is the iteration count used when sealing key slots.
+var kdfIterations uint32 = DefaultKDFIterations
+
+// keySlot is a passphrase-wrapped copy of the master key.
+type keySlot struct {
+	active     bool
+	iterations uint32
+	salt       [encSaltLen]byte
+	nonce      [encNonceLen]byte
+	sealed     [encSealedLen]byte
+}
+
+// EncryptedBlockDevice wraps a BlockDevice with AES-XTS encryption.
+//
+// Each block is encrypted with the block number as the XTS tweak, so the
+// device can sit above or below a BlockCache, RAID array or snapshot
+// manager. Devices opened with OpenEncryptedBlockDevice reserve a header
+// with key slots at the start of the underlying device; devices created
+// with NewEncryptedBlockDevice use a raw key and have no header.
+type EncryptedBlockDevice struct {
+	device       BlockDevice
+	xts          *xtsCipher
+	masterKey    []byte
+	headerBlocks uint64 // Both header copies
+	seq          uint64 // Sequence number of the newest header copy
+	slots        [encKeySlots]keySlot
+	closed       bool
+	mu           sync.RWMutex
+}
+
+// NewEncryptedBlockDevice creates an encrypted wrapper using a raw XTS key
+// of 32, 48 or 64 bytes. No header is stored on the device.
+func NewEncryptedBlockDevice(device BlockDevice, key []byte) (*EncryptedBlockDevice, error) {
+	if device.BlockSize()%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("block size %d is not a multiple of %d", device.BlockSize(), aes.BlockSize)
+	}
+
+	xts, err := newXTSCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptedBlockDevice{
+		device: device,
+		xts:    xts,
+	}, nil
+}
+
+// FormatEncryptedBlockDevice writes a new encryption header to device with
+// a random master key protected by passphrase in key slot 0. Any existing
+// data on the device becomes unreadable.
+func FormatEncryptedBlockDevice(device BlockDevice, passphrase string) error {
+	blockSize := device.BlockSize()
+	if blockSize%aes.BlockSize != 0 {
+		return fmt.Errorf("block size %d is not a multiple of %d", blockSize, aes.BlockSize)
+	}
+
+	headerBlocks := encHeaderBlocks(blockSize)
+	if headerBlocks >= device.BlockCount() {
+		return ErrDeviceTooSmall
+	}
+
+	masterKey := make([]byte, encMasterKeyLen)
+	if _, err := rand.Read(masterKey); err != nil {
+		return fmt.Errorf("%w: %v", ErrEncryptionFailed, err)
+	}
+
+	d := &EncryptedBlockDevice{
+		device:       device,
+		masterKey:    masterKey,
+		headerBlocks: headerBlocks,
+	}
+	if err := d.sealSlot(0, passphrase); err != nil {
+		return err
+	}
+	if err := d.writeHeader(); err != nil {
+		return err
+	}
+
+	return device.Flush()
+}
+
+// OpenEncryptedBlockDevice unlocks a formatted device with a passphrase.
+func OpenEncryptedBlockDevice(device BlockDevice, passphrase string) (*EncryptedBlockDevice, error) {
+	d := &EncryptedBlockDevice{
+		device:       device,
+		headerBlocks: encHeaderBlocks(device.BlockSize()),
+	}
+	if err := d.readHeader(); err != nil {
+		return nil, err
+	}
+
+	for i := range d.slots {
+		if key, err := d.openSlot(i, passphrase); err == nil {
+			d.masterKey = key
+			break
+		}
+	}
+	if d.masterKey == nil {
+		return nil, ErrInvalidPassphrase
+	}
+
+	xts, err := newXTSCipher(d.masterKey)
+	if err != nil {
+		return nil, err
+	}
+	d.xts = xts
+
+	return d, nil
+}
+
+// Read reads and decrypts a block.
+func (d *EncryptedBlockDevice) Read(block uint64, data []byte) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	if block >= d.BlockCount() {
+		return ErrInvalidBlockNumber
+	}
+	if len(data) != d.device.BlockSize() {
+		return fmt.Errorf("data length %d != block size %d", len(data), d.device.BlockSize())
+	}
+
+	if err := d.device.Read(block+d.headerBlocks, data); err != nil {
+		return err
+	}
+
+	d.xts.decrypt(data, data, block)
+	return nil
+}
+
+// Write encrypts and writes a block.
+func (d *EncryptedBlockDevice) Write(block uint64, data []byte) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	if block >= d.BlockCount() {
+		return ErrInvalidBlockNumber
+	}
+	if len(data) != d.device.BlockSize() {
+		return ErrBlockTooLarge
+	}
+
+	encrypted := make([]byte, len(data))
+	d.xts.encrypt(encrypted, data, block)
+	return d.device.Write(block+d.headerBlocks, encrypted)
+}
+
+// AddPassphrase stores the master key under a new passphrase in the first
+// free key slot and returns the slot index.
+func (d *EncryptedBlockDevice) AddPassphrase(passphrase string) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.checkHeaderLocked(); err != nil {
+		return -1, err
+	}
+
+	for i := range d.slots {
+		if d.slots[i].active {
+			continue
+		}
+		if err := d.sealSlot(i, passphrase); err != nil {
+			return -1, err
+		}
+		if err := d.writeHeader(); err != nil {
+			d.slots[i] = keySlot{}
+			return -1, err
+		}
+		return i, nil
+	}
+
+	return -1, ErrNoFreeKeySlot
+}
+
+// RemoveKeySlot erases a key slot. The last active slot cannot be removed.
+func (d *EncryptedBlockDevice) RemoveKeySlot(slot int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.checkHeaderLocked(); err != nil {
+		return err
+	}
+	if slot < 0 || slot >= encKeySlots || !d.slots[slot].active {
+		return ErrInvalidKeySlot
+	}
+	if d.activeSlots() == 1 {
+		return ErrLastKeySlot
+	}
+
+	d.slots[slot] = keySlot{}
+	return d.writeHeader()
+}
+
+// ChangePassphrase replaces the key slot unlocked by oldPassphrase with one
+// protected by newPassphrase. The data is not re-encrypted.
+func (d *EncryptedBlockDevice) ChangePassphrase(oldPassphrase, newPassphrase string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.checkHeaderLocked(); err != nil {
+		return err
+	}
+
+	for i := range d.slots {
+		key, err := d.openSlot(i, oldPassphrase)
+		if err != nil || !bytes.Equal(key, d.masterKey) {
+			continue
+		}
+
+		old := d.slots[i]
+		if err := d.sealSlot(i, newPassphrase); err != nil {
+			return err
+		}
+		if err := d.writeHeader(); err != nil {
+			d.slots[i] = old
+			return err
+		}
+		return nil
+	}
+
+	return ErrInvalidPassphrase
+}
+
+// KeySlots reports which key slots are in use.
+func (d *EncryptedBlockDevice) KeySlots() []bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	slots := make([]bool, encKeySlots)
+	for i := range d.slots {
+		slots[i] = d.slots[i].active
+	}
+	return slots
+}
+
+// BlockSize returns the underlying device's block size.
+func (d *EncryptedBlockDevice) BlockSize() int {
+	return d.device.BlockSize()
+}
+
+// BlockCount returns the underlying device's block count, excluding the
+// encryption header.
+func (d *EncryptedBlockDevice) BlockCount() uint64 {
+	return d.device.BlockCount() - d.headerBlocks
+}
+
+// Flush forwards to the underlying device.
+func (d *EncryptedBlockDevice) Flush() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	return d.device.Flush()
+}
+
+// Close wipes the key material and closes the underlying device.
+func (d *EncryptedBlockDevice) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+
+	for i := range d.masterKey {
+		d.masterKey[i] = 0
+	}
+	d.xts = nil
+
+	return d.device.Close()
+}
+
+// checkHeaderLocked verifies key slots can be managed (caller must hold lock).
+func (d *EncryptedBlockDevice) checkHeaderLocked() error {
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	if d.headerBlocks == 0 {
+		return ErrNotSupported
+	}
+	return nil
+}
+
+// activeSlots counts the key slots in use.
+func (d *EncryptedBlockDevice) activeSlots() int {
+	count := 0
+	for i := range d.slots {
+		if d.slots[i].active {
+			count++
+		}
+	}
+	return count
+}
+
+// slotKey derives the key-encryption key for a slot from a passphrase.
+func slotKey(slot *keySlot, passphrase string) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, passphrase, slot.salt[:], int(slot.iterations), 32)
+}
+
+// slotAAD binds a sealed key to its header and slot position.
+func slotAAD(index int) []byte {
+	aad := make([]byte, len(encMagic)+1)
+	copy(aad, encMagic)
+	aad[len(encMagic)] = byte(index)
+	return aad
+}
+
+// sealSlot wraps the master key with a passphrase into a key slot.
+func (d *EncryptedBlockDevice) sealSlot(index int, passphrase string) error {
+	slot := keySlot{active: true, iterations: kdfIterations}
+	if _, err := rand.Read(slot.salt[:]); err != nil {
+		return fmt.Errorf("%w: %v", ErrEncryptionFailed, err)
+	}
+	if _, err := rand.Read(slot.nonce[:]); err != nil {
+		return fmt.Errorf("%w: %v", ErrEncryptionFailed, err)
+	}
+
+	kek, err := slotKey(&slot, passphrase)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrEncryptionFailed, err)
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return err
+	}
+
+	aead.Seal(slot.sealed[:0], slot.nonce[:], d.masterKey, slotAAD(index))
+	d.slots[index] = slot
+	return nil
+}
+
+// openSlot unwraps the master key from a key slot.
+func (d *EncryptedBlockDevice) openSlot(index int, passphrase string) ([]byte, error) {
+	slot := &d.slots[index]
+	if !slot.active {
+		return nil, ErrInvalidKeySlot
+	}
+
+	kek, err := slotKey(slot, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryptionFailed, err)
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := aead.Open(nil, slot.nonce[:], slot.sealed[:], slotAAD(index))
+	if err != nil {
+		return nil, ErrInvalidPassphrase
+	}
+	return key, nil
+}
+
+// newGCM creates an AES-GCM AEAD for key slot wrapping.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEncryptionFailed, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encCopyBlocks returns the number of blocks one header copy occupies.
+func encCopyBlocks(blockSize int) uint64 {
+	return uint64((encHeaderSize + blockSize - 1) / blockSize)
+}
+
+// encHeaderBlocks returns the number of blocks both header copies occupy.
+func encHeaderBlocks(blockSize int) uint64 {
+	return 2 * encCopyBlocks(blockSize)
+}
+
+// writeHeader serializes the header and key slots to both header copies
+// under the next sequence number.
+func (d *EncryptedBlockDevice) writeHeader() error {
+	blockSize := d.device.BlockSize()
+	copyBlocks := d.headerBlocks / 2
+	buf := make([]byte, int(copyBlocks)*blockSize)
+
+	copy(buf[0:8], encMagic)
+	binary.BigEndian.PutUint16(buf[8:10], encVersion)
+	binary.BigEndian.PutUint32(buf[10:14], uint32(blockSize))
+	binary.BigEndian.PutUint32(buf[14:18], uint32(d.headerBlocks))
+	binary.BigEndian.PutUint32(buf[18:22], encKeySlots)
+	binary.BigEndian.PutUint64(buf[encSeqOffset:encSumOffset], d.seq+1)
+
+	for i := range d.slots {
+		slot := &d.slots[i]
+		off := encSlotOffset + i*encSlotSize
+		if !slot.active {
+			continue
+		}
+		buf[off] = 1
+		binary.BigEndian.PutUint32(buf[off+1:off+5], slot.iterations)
+		copy(buf[off+5:off+37], slot.salt[:])
+		copy(buf[off+37:off+49], slot.nonce[:])
+		copy(buf[off+49:off+49+encSealedLen], slot.sealed[:])
+	}
+
+	sum := sha256.Sum256(buf)
+	copy(buf[encSumOffset:encSumOffset+sha256.Size], sum[:])
+
+	// One copy is complete on the device before the other is touched
+	for c := uint64(0); c < 2; c++ {
+		for i := uint64(0); i < copyBlocks; i++ {
+			start := int(i) * blockSize
+			if err := d.device.Write(c*copyBlocks+i, buf[start:start+blockSize]); err != nil {
+				return fmt.Errorf("failed to write encryption header: %w", err)
+			}
+		}
+		if err := d.device.Flush(); err != nil {
+			return fmt.Errorf("failed to write encryption header: %w", err)
+		}
+	}
+
+	d.seq++
+	return nil
+}
+
+// readHeader loads the newest valid header copy and its key slots from the
+// device.
+func (d *EncryptedBlockDevice) readHeader() error {
+	blockSize := d.device.BlockSize()
+	if d.headerBlocks >= d.device.BlockCount() {
+		return ErrNotEncrypted
+	}
+
+	copyBlocks := d.headerBlocks / 2
+	var buf []byte
+	var firstErr error
+	for c := uint64(0); c < 2; c++ {
+		candidate := make([]byte, int(copyBlocks)*blockSize)
+		for i := uint64(0); i < copyBlocks; i++ {
+			start := int(i) * blockSize
+			if err := d.device.Read(c*copyBlocks+i, candidate[start:start+blockSize]); err != nil {
+				return fmt.Errorf("failed to read encryption header: %w", err)
+			}
+		}
+
+		seq, err := checkHeaderCopy(candidate, blockSize)
+		if err != nil {
+			if firstErr == nil || firstErr == ErrNotEncrypted {
+				firstErr = err
+			}
+			continue
+		}
+		if buf == nil || seq > d.seq {
+			buf, d.seq = candidate, seq
+		}
+	}
+	if buf == nil {
+		return firstErr
+	}
+
+	for i := range d.slots {
+		off := encSlotOffset + i*encSlotSize
+		if buf[off] != 1 {
+			continue
+		}
+		slot := &d.slots[i]
+		slot.active = true
+		slot.iterations = binary.BigEndian.Uint32(buf[off+1 : off+5])
+		copy(slot.salt[:], buf[off+5:off+37])
+		copy(slot.nonce[:], buf[off+37:off+49])
+		copy(slot.sealed[:], buf[off+49:off+49+encSealedLen])
+	}
+
+	return nil
+}
+
+// checkHeaderCopy validates one header copy and returns its sequence
+// number.
+func checkHeaderCopy(buf []byte, blockSize int) (uint64, error) {
+	if string(buf[0:8]) != encMagic {
+		return 0, ErrNotEncrypted
+	}
+	if version := binary.BigEndian.Uint16(buf[8:10]); version != encVersion {
+		return 0, fmt.Errorf("unsupported encryption header version %d", version)
+	}
+
+	var stored [sha256.Size]byte
+	copy(stored[:], buf[encSumOffset:])
+	clear(buf[encSumOffset : encSumOffset+sha256.Size])
+	sum := sha256.Sum256(buf)
+	copy(buf[encSumOffset:], stored[:])
+	if sum != stored {
+		return 0, ErrHeaderCorrupted
+	}
+
+	if size := binary.BigEndian.Uint32(buf[10:14]); size != uint32(blockSize) {
+		return 0, fmt.Errorf("block size mismatch: %d != %d", size, blockSize)
+	}
+	return binary.BigEndian.Uint64(buf[encSeqOffset:encSumOffset]), nil
+}
+
+// xtsCipher implements AES-XTS (IEEE 1619) for whole blocks whose size is a
+// multiple of the AES block size.
+type xtsCipher struct {
+	data  cipher.Block
+	tweak cipher.Block
+}
+
+// newXTSCipher splits key into data and tweak keys.
+func newXTSCipher(key []byte) (*xtsCipher, error) {
+	switch len(key) {
+	case 32, 48, 64:
+	default:
+		return nil, ErrInvalidKey
+	}
+
+	half := len(key) / 2
+	data, err := aes.NewCipher(key[:half])
+	if err != nil {
+		return nil, err
+	}
+	tweak, err := aes.NewCipher(key[half:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &xtsCipher{data: data, tweak: tweak}, nil
+}
+
+// encrypt encrypts src into dst using sector as the tweak.
+func (x *xtsCipher) encrypt(dst, src []byte, sector uint64) {
+	x.crypt(dst, src, sector, x.data.Encrypt)
+}
+
+// decrypt decrypts src into dst using sector as the tweak.
+func (x *xtsCipher) decrypt(dst, src []byte, sector uint64) {
+	x.crypt(dst, src, sector, x.data.Decrypt)
+}
+
+// crypt applies the XTS construction with the given block function.
+func (x *xtsCipher) crypt(dst, src []byte, sector uint64, fn func(dst, src []byte)) {
+	var tweak [aes.BlockSize]byte
+	binary.LittleEndian.PutUint64(tweak[:8], sector)
+	x.tweak.Encrypt(tweak[:], tweak[:])
+
+	var buf [aes.BlockSize]byte
+	for i := 0; i+aes.BlockSize <= len(src); i += aes.BlockSize {
+		for j := range buf {
+			buf[j] = src[i+j] ^ tweak[j]
+		}
+		fn(buf[:], buf[:])
+		for j := range buf {
+			dst[i+j] = buf[j] ^ tweak[j]
+		}
+		xtsMulAlpha(&tweak)
+	}
+}
+
+// xtsMulAlpha multiplies the tweak by the primitive element of GF(2^128).
+func xtsMulAlpha(tweak *[aes.BlockSize]byte) {
+	carry := tweak[aes.BlockSize-1] >> 7
+	for j := aes.BlockSize - 1; j > 0; j-- {
+		tweak[j] = tweak[j]<<1 | tweak[j-1]>>7
+	}
+	tweak[0] <<= 1
+	if carry != 0 {
+		tweak[0] ^= 0x87
+	}
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	return b
+}
+
+// Vectors 1 and 2 from IEEE 1619-2007 Annex B.
+func TestXTSKnownAnswers(t *testing.T) {
+	tests := []struct {
+		key        string
+		sector     uint64
+		plaintext  string
+		ciphertext string
+	}{
+		{
+			key:        "0000000000000000000000000000000000000000000000000000000000000000",
+			sector:     0,
+			plaintext:  "0000000000000000000000000000000000000000000000000000000000000000",
+			ciphertext: "917cf69ebd68b2ec9b9fe9a3eadda692cd43d2f59598ed858c02c2652fbf922e",
+		},
+		{
+			key:        "1111111111111111111111111111111122222222222222222222222222222222",
+			sector:     0x3333333333,
+			plaintext:  "4444444444444444444444444444444444444444444444444444444444444444",
+			ciphertext: "c454185e6a16936e39334038acef838bfb186fff7480adc4289382ecd6d394f0",
+		},
+	}
+
+	for i, tt := range tests {
+		x, err := newXTSCipher(unhex(t, tt.key))
+		if err != nil {
+			t.Fatalf("vector %d: newXTSCipher failed: %v", i+1, err)
+		}
+		plaintext, ciphertext := unhex(t, tt.plaintext), unhex(t, tt.ciphertext)
+
+		got := make([]byte, len(plaintext))
+		x.encrypt(got, plaintext, tt.sector)
+		if !bytes.Equal(got, ciphertext) {
+			t.Errorf("vector %d: encrypt = %x, expected %x", i+1, got, ciphertext)
+		}
+		x.decrypt(got, got, tt.sector)
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("vector %d: decrypt = %x, expected %x", i+1, got, plaintext)
+		}
+	}
+}
+
+// fastKDF lowers the key slot iteration count for the duration of a test.
+func fastKDF(t *testing.T) {
+	saved := kdfIterations
+	kdfIterations = 1000
+	t.Cleanup(func() { kdfIterations = saved })
+}
+
+func TestEncryptedPassphrases(t *testing.T) {
+	fastKDF(t)
+	mem := newMemoryDevice(t, 32, 512)
+	if err := FormatEncryptedBlockDevice(mem, "correct horse"); err != nil {
+		t.Fatalf("FormatEncryptedBlockDevice failed: %v", err)
+	}
+
+	if _, err := OpenEncryptedBlockDevice(mem, "wrong"); !errors.Is(err, ErrInvalidPassphrase) {
+		t.Errorf("Open with wrong passphrase returned %v", err)
+	}
+	d, err := OpenEncryptedBlockDevice(mem, "correct horse")
+	if err != nil {
+		t.Fatalf("OpenEncryptedBlockDevice failed: %v", err)
+	}
+
+	if err := d.Write(0, fill(512, 's')); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	raw := make([]byte, 512)
+	mem.Read(d.headerBlocks, raw)
+	if bytes.Equal(raw, fill(512, 's')) {
+		t.Error("data is stored in plaintext")
+	}
+
+	slot, err := d.AddPassphrase("battery staple")
+	if err != nil || slot != 1 {
+		t.Fatalf("AddPassphrase returned %d, %v", slot, err)
+	}
+	if err := d.RemoveKeySlot(0); err != nil {
+		t.Fatalf("RemoveKeySlot failed: %v", err)
+	}
+	if err := d.RemoveKeySlot(1); !errors.Is(err, ErrLastKeySlot) {
+		t.Errorf("removing the last slot returned %v", err)
+	}
+
+	if _, err := OpenEncryptedBlockDevice(mem, "correct horse"); !errors.Is(err, ErrInvalidPassphrase) {
+		t.Errorf("removed passphrase still opens the device: %v", err)
+	}
+	reopened, err := OpenEncryptedBlockDevice(mem, "battery staple")
+	if err != nil {
+		t.Fatalf("Open with added passphrase failed: %v", err)
+	}
+	buf := make([]byte, 512)
+	if err := reopened.Read(0, buf); err != nil || buf[0] != 's' {
+		t.Errorf("Read returned %q, %v", buf[0], err)
+	}
+	if slots := reopened.KeySlots(); slots[0] || !slots[1] {
+		t.Errorf("KeySlots = %v", slots)
+	}
+}
+
+func TestEncryptedHeaderCrash(t *testing.T) {
+	fastKDF(t)
+	faulty := newFaultyDevice(newMemoryDevice(t, 32, 512))
+	if err := FormatEncryptedBlockDevice(faulty, "old"); err != nil {
+		t.Fatalf("FormatEncryptedBlockDevice failed: %v", err)
+	}
+	d, err := OpenEncryptedBlockDevice(faulty, "old")
+	if err != nil {
+		t.Fatalf("OpenEncryptedBlockDevice failed: %v", err)
+	}
+	copyBlocks := d.headerBlocks / 2
+
+	// Interrupted while writing the first copy: the second still holds
+	// the old slots
+	faulty.failWrites[0] = true
+	if err := d.ChangePassphrase("old", "new"); err == nil {
+		t.Fatal("ChangePassphrase succeeded despite the failing write")
+	}
+	if _, err := OpenEncryptedBlockDevice(faulty, "old"); err != nil {
+		t.Errorf("old passphrase lost after interrupted first copy: %v", err)
+	}
+
+	// Interrupted while writing the second copy: the first holds the new
+	// slots
+	faulty.failWrites = map[uint64]bool{copyBlocks: true}
+	if err := d.ChangePassphrase("old", "new"); err == nil {
+		t.Fatal("ChangePassphrase succeeded despite the failing write")
+	}
+	if _, err := OpenEncryptedBlockDevice(faulty, "new"); err != nil {
+		t.Errorf("new passphrase missing after interrupted second copy: %v", err)
+	}
+
+	// A torn copy is ignored in favor of the intact one
+	faulty.failWrites = map[uint64]bool{}
+	tear := func(block uint64) {
+		buf := make([]byte, 512)
+		faulty.Read(block, buf)
+		buf[100] ^= 0xff
+		faulty.Write(block, buf)
+	}
+	tear(copyBlocks)
+	if _, err := OpenEncryptedBlockDevice(faulty, "new"); err != nil {
+		t.Errorf("Open with one corrupted copy failed: %v", err)
+	}
+	tear(0)
+	if _, err := OpenEncryptedBlockDevice(faulty, "new"); !errors.Is(err, ErrHeaderCorrupted) {
+		t.Errorf("Open with both copies corrupted returned %v", err)
+	}
+}
@@ -0,0 +1,652 @@
+/*
+Package storage provides block storage abstraction with caching,
+write-ahead logging, RAID support, and snapshot management.
+*/
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Deduplication errors
+var (
+	ErrDeviceFull    = errors.New("no free space on device")
+	ErrDedupMetadata = errors.New("deduplication metadata is inconsistent")
+)
+
+// dedupUnits is the number of allocation units each physical block is
+// divided into. Compressed chunks occupy one or more contiguous units
+// within a single physical block.
+const dedupUnits = 8
+
+// dedupChunk is a unique block image stored on the underlying device.
+type dedupChunk struct {
+	Hash       string `json:"hash"`
+	Block      uint64 `json:"block"`
+	Offset     uint8  `json:"offset"`
+	Units      uint8  `json:"units"`
+	Length     int    `json:"length"`
+	Compressed bool   `json:"compressed"`
+	Refs       uint64 `json:"refs"`
+	sum        [sha256.Size]byte
+}
+
+// dedupMetadata is the persisted form of a DedupBlockDevice.
+type dedupMetadata struct {
+	Version    int               `json:"version"`
+	BlockSize  int               `json:"blockSize"`
+	BlockCount uint64            `json:"blockCount"`
+	Chunks     []*dedupChunk     `json:"chunks"`
+	Blocks     map[uint64]uint64 `json:"blocks"`
+}
+
+// DedupStats reports space savings of a DedupBlockDevice.
+type DedupStats struct {
+	LogicalBlocks    uint64  `json:"logicalBlocks"`
+	MappedBlocks     uint64  `json:"mappedBlocks"`
+	UniqueChunks     uint64  `json:"uniqueChunks"`
+	LogicalBytes     uint64  `json:"logicalBytes"`
+	StoredBytes      uint64  `json:"storedBytes"`
+	PhysicalBytes    uint64  `json:"physicalBytes"`
+	DedupRatio       float64 `json:"dedupRatio"`
+	CompressionRatio float64 `json:"compressionRatio"`
+}
+
+// DedupBlockDevice stores identical blocks once and compresses unique
+// blocks into variable-size slots on an underlying device.
+//
+// Each written block is hashed with SHA-256. Blocks with the same content
+// share one reference-counted chunk; new content is DEFLATE-compressed and
+// packed into the smallest run of free allocation units that fits. Blocks
+// that are all zeros are not stored at all. The logical block count is
+// independent of the underlying device size, so a volume full of shared
+// base-image blocks can be much larger than the space it consumes.
+//
+// The block map is kept in memory and saved to metadataPath on Flush and
+// Close. Space released by overwritten chunks is not reused until the
+// metadata has been saved, so a crash never leaves the saved map pointing
+// at reused space. A physical block holding live chunks is never rewritten:
+// adding a chunk to it writes the block's chunks and the new one to an
+// empty block instead, so a torn write cannot damage chunks already stored.
+type DedupBlockDevice struct {
+	device       BlockDevice
+	blockSize    int
+	unitSize     int
+	blockCount   uint64
+	metadataPath string
+	chunks       map[[sha256.Size]byte]*dedupChunk
+	blocks       map[uint64]*dedupChunk
+	used         []uint8                             // Allocated unit bitmap per physical block
+	resident     map[uint64]map[*dedupChunk]struct{} // Live chunks by physical block
+	pendingFree  []*dedupChunk
+	retired      []retiredUnits
+	next         uint64
+	compressor   *flate.Writer
+	compressBuf  bytes.Buffer
+	dirty        bool
+	closed       bool
+	mu           sync.RWMutex
+}
+
+// NewDedupBlockDevice creates a deduplicating, compressing device with
+// blockCount logical blocks on top of device. If metadataPath is non-empty
+// the block map is loaded from it when present and saved to it on Flush.
+func NewDedupBlockDevice(device BlockDevice, blockCount uint64, metadataPath string) (*DedupBlockDevice, error) {
+	blockSize := device.BlockSize()
+	if blockSize%dedupUnits != 0 {
+		return nil, fmt.Errorf("block size %d is not a multiple of %d", blockSize, dedupUnits)
+	}
+
+	compressor, err := flate.NewWriter(nil, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DedupBlockDevice{
+		device:       device,
+		blockSize:    blockSize,
+		unitSize:     blockSize / dedupUnits,
+		blockCount:   blockCount,
+		metadataPath: metadataPath,
+		chunks:       make(map[[sha256.Size]byte]*dedupChunk),
+		blocks:       make(map[uint64]*dedupChunk),
+		used:         make([]uint8, device.BlockCount()),
+		resident:     make(map[uint64]map[*dedupChunk]struct{}),
+		compressor:   compressor,
+	}
+
+	if metadataPath != "" {
+		if err := d.loadMetadata(); err != nil {
+			return nil, fmt.Errorf("failed to load dedup metadata: %w", err)
+		}
+	}
+
+	return d, nil
+}
+
+// Read reads a block, decompressing its chunk. Blocks that were never
+// written read as zeros.
+func (d *DedupBlockDevice) Read(block uint64, data []byte) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	if block >= d.blockCount {
+		return ErrInvalidBlockNumber
+	}
+	if len(data) != d.blockSize {
+		return fmt.Errorf("data length %d != block size %d", len(data), d.blockSize)
+	}
+
+	chunk, ok := d.blocks[block]
+	if !ok {
+		clear(data)
+		return nil
+	}
+
+	return d.readChunk(chunk, data)
+}
+
+// Write writes a block, sharing storage with any identical block.
+func (d *DedupBlockDevice) Write(block uint64, data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	if block >= d.blockCount {
+		return ErrInvalidBlockNumber
+	}
+	if len(data) != d.blockSize {
+		return ErrBlockTooLarge
+	}
+
+	if isZeroBlock(data) {
+		d.unmap(block)
+		return nil
+	}
+
+	sum := sha256.Sum256(data)
+	if chunk, ok := d.chunks[sum]; ok {
+		if d.blocks[block] == chunk {
+			return nil
+		}
+		chunk.Refs++
+		d.unmap(block)
+		d.blocks[block] = chunk
+		d.dirty = true
+		return nil
+	}
+
+	chunk, err := d.storeChunk(data)
+	if err != nil {
+		return err
+	}
+	chunk.Hash = hex.EncodeToString(sum[:])
+	chunk.sum = sum
+	chunk.Refs = 1
+
+	d.unmap(block)
+	d.chunks[sum] = chunk
+	d.blocks[block] = chunk
+	d.dirty = true
+	return nil
+}
+
+// Discard drops a block's reference to its chunk so it reads as zeros.
+func (d *DedupBlockDevice) Discard(block uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	if block >= d.blockCount {
+		return ErrInvalidBlockNumber
+	}
+
+	d.unmap(block)
+	return nil
+}
+
+// Stats returns the current space savings.
+func (d *DedupBlockDevice) Stats() DedupStats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	stats := DedupStats{
+		LogicalBlocks: d.blockCount,
+		MappedBlocks:  uint64(len(d.blocks)),
+		UniqueChunks:  uint64(len(d.chunks)),
+	}
+	stats.LogicalBytes = stats.MappedBlocks * uint64(d.blockSize)
+
+	for _, chunk := range d.chunks {
+		stats.StoredBytes += uint64(chunk.Length)
+		stats.PhysicalBytes += uint64(chunk.Units) * uint64(d.unitSize)
+	}
+
+	if stats.UniqueChunks > 0 {
+		stats.DedupRatio = float64(stats.MappedBlocks) / float64(stats.UniqueChunks)
+	}
+	if stats.PhysicalBytes > 0 {
+		stats.CompressionRatio = float64(stats.UniqueChunks*uint64(d.blockSize)) / float64(stats.PhysicalBytes)
+	}
+
+	return stats
+}
+
+// BlockSize returns the underlying device's block size.
+func (d *DedupBlockDevice) BlockSize() int {
+	return d.blockSize
+}
+
+// BlockCount returns the logical block count.
+func (d *DedupBlockDevice) BlockCount() uint64 {
+	return d.blockCount
+}
+
+// Flush flushes the underlying device and saves the block map.
+func (d *DedupBlockDevice) Flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	return d.flushLocked()
+}
+
+// Close flushes and closes the underlying device.
+func (d *DedupBlockDevice) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil
+	}
+
+	err := d.flushLocked()
+	d.closed = true
+	if closeErr := d.device.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// flushLocked flushes data then metadata (caller must hold lock).
+func (d *DedupBlockDevice) flushLocked() error {
+	if err := d.device.Flush(); err != nil {
+		return err
+	}
+	if d.dirty {
+		return d.saveMetadata()
+	}
+	return nil
+}
+
+// unmap drops a logical block's chunk reference (caller must hold lock).
+func (d *DedupBlockDevice) unmap(block uint64) {
+	chunk, ok := d.blocks[block]
+	if !ok {
+		return
+	}
+	delete(d.blocks, block)
+	d.dirty = true
+
+	chunk.Refs--
+	if chunk.Refs > 0 {
+		return
+	}
+
+	delete(d.chunks, chunk.sum)
+	d.evict(chunk)
+	if d.metadataPath == "" {
+		d.release(chunk)
+	} else {
+		d.pendingFree = append(d.pendingFree, chunk)
+	}
+}
+
+// storeChunk compresses data and writes it into free space
+// (caller must hold lock).
+func (d *DedupBlockDevice) storeChunk(data []byte) (*dedupChunk, error) {
+	d.compressBuf.Reset()
+	d.compressor.Reset(&d.compressBuf)
+	if _, err := d.compressor.Write(data); err != nil {
+		return nil, err
+	}
+	if err := d.compressor.Close(); err != nil {
+		return nil, err
+	}
+
+	chunk := &dedupChunk{Compressed: true}
+	payload := d.compressBuf.Bytes()
+	if len(payload) > d.blockSize-d.unitSize {
+		// Compression would not save a unit; store the block as is
+		chunk.Compressed = false
+		payload = data
+	}
+	chunk.Length = len(payload)
+	chunk.Units = uint8((len(payload) + d.unitSize - 1) / d.unitSize)
+
+	ok, err := d.place(chunk, payload)
+	if err == nil && !ok && (len(d.pendingFree) > 0 || len(d.retired) > 0) {
+		// Persist the map so space from dropped chunks can be reused
+		if err := d.saveMetadata(); err != nil {
+			return nil, err
+		}
+		ok, err = d.place(chunk, payload)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrDeviceFull
+	}
+
+	d.settle(chunk)
+	return chunk, nil
+}
+
+// retiredUnits are units of a physical block whose chunks were moved to
+// another block; the saved metadata may still refer to them.
+type retiredUnits struct {
+	block uint64
+	mask  uint8
+}
+
+// place allocates units for a chunk and writes its payload, reporting
+// false if there is no room (caller must hold lock).
+//
+// Chunks are only written into empty blocks. If the units found are in a
+// block holding other chunks, the block's contents and the payload are
+// written to an empty block and the chunks move there, leaving the old
+// copies in place until the metadata stops referring to them.
+func (d *DedupBlockDevice) place(chunk *dedupChunk, payload []byte) (bool, error) {
+	if !d.allocate(chunk) {
+		return false, nil
+	}
+	block, mask := chunk.Block, unitMask(chunk)
+	buf := make([]byte, d.blockSize)
+
+	if d.used[block]&^mask == 0 {
+		copy(buf[int(chunk.Offset)*d.unitSize:], payload)
+		if err := d.device.Write(block, buf); err != nil {
+			d.release(chunk)
+			return false, err
+		}
+		return true, nil
+	}
+
+	fresh, ok := d.emptyBlock(block)
+	if !ok {
+		d.release(chunk)
+		return false, nil
+	}
+	if err := d.device.Read(block, buf); err != nil {
+		d.release(chunk)
+		return false, err
+	}
+	copy(buf[int(chunk.Offset)*d.unitSize:], payload)
+	if err := d.device.Write(fresh, buf); err != nil {
+		d.release(chunk)
+		return false, err
+	}
+
+	moved := uint8(0)
+	for c := range d.resident[block] {
+		c.Block = fresh
+		moved |= unitMask(c)
+		d.settle(c)
+	}
+	delete(d.resident, block)
+
+	d.used[block] &^= mask
+	d.used[fresh] = moved | mask
+	chunk.Block = fresh
+	d.retire(block, moved)
+	return true, nil
+}
+
+// emptyBlock finds a physical block with no allocated units other than
+// except (caller must hold lock).
+func (d *DedupBlockDevice) emptyBlock(except uint64) (uint64, bool) {
+	count := uint64(len(d.used))
+	for i := uint64(0); i < count; i++ {
+		block := (d.next + i) % count
+		if block != except && d.used[block] == 0 {
+			return block, true
+		}
+	}
+	return 0, false
+}
+
+// retire frees units whose chunks moved away once the metadata no longer
+// refers to them (caller must hold lock).
+func (d *DedupBlockDevice) retire(block uint64, mask uint8) {
+	if d.metadataPath == "" {
+		d.used[block] &^= mask
+		return
+	}
+	d.retired = append(d.retired, retiredUnits{block: block, mask: mask})
+}
+
+// settle records a live chunk as resident in its physical block (caller
+// must hold lock).
+func (d *DedupBlockDevice) settle(chunk *dedupChunk) {
+	chunks, ok := d.resident[chunk.Block]
+	if !ok {
+		chunks = make(map[*dedupChunk]struct{})
+		d.resident[chunk.Block] = chunks
+	}
+	chunks[chunk] = struct{}{}
+}
+
+// evict removes a dropped chunk from its physical block's residents
+// (caller must hold lock).
+func (d *DedupBlockDevice) evict(chunk *dedupChunk) {
+	chunks := d.resident[chunk.Block]
+	delete(chunks, chunk)
+	if len(chunks) == 0 {
+		delete(d.resident, chunk.Block)
+	}
+}
+
+// readChunk reads and decompresses a chunk into data.
+func (d *DedupBlockDevice) readChunk(chunk *dedupChunk, data []byte) error {
+	buf := make([]byte, d.blockSize)
+	if err := d.device.Read(chunk.Block, buf); err != nil {
+		return err
+	}
+
+	start := int(chunk.Offset) * d.unitSize
+	payload := buf[start : start+chunk.Length]
+
+	if chunk.Compressed {
+		r := flate.NewReader(bytes.NewReader(payload))
+		_, err := io.ReadFull(r, data)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBlockCorrupted, err)
+		}
+	} else {
+		copy(data, payload)
+	}
+
+	if sha256.Sum256(data) != chunk.sum {
+		return ErrBlockCorrupted
+	}
+	return nil
+}
+
+// allocate finds contiguous free units for a chunk, setting its Block and
+// Offset (caller must hold lock).
+func (d *DedupBlockDevice) allocate(chunk *dedupChunk) bool {
+	count := uint64(len(d.used))
+	for i := uint64(0); i < count; i++ {
+		block := (d.next + i) % count
+		if d.used[block] == 0xff {
+			continue
+		}
+		for off := uint8(0); off+chunk.Units <= dedupUnits; off++ {
+			chunk.Block, chunk.Offset = block, off
+			mask := unitMask(chunk)
+			if d.used[block]&mask == 0 {
+				d.used[block] |= mask
+				d.next = block
+				return true
+			}
+		}
+	}
+	chunk.Block, chunk.Offset = 0, 0
+	return false
+}
+
+// release returns a chunk's units to the free map (caller must hold lock).
+func (d *DedupBlockDevice) release(chunk *dedupChunk) {
+	d.used[chunk.Block] &^= unitMask(chunk)
+}
+
+// unitMask returns the bitmap bits covered by a chunk. The run is built
+// in 16 bits so that a chunk spanning all eight units yields 0xff.
+func unitMask(chunk *dedupChunk) uint8 {
+	run := uint16(1)<<chunk.Units - 1
+	return uint8(run << chunk.Offset)
+}
+
+// isZeroBlock reports whether data is all zeros.
+func isZeroBlock(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// loadMetadata restores the block map from disk.
+func (d *DedupBlockDevice) loadMetadata() error {
+	data, err := os.ReadFile(d.metadataPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var meta dedupMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return err
+	}
+
+	if meta.BlockSize != d.blockSize {
+		return fmt.Errorf("block size mismatch: %d != %d", meta.BlockSize, d.blockSize)
+	}
+	if meta.BlockCount != d.blockCount {
+		return fmt.Errorf("block count mismatch: %d != %d", meta.BlockCount, d.blockCount)
+	}
+
+	for _, chunk := range meta.Chunks {
+		sum, err := hex.DecodeString(chunk.Hash)
+		if err != nil || len(sum) != sha256.Size {
+			return ErrDedupMetadata
+		}
+		if chunk.Block >= uint64(len(d.used)) || chunk.Units == 0 ||
+			int(chunk.Offset)+int(chunk.Units) > dedupUnits ||
+			chunk.Length > int(chunk.Units)*d.unitSize {
+			return ErrDedupMetadata
+		}
+		mask := unitMask(chunk)
+		if d.used[chunk.Block]&mask != 0 {
+			return ErrDedupMetadata
+		}
+		d.used[chunk.Block] |= mask
+		chunk.Refs = 0
+		chunk.sum = [sha256.Size]byte(sum)
+		d.chunks[chunk.sum] = chunk
+	}
+
+	for block, index := range meta.Blocks {
+		if block >= d.blockCount || index >= uint64(len(meta.Chunks)) {
+			return ErrDedupMetadata
+		}
+		chunk := meta.Chunks[index]
+		chunk.Refs++
+		d.blocks[block] = chunk
+	}
+
+	// Drop chunks no block references
+	for sum, chunk := range d.chunks {
+		if chunk.Refs == 0 {
+			delete(d.chunks, sum)
+			d.release(chunk)
+			continue
+		}
+		d.settle(chunk)
+	}
+
+	return nil
+}
+
+// saveMetadata writes the block map to disk and releases space held by
+// dropped chunks (caller must hold lock).
+func (d *DedupBlockDevice) saveMetadata() error {
+	if d.metadataPath != "" {
+		meta := dedupMetadata{
+			Version:    1,
+			BlockSize:  d.blockSize,
+			BlockCount: d.blockCount,
+			Chunks:     make([]*dedupChunk, 0, len(d.chunks)),
+			Blocks:     make(map[uint64]uint64, len(d.blocks)),
+		}
+
+		index := make(map[*dedupChunk]uint64, len(d.chunks))
+		for _, chunk := range d.chunks {
+			index[chunk] = uint64(len(meta.Chunks))
+			meta.Chunks = append(meta.Chunks, chunk)
+		}
+		for block, chunk := range d.blocks {
+			meta.Blocks[block] = index[chunk]
+		}
+
+		data, err := json.Marshal(&meta)
+		if err != nil {
+			return fmt.Errorf("failed to marshal metadata: %w", err)
+		}
+
+		// Chunk data must be durable before the map references it
+		if err := d.device.Flush(); err != nil {
+			return err
+		}
+
+		if err := replaceFileSync(d.metadataPath, data, 0600); err != nil {
+			return err
+		}
+	}
+
+	// Only once the saved map no longer refers to them may dropped chunks
+	// be reused
+	for _, chunk := range d.pendingFree {
+		d.release(chunk)
+	}
+	for _, r := range d.retired {
+		d.used[r.block] &^= r.mask
+	}
+	d.pendingFree = nil
+	d.retired = nil
+	d.dirty = false
+	return nil
+}
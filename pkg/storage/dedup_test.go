@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDedup(t *testing.T) {
+	d, err := NewDedupBlockDevice(newMemoryDevice(t, 8, 512), 64, "")
+	if err != nil {
+		t.Fatalf("NewDedupBlockDevice failed: %v", err)
+	}
+
+	for block := uint64(0); block < 10; block++ {
+		if err := d.Write(block, fill(512, 'a')); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	d.Write(10, make([]byte, 512))
+
+	stats := d.Stats()
+	if stats.MappedBlocks != 10 || stats.UniqueChunks != 1 {
+		t.Errorf("mapped %d blocks to %d chunks, expected 10 and 1", stats.MappedBlocks, stats.UniqueChunks)
+	}
+	if stats.PhysicalBytes != 64 {
+		t.Errorf("PhysicalBytes = %d, expected one unit", stats.PhysicalBytes)
+	}
+
+	buf := make([]byte, 512)
+	if err := d.Read(9, buf); err != nil || !bytes.Equal(buf, fill(512, 'a')) {
+		t.Errorf("Read returned %q, %v", buf[0], err)
+	}
+	if err := d.Read(10, buf); err != nil || !isZeroBlock(buf) {
+		t.Errorf("zero block reads %q, %v", buf[0], err)
+	}
+}
+
+func TestDedupIncompressible(t *testing.T) {
+	d, err := NewDedupBlockDevice(newMemoryDevice(t, 4, 512), 16, "")
+	if err != nil {
+		t.Fatalf("NewDedupBlockDevice failed: %v", err)
+	}
+
+	// Random blocks are stored uncompressed in all eight units
+	rng := rand.New(rand.NewSource(1))
+	blocks := make([][]byte, 4)
+	for i := range blocks {
+		blocks[i] = make([]byte, 512)
+		rng.Read(blocks[i])
+		if err := d.Write(uint64(i), blocks[i]); err != nil {
+			t.Fatalf("Write %d failed: %v", i, err)
+		}
+	}
+	for _, used := range d.used {
+		if used != 0xff {
+			t.Errorf("used bitmap %08b, expected a full block", used)
+		}
+	}
+	if err := d.Write(4, fill(512, 'x')); !errors.Is(err, ErrDeviceFull) {
+		t.Errorf("Write to a full device returned %v", err)
+	}
+
+	buf := make([]byte, 512)
+	for i, want := range blocks {
+		if err := d.Read(uint64(i), buf); err != nil || !bytes.Equal(buf, want) {
+			t.Errorf("block %d mismatch: %v", i, err)
+		}
+	}
+}
+
+func TestDedupSharedBlockNotRewritten(t *testing.T) {
+	faulty := newFaultyDevice(newMemoryDevice(t, 4, 512))
+	metaPath := filepath.Join(t.TempDir(), "dedup.json")
+
+	d, err := NewDedupBlockDevice(faulty, 16, metaPath)
+	if err != nil {
+		t.Fatalf("NewDedupBlockDevice failed: %v", err)
+	}
+	if err := d.Write(0, fill(512, 'a')); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	// Packing a second chunk next to the first must not touch the
+	// physical block that already holds it
+	held := d.blocks[0].Block
+	faulty.failWrites[held] = true
+	if err := d.Write(1, fill(512, 'b')); err != nil {
+		t.Fatalf("Write next to a live chunk failed: %v", err)
+	}
+	if d.blocks[0].Block != d.blocks[1].Block {
+		t.Errorf("chunks in blocks %d and %d, expected them packed together", d.blocks[0].Block, d.blocks[1].Block)
+	}
+	faulty.failWrites = map[uint64]bool{}
+
+	// Reopen from the saved map without Flush, as after a crash
+	crashed, err := NewDedupBlockDevice(faulty, 16, metaPath)
+	if err != nil {
+		t.Fatalf("NewDedupBlockDevice failed: %v", err)
+	}
+	buf := make([]byte, 512)
+	if err := crashed.Read(0, buf); err != nil || !bytes.Equal(buf, fill(512, 'a')) {
+		t.Errorf("block 0 after crash reads %q, %v", buf[0], err)
+	}
+
+	// The old copy stays reserved until the map no longer refers to it,
+	// including when saving the map fails
+	if d.used[held] == 0 {
+		t.Error("moved chunk's old units were freed before the metadata was saved")
+	}
+	os.Mkdir(metaPath+".tmp", 0755)
+	if err := d.Flush(); err == nil {
+		t.Fatal("Flush succeeded without saving the metadata")
+	}
+	if d.used[held] == 0 {
+		t.Error("moved chunk's old units were freed by a failed metadata save")
+	}
+	os.Remove(metaPath + ".tmp")
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if d.used[held] != 0 {
+		t.Errorf("old units %08b still reserved after Flush", d.used[held])
+	}
+
+	reopened, err := NewDedupBlockDevice(faulty, 16, metaPath)
+	if err != nil {
+		t.Fatalf("NewDedupBlockDevice failed: %v", err)
+	}
+	for block, b := range []byte{'a', 'b'} {
+		if err := reopened.Read(uint64(block), buf); err != nil || !bytes.Equal(buf, fill(512, b)) {
+			t.Errorf("block %d reads %q, %v", block, buf[0], err)
+		}
+	}
+}
+
+func TestDedupUnitMask(t *testing.T) {
+	tests := []struct {
+		offset, units uint8
+		mask          uint8
+	}{
+		{0, 1, 0x01},
+		{3, 2, 0x18},
+		{7, 1, 0x80},
+		{0, 8, 0xff},
+	}
+	for _, tt := range tests {
+		if got := unitMask(&dedupChunk{Offset: tt.offset, Units: tt.units}); got != tt.mask {
+			t.Errorf("unitMask(%d, %d) = %08b, expected %08b", tt.offset, tt.units, got, tt.mask)
+		}
+	}
+}
@@ -0,0 +1,579 @@
+/*
+Package storage provides block storage abstraction with caching,
+write-ahead logging, RAID support, and snapshot management.
+*/
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Image errors
+var (
+	ErrNotImage        = errors.New("file is not a block image")
+	ErrImageCorrupted  = errors.New("block image table is corrupted")
+	ErrImageChainDepth = errors.New("backing image chain too deep")
+)
+
+// Image file layout. The file is divided into clusters of one block each:
+// cluster 0 holds the header, followed by the L1 table. L2 tables and data
+// clusters are appended as blocks are first written. An L1 entry holds the
+// file offset of an L2 table and an L2 entry the file offset of a data
+// cluster; 0 means unallocated.
+const (
+	imageMagic         = "WEBOSIMG"
+	imageVersion       = 1
+	imageHeaderSize    = 40
+	imageMinBlockSize  = 512
+	imageMaxChainDepth = 16
+)
+
+// ImageBlockDevice is a sparse, file-backed block device.
+//
+// Blocks are allocated in the image file on first write, so the file only
+// grows as data is written. Unallocated blocks read from the backing image
+// when one is configured, and as zeros otherwise. Backing images are opened
+// read-only, which makes it cheap to clone many writable disks from one
+// golden image.
+type ImageBlockDevice struct {
+	file        *os.File
+	path        string
+	blockSize   int
+	blockCount  uint64
+	l2Entries   uint64
+	l1Offset    int64
+	l1          []uint64
+	l2          map[uint64][]uint64 // L2 tables by L1 index
+	fileEnd     int64
+	backing     BlockDevice
+	backingPath string
+	readOnly    bool
+	closed      bool
+	mu          sync.RWMutex
+	tableMu     sync.Mutex // Guards the L2 table cache
+}
+
+// CreateImage creates a sparse image at path. If backingPath is non-empty,
+// unallocated blocks read from that image or raw file; a blockCount of 0
+// then inherits the backing device's size. A relative backingPath is
+// resolved against the directory of path.
+func CreateImage(path string, blockCount uint64, blockSize int, backingPath string) (*ImageBlockDevice, error) {
+	if blockSize < imageMinBlockSize || blockSize%8 != 0 {
+		return nil, fmt.Errorf("invalid block size: %d", blockSize)
+	}
+	if imageHeaderSize+len(backingPath) > blockSize {
+		return nil, fmt.Errorf("backing path too long: %d bytes", len(backingPath))
+	}
+
+	var backing BlockDevice
+	if backingPath != "" {
+		var err error
+		backing, err = openBacking(resolveBacking(path, backingPath), blockSize, 1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open backing image: %w", err)
+		}
+		if blockCount == 0 {
+			blockCount = backing.BlockCount()
+		}
+	}
+	if blockCount == 0 {
+		if backing != nil {
+			backing.Close()
+		}
+		return nil, ErrInvalidBlockNumber
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if backing != nil {
+			backing.Close()
+		}
+		return nil, err
+	}
+
+	d := newImage(file, path, blockSize, blockCount)
+	d.backing = backing
+	d.backingPath = backingPath
+	d.l1 = make([]uint64, (blockCount+d.l2Entries-1)/d.l2Entries)
+	d.fileEnd = d.tablesEnd(len(d.l1))
+
+	if err := d.writeHeader(); err != nil {
+		d.Close()
+		os.Remove(path)
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// OpenImage opens an existing sparse image and its backing chain.
+func OpenImage(path string) (*ImageBlockDevice, error) {
+	return openImage(path, false, 0)
+}
+
+// openImage opens an image at a given depth in a backing chain.
+func openImage(path string, readOnly bool, depth int) (*ImageBlockDevice, error) {
+	if depth > imageMaxChainDepth {
+		return nil, ErrImageChainDepth
+	}
+
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(path, flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, imageHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		file.Close()
+		if err == io.EOF {
+			return nil, ErrNotImage
+		}
+		return nil, err
+	}
+	if string(header[0:8]) != imageMagic {
+		file.Close()
+		return nil, ErrNotImage
+	}
+	if version := binary.BigEndian.Uint32(header[8:12]); version != imageVersion {
+		file.Close()
+		return nil, fmt.Errorf("unsupported image version %d", version)
+	}
+
+	blockSize := int(binary.BigEndian.Uint32(header[12:16]))
+	blockCount := binary.BigEndian.Uint64(header[16:24])
+	l1Entries := binary.BigEndian.Uint32(header[24:28])
+	backingLen := int(binary.BigEndian.Uint32(header[28:32]))
+	if blockSize < imageMinBlockSize || blockSize%8 != 0 || imageHeaderSize+backingLen > blockSize {
+		file.Close()
+		return nil, ErrImageCorrupted
+	}
+
+	d := newImage(file, path, blockSize, blockCount)
+	d.readOnly = readOnly
+	if uint64(l1Entries) != (blockCount+d.l2Entries-1)/d.l2Entries {
+		file.Close()
+		return nil, ErrImageCorrupted
+	}
+
+	if backingLen > 0 {
+		name := make([]byte, backingLen)
+		if _, err := file.ReadAt(name, imageHeaderSize); err != nil {
+			file.Close()
+			return nil, err
+		}
+		d.backingPath = string(name)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	d.fileEnd = d.alignUp(stat.Size())
+	if minEnd := d.tablesEnd(int(l1Entries)); d.fileEnd < minEnd {
+		d.fileEnd = minEnd
+	}
+
+	table := make([]byte, int(l1Entries)*8)
+	if _, err := file.ReadAt(table, d.l1Offset); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read L1 table: %w", err)
+	}
+	d.l1 = make([]uint64, l1Entries)
+	for i := range d.l1 {
+		d.l1[i] = binary.BigEndian.Uint64(table[i*8:])
+		if d.l1[i] != 0 && !d.validCluster(d.l1[i]) {
+			file.Close()
+			return nil, fmt.Errorf("%w: L1 entry %d points at offset %d", ErrImageCorrupted, i, d.l1[i])
+		}
+	}
+
+	if d.backingPath != "" {
+		backing, err := openBacking(resolveBacking(path, d.backingPath), blockSize, depth+1)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to open backing image: %w", err)
+		}
+		d.backing = backing
+	}
+
+	return d, nil
+}
+
+// newImage initializes the in-memory state shared by create and open.
+func newImage(file *os.File, path string, blockSize int, blockCount uint64) *ImageBlockDevice {
+	return &ImageBlockDevice{
+		file:       file,
+		path:       path,
+		blockSize:  blockSize,
+		blockCount: blockCount,
+		l2Entries:  uint64(blockSize / 8),
+		l1Offset:   int64(blockSize),
+		l2:         make(map[uint64][]uint64),
+	}
+}
+
+// openBacking opens a backing file read-only, as an image when it has an
+// image header and as a raw block file otherwise.
+func openBacking(path string, blockSize int, depth int) (BlockDevice, error) {
+	image, err := openImage(path, true, depth)
+	if err == nil {
+		if image.blockSize != blockSize {
+			image.Close()
+			return nil, fmt.Errorf("block size mismatch: %d != %d", image.blockSize, blockSize)
+		}
+		return image, nil
+	}
+	if !errors.Is(err, ErrNotImage) {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return NewReadOnlyDevice(&FileBlockDevice{
+		file:       file,
+		blockSize:  blockSize,
+		blockCount: uint64(stat.Size()) / uint64(blockSize),
+	}), nil
+}
+
+// resolveBacking resolves a backing path relative to the image's directory.
+func resolveBacking(imagePath, backingPath string) string {
+	if filepath.IsAbs(backingPath) {
+		return backingPath
+	}
+	return filepath.Join(filepath.Dir(imagePath), backingPath)
+}
+
+// Read reads a block from the image, its backing chain, or as zeros.
+func (d *ImageBlockDevice) Read(block uint64, data []byte) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	if block >= d.blockCount {
+		return ErrInvalidBlockNumber
+	}
+	if len(data) != d.blockSize {
+		return fmt.Errorf("data length %d != block size %d", len(data), d.blockSize)
+	}
+
+	offset, err := d.lookup(block)
+	if err != nil {
+		return err
+	}
+	if offset != 0 {
+		_, err := d.file.ReadAt(data, int64(offset))
+		return err
+	}
+
+	if d.backing != nil && block < d.backing.BlockCount() {
+		return d.backing.Read(block, data)
+	}
+
+	clear(data)
+	return nil
+}
+
+// Write writes a block, allocating a cluster on first write.
+func (d *ImageBlockDevice) Write(block uint64, data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if block >= d.blockCount {
+		return ErrInvalidBlockNumber
+	}
+	if len(data) != d.blockSize {
+		return ErrBlockTooLarge
+	}
+
+	offset, err := d.lookup(block)
+	if err != nil {
+		return err
+	}
+	if offset != 0 {
+		_, err := d.file.WriteAt(data, int64(offset))
+		return err
+	}
+
+	// Data first, synced, then the tables that point at it, so a crash can
+	// only leak a cluster and never expose an unwritten one
+	l1Index, l2Index := block/d.l2Entries, block%d.l2Entries
+	table, err := d.l2Table(l1Index, true)
+	if err != nil {
+		return err
+	}
+
+	cluster := d.fileEnd
+	if _, err := d.file.WriteAt(data, cluster); err != nil {
+		return err
+	}
+	d.fileEnd += int64(d.blockSize)
+	if err := d.file.Sync(); err != nil {
+		return err
+	}
+
+	if err := d.writeEntry(int64(d.l1[l1Index])+int64(l2Index)*8, uint64(cluster)); err != nil {
+		return err
+	}
+
+	d.tableMu.Lock()
+	table[l2Index] = uint64(cluster)
+	d.tableMu.Unlock()
+	return nil
+}
+
+// Allocated reports whether a block is stored in this image rather than
+// its backing chain.
+func (d *ImageBlockDevice) Allocated(block uint64) (bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return false, ErrDeviceClosed
+	}
+	if block >= d.blockCount {
+		return false, ErrInvalidBlockNumber
+	}
+
+	offset, err := d.lookup(block)
+	return offset != 0, err
+}
+
+// AllocatedBlocks returns the number of data clusters in the image file.
+func (d *ImageBlockDevice) AllocatedBlocks() (uint64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return 0, ErrDeviceClosed
+	}
+
+	var count uint64
+	for i, offset := range d.l1 {
+		if offset == 0 {
+			continue
+		}
+		table, err := d.l2Table(uint64(i), false)
+		if err != nil {
+			return 0, err
+		}
+		d.tableMu.Lock()
+		for _, entry := range table {
+			if entry != 0 {
+				count++
+			}
+		}
+		d.tableMu.Unlock()
+	}
+	return count, nil
+}
+
+// BackingFile returns the backing path recorded in the header.
+func (d *ImageBlockDevice) BackingFile() string {
+	return d.backingPath
+}
+
+// Path returns the image file path.
+func (d *ImageBlockDevice) Path() string {
+	return d.path
+}
+
+// BlockSize returns the configured block size.
+func (d *ImageBlockDevice) BlockSize() int {
+	return d.blockSize
+}
+
+// BlockCount returns the virtual block count.
+func (d *ImageBlockDevice) BlockCount() uint64 {
+	return d.blockCount
+}
+
+// Flush syncs the image file to disk.
+func (d *ImageBlockDevice) Flush() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	if d.readOnly {
+		return nil
+	}
+	return d.file.Sync()
+}
+
+// Close closes the image and its backing chain.
+func (d *ImageBlockDevice) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+
+	var err error
+	if !d.readOnly {
+		err = d.file.Sync()
+	}
+	if closeErr := d.file.Close(); err == nil {
+		err = closeErr
+	}
+	if d.backing != nil {
+		if closeErr := d.backing.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// lookup returns the file offset of a block's data cluster, or 0 if the
+// block is unallocated (caller must hold lock).
+func (d *ImageBlockDevice) lookup(block uint64) (uint64, error) {
+	l1Index := block / d.l2Entries
+	if d.l1[l1Index] == 0 {
+		return 0, nil
+	}
+
+	table, err := d.l2Table(l1Index, false)
+	if err != nil {
+		return 0, err
+	}
+
+	d.tableMu.Lock()
+	defer d.tableMu.Unlock()
+	return table[block%d.l2Entries], nil
+}
+
+// l2Table returns the L2 table for an L1 index, loading it from the file
+// or, when allocate is set, creating it (caller must hold lock; write lock
+// when allocating).
+func (d *ImageBlockDevice) l2Table(l1Index uint64, allocate bool) ([]uint64, error) {
+	d.tableMu.Lock()
+	table, ok := d.l2[l1Index]
+	d.tableMu.Unlock()
+	if ok {
+		return table, nil
+	}
+
+	offset := d.l1[l1Index]
+	if offset == 0 {
+		if !allocate {
+			return nil, nil
+		}
+
+		// Zeroed table first, synced, then the L1 entry pointing at it
+		cluster := d.fileEnd
+		if _, err := d.file.WriteAt(make([]byte, d.blockSize), cluster); err != nil {
+			return nil, err
+		}
+		d.fileEnd += int64(d.blockSize)
+		if err := d.file.Sync(); err != nil {
+			return nil, err
+		}
+
+		if err := d.writeEntry(d.l1Offset+int64(l1Index)*8, uint64(cluster)); err != nil {
+			return nil, err
+		}
+		d.l1[l1Index] = uint64(cluster)
+		table = make([]uint64, d.l2Entries)
+	} else {
+		buf := make([]byte, d.blockSize)
+		if _, err := d.file.ReadAt(buf, int64(offset)); err != nil {
+			return nil, fmt.Errorf("failed to read L2 table: %w", err)
+		}
+		table = make([]uint64, d.l2Entries)
+		for i := range table {
+			table[i] = binary.BigEndian.Uint64(buf[i*8:])
+			if table[i] != 0 && !d.validCluster(table[i]) {
+				return nil, ErrImageCorrupted
+			}
+		}
+	}
+
+	d.tableMu.Lock()
+	if cached, ok := d.l2[l1Index]; ok {
+		table = cached
+	} else {
+		d.l2[l1Index] = table
+	}
+	d.tableMu.Unlock()
+	return table, nil
+}
+
+// writeEntry writes one big-endian table entry.
+func (d *ImageBlockDevice) writeEntry(offset int64, value uint64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], value)
+	_, err := d.file.WriteAt(buf[:], offset)
+	return err
+}
+
+// writeHeader writes the header and an empty L1 table.
+func (d *ImageBlockDevice) writeHeader() error {
+	header := make([]byte, d.blockSize)
+	copy(header[0:8], imageMagic)
+	binary.BigEndian.PutUint32(header[8:12], imageVersion)
+	binary.BigEndian.PutUint32(header[12:16], uint32(d.blockSize))
+	binary.BigEndian.PutUint64(header[16:24], d.blockCount)
+	binary.BigEndian.PutUint32(header[24:28], uint32(len(d.l1)))
+	binary.BigEndian.PutUint32(header[28:32], uint32(len(d.backingPath)))
+	copy(header[imageHeaderSize:], d.backingPath)
+
+	if _, err := d.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+
+	// Extend the file over the L1 table; the filesystem keeps it sparse
+	if err := d.file.Truncate(d.fileEnd); err != nil {
+		return err
+	}
+	return d.file.Sync()
+}
+
+// tablesEnd returns the end of the header and an L1 table of n entries,
+// where the first L2 table or data cluster can start.
+func (d *ImageBlockDevice) tablesEnd(n int) int64 {
+	return d.l1Offset + d.alignUp(int64(n)*8)
+}
+
+// validCluster reports whether a table entry points at a whole cluster
+// past the header and L1 table and inside the file.
+func (d *ImageBlockDevice) validCluster(offset uint64) bool {
+	return offset%uint64(d.blockSize) == 0 &&
+		int64(offset) >= d.tablesEnd(len(d.l1)) &&
+		offset < uint64(d.fileEnd)
+}
+
+// alignUp rounds n up to a whole number of clusters.
+func (d *ImageBlockDevice) alignUp(n int64) int64 {
+	size := int64(d.blockSize)
+	return (n + size - 1) / size * size
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageSparse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	d, err := CreateImage(path, 1000, 512, "")
+	if err != nil {
+		t.Fatalf("CreateImage failed: %v", err)
+	}
+
+	buf := make([]byte, 512)
+	if err := d.Read(999, buf); err != nil || !isZeroBlock(buf) {
+		t.Errorf("unwritten block reads %q, %v", buf[0], err)
+	}
+	for _, block := range []uint64{3, 500, 999} {
+		if err := d.Write(block, fill(512, byte(block))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if n, err := d.AllocatedBlocks(); err != nil || n != 3 {
+		t.Errorf("AllocatedBlocks = %d, %v; expected 3", n, err)
+	}
+	d.Close()
+
+	reopened, err := OpenImage(path)
+	if err != nil {
+		t.Fatalf("OpenImage failed: %v", err)
+	}
+	defer reopened.Close()
+	for _, block := range []uint64{3, 500, 999} {
+		if err := reopened.Read(block, buf); err != nil || buf[0] != byte(block) {
+			t.Errorf("block %d reads %q, %v", block, buf[0], err)
+		}
+	}
+	if allocated, _ := reopened.Allocated(4); allocated {
+		t.Error("block 4 is allocated without being written")
+	}
+}
+
+func TestImageBacking(t *testing.T) {
+	dir := t.TempDir()
+	base, err := CreateImage(filepath.Join(dir, "base.img"), 64, 512, "")
+	if err != nil {
+		t.Fatalf("CreateImage failed: %v", err)
+	}
+	base.Write(1, fill(512, 'b'))
+	base.Write(2, fill(512, 'b'))
+	base.Close()
+
+	overlay, err := CreateImage(filepath.Join(dir, "overlay.img"), 0, 512, "base.img")
+	if err != nil {
+		t.Fatalf("CreateImage with backing failed: %v", err)
+	}
+	defer overlay.Close()
+	if overlay.BlockCount() != 64 {
+		t.Errorf("BlockCount = %d, expected the backing size", overlay.BlockCount())
+	}
+
+	overlay.Write(2, fill(512, 'o'))
+	buf := make([]byte, 512)
+	for block, want := range map[uint64]byte{1: 'b', 2: 'o', 3: 0} {
+		if err := overlay.Read(block, buf); err != nil || buf[0] != want {
+			t.Errorf("block %d reads %q, %v; expected %q", block, buf[0], err, want)
+		}
+	}
+
+	// The backing image is untouched
+	reopened, _ := OpenImage(filepath.Join(dir, "base.img"))
+	defer reopened.Close()
+	if reopened.Read(2, buf); buf[0] != 'b' {
+		t.Errorf("backing block overwritten with %q", buf[0])
+	}
+}
+
+func TestImageCorruptL1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	d, err := CreateImage(path, 1000, 512, "")
+	if err != nil {
+		t.Fatalf("CreateImage failed: %v", err)
+	}
+	d.Write(0, fill(512, 'a'))
+	d.Close()
+
+	tests := []struct {
+		name  string
+		entry uint64
+	}{
+		{"past end of file", 1 << 40},
+		{"unaligned", 512*3 + 7},
+		{"inside the L1 table", 512},
+	}
+	for _, tt := range tests {
+		data, _ := os.ReadFile(path)
+		binary.BigEndian.PutUint64(data[512:], tt.entry)
+		broken := filepath.Join(t.TempDir(), "broken.img")
+		os.WriteFile(broken, data, 0600)
+
+		if _, err := OpenImage(broken); !errors.Is(err, ErrImageCorrupted) {
+			t.Errorf("%s: OpenImage returned %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+/*
+Package storage provides block storage abstraction with caching,
+write-ahead logging, RAID support, and snapshot management.
+*/
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+)
+
+// Integrity errors
+var (
+	ErrBlockCorrupted    = errors.New("block checksum mismatch")
+	ErrDeviceTooSmall    = errors.New("device too small for integrity metadata")
+	ErrIntegrityMetadata = errors.New("integrity metadata is unreadable")
+)
+
+// checksumSize is the size in bytes of a stored block checksum. Each block
+// has two: its current checksum and the one it had before the last write.
+const (
+	checksumSize = 4
+	entrySize    = 2 * checksumSize
+)
+
+// maxPendingBlocks is how many written blocks are held in memory before
+// they are flushed to the device without waiting for Flush.
+const maxPendingBlocks = 64
+
+// crc32cTable is the Castagnoli polynomial table used for block checksums.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptionError reports a block whose contents do not match its stored
+// checksum. It matches ErrBlockCorrupted with errors.Is.
+type CorruptionError struct {
+	Block    uint64
+	Expected uint32
+	Actual   uint32
+}
+
+// Error implements the error interface.
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("block %d: checksum mismatch (expected %08x, got %08x)", e.Block, e.Expected, e.Actual)
+}
+
+// Unwrap returns ErrBlockCorrupted.
+func (e *CorruptionError) Unwrap() error {
+	return ErrBlockCorrupted
+}
+
+// BlockChecksum computes the CRC32C checksum of block data.
+func BlockChecksum(data []byte) uint32 {
+	return crc32.Checksum(data, crc32cTable)
+}
+
+// IntegrityBlockDevice wraps a BlockDevice with per-block CRC32C checksums.
+//
+// The checksums live in a metadata region at the end of the underlying
+// device, so the wrapper exposes fewer blocks than the device it wraps.
+// Stored checksums are XORed with the checksum of an all-zero block, which
+// means a freshly zeroed device is already consistent and needs no format.
+// Wrap each member of a RAID1 or RAID5 array to let the array repair
+// corrupted blocks from redundancy.
+//
+// Writes are held in memory until Flush, or until maxPendingBlocks have
+// accumulated. A flush stores the new checksums next to the previous ones
+// and flushes them before writing the data, and while it is in progress
+// blocks matching either checksum verify. A crash in the middle therefore
+// leaves each block with its old or new contents, never a false corruption
+// report. Once the data is flushed only the new checksums are accepted, so
+// a lost or misdirected write that leaves the old contents is detected.
+type IntegrityBlockDevice struct {
+	device     BlockDevice
+	blockSize  int
+	dataBlocks uint64
+	metaBlocks uint64
+	perMeta    uint64
+	checksums  []uint32
+	previous   []uint32          // Checksums of blocks being flushed from before their last write
+	pending    map[uint64][]byte // Data written since the last flush
+	dirtyMeta  map[uint64]bool   // Metadata blocks changed since they were written
+	zeroSum    uint32
+	closed     bool
+	mu         sync.RWMutex
+}
+
+// NewIntegrityBlockDevice creates an integrity wrapper around a device and
+// loads its checksum table.
+func NewIntegrityBlockDevice(device BlockDevice) (*IntegrityBlockDevice, error) {
+	blockSize := device.BlockSize()
+	if blockSize < entrySize {
+		return nil, fmt.Errorf("invalid block size: %d", blockSize)
+	}
+
+	perMeta := uint64(blockSize / entrySize)
+	total := device.BlockCount()
+
+	// Reserve one metadata block for every perMeta data blocks.
+	metaBlocks := (total + perMeta) / (perMeta + 1)
+	if metaBlocks >= total {
+		return nil, ErrDeviceTooSmall
+	}
+
+	d := &IntegrityBlockDevice{
+		device:     device,
+		blockSize:  blockSize,
+		dataBlocks: total - metaBlocks,
+		metaBlocks: metaBlocks,
+		perMeta:    perMeta,
+		pending:    make(map[uint64][]byte),
+		dirtyMeta:  make(map[uint64]bool),
+		zeroSum:    BlockChecksum(make([]byte, blockSize)),
+	}
+
+	if err := d.loadChecksums(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// loadChecksums reads the metadata region into memory.
+func (d *IntegrityBlockDevice) loadChecksums() error {
+	d.checksums = make([]uint32, d.dataBlocks)
+	d.previous = make([]uint32, d.dataBlocks)
+	buf := make([]byte, d.blockSize)
+
+	for meta := uint64(0); meta < d.metaBlocks; meta++ {
+		if err := d.device.Read(d.dataBlocks+meta, buf); err != nil {
+			return fmt.Errorf("%w: %v", ErrIntegrityMetadata, err)
+		}
+
+		start := meta * d.perMeta
+		for i := uint64(0); i < d.perMeta && start+i < d.dataBlocks; i++ {
+			d.checksums[start+i] = binary.BigEndian.Uint32(buf[i*entrySize:])
+			d.previous[start+i] = binary.BigEndian.Uint32(buf[i*entrySize+checksumSize:])
+		}
+	}
+
+	return nil
+}
+
+// writeChecksum persists the metadata block holding a data block's checksum.
+// Caller must hold the write lock.
+func (d *IntegrityBlockDevice) writeChecksum(block uint64) error {
+	meta := block / d.perMeta
+	start := meta * d.perMeta
+
+	buf := make([]byte, d.blockSize)
+	for i := uint64(0); i < d.perMeta && start+i < d.dataBlocks; i++ {
+		binary.BigEndian.PutUint32(buf[i*entrySize:], d.checksums[start+i])
+		binary.BigEndian.PutUint32(buf[i*entrySize+checksumSize:], d.previous[start+i])
+	}
+
+	return d.device.Write(d.dataBlocks+meta, buf)
+}
+
+// writeDirtyMeta persists the metadata blocks changed since they were last
+// written. Caller must hold the write lock.
+func (d *IntegrityBlockDevice) writeDirtyMeta() error {
+	for meta := range d.dirtyMeta {
+		if err := d.writeChecksum(meta * d.perMeta); err != nil {
+			return err
+		}
+		delete(d.dirtyMeta, meta)
+	}
+	return nil
+}
+
+// flush writes the pending blocks and their checksums to the device.
+// Caller must hold the write lock.
+func (d *IntegrityBlockDevice) flush() error {
+	if len(d.pending) > 0 {
+		// The checksums reach the device before the data, so whichever
+		// contents survive a crash still verify
+		if err := d.writeDirtyMeta(); err != nil {
+			return err
+		}
+		if err := d.device.Flush(); err != nil {
+			return err
+		}
+		for block, data := range d.pending {
+			if err := d.device.Write(block, data); err != nil {
+				return err
+			}
+		}
+		if err := d.device.Flush(); err != nil {
+			return err
+		}
+
+		// The new contents are durable, so the old ones no longer verify.
+		// The cleared entries reach the device with the next flush.
+		for block := range d.pending {
+			d.previous[block] = d.checksums[block]
+			d.dirtyMeta[block/d.perMeta] = true
+		}
+		clear(d.pending)
+		return nil
+	}
+
+	if err := d.writeDirtyMeta(); err != nil {
+		return err
+	}
+	return d.device.Flush()
+}
+
+// verify checks block data against its stored checksums. Data matching the
+// previous checksum is what the block held before a write that has not
+// been flushed yet, or whose flush was interrupted.
+func (d *IntegrityBlockDevice) verify(block uint64, data []byte) error {
+	expected := d.checksums[block] ^ d.zeroSum
+	actual := BlockChecksum(data)
+	if actual != expected && actual != d.previous[block]^d.zeroSum {
+		return &CorruptionError{Block: block, Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+// Read reads a block and verifies its checksum. A mismatch is reported as a
+// *CorruptionError; data still holds the bytes read from the device. Blocks
+// written since the last flush are read from memory.
+func (d *IntegrityBlockDevice) Read(block uint64, data []byte) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	if block >= d.dataBlocks {
+		return ErrInvalidBlockNumber
+	}
+	if len(data) != d.blockSize {
+		return fmt.Errorf("data length %d != block size %d", len(data), d.blockSize)
+	}
+
+	if pending, ok := d.pending[block]; ok {
+		copy(data, pending)
+		return nil
+	}
+	if err := d.device.Read(block, data); err != nil {
+		return err
+	}
+
+	return d.verify(block, data)
+}
+
+// Write records a block and its checksum, to be written to the device on
+// the next flush.
+func (d *IntegrityBlockDevice) Write(block uint64, data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	if block >= d.dataBlocks {
+		return ErrInvalidBlockNumber
+	}
+	if len(data) != d.blockSize {
+		return ErrBlockTooLarge
+	}
+
+	// The device holds the contents the current checksum describes until
+	// the block is flushed
+	if _, ok := d.pending[block]; !ok {
+		d.previous[block] = d.checksums[block]
+	}
+	d.checksums[block] = BlockChecksum(data) ^ d.zeroSum
+	d.pending[block] = append([]byte(nil), data...)
+	d.dirtyMeta[block/d.perMeta] = true
+
+	if len(d.pending) >= maxPendingBlocks {
+		return d.flush()
+	}
+	return nil
+}
+
+// Checksum returns the stored checksum of a block.
+func (d *IntegrityBlockDevice) Checksum(block uint64) (uint32, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if block >= d.dataBlocks {
+		return 0, ErrInvalidBlockNumber
+	}
+	return d.checksums[block] ^ d.zeroSum, nil
+}
+
+// Metadata returns the integrity metadata for a block.
+func (d *IntegrityBlockDevice) Metadata(block uint64) (BlockMetadata, error) {
+	checksum, err := d.Checksum(block)
+	if err != nil {
+		return BlockMetadata{}, err
+	}
+	return BlockMetadata{BlockNumber: block, Checksum: checksum}, nil
+}
+
+// Scrub reads every block and returns the numbers of those that fail
+// verification.
+func (d *IntegrityBlockDevice) Scrub() ([]uint64, error) {
+	data := make([]byte, d.blockSize)
+	var corrupted []uint64
+
+	for block := uint64(0); block < d.dataBlocks; block++ {
+		err := d.Read(block, data)
+		if errors.Is(err, ErrBlockCorrupted) {
+			corrupted = append(corrupted, block)
+			continue
+		}
+		if err != nil {
+			return corrupted, err
+		}
+	}
+
+	return corrupted, nil
+}
+
+// Format recomputes every checksum from the current device contents. Use it
+// when wrapping a device that already holds data.
+func (d *IntegrityBlockDevice) Format() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	if err := d.flush(); err != nil {
+		return err
+	}
+
+	data := make([]byte, d.blockSize)
+	for block := uint64(0); block < d.dataBlocks; block++ {
+		if err := d.device.Read(block, data); err != nil {
+			return fmt.Errorf("failed to read block %d: %w", block, err)
+		}
+		d.checksums[block] = BlockChecksum(data) ^ d.zeroSum
+		d.previous[block] = d.checksums[block]
+	}
+
+	for meta := uint64(0); meta < d.metaBlocks; meta++ {
+		if err := d.writeChecksum(meta * d.perMeta); err != nil {
+			return err
+		}
+	}
+	clear(d.dirtyMeta)
+
+	return d.device.Flush()
+}
+
+// BlockSize returns the underlying device's block size.
+func (d *IntegrityBlockDevice) BlockSize() int {
+	return d.blockSize
+}
+
+// BlockCount returns the number of data blocks, excluding metadata.
+func (d *IntegrityBlockDevice) BlockCount() uint64 {
+	return d.dataBlocks
+}
+
+// Flush writes the pending blocks and their checksums and flushes the
+// underlying device.
+func (d *IntegrityBlockDevice) Flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	return d.flush()
+}
+
+// Close closes the underlying device.
+func (d *IntegrityBlockDevice) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	err := d.flush()
+	if closeErr := d.device.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
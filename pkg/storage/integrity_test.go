@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+)
+
+var errInjected = errors.New("injected failure")
+
+// faultyDevice wraps a device and fails the writes and flushes it is told
+// to.
+type faultyDevice struct {
+	BlockDevice
+	mu         sync.Mutex
+	failWrites map[uint64]bool
+	dropWrites map[uint64]bool // Acknowledged but not written
+	failAll    bool
+	failFlush  bool
+	flushes    int
+}
+
+func newFaultyDevice(device BlockDevice) *faultyDevice {
+	return &faultyDevice{BlockDevice: device, failWrites: make(map[uint64]bool), dropWrites: make(map[uint64]bool)}
+}
+
+func (d *faultyDevice) Write(block uint64, data []byte) error {
+	d.mu.Lock()
+	fail := d.failAll || d.failWrites[block]
+	drop := d.dropWrites[block]
+	d.mu.Unlock()
+	if fail {
+		return errInjected
+	}
+	if drop {
+		return nil
+	}
+	return d.BlockDevice.Write(block, data)
+}
+
+func (d *faultyDevice) Flush() error {
+	d.mu.Lock()
+	fail := d.failFlush
+	d.flushes++
+	d.mu.Unlock()
+	if fail {
+		return errInjected
+	}
+	return d.BlockDevice.Flush()
+}
+
+// holds checks the first byte of a block on the wrapped device.
+func (d *faultyDevice) holds(t *testing.T, block uint64, want byte) {
+	t.Helper()
+	buf := make([]byte, d.BlockSize())
+	d.BlockDevice.Read(block, buf)
+	if buf[0] != want {
+		t.Errorf("device block %d holds %q, expected %q", block, buf[0], want)
+	}
+}
+
+func newMemoryDevice(t *testing.T, blockCount uint64, blockSize int) *MemoryBlockDevice {
+	t.Helper()
+	device, err := NewMemoryBlockDevice(blockCount, blockSize)
+	if err != nil {
+		t.Fatalf("NewMemoryBlockDevice failed: %v", err)
+	}
+	return device
+}
+
+func fill(blockSize int, b byte) []byte {
+	return bytes.Repeat([]byte{b}, blockSize)
+}
+
+// corrupt flips a byte of a block behind the integrity layer's back.
+func corrupt(t *testing.T, device BlockDevice, block uint64) {
+	t.Helper()
+	buf := make([]byte, device.BlockSize())
+	device.Read(block, buf)
+	buf[0] ^= 0xff
+	if err := device.Write(block, buf); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
+
+func TestIntegrity(t *testing.T) {
+	mem := newMemoryDevice(t, 64, 512)
+	d, err := NewIntegrityBlockDevice(mem)
+	if err != nil {
+		t.Fatalf("NewIntegrityBlockDevice failed: %v", err)
+	}
+
+	// A zeroed device verifies without formatting
+	buf := make([]byte, 512)
+	if err := d.Read(3, buf); err != nil {
+		t.Errorf("Read of fresh block failed: %v", err)
+	}
+
+	if err := d.Write(3, fill(512, 'a')); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	corrupt(t, mem, 3)
+
+	err = d.Read(3, buf)
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) || corruption.Block != 3 || !errors.Is(err, ErrBlockCorrupted) {
+		t.Errorf("Read of corrupted block returned %v", err)
+	}
+	if bad, err := d.Scrub(); err != nil || len(bad) != 1 || bad[0] != 3 {
+		t.Errorf("Scrub returned %v, %v", bad, err)
+	}
+
+	// Checksums survive reopening
+	d.Write(5, fill(512, 'b'))
+	d.Flush()
+	reopened, err := NewIntegrityBlockDevice(mem)
+	if err != nil {
+		t.Fatalf("NewIntegrityBlockDevice failed: %v", err)
+	}
+	if err := reopened.Read(5, buf); err != nil || buf[0] != 'b' {
+		t.Errorf("Read after reopening returned %q, %v", buf[0], err)
+	}
+	if err := reopened.Read(3, buf); !errors.Is(err, ErrBlockCorrupted) {
+		t.Errorf("Read of corrupted block after reopening returned %v", err)
+	}
+}
+
+func TestIntegrityInterruptedWrite(t *testing.T) {
+	faulty := newFaultyDevice(newMemoryDevice(t, 64, 512))
+	d, err := NewIntegrityBlockDevice(faulty)
+	if err != nil {
+		t.Fatalf("NewIntegrityBlockDevice failed: %v", err)
+	}
+	d.Write(7, fill(512, 'a'))
+	d.Flush()
+
+	// The checksum is stored but the data never arrives, as in a crash
+	// between the two writes
+	faulty.failWrites[7] = true
+	d.Write(7, fill(512, 'b'))
+	if err := d.Flush(); !errors.Is(err, errInjected) {
+		t.Fatalf("Flush returned %v, expected the injected failure", err)
+	}
+
+	reopened, err := NewIntegrityBlockDevice(faulty)
+	if err != nil {
+		t.Fatalf("NewIntegrityBlockDevice failed: %v", err)
+	}
+	buf := make([]byte, 512)
+	if err := reopened.Read(7, buf); err != nil || buf[0] != 'a' {
+		t.Errorf("Read after interrupted write returned %q, %v; expected old contents", buf[0], err)
+	}
+
+	// A failed metadata flush stops the data write
+	faulty.failWrites[7] = false
+	d.Write(8, fill(512, 'a'))
+	d.Flush()
+	faulty.failFlush = true
+	d.Write(8, fill(512, 'c'))
+	if err := d.Flush(); !errors.Is(err, errInjected) {
+		t.Errorf("Flush with failing device flush returned %v", err)
+	}
+	faulty.holds(t, 8, 'a')
+	faulty.failFlush = false
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	faulty.holds(t, 8, 'c')
+}
+
+func TestIntegrityLostWrite(t *testing.T) {
+	faulty := newFaultyDevice(newMemoryDevice(t, 64, 512))
+	d, err := NewIntegrityBlockDevice(faulty)
+	if err != nil {
+		t.Fatalf("NewIntegrityBlockDevice failed: %v", err)
+	}
+	for block := uint64(0); block < 10; block++ {
+		d.Write(block, fill(512, 'a'))
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if faulty.flushes != 2 {
+		t.Errorf("flushing 10 writes flushed the device %d times, expected 2", faulty.flushes)
+	}
+
+	// A write the device acknowledges but loses leaves the old contents,
+	// which no longer verify once the write was flushed
+	faulty.dropWrites[3] = true
+	d.Write(3, fill(512, 'b'))
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	buf := make([]byte, 512)
+	if err := d.Read(3, buf); !errors.Is(err, ErrBlockCorrupted) {
+		t.Errorf("Read after a lost write returned %q, %v", buf[0], err)
+	}
+
+	// The same holds after reopening once the cleared entry is saved
+	d.Flush()
+	reopened, err := NewIntegrityBlockDevice(faulty)
+	if err != nil {
+		t.Fatalf("NewIntegrityBlockDevice failed: %v", err)
+	}
+	if err := reopened.Read(3, buf); !errors.Is(err, ErrBlockCorrupted) {
+		t.Errorf("Read after a lost write and reopening returned %q, %v", buf[0], err)
+	}
+}
+
+func newIntegrityArray(t *testing.T, n int) ([]*MemoryBlockDevice, []BlockDevice) {
+	t.Helper()
+	mems := make([]*MemoryBlockDevice, n)
+	devices := make([]BlockDevice, n)
+	for i := range mems {
+		mems[i] = newMemoryDevice(t, 64, 512)
+		d, err := NewIntegrityBlockDevice(mems[i])
+		if err != nil {
+			t.Fatalf("NewIntegrityBlockDevice failed: %v", err)
+		}
+		devices[i] = d
+	}
+	return mems, devices
+}
+
+func TestRAID1Repair(t *testing.T) {
+	mems, devices := newIntegrityArray(t, 2)
+	raid, err := NewRAID1(devices)
+	if err != nil {
+		t.Fatalf("NewRAID1 failed: %v", err)
+	}
+
+	raid.Write(4, fill(512, 'm'))
+	raid.Flush()
+	corrupt(t, mems[0], 4)
+
+	buf := make([]byte, 512)
+	if err := raid.Read(4, buf); err != nil || buf[0] != 'm' {
+		t.Fatalf("Read returned %q, %v", buf[0], err)
+	}
+	if err := devices[0].Read(4, buf); err != nil || buf[0] != 'm' {
+		t.Errorf("mirror not repaired: %q, %v", buf[0], err)
+	}
+
+	// A mirror that cannot be rewritten is reported and marked failed
+	raid.Flush()
+	faulty := newFaultyDevice(devices[0])
+	raid.devices[0] = faulty
+	corrupt(t, mems[0], 4)
+	faulty.failAll = true
+	if err := raid.Read(4, buf); !errors.Is(err, errInjected) || buf[0] != 'm' {
+		t.Errorf("Read with failing repair returned %q, %v", buf[0], err)
+	}
+	if status := raid.Status(); status.FailedDevices != 1 {
+		t.Errorf("FailedDevices = %d, expected 1", status.FailedDevices)
+	}
+}
+
+func TestRAID5Repair(t *testing.T) {
+	mems, devices := newIntegrityArray(t, 3)
+	raid, err := NewRAID5(devices)
+	if err != nil {
+		t.Fatalf("NewRAID5 failed: %v", err)
+	}
+
+	for block := uint64(0); block < 4; block++ {
+		raid.Write(block, fill(512, byte('0'+block)))
+	}
+	raid.Flush()
+
+	// Block 0 lives on device 1 of stripe 0, whose parity is on device 0
+	corrupt(t, mems[1], 0)
+	buf := make([]byte, 512)
+	if err := raid.Read(0, buf); err != nil || buf[0] != '0' {
+		t.Fatalf("Read returned %q, %v", buf[0], err)
+	}
+	if err := devices[1].Read(0, buf); err != nil || buf[0] != '0' {
+		t.Errorf("block not repaired: %q, %v", buf[0], err)
+	}
+
+	// With the parity also bad, reconstruction must fail rather than
+	// write garbage back
+	raid.Flush()
+	corrupt(t, mems[1], 0)
+	corrupt(t, mems[0], 0)
+	if err := raid.Read(0, buf); !errors.Is(err, ErrBlockCorrupted) {
+		t.Errorf("Read with corrupted parity returned %v", err)
+	}
+	mems[1].Read(0, buf)
+	if buf[0] != '0'^0xff {
+		t.Errorf("block was overwritten with %q", buf[0])
+	}
+}
@@ -0,0 +1,345 @@
+/*
+Package storage provides block storage abstraction with caching,
+write-ahead logging, RAID support, and snapshot management.
+*/
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the latency histogram buckets.
+// Operations slower than the last bound fall into a final overflow bucket.
+var latencyBounds = []time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// IOLimits configures rate limits for a MeteredBlockDevice. A zero rate
+// means unlimited. Burst is how many seconds of rate may be used at once
+// after a quiet period; 0 means one second.
+type IOLimits struct {
+	IOPS      float64 `json:"iops"`      // Operations per second
+	Bandwidth float64 `json:"bandwidth"` // Bytes per second
+	Burst     float64 `json:"burst"`     // Seconds of burst allowance
+}
+
+// LatencyBucket counts operations no slower than UpperBound. The final
+// bucket has an UpperBound of 0 and counts everything slower.
+type LatencyBucket struct {
+	UpperBound time.Duration `json:"upperBound"`
+	Count      uint64        `json:"count"`
+}
+
+// LatencyHistogram summarizes operation latencies.
+type LatencyHistogram struct {
+	Count   uint64          `json:"count"`
+	Total   time.Duration   `json:"total"`
+	Max     time.Duration   `json:"max"`
+	Buckets []LatencyBucket `json:"buckets"`
+}
+
+// Mean returns the average latency.
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Total / time.Duration(h.Count)
+}
+
+// Percentile estimates the latency below which fraction p (0..1) of
+// operations fall, reporting the upper bound of the matching bucket.
+func (h LatencyHistogram) Percentile(p float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+
+	target := uint64(p * float64(h.Count))
+	if target == 0 {
+		target = 1
+	}
+
+	var seen uint64
+	for _, bucket := range h.Buckets {
+		seen += bucket.Count
+		if seen >= target {
+			if bucket.UpperBound == 0 {
+				return h.Max
+			}
+			return bucket.UpperBound
+		}
+	}
+	return h.Max
+}
+
+// IOStats contains I/O statistics for a MeteredBlockDevice.
+type IOStats struct {
+	DeviceType    string           `json:"deviceType"`
+	BlockSize     int              `json:"blockSize"`
+	ReadOps       uint64           `json:"readOps"`
+	WriteOps      uint64           `json:"writeOps"`
+	ReadBytes     uint64           `json:"readBytes"`
+	WriteBytes    uint64           `json:"writeBytes"`
+	ReadErrors    uint64           `json:"readErrors"`
+	WriteErrors   uint64           `json:"writeErrors"`
+	FlushOps      uint64           `json:"flushOps"`
+	ThrottledOps  uint64           `json:"throttledOps"`
+	ThrottledTime time.Duration    `json:"throttledTime"`
+	ReadLatency   LatencyHistogram `json:"readLatency"`
+	WriteLatency  LatencyHistogram `json:"writeLatency"`
+	FlushLatency  LatencyHistogram `json:"flushLatency"`
+	Limits        IOLimits         `json:"limits"`
+	Since         time.Time        `json:"since"`
+}
+
+// latencyRecorder accumulates a latency histogram.
+type latencyRecorder struct {
+	counts [16]uint64 // len(latencyBounds) + overflow
+	count  uint64
+	total  time.Duration
+	max    time.Duration
+}
+
+// record adds one observation.
+func (r *latencyRecorder) record(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+	r.counts[i]++
+	r.count++
+	r.total += d
+	if d > r.max {
+		r.max = d
+	}
+}
+
+// histogram exports the recorded observations.
+func (r *latencyRecorder) histogram() LatencyHistogram {
+	h := LatencyHistogram{
+		Count:   r.count,
+		Total:   r.total,
+		Max:     r.max,
+		Buckets: make([]LatencyBucket, len(r.counts)),
+	}
+	for i, count := range r.counts {
+		if i < len(latencyBounds) {
+			h.Buckets[i].UpperBound = latencyBounds[i]
+		}
+		h.Buckets[i].Count = count
+	}
+	return h
+}
+
+// tokenBucket is a token-bucket rate limiter. Reservations may drive the
+// balance negative, so requests larger than the burst still proceed after
+// an appropriate wait.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// configure sets the rate and burst, refilling the bucket.
+func (b *tokenBucket) configure(rate, burstSeconds float64) {
+	if burstSeconds <= 0 {
+		burstSeconds = 1
+	}
+	b.rate = rate
+	b.burst = rate * burstSeconds
+	b.tokens = b.burst
+	b.last = time.Now()
+}
+
+// reserve takes n tokens and returns how long the caller must wait.
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// MeteredBlockDevice wraps a BlockDevice with I/O statistics and rate
+// limits.
+//
+// Every read, write and flush is counted and timed. When limits are set,
+// operations wait for IOPS and bandwidth tokens before reaching the
+// underlying device, so one workload cannot saturate a shared device.
+type MeteredBlockDevice struct {
+	device    BlockDevice
+	limits    IOLimits
+	iops      tokenBucket
+	bandwidth tokenBucket
+	stats     IOStats
+	reads     latencyRecorder
+	writes    latencyRecorder
+	flushes   latencyRecorder
+	mu        sync.Mutex
+}
+
+// NewMeteredBlockDevice creates a metering wrapper with the given limits.
+func NewMeteredBlockDevice(device BlockDevice, limits IOLimits) *MeteredBlockDevice {
+	d := &MeteredBlockDevice{device: device}
+	d.stats.Since = time.Now()
+	d.SetLimits(limits)
+	return d
+}
+
+// SetLimits replaces the rate limits.
+func (d *MeteredBlockDevice) SetLimits(limits IOLimits) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.limits = limits
+	d.iops.configure(limits.IOPS, limits.Burst)
+	d.bandwidth.configure(limits.Bandwidth, limits.Burst)
+}
+
+// Limits returns the current rate limits.
+func (d *MeteredBlockDevice) Limits() IOLimits {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.limits
+}
+
+// Read reads a block after waiting for rate-limit tokens.
+func (d *MeteredBlockDevice) Read(block uint64, data []byte) error {
+	d.throttle(len(data))
+
+	start := time.Now()
+	err := d.device.Read(block, data)
+	elapsed := time.Since(start)
+
+	d.mu.Lock()
+	d.stats.ReadOps++
+	if err != nil {
+		d.stats.ReadErrors++
+	} else {
+		d.stats.ReadBytes += uint64(len(data))
+	}
+	d.reads.record(elapsed)
+	d.mu.Unlock()
+
+	return err
+}
+
+// Write writes a block after waiting for rate-limit tokens.
+func (d *MeteredBlockDevice) Write(block uint64, data []byte) error {
+	d.throttle(len(data))
+
+	start := time.Now()
+	err := d.device.Write(block, data)
+	elapsed := time.Since(start)
+
+	d.mu.Lock()
+	d.stats.WriteOps++
+	if err != nil {
+		d.stats.WriteErrors++
+	} else {
+		d.stats.WriteBytes += uint64(len(data))
+	}
+	d.writes.record(elapsed)
+	d.mu.Unlock()
+
+	return err
+}
+
+// throttle waits until an operation of size bytes is within the limits.
+func (d *MeteredBlockDevice) throttle(size int) {
+	d.mu.Lock()
+	now := time.Now()
+	wait := d.iops.reserve(1, now)
+	if bw := d.bandwidth.reserve(float64(size), now); bw > wait {
+		wait = bw
+	}
+	if wait > 0 {
+		d.stats.ThrottledOps++
+		d.stats.ThrottledTime += wait
+	}
+	d.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Stats returns a snapshot of the I/O statistics.
+func (d *MeteredBlockDevice) Stats() IOStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats := d.stats
+	stats.DeviceType = GetInfo(d.device).Type
+	stats.BlockSize = d.device.BlockSize()
+	stats.ReadLatency = d.reads.histogram()
+	stats.WriteLatency = d.writes.histogram()
+	stats.FlushLatency = d.flushes.histogram()
+	stats.Limits = d.limits
+	return stats
+}
+
+// ResetStats clears the counters and histograms.
+func (d *MeteredBlockDevice) ResetStats() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stats = IOStats{Since: time.Now()}
+	d.reads = latencyRecorder{}
+	d.writes = latencyRecorder{}
+	d.flushes = latencyRecorder{}
+}
+
+// BlockSize returns the underlying device's block size.
+func (d *MeteredBlockDevice) BlockSize() int {
+	return d.device.BlockSize()
+}
+
+// BlockCount returns the underlying device's block count.
+func (d *MeteredBlockDevice) BlockCount() uint64 {
+	return d.device.BlockCount()
+}
+
+// Flush forwards to the underlying device and records its latency.
+func (d *MeteredBlockDevice) Flush() error {
+	start := time.Now()
+	err := d.device.Flush()
+	elapsed := time.Since(start)
+
+	d.mu.Lock()
+	d.stats.FlushOps++
+	d.flushes.record(elapsed)
+	d.mu.Unlock()
+
+	return err
+}
+
+// Close forwards to the underlying device.
+func (d *MeteredBlockDevice) Close() error {
+	return d.device.Close()
+}
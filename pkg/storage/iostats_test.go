@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMeteredCounters(t *testing.T) {
+	faulty := newFaultyDevice(newMemoryDevice(t, 8, 512))
+	d := NewMeteredBlockDevice(faulty, IOLimits{})
+
+	buf := make([]byte, 512)
+	d.Write(0, fill(512, 'a'))
+	d.Read(0, buf)
+	d.Read(1, buf)
+	faulty.failWrites[2] = true
+	if err := d.Write(2, buf); !errors.Is(err, errInjected) {
+		t.Errorf("Write returned %v, expected the device error", err)
+	}
+	d.Flush()
+
+	stats := d.Stats()
+	if stats.ReadOps != 2 || stats.ReadBytes != 1024 || stats.ReadErrors != 0 {
+		t.Errorf("reads: %d ops, %d bytes, %d errors", stats.ReadOps, stats.ReadBytes, stats.ReadErrors)
+	}
+	if stats.WriteOps != 2 || stats.WriteBytes != 512 || stats.WriteErrors != 1 {
+		t.Errorf("writes: %d ops, %d bytes, %d errors", stats.WriteOps, stats.WriteBytes, stats.WriteErrors)
+	}
+	if stats.FlushOps != 1 || stats.FlushLatency.Count != 1 {
+		t.Errorf("flushes: %d ops, %d timed", stats.FlushOps, stats.FlushLatency.Count)
+	}
+	if stats.ReadLatency.Count != 2 || stats.WriteLatency.Count != 2 {
+		t.Errorf("latency counts %d and %d, expected 2 and 2", stats.ReadLatency.Count, stats.WriteLatency.Count)
+	}
+	if stats.DeviceType != "unknown" || stats.BlockSize != 512 {
+		t.Errorf("device %q with block size %d", stats.DeviceType, stats.BlockSize)
+	}
+
+	d.ResetStats()
+	if stats := d.Stats(); stats.ReadOps != 0 || stats.ReadLatency.Count != 0 {
+		t.Errorf("ResetStats left %d reads", stats.ReadOps)
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	var r latencyRecorder
+	for _, d := range []time.Duration{
+		5 * time.Microsecond,  // first bucket
+		10 * time.Microsecond, // bounds are inclusive
+		30 * time.Microsecond,
+		3 * time.Millisecond,
+		2 * time.Second, // overflow
+	} {
+		r.record(d)
+	}
+
+	h := r.histogram()
+	if len(h.Buckets) != len(latencyBounds)+1 {
+		t.Fatalf("%d buckets, expected %d", len(h.Buckets), len(latencyBounds)+1)
+	}
+	expected := map[int]uint64{0: 2, 1: 1, 7: 1, len(latencyBounds): 1}
+	for i, bucket := range h.Buckets {
+		if bucket.Count != expected[i] {
+			t.Errorf("bucket %d (%v) has %d, expected %d", i, bucket.UpperBound, bucket.Count, expected[i])
+		}
+	}
+	if last := h.Buckets[len(h.Buckets)-1]; last.UpperBound != 0 {
+		t.Errorf("overflow bucket bound %v, expected 0", last.UpperBound)
+	}
+
+	if h.Max != 2*time.Second {
+		t.Errorf("Max = %v", h.Max)
+	}
+	if mean := h.Mean(); mean != h.Total/5 {
+		t.Errorf("Mean = %v", mean)
+	}
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, 10 * time.Microsecond},
+		{0.4, 10 * time.Microsecond},
+		{0.6, 50 * time.Microsecond},
+		{0.8, 5 * time.Millisecond},
+		{1, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := h.Percentile(tt.p); got != tt.want {
+			t.Errorf("Percentile(%v) = %v, expected %v", tt.p, got, tt.want)
+		}
+	}
+	if got := (LatencyHistogram{}).Percentile(0.5); got != 0 {
+		t.Errorf("empty Percentile = %v", got)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	b.configure(100, 2) // 100 per second, 200 of burst
+	now := b.last
+
+	if wait := b.reserve(200, now); wait != 0 {
+		t.Errorf("burst waited %v", wait)
+	}
+	if wait := b.reserve(50, now); wait != 500*time.Millisecond {
+		t.Errorf("overdraft waited %v, expected 500ms", wait)
+	}
+
+	// Refill is capped at the burst
+	now = now.Add(time.Hour)
+	if wait := b.reserve(200, now); wait != 0 {
+		t.Errorf("refilled bucket waited %v", wait)
+	}
+	if wait := b.reserve(1, now); wait != 10*time.Millisecond {
+		t.Errorf("bucket refilled beyond its burst: waited %v", wait)
+	}
+
+	var unlimited tokenBucket
+	unlimited.configure(0, 0)
+	if wait := unlimited.reserve(1e9, now); wait != 0 {
+		t.Errorf("unlimited bucket waited %v", wait)
+	}
+}
+
+func TestMeteredThrottle(t *testing.T) {
+	d := NewMeteredBlockDevice(newMemoryDevice(t, 8, 512), IOLimits{IOPS: 100, Burst: 0.01})
+
+	// One operation of burst, then each waits about 10ms
+	start := time.Now()
+	buf := make([]byte, 512)
+	for i := 0; i < 4; i++ {
+		d.Read(0, buf)
+	}
+	if elapsed := time.Since(start); elapsed < 25*time.Millisecond {
+		t.Errorf("4 reads at 100 IOPS took %v", elapsed)
+	}
+	if stats := d.Stats(); stats.ThrottledOps != 3 || stats.ThrottledTime <= 0 {
+		t.Errorf("ThrottledOps = %d, ThrottledTime = %v", stats.ThrottledOps, stats.ThrottledTime)
+	}
+}
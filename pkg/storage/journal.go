@@ -0,0 +1,370 @@
+/*
+Package storage provides block storage abstraction with caching,
+write-ahead logging, RAID support, and snapshot management.
+*/
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Journal errors
+var (
+	ErrTransactionDone = errors.New("transaction already committed or aborted")
+)
+
+// DefaultCheckpointInterval is how often a JournaledBlockDevice applies
+// committed blocks to the underlying device.
+const DefaultCheckpointInterval = 5 * time.Second
+
+// JournaledBlockDevice wraps a BlockDevice with a write-ahead journal.
+//
+// Writes go to the WAL first and are applied to the underlying device by a
+// background checkpoint. Until then, reads are served from the committed
+// blocks held in memory. Opening a journaled device replays transactions
+// that committed but were never checkpointed and discards transactions that
+// were torn by a crash, so a multi-block update is either fully applied or
+// not at all. If the WAL cannot be written, the failed commit is discarded
+// and later commits and checkpoints return the error until the device is
+// reopened.
+type JournaledBlockDevice struct {
+	device     BlockDevice
+	wal        *WriteAheadLog
+	pending    map[uint64][]byte // Committed blocks not yet checkpointed
+	committing []*journalCommit  // Commits queued in the WAL, in commit order
+	stop       chan struct{}
+	done       chan struct{}
+	closed     bool
+	mu         sync.RWMutex
+}
+
+// journalCommit is a commit waiting for its WAL sync.
+type journalCommit struct {
+	future *CommitFuture
+	writes map[uint64][]byte
+}
+
+// JournalTransaction groups block writes that commit atomically.
+type JournalTransaction struct {
+	journal *JournaledBlockDevice
+	id      uint64
+	writes  map[uint64][]byte
+	done    bool
+	mu      sync.Mutex
+}
+
+// NewJournaledBlockDevice creates a journaled device, replaying any
+// committed records in wal onto device first. Committed blocks are
+// checkpointed every interval; an interval of 0 disables background
+// checkpoints, leaving them to Flush and Close.
+func NewJournaledBlockDevice(device BlockDevice, wal *WriteAheadLog, interval time.Duration) (*JournaledBlockDevice, error) {
+	if _, err := wal.Replay(device); err != nil {
+		return nil, fmt.Errorf("failed to replay journal: %w", err)
+	}
+
+	d := &JournaledBlockDevice{
+		device:  device,
+		wal:     wal,
+		pending: make(map[uint64][]byte),
+	}
+	if err := d.checkpointLocked(); err != nil {
+		return nil, err
+	}
+
+	if interval > 0 {
+		d.stop = make(chan struct{})
+		d.done = make(chan struct{})
+		go d.checkpointLoop(interval, d.stop, d.done)
+	}
+
+	return d, nil
+}
+
+// checkpointLoop periodically checkpoints until stop is closed.
+func (d *JournaledBlockDevice) checkpointLoop(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			d.Checkpoint()
+		}
+	}
+}
+
+// Read reads a block, preferring committed data not yet checkpointed.
+func (d *JournaledBlockDevice) Read(block uint64, data []byte) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	if block >= d.device.BlockCount() {
+		return ErrInvalidBlockNumber
+	}
+	if len(data) != d.device.BlockSize() {
+		return fmt.Errorf("data length %d != block size %d", len(data), d.device.BlockSize())
+	}
+
+	if buf, ok := d.pending[block]; ok {
+		copy(data, buf)
+		return nil
+	}
+	return d.device.Read(block, data)
+}
+
+// Write writes a single block as its own transaction.
+func (d *JournaledBlockDevice) Write(block uint64, data []byte) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	if err := tx.Write(block, data); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Begin starts a transaction.
+func (d *JournaledBlockDevice) Begin() (*JournalTransaction, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return nil, ErrDeviceClosed
+	}
+
+	id, err := d.wal.BeginTransaction()
+	if err != nil {
+		return nil, err
+	}
+
+	return &JournalTransaction{
+		journal: d,
+		id:      id,
+		writes:  make(map[uint64][]byte),
+	}, nil
+}
+
+// Checkpoint applies committed blocks to the underlying device, flushes it
+// and trims the journal.
+func (d *JournaledBlockDevice) Checkpoint() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	return d.checkpointLocked()
+}
+
+// checkpointLocked writes pending blocks and trims the WAL
+// (caller must hold lock).
+func (d *JournaledBlockDevice) checkpointLocked() error {
+	// Queued commits must be durable before their blocks reach the device
+	if err := d.wal.Flush(); err != nil {
+		return err
+	}
+	d.publish()
+
+	for block, data := range d.pending {
+		if err := d.device.Write(block, data); err != nil {
+			return fmt.Errorf("checkpoint failed: %w", err)
+		}
+	}
+	if err := d.device.Flush(); err != nil {
+		return fmt.Errorf("checkpoint failed: %w", err)
+	}
+
+	if err := d.wal.Checkpoint(); err != nil {
+		return err
+	}
+	if err := d.wal.Truncate(d.wal.GetSequence()); err != nil {
+		return err
+	}
+
+	clear(d.pending)
+	return nil
+}
+
+// publish moves the writes of synced commits into pending, stopping at
+// the first commit still waiting. Commits are synced in the order they
+// were queued, so blocks written by several transactions end up with the
+// last committed data. Failed commits are dropped (caller must hold lock).
+func (d *JournaledBlockDevice) publish() {
+	for len(d.committing) > 0 {
+		commit := d.committing[0]
+		select {
+		case <-commit.future.Done():
+		default:
+			return
+		}
+
+		if commit.future.err == nil {
+			for block, data := range commit.writes {
+				d.pending[block] = data
+			}
+		}
+		d.committing[0] = nil
+		d.committing = d.committing[1:]
+	}
+}
+
+// PendingBlocks returns the number of committed blocks awaiting checkpoint.
+func (d *JournaledBlockDevice) PendingBlocks() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.pending)
+}
+
+// BlockSize returns the underlying device's block size.
+func (d *JournaledBlockDevice) BlockSize() int {
+	return d.device.BlockSize()
+}
+
+// BlockCount returns the underlying device's block count.
+func (d *JournaledBlockDevice) BlockCount() uint64 {
+	return d.device.BlockCount()
+}
+
+// Flush checkpoints all committed blocks.
+func (d *JournaledBlockDevice) Flush() error {
+	return d.Checkpoint()
+}
+
+// Close stops background checkpoints, checkpoints once more and closes the
+// WAL and the underlying device.
+func (d *JournaledBlockDevice) Close() error {
+	d.mu.Lock()
+	stop, done := d.stop, d.done
+	d.stop, d.done = nil, nil
+	d.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil
+	}
+
+	err := d.checkpointLocked()
+	d.closed = true
+	if walErr := d.wal.Close(); err == nil {
+		err = walErr
+	}
+	if devErr := d.device.Close(); err == nil {
+		err = devErr
+	}
+	return err
+}
+
+// ID returns the transaction's WAL identifier.
+func (tx *JournalTransaction) ID() uint64 {
+	return tx.id
+}
+
+// Read reads a block as seen by the transaction, including its own
+// uncommitted writes.
+func (tx *JournalTransaction) Read(block uint64, data []byte) error {
+	tx.mu.Lock()
+	buf, ok := tx.writes[block]
+	tx.mu.Unlock()
+
+	if ok {
+		if len(data) != len(buf) {
+			return fmt.Errorf("data length %d != block size %d", len(data), len(buf))
+		}
+		copy(data, buf)
+		return nil
+	}
+	return tx.journal.Read(block, data)
+}
+
+// Write logs a block write. It is not visible outside the transaction
+// until Commit.
+func (tx *JournalTransaction) Write(block uint64, data []byte) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTransactionDone
+	}
+
+	d := tx.journal
+	if block >= d.device.BlockCount() {
+		return ErrInvalidBlockNumber
+	}
+	if len(data) != d.device.BlockSize() {
+		return ErrBlockTooLarge
+	}
+
+	if err := d.wal.WriteTransactionBlock(tx.id, block, data); err != nil {
+		return err
+	}
+
+	tx.writes[block] = append([]byte(nil), data...)
+	return nil
+}
+
+// Commit makes the transaction's writes durable and visible. Concurrent
+// commits are synced to the WAL as a group; the writes become visible to
+// readers once the sync succeeds and are discarded if it fails.
+func (tx *JournalTransaction) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTransactionDone
+	}
+
+	d := tx.journal
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return ErrDeviceClosed
+	}
+	future, err := d.wal.CommitAsync(tx.id)
+	if err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	d.committing = append(d.committing, &journalCommit{future: future, writes: tx.writes})
+	tx.done = true
+	d.mu.Unlock()
+
+	err = future.Wait()
+
+	d.mu.Lock()
+	d.publish()
+	d.mu.Unlock()
+	return err
+}
+
+// Abort discards the transaction's writes.
+func (tx *JournalTransaction) Abort() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTransactionDone
+	}
+	tx.done = true
+	tx.writes = nil
+
+	return tx.journal.wal.EndTransaction(tx.id)
+}
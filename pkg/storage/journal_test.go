@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func newTestJournal(t *testing.T, mem BlockDevice) (*JournaledBlockDevice, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "journal.wal")
+	wal, err := NewWriteAheadLog(path, mem.BlockSize(), 0)
+	if err != nil {
+		t.Fatalf("NewWriteAheadLog failed: %v", err)
+	}
+	d, err := NewJournaledBlockDevice(mem, wal, 0)
+	if err != nil {
+		t.Fatalf("NewJournaledBlockDevice failed: %v", err)
+	}
+	return d, path
+}
+
+func TestJournalRecover(t *testing.T) {
+	mem := newMemoryDevice(t, 16, 512)
+	d, path := newTestJournal(t, mem)
+
+	tx, _ := d.Begin()
+	tx.Write(1, fill(512, 'a'))
+	tx.Write(2, fill(512, 'b'))
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	buf := make([]byte, 512)
+	if err := d.Read(1, buf); err != nil || buf[0] != 'a' {
+		t.Errorf("Read of committed block returned %q, %v", buf[0], err)
+	}
+	if mem.Read(1, buf); buf[0] != 0 {
+		t.Error("block reached the device before a checkpoint")
+	}
+
+	// A transaction torn by the crash is discarded on recovery
+	torn, _ := d.Begin()
+	torn.Write(3, fill(512, 'c'))
+
+	// Reopen without Close, as after a crash
+	wal, err := OpenWriteAheadLog(path, 512)
+	if err != nil {
+		t.Fatalf("OpenWriteAheadLog failed: %v", err)
+	}
+	if _, err := NewJournaledBlockDevice(mem, wal, 0); err != nil {
+		t.Fatalf("NewJournaledBlockDevice failed: %v", err)
+	}
+	for block, want := range map[uint64]byte{1: 'a', 2: 'b', 3: 0} {
+		mem.Read(block, buf)
+		if buf[0] != want {
+			t.Errorf("block %d holds %q after recovery, expected %q", block, buf[0], want)
+		}
+	}
+}
+
+func TestJournalCommitFailure(t *testing.T) {
+	mem := newMemoryDevice(t, 16, 512)
+	d, path := newTestJournal(t, mem)
+	if err := d.Write(1, fill(512, 'a')); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// Pull the log file out from under the WAL so the next sync fails
+	d.wal.file.Close()
+
+	tx, _ := d.Begin()
+	tx.Write(2, fill(512, 'b'))
+	if err := tx.Commit(); err == nil {
+		t.Fatal("Commit succeeded despite the failing log")
+	}
+
+	buf := make([]byte, 512)
+	if err := d.Read(2, buf); err != nil || buf[0] != 0 {
+		t.Errorf("failed commit is visible: %q, %v", buf[0], err)
+	}
+	if n := d.PendingBlocks(); n != 1 {
+		t.Errorf("PendingBlocks = %d, expected 1", n)
+	}
+	if records := d.wal.GetCommittedRecords(); len(records) != 1 {
+		t.Errorf("%d committed records after the failure, expected 1", len(records))
+	}
+
+	// The log stays failed, so the checkpoint cannot apply anything
+	if err := d.Checkpoint(); err == nil {
+		t.Error("Checkpoint succeeded after the failed commit")
+	}
+	if mem.Read(2, buf); buf[0] != 0 {
+		t.Error("failed commit was checkpointed to the device")
+	}
+	if err := d.Write(3, fill(512, 'c')); err == nil {
+		t.Error("Write succeeded after the failed commit")
+	}
+
+	wal, err := OpenWriteAheadLog(path, 512)
+	if err != nil {
+		t.Fatalf("OpenWriteAheadLog failed: %v", err)
+	}
+	if _, err := NewJournaledBlockDevice(mem, wal, 0); err != nil {
+		t.Fatalf("NewJournaledBlockDevice failed: %v", err)
+	}
+	for block, want := range map[uint64]byte{1: 'a', 2: 0} {
+		mem.Read(block, buf)
+		if buf[0] != want {
+			t.Errorf("block %d holds %q after recovery, expected %q", block, buf[0], want)
+		}
+	}
+}
+
+func TestWALTruncateKeepsImplicitWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, err := NewWriteAheadLog(path, 512, 0)
+	if err != nil {
+		t.Fatalf("NewWriteAheadLog failed: %v", err)
+	}
+	w.WriteBlock(1, fill(512, 'a'))
+	w.Commit(0)
+	w.WriteBlock(2, fill(512, 'b'))
+
+	if err := w.Truncate(w.GetSequence()); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if err := w.Commit(0); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	w.Close()
+
+	reopened, err := OpenWriteAheadLog(path, 512)
+	if err != nil {
+		t.Fatalf("OpenWriteAheadLog failed: %v", err)
+	}
+	defer reopened.Close()
+	records := reopened.GetCommittedRecords()
+	if len(records) != 1 || records[0].Block != 2 {
+		t.Errorf("committed records after Truncate: %d, expected block 2 only", len(records))
+	}
+}
@@ -325,19 +325,56 @@ func (r *RAID1Mirror) Read(block uint64, data []byte) error {
 	}
 
 	r.mu.RLock()
-	defer r.mu.RUnlock()
+	corrupted, err := r.read(block, data)
+	r.mu.RUnlock()
+	if err != nil || len(corrupted) == 0 {
+		return err
+	}
+
+	// Repairs write to the mirrors, so read again under the write lock
+	// in case the block changed in between
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	corrupted, err = r.read(block, data)
+	if err != nil {
+		return err
+	}
+	return r.repair(block, data, corrupted)
+}
 
-	// Try each device in order
+// read tries each mirror in order, returning the mirrors that returned
+// corrupted data before a good copy was found (caller must hold lock).
+func (r *RAID1Mirror) read(block uint64, data []byte) ([]int, error) {
+	var corrupted []int
 	for i, device := range r.devices {
 		if r.failed[i] {
 			continue
 		}
-		if err := device.Read(block, data); err == nil {
-			return nil
+		err := device.Read(block, data)
+		if err == nil {
+			return corrupted, nil
+		}
+		if errors.Is(err, ErrBlockCorrupted) {
+			corrupted = append(corrupted, i)
 		}
 	}
 
-	return ErrRAIDDeviceFailed
+	return nil, ErrRAIDDeviceFailed
+}
+
+// repair rewrites good block data to mirrors that returned corrupted data.
+// A mirror that cannot be rewritten is marked failed and the error is
+// returned; data still holds the good copy (caller must hold write lock).
+func (r *RAID1Mirror) repair(block uint64, data []byte, devices []int) error {
+	var errs []error
+	for _, i := range devices {
+		if err := r.devices[i].Write(block, data); err != nil {
+			r.failed[i] = true
+			errs = append(errs, fmt.Errorf("failed to repair block %d on device %d: %w", block, i, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
 // Write writes to all mirrors.
@@ -485,8 +522,28 @@ func (r *RAID5Parity) Read(block uint64, data []byte) error {
 	}
 
 	r.mu.RLock()
-	defer r.mu.RUnlock()
+	err := r.read(block, data, false)
+	r.mu.RUnlock()
+	if !errors.Is(err, errNeedsRepair) {
+		return err
+	}
+
+	// Repairs write to the device, so read again under the write lock in
+	// case the stripe changed in between
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.read(block, data, true)
+}
+
+// errNeedsRepair is returned by read for a corrupted block it may not
+// repair.
+var errNeedsRepair = errors.New("block needs repair")
 
+// read reads a block, reconstructing it around a failed device. A block
+// that fails verification on a healthy array is rebuilt from parity and
+// rewritten when repair is set (caller must hold the write lock for
+// repairs).
+func (r *RAID5Parity) read(block uint64, data []byte, repair bool) error {
 	// Calculate stripe info
 	stripeSize := uint64(len(r.devices) - 1)
 	stripe := block / stripeSize
@@ -512,14 +569,28 @@ func (r *RAID5Parity) Read(block uint64, data []byte) error {
 
 	if failedIdx == -1 {
 		// All devices healthy, read from data device
-		return r.devices[dataIdx].Read(stripe, data)
+		err := r.devices[dataIdx].Read(stripe, data)
+		if !errors.Is(err, ErrBlockCorrupted) {
+			return err
+		}
+		if !repair {
+			return errNeedsRepair
+		}
+
+		// Silent corruption: rebuild the block from parity and repair it
+		if err := r.reconstructRead(stripe, dataIdx, parityIdx, dataIdx, data); err != nil {
+			return err
+		}
+		return r.devices[dataIdx].Write(stripe, data)
 	}
 
 	// Need to reconstruct
 	return r.reconstructRead(stripe, dataIdx, parityIdx, failedIdx, data)
 }
 
-// reconstructRead rebuilds data from remaining devices.
+// reconstructRead rebuilds data from remaining devices. It fails if any of
+// them cannot be read or returns corrupted data, since the result would
+// be garbage.
 func (r *RAID5Parity) reconstructRead(stripe uint64, dataIdx, parityIdx, failedIdx int, data []byte) error {
 	// Collect data from all non-failed devices
 	parityData := make([]byte, r.blockSize)
@@ -532,10 +603,14 @@ func (r *RAID5Parity) reconstructRead(stripe uint64, dataIdx, parityIdx, failedI
 			continue
 		}
 		if i == parityIdx {
-			device.Read(stripe, parityData)
+			if err := device.Read(stripe, parityData); err != nil {
+				return fmt.Errorf("cannot reconstruct stripe %d: device %d: %w", stripe, i, err)
+			}
 		} else {
 			buf := make([]byte, r.blockSize)
-			device.Read(stripe, buf)
+			if err := device.Read(stripe, buf); err != nil {
+				return fmt.Errorf("cannot reconstruct stripe %d: device %d: %w", stripe, i, err)
+			}
 			dataDevices[idx] = buf
 			dataIndices[idx] = i
 			idx++
@@ -544,7 +619,7 @@ func (r *RAID5Parity) reconstructRead(stripe uint64, dataIdx, parityIdx, failedI
 
 	// XOR to reconstruct missing data
 	xorResult := make([]byte, r.blockSize)
-	for _, devData := range dataDevices {
+	for _, devData := range dataDevices[:idx] {
 		for j := 0; j < len(xorResult); j++ {
 			xorResult[j] ^= devData[j]
 		}
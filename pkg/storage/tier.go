@@ -0,0 +1,648 @@
+/*
+Package storage provides block storage abstraction with caching,
+write-ahead logging, RAID support, and snapshot management.
+*/
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TieringPolicy controls how blocks move between storage tiers.
+type TieringPolicy struct {
+	// Interval is how often background tiering runs.
+	Interval time.Duration
+	// HotThreshold is the access count at which a block is promoted.
+	HotThreshold uint64
+	// ColdThreshold is the access count at or below which a block is demoted.
+	ColdThreshold uint64
+	// MaxMigrations limits the blocks moved per pass (0 means unlimited).
+	MaxMigrations int
+}
+
+// DefaultTieringPolicy returns a policy suitable for most workloads.
+func DefaultTieringPolicy() TieringPolicy {
+	return TieringPolicy{
+		Interval:      30 * time.Second,
+		HotThreshold:  8,
+		ColdThreshold: 1,
+		MaxMigrations: 256,
+	}
+}
+
+// tierTable is the persisted block-location table of a tiered device.
+type tierTable struct {
+	Version   int               `json:"version"`
+	BlockSize int               `json:"blockSize"`
+	Next      []uint64          `json:"next"`
+	Free      [][]uint64        `json:"free"`
+	Locations map[uint64]extent `json:"locations"`
+}
+
+// TieredBlockDevice provides multiple storage tiers (e.g., SSD, HDD).
+//
+// Tier 0 is the fastest. Every virtual block is mapped to a physical block
+// on one tier through a block-location table, so reads always go where the
+// data was written. New blocks land on the fastest tier with free space,
+// and background tiering promotes hot blocks and demotes cold ones based on
+// the access counts gathered by a BlockCache stacked on top of the device.
+//
+// The table is saved on Flush and after each tiering pass, once the tiers
+// are flushed, so the saved table only maps blocks whose data is durable.
+// Like the data itself, blocks first written since the last Flush may be
+// lost in a crash. Physical blocks given up by a move are not reused until
+// the saved table no longer refers to them, so a crash never leaves a
+// block mapped to another block's data.
+type TieredBlockDevice struct {
+	tiers     []*physicalDevice
+	blockSize int
+	tablePath string
+	cutoffs   []uint64
+	locations map[uint64]extent
+	dirty     bool
+	closed    bool
+	mu        sync.RWMutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewTieredBlockDevice creates a tiered storage device with an in-memory
+// block-location table. A block first written below cutoffs[i] is placed on
+// tier i when it has space, and blocks past the last cutoff on the slowest
+// tier.
+func NewTieredBlockDevice(tiers []BlockDevice, cutoffs []uint64) (*TieredBlockDevice, error) {
+	d, err := OpenTieredBlockDevice(tiers, "")
+	if err != nil {
+		return nil, err
+	}
+	d.cutoffs = cutoffs
+	return d, nil
+}
+
+// OpenTieredBlockDevice creates a tiered storage device. If tablePath names
+// an existing file, the block-location table is loaded from it; an empty
+// path keeps the table in memory only.
+func OpenTieredBlockDevice(tiers []BlockDevice, tablePath string) (*TieredBlockDevice, error) {
+	if len(tiers) == 0 {
+		return nil, ErrRAIDDeviceCount
+	}
+
+	blockSize := tiers[0].BlockSize()
+	for _, tier := range tiers[1:] {
+		if tier.BlockSize() != blockSize {
+			return nil, fmt.Errorf("device block size mismatch: %d != %d", tier.BlockSize(), blockSize)
+		}
+	}
+
+	d := &TieredBlockDevice{
+		tiers:     make([]*physicalDevice, len(tiers)),
+		blockSize: blockSize,
+		tablePath: tablePath,
+		locations: make(map[uint64]extent),
+	}
+	for i, tier := range tiers {
+		d.tiers[i] = &physicalDevice{device: tier}
+	}
+
+	if tablePath != "" {
+		if err := d.loadTable(); err != nil {
+			return nil, fmt.Errorf("failed to load tier table: %w", err)
+		}
+	}
+
+	return d, nil
+}
+
+// Read reads a block from the tier that holds it. Blocks that were never
+// written read as zeros.
+func (d *TieredBlockDevice) Read(block uint64, data []byte) error {
+	if len(data) != d.blockSize {
+		return fmt.Errorf("data length %d != block size %d", len(data), d.blockSize)
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	if block >= d.blockCount() {
+		return ErrInvalidBlockNumber
+	}
+
+	loc, ok := d.locations[block]
+	if !ok {
+		for i := range data {
+			data[i] = 0
+		}
+		return nil
+	}
+
+	return d.tiers[loc.Device].device.Read(loc.Block, data)
+}
+
+// Write writes a block in place, or to the fastest tier with free space if
+// the block has not been written before.
+func (d *TieredBlockDevice) Write(block uint64, data []byte) error {
+	if len(data) != d.blockSize {
+		return ErrBlockTooLarge
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	if block >= d.blockCount() {
+		return ErrInvalidBlockNumber
+	}
+
+	if loc, ok := d.locations[block]; ok {
+		return d.tiers[loc.Device].device.Write(loc.Block, data)
+	}
+
+	loc, err := d.allocate(d.placement(block), len(d.tiers))
+	if err != nil {
+		loc, err = d.allocate(0, len(d.tiers))
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := d.tiers[loc.Device].device.Write(loc.Block, data); err != nil {
+		d.unallocate(loc)
+		return err
+	}
+	d.locations[block] = loc
+	d.dirty = true
+	return nil
+}
+
+// placement returns the tier a new block starts on (caller must hold lock).
+func (d *TieredBlockDevice) placement(block uint64) int {
+	if d.cutoffs == nil {
+		return 0
+	}
+	for i, cutoff := range d.cutoffs {
+		if block < cutoff && i < len(d.tiers) {
+			return i
+		}
+	}
+	return len(d.tiers) - 1
+}
+
+// Tier returns the tier currently holding a block, or -1 if the block has
+// never been written.
+func (d *TieredBlockDevice) Tier(block uint64) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	loc, ok := d.locations[block]
+	if !ok {
+		return -1
+	}
+	return loc.Device
+}
+
+// Migrate runs one tiering pass using the given per-block access counts and
+// returns the number of blocks moved.
+//
+// Cold blocks are first demoted to the next slower tier with free space.
+// Hot blocks are then promoted to the next faster tier, either into free
+// space or by swapping with that tier's coldest block when it is colder.
+// A swap counts as two moves and goes through free space on a slower tier,
+// so it is skipped when no tier has room. The table is saved once at the
+// end of the pass.
+func (d *TieredBlockDevice) Migrate(counts map[uint64]uint64, policy TieringPolicy) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return 0, ErrDeviceClosed
+	}
+
+	moved, err := d.migrate(counts, policy)
+	if d.dirty {
+		if saveErr := d.saveTable(); err == nil {
+			err = saveErr
+		}
+	}
+	return moved, err
+}
+
+// migrate runs a tiering pass for Migrate (caller must hold lock).
+func (d *TieredBlockDevice) migrate(counts map[uint64]uint64, policy TieringPolicy) (int, error) {
+	// Group blocks by tier, coldest first
+	byTier := make([][]uint64, len(d.tiers))
+	for block, loc := range d.locations {
+		byTier[loc.Device] = append(byTier[loc.Device], block)
+	}
+	for _, blocks := range byTier {
+		sort.Slice(blocks, func(i, j int) bool { return counts[blocks[i]] < counts[blocks[j]] })
+	}
+
+	budget := policy.MaxMigrations
+	if budget <= 0 {
+		budget = len(d.locations)
+	}
+	moved := 0
+
+	// Demote cold blocks
+	for tier := 0; tier < len(d.tiers)-1 && moved < budget; tier++ {
+		for _, block := range byTier[tier] {
+			if moved >= budget || counts[block] > policy.ColdThreshold {
+				break
+			}
+			if d.tiers[tier+1].unusedBlocks() == 0 {
+				break
+			}
+			if err := d.move(block, tier+1); err != nil {
+				return moved, err
+			}
+			moved++
+		}
+	}
+
+	// Promote hot blocks, hottest first
+	for tier := len(d.tiers) - 1; tier > 0 && moved < budget; tier-- {
+		blocks := byTier[tier]
+		victims := byTier[tier-1]
+		for i := len(blocks) - 1; i >= 0 && moved < budget; i-- {
+			block := blocks[i]
+			if counts[block] < policy.HotThreshold {
+				break
+			}
+			if d.locations[block].Device != tier {
+				continue
+			}
+
+			if d.tiers[tier-1].unusedBlocks() > 0 {
+				if err := d.move(block, tier-1); err != nil {
+					return moved, err
+				}
+				moved++
+				continue
+			}
+
+			// Swap with the coldest block still in the faster tier
+			if moved+2 > budget {
+				break
+			}
+			for len(victims) > 0 && d.locations[victims[0]].Device != tier-1 {
+				victims = victims[1:]
+			}
+			if len(victims) == 0 || counts[victims[0]] >= counts[block] {
+				break
+			}
+			swapped, err := d.swap(block, victims[0], tier-1)
+			if err != nil {
+				return moved, err
+			}
+			if !swapped {
+				break
+			}
+			victims = victims[1:]
+			moved += 2
+		}
+	}
+
+	return moved, nil
+}
+
+// StartAutoTiering runs Migrate in the background using the access counts
+// of cache, which must be stacked on top of this device. Counts are decayed
+// after each pass so that tiering follows the recent workload.
+func (d *TieredBlockDevice) StartAutoTiering(cache *BlockCache, policy TieringPolicy) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stop != nil || d.closed {
+		return
+	}
+	if policy.Interval <= 0 {
+		policy.Interval = DefaultTieringPolicy().Interval
+	}
+
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+
+		ticker := time.NewTicker(policy.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// Write dirty cached blocks so migration moves current data
+				cache.Flush()
+				d.Migrate(cache.AccessCounts(), policy)
+				cache.DecayAccessCounts()
+			}
+		}
+	}(d.stop, d.done)
+}
+
+// StopAutoTiering stops background tiering and waits for it to finish.
+func (d *TieredBlockDevice) StopAutoTiering() {
+	d.mu.Lock()
+	stop, done := d.stop, d.done
+	d.stop, d.done = nil, nil
+	d.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// move relocates a block to another tier (caller must hold lock).
+func (d *TieredBlockDevice) move(block uint64, tier int) error {
+	dst, err := d.allocate(tier, tier+1)
+	if err != nil {
+		return err
+	}
+	return d.moveTo(block, dst)
+}
+
+// moveTo copies a block to a newly allocated location. The old location
+// stays reserved until the table no longer refers to it (caller must hold
+// lock).
+func (d *TieredBlockDevice) moveTo(block uint64, dst extent) error {
+	src := d.locations[block]
+
+	data := make([]byte, d.blockSize)
+	err := d.tiers[src.Device].device.Read(src.Block, data)
+	if err == nil {
+		err = d.tiers[dst.Device].device.Write(dst.Block, data)
+	}
+	if err != nil {
+		d.unallocate(dst)
+		return err
+	}
+
+	d.locations[block] = dst
+	d.release(src)
+	return nil
+}
+
+// swap exchanges the tiers of a hot block and a colder block on the given
+// faster tier by moving the cold block down to free space first. It
+// reports false without moving anything when no slower tier has room
+// (caller must hold lock).
+func (d *TieredBlockDevice) swap(hot, cold uint64, fast int) (bool, error) {
+	dst, err := d.allocate(fast+1, len(d.tiers))
+	if err != nil {
+		return false, nil
+	}
+	if err := d.moveTo(cold, dst); err != nil {
+		return false, err
+	}
+	if err := d.move(hot, fast); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// allocate takes a free block from the first tier in [from, to) that has
+// space, saving the table first if only released blocks are left (caller
+// must hold lock).
+func (d *TieredBlockDevice) allocate(from, to int) (extent, error) {
+	loc, err := d.take(from, to)
+	if err != ErrPoolExhausted {
+		return loc, err
+	}
+	for _, pd := range d.tiers[from:to] {
+		if len(pd.pending) > 0 {
+			if err := d.saveTable(); err != nil {
+				return extent{}, err
+			}
+			return d.take(from, to)
+		}
+	}
+	return extent{}, ErrPoolExhausted
+}
+
+// take removes a free block from the first tier in [from, to) that has
+// space (caller must hold lock).
+func (d *TieredBlockDevice) take(from, to int) (extent, error) {
+	for tier := from; tier < to; tier++ {
+		pd := d.tiers[tier]
+		if pd.freeBlocks() == 0 {
+			continue
+		}
+
+		if n := len(pd.free); n > 0 {
+			block := pd.free[n-1]
+			pd.free = pd.free[:n-1]
+			return extent{Device: tier, Block: block}, nil
+		}
+
+		block := pd.next
+		pd.next++
+		return extent{Device: tier, Block: block}, nil
+	}
+	return extent{}, ErrPoolExhausted
+}
+
+// release returns a physical block to its tier once the table is saved
+// (caller must hold lock).
+func (d *TieredBlockDevice) release(loc extent) {
+	pd := d.tiers[loc.Device]
+	pd.pending = append(pd.pending, loc.Block)
+	d.dirty = true
+}
+
+// unallocate returns a block that was never mapped to its tier's free list
+// (caller must hold lock).
+func (d *TieredBlockDevice) unallocate(loc extent) {
+	pd := d.tiers[loc.Device]
+	pd.free = append(pd.free, loc.Block)
+}
+
+// blockCount returns the total capacity across all tiers.
+func (d *TieredBlockDevice) blockCount() uint64 {
+	var total uint64
+	for _, tier := range d.tiers {
+		total += tier.device.BlockCount()
+	}
+	return total
+}
+
+// BlockSize returns the tiers' block size.
+func (d *TieredBlockDevice) BlockSize() int {
+	return d.blockSize
+}
+
+// BlockCount returns the total capacity across all tiers.
+func (d *TieredBlockDevice) BlockCount() uint64 {
+	return d.blockCount()
+}
+
+// TierStatus returns the number of blocks held on each tier.
+func (d *TieredBlockDevice) TierStatus() []uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	used := make([]uint64, len(d.tiers))
+	for _, loc := range d.locations {
+		used[loc.Device]++
+	}
+	return used
+}
+
+// Flush saves the block-location table and flushes all tiers.
+func (d *TieredBlockDevice) Flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrDeviceClosed
+	}
+	return d.flushLocked()
+}
+
+// flushLocked flushes tiers and the table (caller must hold lock).
+func (d *TieredBlockDevice) flushLocked() error {
+	if d.dirty {
+		return d.saveTable()
+	}
+	return d.flushTiers()
+}
+
+// flushTiers flushes every tier (caller must hold lock).
+func (d *TieredBlockDevice) flushTiers() error {
+	for _, tier := range d.tiers {
+		if err := tier.device.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops background tiering, saves the table and closes all tiers.
+func (d *TieredBlockDevice) Close() error {
+	d.StopAutoTiering()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil
+	}
+
+	err := d.flushLocked()
+	d.closed = true
+	for _, tier := range d.tiers {
+		tier.device.Close()
+	}
+	return err
+}
+
+// loadTable reads the block-location table from disk, if present.
+func (d *TieredBlockDevice) loadTable() error {
+	data, err := os.ReadFile(d.tablePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var table tierTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return err
+	}
+
+	if table.BlockSize != d.blockSize {
+		return fmt.Errorf("block size mismatch: %d != %d", table.BlockSize, d.blockSize)
+	}
+	if len(table.Next) != len(d.tiers) || len(table.Free) != len(d.tiers) {
+		return fmt.Errorf("device has %d tiers, table describes %d", len(d.tiers), len(table.Next))
+	}
+
+	// Every allocated block is either free or holds one virtual block
+	used := make(map[extent]bool)
+	for i, pd := range d.tiers {
+		if table.Next[i] > pd.device.BlockCount() {
+			return fmt.Errorf("tier %d is smaller than its recorded allocation", i)
+		}
+		for _, block := range table.Free[i] {
+			ext := extent{Device: i, Block: block}
+			if block >= table.Next[i] || used[ext] {
+				return fmt.Errorf("tier %d has invalid free block %d", i, block)
+			}
+			used[ext] = true
+		}
+		pd.next = table.Next[i]
+		pd.free = table.Free[i]
+	}
+	for block, loc := range table.Locations {
+		if block >= d.blockCount() || loc.Device < 0 || loc.Device >= len(d.tiers) ||
+			loc.Block >= table.Next[loc.Device] || used[loc] {
+			return fmt.Errorf("block %d has invalid location %d:%d", block, loc.Device, loc.Block)
+		}
+		used[loc] = true
+	}
+	if table.Locations != nil {
+		d.locations = table.Locations
+	}
+
+	return nil
+}
+
+// saveTable flushes the tiers, so that every mapped block holds its data,
+// and atomically rewrites the table file (caller must hold lock).
+func (d *TieredBlockDevice) saveTable() error {
+	if err := d.flushTiers(); err != nil {
+		return err
+	}
+	if d.tablePath == "" {
+		d.commitReleased()
+		return nil
+	}
+
+	table := tierTable{
+		Version:   1,
+		BlockSize: d.blockSize,
+		Next:      make([]uint64, len(d.tiers)),
+		Free:      make([][]uint64, len(d.tiers)),
+		Locations: d.locations,
+	}
+	for i, pd := range d.tiers {
+		table.Next[i] = pd.next
+		table.Free[i] = append(append([]uint64{}, pd.free...), pd.pending...)
+	}
+
+	data, err := json.Marshal(&table)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tier table: %w", err)
+	}
+
+	if err := replaceFileSync(d.tablePath, data, 0600); err != nil {
+		return err
+	}
+
+	d.commitReleased()
+	return nil
+}
+
+// commitReleased makes blocks released before a table save reusable
+// (caller must hold lock).
+func (d *TieredBlockDevice) commitReleased() {
+	for _, pd := range d.tiers {
+		pd.free = append(pd.free, pd.pending...)
+		pd.pending = nil
+	}
+	d.dirty = false
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTierCrashKeepsFlushedLocations(t *testing.T) {
+	tiers := []BlockDevice{newMemoryDevice(t, 4, 512), newMemoryDevice(t, 8, 512)}
+	tablePath := filepath.Join(t.TempDir(), "tiers.json")
+
+	d, err := OpenTieredBlockDevice(tiers, tablePath)
+	if err != nil {
+		t.Fatalf("OpenTieredBlockDevice failed: %v", err)
+	}
+	for block := uint64(0); block < 6; block++ {
+		if err := d.Write(block, fill(512, byte('a'+block))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if block == 3 {
+			if err := d.Flush(); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+		}
+	}
+
+	// Reopen without another Flush or Close, as after a crash
+	reopened, err := OpenTieredBlockDevice(tiers, tablePath)
+	if err != nil {
+		t.Fatalf("OpenTieredBlockDevice failed: %v", err)
+	}
+	buf := make([]byte, 512)
+	for block := uint64(0); block < 4; block++ {
+		if err := reopened.Read(block, buf); err != nil || buf[0] != byte('a'+block) {
+			t.Errorf("block %d reads %q, %v", block, buf[0], err)
+		}
+	}
+
+	// Blocks first written after the Flush are lost with their data
+	for block := uint64(4); block < 6; block++ {
+		if tier := reopened.Tier(block); tier != -1 {
+			t.Errorf("unflushed block %d is on tier %d after reopening", block, tier)
+		}
+	}
+}
+
+func TestTierInvalidTable(t *testing.T) {
+	tests := []struct {
+		name      string
+		locations string
+	}{
+		{"tier out of range", `{"0":{"device":2,"block":0}}`},
+		{"unallocated block", `{"0":{"device":0,"block":3}}`},
+		{"block past the device", `{"12":{"device":0,"block":0}}`},
+		{"free block mapped", `{"0":{"device":0,"block":1}}`},
+		{"block mapped twice", `{"0":{"device":0,"block":0},"1":{"device":0,"block":0}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tablePath := filepath.Join(t.TempDir(), "tiers.json")
+			data := `{"version":1,"blockSize":512,"next":[2,0],"free":[[1],[]],"locations":` + tt.locations + `}`
+			if err := os.WriteFile(tablePath, []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			tiers := []BlockDevice{newMemoryDevice(t, 4, 512), newMemoryDevice(t, 8, 512)}
+			if _, err := OpenTieredBlockDevice(tiers, tablePath); err == nil {
+				t.Error("OpenTieredBlockDevice accepted an invalid table")
+			}
+		})
+	}
+}
+
+func TestTierMigrate(t *testing.T) {
+	tiers := []BlockDevice{newMemoryDevice(t, 2, 512), newMemoryDevice(t, 8, 512)}
+	tablePath := filepath.Join(t.TempDir(), "tiers.json")
+	d, err := OpenTieredBlockDevice(tiers, tablePath)
+	if err != nil {
+		t.Fatalf("OpenTieredBlockDevice failed: %v", err)
+	}
+	for block := uint64(0); block < 4; block++ {
+		d.Write(block, fill(512, byte('a'+block)))
+	}
+	if d.Tier(0) != 0 || d.Tier(1) != 0 || d.Tier(2) != 1 {
+		t.Fatalf("initial tiers %d %d %d", d.Tier(0), d.Tier(1), d.Tier(2))
+	}
+
+	// Blocks 2 and 3 are hot, 0 and 1 are warm enough not to be demoted,
+	// so promotion has to swap
+	counts := map[uint64]uint64{0: 2, 1: 2, 2: 10, 3: 10}
+	policy := TieringPolicy{HotThreshold: 5, ColdThreshold: 1, MaxMigrations: 3}
+
+	moved, err := d.Migrate(counts, policy)
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if moved != 2 {
+		t.Errorf("moved %d blocks, expected 2 within a budget of 3", moved)
+	}
+	if status := d.TierStatus(); status[0] != 2 || status[1] != 2 {
+		t.Errorf("TierStatus = %v", status)
+	}
+
+	reopened, err := OpenTieredBlockDevice(tiers, tablePath)
+	if err != nil {
+		t.Fatalf("OpenTieredBlockDevice failed: %v", err)
+	}
+	buf := make([]byte, 512)
+	for block := uint64(0); block < 4; block++ {
+		if err := reopened.Read(block, buf); err != nil || buf[0] != byte('a'+block) {
+			t.Errorf("block %d reads %q, %v after migration", block, buf[0], err)
+		}
+	}
+
+	// A budget of one cannot fit a swap
+	counts = map[uint64]uint64{0: 2, 1: 2, 2: 2, 3: 2}
+	counts[blockOnTier(reopened, 1)] = 10
+	if moved, err := reopened.Migrate(counts, TieringPolicy{HotThreshold: 5, MaxMigrations: 1}); err != nil || moved != 0 {
+		t.Errorf("Migrate with a budget of one moved %d, %v", moved, err)
+	}
+}
+
+// blockOnTier returns some block held on a tier.
+func blockOnTier(d *TieredBlockDevice, tier int) uint64 {
+	for block, loc := range d.locations {
+		if loc.Device == tier {
+			return block
+		}
+	}
+	return 0
+}
+
+func TestTierCutoffs(t *testing.T) {
+	tiers := []BlockDevice{newMemoryDevice(t, 4, 512), newMemoryDevice(t, 4, 512)}
+	d, err := NewTieredBlockDevice(tiers, []uint64{2})
+	if err != nil {
+		t.Fatalf("NewTieredBlockDevice failed: %v", err)
+	}
+
+	d.Write(0, fill(512, 'a'))
+	d.Write(5, fill(512, 'b'))
+	if d.Tier(0) != 0 || d.Tier(5) != 1 {
+		t.Errorf("blocks placed on tiers %d and %d, expected 0 and 1", d.Tier(0), d.Tier(5))
+	}
+}
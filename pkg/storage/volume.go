@@ -0,0 +1,718 @@
+/*
+Package storage provides block storage abstraction with caching,
+write-ahead logging, RAID support, and snapshot management.
+*/
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Volume manager errors
+var (
+	ErrVolumeNotFound = errors.New("volume not found")
+	ErrVolumeExists   = errors.New("volume already exists")
+	ErrVolumeClosed   = errors.New("volume is closed")
+	ErrPoolExhausted  = errors.New("storage pool has no free blocks")
+	ErrInvalidVolume  = errors.New("invalid volume name")
+)
+
+// extent addresses a block on one of the pool's physical devices.
+type extent struct {
+	Device int    `json:"device"`
+	Block  uint64 `json:"block"`
+}
+
+// physicalDevice tracks allocation state for one pooled device.
+type physicalDevice struct {
+	device  BlockDevice
+	next    uint64   // First never-allocated block
+	free    []uint64 // Blocks released by discard, shrink or removal
+	pending []uint64 // Released blocks the saved metadata still maps
+}
+
+// freeBlocks returns the number of blocks available for allocation.
+func (p *physicalDevice) freeBlocks() uint64 {
+	return p.device.BlockCount() - p.next + uint64(len(p.free))
+}
+
+// unusedBlocks returns the number of blocks available for allocation once
+// released blocks are committed.
+func (p *physicalDevice) unusedBlocks() uint64 {
+	return p.freeBlocks() + uint64(len(p.pending))
+}
+
+// volumeMetadata is the persisted description of a logical volume.
+type volumeMetadata struct {
+	Name      string            `json:"name"`
+	Size      uint64            `json:"size"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Extents   map[uint64]extent `json:"extents"`
+}
+
+// poolMetadata is the persisted state of a volume manager.
+type poolMetadata struct {
+	Version   int               `json:"version"`
+	BlockSize int               `json:"blockSize"`
+	Next      []uint64          `json:"next"`
+	Free      [][]uint64        `json:"free"`
+	Volumes   []*volumeMetadata `json:"volumes"`
+}
+
+// VolumeManager pools several block devices and carves them into
+// thin-provisioned logical volumes.
+//
+// Volumes have a virtual size that acts as their quota; physical blocks are
+// only allocated from the pool on first write. Allocation metadata is kept
+// in a JSON file that is rewritten on Flush and on every volume change,
+// after the pooled devices are flushed, so the saved metadata only maps
+// blocks whose data is durable. Like the data itself, blocks first written
+// since the last Flush may be lost in a crash. Blocks released by Discard
+// are not reused until the metadata no longer maps them, so after a crash
+// a volume cannot see another volume's data.
+type VolumeManager struct {
+	devices      []*physicalDevice
+	blockSize    int
+	metadataPath string
+	volumes      map[string]*LogicalVolume
+	dirty        bool
+	closed       bool
+	mu           sync.RWMutex
+}
+
+// NewVolumeManager creates a volume manager over a pool of devices.
+// If metadataPath names an existing file, the volumes recorded there are
+// loaded; an empty path keeps metadata in memory only.
+func NewVolumeManager(devices []BlockDevice, metadataPath string) (*VolumeManager, error) {
+	if len(devices) == 0 {
+		return nil, ErrRAIDDeviceCount
+	}
+
+	blockSize := devices[0].BlockSize()
+	for _, device := range devices[1:] {
+		if device.BlockSize() != blockSize {
+			return nil, fmt.Errorf("device block size mismatch: %d != %d", device.BlockSize(), blockSize)
+		}
+	}
+
+	m := &VolumeManager{
+		devices:      make([]*physicalDevice, len(devices)),
+		blockSize:    blockSize,
+		metadataPath: metadataPath,
+		volumes:      make(map[string]*LogicalVolume),
+	}
+	for i, device := range devices {
+		m.devices[i] = &physicalDevice{device: device}
+	}
+
+	if metadataPath != "" {
+		if err := m.loadMetadata(); err != nil {
+			return nil, fmt.Errorf("failed to load volume metadata: %w", err)
+		}
+	}
+
+	return m, nil
+}
+
+// CreateVolume creates a thin volume with the given virtual size in blocks.
+func (m *VolumeManager) CreateVolume(name string, size uint64) (*LogicalVolume, error) {
+	if name == "" {
+		return nil, ErrInvalidVolume
+	}
+	if size == 0 {
+		return nil, ErrInvalidBlockNumber
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, ErrDeviceClosed
+	}
+	if _, ok := m.volumes[name]; ok {
+		return nil, ErrVolumeExists
+	}
+
+	vol := &LogicalVolume{
+		manager:   m,
+		name:      name,
+		size:      size,
+		createdAt: time.Now(),
+		extents:   make(map[uint64]extent),
+	}
+	m.volumes[name] = vol
+
+	if err := m.saveMetadata(); err != nil {
+		delete(m.volumes, name)
+		return nil, err
+	}
+
+	return vol, nil
+}
+
+// Volume returns an existing volume by name.
+func (m *VolumeManager) Volume(name string) (*LogicalVolume, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	vol, ok := m.volumes[name]
+	if !ok {
+		return nil, ErrVolumeNotFound
+	}
+	return vol, nil
+}
+
+// ResizeVolume changes a volume's virtual size. Shrinking releases the
+// physical blocks mapped beyond the new end.
+func (m *VolumeManager) ResizeVolume(name string, size uint64) error {
+	if size == 0 {
+		return ErrInvalidBlockNumber
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrDeviceClosed
+	}
+
+	vol, ok := m.volumes[name]
+	if !ok {
+		return ErrVolumeNotFound
+	}
+
+	for block, ext := range vol.extents {
+		if block >= size {
+			m.release(ext)
+			delete(vol.extents, block)
+		}
+	}
+	vol.size = size
+
+	return m.saveMetadata()
+}
+
+// RemoveVolume deletes a volume and returns its blocks to the pool.
+func (m *VolumeManager) RemoveVolume(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrDeviceClosed
+	}
+
+	vol, ok := m.volumes[name]
+	if !ok {
+		return ErrVolumeNotFound
+	}
+
+	for _, ext := range vol.extents {
+		m.release(ext)
+	}
+	vol.extents = nil
+	vol.removed = true
+	delete(m.volumes, name)
+
+	return m.saveMetadata()
+}
+
+// Volumes returns information about all volumes, sorted by name.
+func (m *VolumeManager) Volumes() []VolumeInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	infos := make([]VolumeInfo, 0, len(m.volumes))
+	for _, vol := range m.volumes {
+		infos = append(infos, vol.infoLocked())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Status returns pool capacity and allocation statistics.
+func (m *VolumeManager) Status() PoolStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	status := PoolStatus{
+		Devices:   len(m.devices),
+		Volumes:   len(m.volumes),
+		BlockSize: m.blockSize,
+	}
+	for _, pd := range m.devices {
+		status.TotalBlocks += pd.device.BlockCount()
+		status.FreeBlocks += pd.unusedBlocks()
+	}
+	for _, vol := range m.volumes {
+		status.VirtualBlocks += vol.size
+	}
+	status.AllocatedBlocks = status.TotalBlocks - status.FreeBlocks
+	if status.TotalBlocks > 0 {
+		status.Overcommit = float64(status.VirtualBlocks) / float64(status.TotalBlocks)
+	}
+
+	return status
+}
+
+// Flush persists allocation metadata and flushes all pooled devices.
+func (m *VolumeManager) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrDeviceClosed
+	}
+	return m.flushLocked()
+}
+
+// flushLocked flushes devices and metadata (caller must hold lock).
+func (m *VolumeManager) flushLocked() error {
+	if m.dirty {
+		return m.saveMetadata()
+	}
+	return m.flushDevices()
+}
+
+// flushDevices flushes every pooled device (caller must hold lock).
+func (m *VolumeManager) flushDevices() error {
+	for _, pd := range m.devices {
+		if err := pd.device.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes metadata and closes all pooled devices.
+func (m *VolumeManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil
+	}
+
+	err := m.flushLocked()
+	m.closed = true
+	for _, pd := range m.devices {
+		pd.device.Close()
+	}
+	return err
+}
+
+// allocate takes a free block from the device with the most free space
+// (caller must hold lock). The allocation is persisted with the next
+// metadata save.
+func (m *VolumeManager) allocate() (extent, error) {
+	ext, err := m.take()
+	if err == ErrPoolExhausted && m.hasPending() {
+		// Saving makes released blocks reusable
+		if err := m.saveMetadata(); err != nil {
+			return extent{}, err
+		}
+		ext, err = m.take()
+	}
+	return ext, err
+}
+
+// hasPending reports whether released blocks wait for a metadata save
+// (caller must hold lock).
+func (m *VolumeManager) hasPending() bool {
+	for _, pd := range m.devices {
+		if len(pd.pending) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// take removes a block from the free space (caller must hold lock).
+func (m *VolumeManager) take() (extent, error) {
+	best := -1
+	var bestFree uint64
+	for i, pd := range m.devices {
+		if free := pd.freeBlocks(); free > bestFree {
+			best = i
+			bestFree = free
+		}
+	}
+	if best == -1 {
+		return extent{}, ErrPoolExhausted
+	}
+
+	pd := m.devices[best]
+	m.dirty = true
+
+	if n := len(pd.free); n > 0 {
+		block := pd.free[n-1]
+		pd.free = pd.free[:n-1]
+		return extent{Device: best, Block: block}, nil
+	}
+
+	block := pd.next
+	pd.next++
+	return extent{Device: best, Block: block}, nil
+}
+
+// release returns a block to its device once the metadata is saved
+// (caller must hold lock).
+func (m *VolumeManager) release(ext extent) {
+	pd := m.devices[ext.Device]
+	pd.pending = append(pd.pending, ext.Block)
+	m.dirty = true
+}
+
+// unallocate returns a block that was never mapped to its device's free
+// list (caller must hold lock).
+func (m *VolumeManager) unallocate(ext extent) {
+	pd := m.devices[ext.Device]
+	pd.free = append(pd.free, ext.Block)
+}
+
+// loadMetadata reads volume metadata from disk, if present.
+func (m *VolumeManager) loadMetadata() error {
+	data, err := os.ReadFile(m.metadataPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var meta poolMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return err
+	}
+
+	if meta.BlockSize != m.blockSize {
+		return fmt.Errorf("block size mismatch: %d != %d", meta.BlockSize, m.blockSize)
+	}
+	if len(meta.Next) != len(m.devices) || len(meta.Free) != len(m.devices) {
+		return fmt.Errorf("pool has %d devices, metadata describes %d", len(m.devices), len(meta.Next))
+	}
+
+	// Every allocated block is either free or mapped by one volume
+	owners := make(map[extent]string)
+	for i, pd := range m.devices {
+		if meta.Next[i] > pd.device.BlockCount() {
+			return fmt.Errorf("device %d is smaller than its recorded allocation", i)
+		}
+		for _, block := range meta.Free[i] {
+			ext := extent{Device: i, Block: block}
+			if block >= meta.Next[i] || owners[ext] != "" {
+				return fmt.Errorf("device %d has invalid free block %d", i, block)
+			}
+			owners[ext] = "free"
+		}
+		pd.next = meta.Next[i]
+		pd.free = meta.Free[i]
+	}
+
+	for _, vm := range meta.Volumes {
+		if vm.Name == "" || m.volumes[vm.Name] != nil {
+			return fmt.Errorf("%w: %q", ErrInvalidVolume, vm.Name)
+		}
+		for block, ext := range vm.Extents {
+			if block >= vm.Size || ext.Device < 0 || ext.Device >= len(m.devices) ||
+				ext.Block >= meta.Next[ext.Device] || owners[ext] != "" {
+				return fmt.Errorf("volume %q maps block %d to invalid extent %d:%d", vm.Name, block, ext.Device, ext.Block)
+			}
+			owners[ext] = vm.Name
+		}
+
+		extents := vm.Extents
+		if extents == nil {
+			extents = make(map[uint64]extent)
+		}
+		m.volumes[vm.Name] = &LogicalVolume{
+			manager:   m,
+			name:      vm.Name,
+			size:      vm.Size,
+			createdAt: vm.CreatedAt,
+			extents:   extents,
+		}
+	}
+
+	return nil
+}
+
+// saveMetadata flushes the devices, so that every mapped block holds its
+// data, and atomically rewrites the metadata file (caller must hold lock).
+func (m *VolumeManager) saveMetadata() error {
+	if err := m.flushDevices(); err != nil {
+		return err
+	}
+	if m.metadataPath == "" {
+		m.dirty = false
+		return nil
+	}
+
+	meta := poolMetadata{
+		Version:   1,
+		BlockSize: m.blockSize,
+		Next:      make([]uint64, len(m.devices)),
+		Free:      make([][]uint64, len(m.devices)),
+	}
+	for i, pd := range m.devices {
+		meta.Next[i] = pd.next
+		meta.Free[i] = append(append([]uint64{}, pd.free...), pd.pending...)
+	}
+	for _, vol := range m.volumes {
+		meta.Volumes = append(meta.Volumes, &volumeMetadata{
+			Name:      vol.name,
+			Size:      vol.size,
+			CreatedAt: vol.createdAt,
+			Extents:   vol.extents,
+		})
+	}
+
+	data, err := json.Marshal(&meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+
+	if err := replaceFileSync(m.metadataPath, data, 0600); err != nil {
+		return err
+	}
+
+	// The saved metadata no longer maps released blocks
+	for _, pd := range m.devices {
+		pd.free = append(pd.free, pd.pending...)
+		pd.pending = nil
+	}
+	m.dirty = false
+	return nil
+}
+
+// writeFileSync writes a file and syncs it to stable storage.
+func writeFileSync(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// replaceFileSync atomically replaces a file with data, syncing the file
+// and then its directory so the rename itself survives a crash.
+func replaceFileSync(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + ".tmp"
+	if err := writeFileSync(tmpPath, data, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs a directory to stable storage. Windows cannot sync
+// directories and makes renames durable without it.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// PoolStatus describes the capacity of a volume manager's pool.
+type PoolStatus struct {
+	Devices         int     `json:"devices"`
+	Volumes         int     `json:"volumes"`
+	BlockSize       int     `json:"blockSize"`
+	TotalBlocks     uint64  `json:"totalBlocks"`
+	AllocatedBlocks uint64  `json:"allocatedBlocks"`
+	FreeBlocks      uint64  `json:"freeBlocks"`
+	VirtualBlocks   uint64  `json:"virtualBlocks"`
+	Overcommit      float64 `json:"overcommit"`
+}
+
+// VolumeInfo describes a logical volume.
+type VolumeInfo struct {
+	Name            string    `json:"name"`
+	Size            uint64    `json:"size"`
+	AllocatedBlocks uint64    `json:"allocatedBlocks"`
+	BlockSize       int       `json:"blockSize"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+// LogicalVolume is a thin-provisioned volume carved from a VolumeManager
+// pool. Unwritten blocks read as zeros and consume no pool space.
+type LogicalVolume struct {
+	manager   *VolumeManager
+	name      string
+	size      uint64
+	createdAt time.Time
+	extents   map[uint64]extent
+	removed   bool
+}
+
+// Read reads a block from the volume.
+func (v *LogicalVolume) Read(block uint64, data []byte) error {
+	m := v.manager
+	if len(data) != m.blockSize {
+		return fmt.Errorf("data length %d != block size %d", len(data), m.blockSize)
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if err := v.checkLocked(block); err != nil {
+		return err
+	}
+
+	ext, ok := v.extents[block]
+	if !ok {
+		for i := range data {
+			data[i] = 0
+		}
+		return nil
+	}
+
+	return m.devices[ext.Device].device.Read(ext.Block, data)
+}
+
+// Write writes a block to the volume, allocating pool space on first write.
+func (v *LogicalVolume) Write(block uint64, data []byte) error {
+	m := v.manager
+	if len(data) != m.blockSize {
+		return ErrBlockTooLarge
+	}
+
+	m.mu.RLock()
+	if err := v.checkLocked(block); err != nil {
+		m.mu.RUnlock()
+		return err
+	}
+	if ext, ok := v.extents[block]; ok {
+		defer m.mu.RUnlock()
+		return m.devices[ext.Device].device.Write(ext.Block, data)
+	}
+	m.mu.RUnlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Re-check: the volume may have changed while the lock was released
+	if err := v.checkLocked(block); err != nil {
+		return err
+	}
+
+	if ext, ok := v.extents[block]; ok {
+		return m.devices[ext.Device].device.Write(ext.Block, data)
+	}
+
+	ext, err := m.allocate()
+	if err != nil {
+		return err
+	}
+	if err := m.devices[ext.Device].device.Write(ext.Block, data); err != nil {
+		m.unallocate(ext)
+		return err
+	}
+	v.extents[block] = ext
+	return nil
+}
+
+// Discard releases the pool space behind a block; it reads as zeros again.
+// The space becomes reusable once the metadata is saved, which happens on
+// Flush and on the next allocation or volume change.
+func (v *LogicalVolume) Discard(block uint64) error {
+	m := v.manager
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := v.checkLocked(block); err != nil {
+		return err
+	}
+
+	if ext, ok := v.extents[block]; ok {
+		m.release(ext)
+		delete(v.extents, block)
+	}
+	return nil
+}
+
+// checkLocked validates the volume state and a block number (caller must
+// hold the manager lock).
+func (v *LogicalVolume) checkLocked(block uint64) error {
+	if v.manager.closed {
+		return ErrDeviceClosed
+	}
+	if v.removed {
+		return ErrVolumeClosed
+	}
+	if block >= v.size {
+		return ErrInvalidBlockNumber
+	}
+	return nil
+}
+
+// Name returns the volume's name.
+func (v *LogicalVolume) Name() string {
+	return v.name
+}
+
+// Info returns information about the volume.
+func (v *LogicalVolume) Info() VolumeInfo {
+	v.manager.mu.RLock()
+	defer v.manager.mu.RUnlock()
+	return v.infoLocked()
+}
+
+// infoLocked builds VolumeInfo (caller must hold the manager lock).
+func (v *LogicalVolume) infoLocked() VolumeInfo {
+	return VolumeInfo{
+		Name:            v.name,
+		Size:            v.size,
+		AllocatedBlocks: uint64(len(v.extents)),
+		BlockSize:       v.manager.blockSize,
+		CreatedAt:       v.createdAt,
+	}
+}
+
+// BlockSize returns the pool's block size.
+func (v *LogicalVolume) BlockSize() int {
+	return v.manager.blockSize
+}
+
+// BlockCount returns the volume's virtual size.
+func (v *LogicalVolume) BlockCount() uint64 {
+	v.manager.mu.RLock()
+	defer v.manager.mu.RUnlock()
+	return v.size
+}
+
+// Flush persists allocation metadata and flushes the pool.
+func (v *LogicalVolume) Flush() error {
+	return v.manager.Flush()
+}
+
+// Close is a no-op; volumes are released by the VolumeManager.
+func (v *LogicalVolume) Close() error {
+	return nil
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVolumeCrashKeepsFlushedAllocations(t *testing.T) {
+	devices := []BlockDevice{newMemoryDevice(t, 8, 512), newMemoryDevice(t, 8, 512)}
+	metaPath := filepath.Join(t.TempDir(), "volumes.json")
+
+	m, err := NewVolumeManager(devices, metaPath)
+	if err != nil {
+		t.Fatalf("NewVolumeManager failed: %v", err)
+	}
+	vol, _ := m.CreateVolume("data", 100)
+	if err := vol.Write(42, fill(512, 'x')); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := vol.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if err := vol.Write(43, fill(512, 'y')); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// Reopen without another Flush or Close, as after a crash
+	m2, err := NewVolumeManager(devices, metaPath)
+	if err != nil {
+		t.Fatalf("NewVolumeManager failed: %v", err)
+	}
+	vol2, err := m2.Volume("data")
+	if err != nil {
+		t.Fatalf("Volume failed: %v", err)
+	}
+	buf := make([]byte, 512)
+	if err := vol2.Read(42, buf); err != nil || buf[0] != 'x' {
+		t.Errorf("Read after reopening returned %q, %v", buf[0], err)
+	}
+
+	// The unflushed allocation is lost along with its data, and its block
+	// is free again
+	if info := vol2.Info(); info.AllocatedBlocks != 1 {
+		t.Errorf("AllocatedBlocks after reopening = %d, expected 1", info.AllocatedBlocks)
+	}
+	if status := m2.Status(); status.FreeBlocks != 15 {
+		t.Errorf("FreeBlocks after reopening = %d, expected 15", status.FreeBlocks)
+	}
+}
+
+func TestVolumeDiscardIsolation(t *testing.T) {
+	// A single-block pool forces the discarded block to be the next one
+	// allocated
+	devices := []BlockDevice{newMemoryDevice(t, 1, 512)}
+	metaPath := filepath.Join(t.TempDir(), "volumes.json")
+
+	m, err := NewVolumeManager(devices, metaPath)
+	if err != nil {
+		t.Fatalf("NewVolumeManager failed: %v", err)
+	}
+	a, _ := m.CreateVolume("a", 10)
+	b, _ := m.CreateVolume("b", 10)
+
+	a.Write(0, fill(512, 'a'))
+	if err := a.Discard(0); err != nil {
+		t.Fatalf("Discard failed: %v", err)
+	}
+	if err := b.Write(0, fill(512, 'b')); err != nil {
+		t.Fatalf("Write reusing the discarded block failed: %v", err)
+	}
+	b.Flush()
+
+	// After a crash, volume a must not map the block now holding b's data
+	m2, err := NewVolumeManager(devices, metaPath)
+	if err != nil {
+		t.Fatalf("NewVolumeManager failed: %v", err)
+	}
+	a2, _ := m2.Volume("a")
+	b2, _ := m2.Volume("b")
+	buf := make([]byte, 512)
+	if err := a2.Read(0, buf); err != nil || buf[0] != 0 {
+		t.Errorf("discarded block reads %q, %v; expected zeros", buf[0], err)
+	}
+	if err := b2.Read(0, buf); err != nil || buf[0] != 'b' {
+		t.Errorf("Read returned %q, %v", buf[0], err)
+	}
+}
+
+func TestVolumeReleaseWaitsForMetadata(t *testing.T) {
+	devices := []BlockDevice{newMemoryDevice(t, 2, 512)}
+	m, err := NewVolumeManager(devices, filepath.Join(t.TempDir(), "volumes.json"))
+	if err != nil {
+		t.Fatalf("NewVolumeManager failed: %v", err)
+	}
+	a, _ := m.CreateVolume("a", 10)
+	a.Write(0, fill(512, 'a'))
+	a.Write(1, fill(512, 'a'))
+
+	m.mu.Lock()
+	extA := a.extents[0]
+	m.mu.Unlock()
+	a.Discard(0)
+
+	// Until the metadata is saved the block stays out of the free list
+	m.mu.Lock()
+	pd := m.devices[extA.Device]
+	free, pending := len(pd.free), len(pd.pending)
+	m.mu.Unlock()
+	if free != 0 || pending != 1 {
+		t.Errorf("free %d pending %d, expected 0 and 1", free, pending)
+	}
+	if status := m.Status(); status.FreeBlocks != 1 {
+		t.Errorf("FreeBlocks = %d, expected 1", status.FreeBlocks)
+	}
+
+	if err := m.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	m.mu.Lock()
+	free, pending = len(pd.free), len(pd.pending)
+	m.mu.Unlock()
+	if free != 1 || pending != 0 {
+		t.Errorf("after Flush free %d pending %d, expected 1 and 0", free, pending)
+	}
+}
+
+func TestVolumeWriteFailure(t *testing.T) {
+	faulty := newFaultyDevice(newMemoryDevice(t, 4, 512))
+	m, err := NewVolumeManager([]BlockDevice{faulty}, "")
+	if err != nil {
+		t.Fatalf("NewVolumeManager failed: %v", err)
+	}
+	vol, _ := m.CreateVolume("v", 10)
+
+	faulty.failAll = true
+	if err := vol.Write(0, fill(512, 'x')); !errors.Is(err, errInjected) {
+		t.Errorf("Write returned %v", err)
+	}
+	if info := vol.Info(); info.AllocatedBlocks != 0 {
+		t.Errorf("failed write left %d blocks allocated", info.AllocatedBlocks)
+	}
+	if status := m.Status(); status.FreeBlocks != 4 {
+		t.Errorf("FreeBlocks = %d, expected 4", status.FreeBlocks)
+	}
+}
+
+func TestVolumeInvalidMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		volumes string
+	}{
+		{"device out of range", `[{"name":"v","size":10,"extents":{"0":{"device":5,"block":0}}}]`},
+		{"negative device", `[{"name":"v","size":10,"extents":{"0":{"device":-1,"block":0}}}]`},
+		{"unallocated block", `[{"name":"v","size":10,"extents":{"0":{"device":0,"block":3}}}]`},
+		{"block past the volume", `[{"name":"v","size":10,"extents":{"10":{"device":0,"block":0}}}]`},
+		{"free block mapped", `[{"name":"v","size":10,"extents":{"0":{"device":0,"block":1}}}]`},
+		{"block mapped twice", `[{"name":"v","size":10,"extents":{"0":{"device":0,"block":0},"1":{"device":0,"block":0}}}]`},
+		{"duplicate volume", `[{"name":"v","size":10},{"name":"v","size":10}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metaPath := filepath.Join(t.TempDir(), "volumes.json")
+			data := `{"version":1,"blockSize":512,"next":[2],"free":[[1]],"volumes":` + tt.volumes + `}`
+			if err := os.WriteFile(metaPath, []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := NewVolumeManager([]BlockDevice{newMemoryDevice(t, 4, 512)}, metaPath); err == nil {
+				t.Error("NewVolumeManager accepted invalid metadata")
+			}
+		})
+	}
+}
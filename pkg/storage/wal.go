@@ -5,6 +5,7 @@ write-ahead logging, RAID support, and snapshot management.
 package storage
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
@@ -12,6 +13,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 )
@@ -24,6 +26,8 @@ var (
 	ErrWALFull         = errors.New("WAL is full")
 	ErrWALSeqMismatch  = errors.New("sequence number mismatch")
 	ErrInvalidWALEntry = errors.New("invalid WAL entry")
+	ErrWALFormat       = errors.New("unsupported WAL format")
+	ErrWALBlockSize    = errors.New("WAL block size mismatch")
 )
 
 // WALRecordType defines the type of WAL record.
@@ -44,32 +48,79 @@ const (
 
 // WALRecord represents a write-ahead log entry.
 type WALRecord struct {
-	Sequence  uint64        // Unique sequence number
-	Type      WALRecordType // Record type
-	Block     uint64        // Block number (for block records)
-	Data      []byte        // Block data
-	Timestamp time.Time     // When record was written
-	Checksum  uint32        // Record checksum
-	CommitSeq uint64        // Commit sequence number (for commit records)
+	Sequence    uint64        // Unique sequence number
+	Type        WALRecordType // Record type
+	Block       uint64        // Block number (for block records)
+	Data        []byte        // Block data
+	Timestamp   time.Time     // When record was written
+	Checksum    uint32        // Record checksum
+	CommitSeq   uint64        // Commit sequence number (for commit records)
+	Transaction uint64        // Begin sequence of the owning transaction, 0 if none
 }
 
+// WAL file header: magic(8) + version(2) + blockSize(4). Files written
+// before the header existed have no magic and are rejected rather than
+// misread.
+const (
+	walMagic          = "WEBOSWAL"
+	walVersion        = 1
+	walFileHeaderSize = 14
+)
+
+// walHeaderSize is the serialized record header length:
+// Sequence(8) + Type(1) + Block(8) + DataLen(4) + Timestamp(8) +
+// Checksum(4) + CommitSeq(8) + Transaction(8).
+const walHeaderSize = 49
+
 // WriteAheadLog provides durability through write-ahead logging.
+//
+// Block records belong to a transaction started with BeginTransaction, or
+// to the implicit transaction 0 when written with WriteBlock. A transaction
+// is durable once Commit returns; records of transactions that never
+// committed are discarded by Replay and dropped by Truncate.
+//
+// Records are buffered in memory and written by group commit: commits that
+// arrive while a sync is pending or in progress share one write and one
+// fsync. SetCommitWindow adds a delay before each sync so more committers
+// can join a batch.
+//
+// A failed write or fsync leaves the log failed: the records that were not
+// synced are dropped, the file is cut back to its last synced length, and
+// every later append, commit and flush returns the error until the log is
+// reopened.
+//
+// The log file starts with a header recording its format version and block
+// size; opening a log with a different block size or format fails instead
+// of discarding records.
 type WriteAheadLog struct {
-	file       *os.File
-	path       string
-	blockSize  int
-	sequence   uint64
-	commitSeq  uint64
-	headerSize int
-	closed     bool
-	mu         sync.RWMutex
-	cond       *sync.Cond
+	file         *os.File
+	path         string
+	blockSize    int
+	maxSize      int64
+	size         int64
+	sequence     uint64
+	commitSeq    uint64
+	headerSize   int
+	active       map[uint64]bool // Open transactions
+	buf          []byte          // Records not yet written to the file
+	waiters      []*CommitFuture // Commits waiting for the next sync
+	syncing      bool
+	commitWindow time.Duration
+	commits      uint64
+	syncBatches  uint64
+	closed       bool
+	mu           sync.RWMutex
+	ioMu         sync.Mutex // Serializes file writes; acquired before mu
+	synced       int64      // File length covered by the last sync
+	syncedSeq    uint64     // Last record covered by the last sync
+	failed       error      // Sticky write or sync failure
 	// Recovery
 	records []*WALRecord
 	maxSeq  uint64
 }
 
-// NewWriteAheadLog creates a new WAL.
+// NewWriteAheadLog creates a new WAL, or opens and recovers an existing one
+// at path. A maxSize of 0 means the log is unbounded.
 func NewWriteAheadLog(path string, blockSize int, maxSize int64) (*WriteAheadLog, error) {
 	// Ensure directory exists
 	dir := filepath.Dir(path)
@@ -82,61 +133,186 @@ func NewWriteAheadLog(path string, blockSize int, maxSize int64) (*WriteAheadLog
 		return nil, fmt.Errorf("failed to open WAL: %w", err)
 	}
 
+	return newWriteAheadLog(file, path, blockSize, maxSize)
+}
+
+// OpenWriteAheadLog opens an existing WAL for recovery.
+func OpenWriteAheadLog(path string, blockSize int) (*WriteAheadLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL: %w", err)
+	}
+
+	return newWriteAheadLog(file, path, blockSize, 0)
+}
+
+// newWriteAheadLog loads the records in file and cuts off any torn tail.
+func newWriteAheadLog(file *os.File, path string, blockSize int, maxSize int64) (*WriteAheadLog, error) {
 	wal := &WriteAheadLog{
 		file:       file,
 		path:       path,
 		blockSize:  blockSize,
-		headerSize: 32, // Sequence(8) + Type(1) + Block(8) + DataLen(4) + Timestamp(8) + Checksum(4)
-		sequence:   0,
-		commitSeq:  0,
-		cond:       sync.NewCond(&sync.Mutex{}),
+		maxSize:    maxSize,
+		headerSize: walHeaderSize,
+		active:     make(map[uint64]bool),
 	}
 
-	// Get current file size to determine starting sequence
-	stat, err := file.Stat()
-	if err != nil {
+	if err := wal.load(); err != nil {
 		file.Close()
 		return nil, err
 	}
 
-	// Calculate initial sequence from file size
-	wal.sequence = uint64(stat.Size()) / uint64(wal.headerSize+blockSize)
-	wal.maxSeq = wal.sequence
-
 	return wal, nil
 }
 
-// OpenWriteAheadLog opens an existing WAL for recovery.
-func OpenWriteAheadLog(path string, blockSize int) (*WriteAheadLog, error) {
-	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+// load checks the file header and reads every intact record. A damaged
+// record is accepted only as the torn tail of an interrupted append: if a
+// valid commit record follows it, the log is corrupt and an error is
+// returned. Otherwise the file is truncated there so new records follow
+// valid ones.
+func (w *WriteAheadLog) load() error {
+	stat, err := w.file.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open WAL: %w", err)
+		return err
+	}
+	if stat.Size() == 0 {
+		return w.writeFileHeader()
 	}
 
-	wal := &WriteAheadLog{
-		file:       file,
-		path:       path,
-		blockSize:  blockSize,
-		headerSize: 32,
-		sequence:   0,
-		commitSeq:  0,
-		cond:       sync.NewCond(&sync.Mutex{}),
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(w.file)
+	if err := w.readFileHeader(reader); err != nil {
+		return err
 	}
 
-	return wal, nil
+	header := make([]byte, w.headerSize)
+	offset := int64(walFileHeaderSize)
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		dataLen := binary.BigEndian.Uint32(header[17:21])
+		if w.blockSize > 0 && dataLen > uint32(w.blockSize) {
+			break
+		}
+		data := make([]byte, w.headerSize+int(dataLen))
+		copy(data, header)
+		if _, err := io.ReadFull(reader, data[w.headerSize:]); err != nil {
+			break
+		}
+		record, err := w.deserializeRecord(data)
+		if err != nil || record.Sequence <= w.sequence {
+			break
+		}
+
+		w.records = append(w.records, record)
+		w.sequence = record.Sequence
+		if record.CommitSeq > w.commitSeq {
+			w.commitSeq = record.CommitSeq
+		}
+		offset += int64(len(data))
+	}
+
+	if stat.Size() > offset {
+		committed, err := w.commitFollows(offset, stat.Size())
+		if err != nil {
+			return err
+		}
+		if committed {
+			return fmt.Errorf("%w: damaged record at offset %d precedes committed records", ErrWALCorrupted, offset)
+		}
+		if err := w.file.Truncate(offset); err != nil {
+			return fmt.Errorf("failed to truncate torn WAL tail: %w", err)
+		}
+	}
+
+	w.size, w.synced = offset, offset
+	w.maxSeq, w.syncedSeq = w.sequence, w.sequence
+	return nil
 }
 
-// Append adds a record to the WAL.
-func (w *WriteAheadLog) Append(record *WALRecord) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+// writeFileHeader writes the header of an empty log file.
+func (w *WriteAheadLog) writeFileHeader() error {
+	if _, err := w.file.Write(w.fileHeader()); err != nil {
+		return fmt.Errorf("failed to write WAL header: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL header: %w", err)
+	}
+	w.size, w.synced = walFileHeaderSize, walFileHeaderSize
+	return nil
+}
+
+// fileHeader returns the serialized file header.
+func (w *WriteAheadLog) fileHeader() []byte {
+	header := make([]byte, walFileHeaderSize)
+	copy(header, walMagic)
+	binary.BigEndian.PutUint16(header[8:10], walVersion)
+	binary.BigEndian.PutUint32(header[10:14], uint32(w.blockSize))
+	return header
+}
+
+// readFileHeader validates the file header against the log's block size.
+// A block size of 0 adopts the size recorded in the file.
+func (w *WriteAheadLog) readFileHeader(reader io.Reader) error {
+	header := make([]byte, walFileHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil || string(header[:8]) != walMagic {
+		return fmt.Errorf("%w: missing header", ErrWALFormat)
+	}
+	if version := binary.BigEndian.Uint16(header[8:10]); version != walVersion {
+		return fmt.Errorf("%w: version %d", ErrWALFormat, version)
+	}
+
+	blockSize := int(binary.BigEndian.Uint32(header[10:14]))
+	if w.blockSize == 0 {
+		w.blockSize = blockSize
+	} else if blockSize != w.blockSize {
+		return fmt.Errorf("%w: log has %d, opened with %d", ErrWALBlockSize, blockSize, w.blockSize)
+	}
+	return nil
+}
 
+// commitFollows reports whether a valid commit record starts anywhere in
+// the file between from and size. Commit records carry no data, so each
+// candidate offset costs one header checksum.
+func (w *WriteAheadLog) commitFollows(from, size int64) (bool, error) {
+	tail := make([]byte, size-from)
+	if _, err := w.file.ReadAt(tail, from); err != nil && err != io.EOF {
+		return false, fmt.Errorf("failed to read WAL tail: %w", err)
+	}
+
+	for i := 0; i+w.headerSize <= len(tail); i++ {
+		header := tail[i : i+w.headerSize]
+		if WALRecordType(header[8]) != WALRecordCommit || binary.BigEndian.Uint32(header[17:21]) != 0 {
+			continue
+		}
+		record, err := w.deserializeRecord(header)
+		if err == nil && record.Sequence > w.sequence {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// appendLocked assigns a sequence number and writes a record
+// (caller must hold lock).
+func (w *WriteAheadLog) appendLocked(record *WALRecord) error {
 	if w.closed {
 		return ErrWALClosed
 	}
+	if w.failed != nil {
+		return w.failed
+	}
 
-	w.sequence++
-	record.Sequence = w.sequence
+	size := int64(w.headerSize + len(record.Data))
+	if record.Type == WALRecordBlock && w.maxSize > 0 && w.size+size > w.maxSize {
+		return ErrWALFull
+	}
+
+	record.Sequence = w.sequence + 1
 	record.Timestamp = time.Now()
 	record.Checksum = w.calculateChecksum(record)
 
@@ -146,120 +322,289 @@ func (w *WriteAheadLog) Append(record *WALRecord) error {
 		return fmt.Errorf("failed to serialize record: %w", err)
 	}
 
-	// Write to file
-	if _, err := w.file.Write(data); err != nil {
-		return fmt.Errorf("failed to write record: %w", err)
-	}
+	// Buffer until the next sync
+	w.buf = append(w.buf, data...)
+
+	w.sequence = record.Sequence
+	w.size += size
 
 	// Keep in memory for recovery
 	w.records = append(w.records, record)
 	w.maxSeq = w.sequence
 
-	w.cond.Broadcast()
 	return nil
 }
 
-// WriteBlock writes a block to the WAL.
+// Append adds a record to the WAL.
+func (w *WriteAheadLog) Append(record *WALRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.appendLocked(record)
+}
+
+// WriteBlock writes a block to the WAL outside any explicit transaction.
+// The record becomes durable with the next Commit(0).
 func (w *WriteAheadLog) WriteBlock(block uint64, data []byte) error {
-	record := &WALRecord{
-		Type:  WALRecordBlock,
-		Block: block,
-		Data:  data,
-	}
-	return w.Append(record)
+	return w.WriteTransactionBlock(0, block, data)
 }
 
-// BeginTransaction starts a new transaction.
-func (w *WriteAheadLog) BeginTransaction() uint64 {
+// WriteTransactionBlock writes a block to the WAL as part of a transaction.
+func (w *WriteAheadLog) WriteTransactionBlock(tx uint64, block uint64, data []byte) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	w.sequence++
-	seq := w.sequence
+	if tx != 0 && !w.active[tx] {
+		return ErrWALNotFound
+	}
 
 	record := &WALRecord{
-		Sequence:  seq,
-		Type:      WALRecordBegin,
-		Timestamp: time.Now(),
+		Type:        WALRecordBlock,
+		Block:       block,
+		Data:        append([]byte(nil), data...),
+		Transaction: tx,
 	}
-	w.records = append(w.records, record)
+	return w.appendLocked(record)
+}
 
-	return seq
+// BeginTransaction starts a new transaction and returns its identifier,
+// the sequence number of its begin record.
+func (w *WriteAheadLog) BeginTransaction() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	record := &WALRecord{Type: WALRecordBegin}
+	if err := w.appendLocked(record); err != nil {
+		return 0, err
+	}
+
+	w.active[record.Sequence] = true
+	return record.Sequence, nil
 }
 
-// EndTransaction ends a transaction.
+// EndTransaction abandons a transaction without committing it.
 func (w *WriteAheadLog) EndTransaction(beginSeq uint64) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	w.sequence++
-	record := &WALRecord{
-		Sequence:  w.sequence,
-		Type:      WALRecordEnd,
-		Timestamp: time.Now(),
+	if !w.active[beginSeq] {
+		return ErrWALNotFound
 	}
 
-	data, err := w.serializeRecord(record)
-	if err != nil {
+	record := &WALRecord{
+		Type:        WALRecordEnd,
+		Transaction: beginSeq,
+	}
+	if err := w.appendLocked(record); err != nil {
 		return err
 	}
 
-	_, err = w.file.Write(data)
-	return err
+	delete(w.active, beginSeq)
+	return nil
+}
+
+// CommitFuture reports the outcome of a group commit.
+type CommitFuture struct {
+	sequence  uint64
+	commitSeq uint64
+	done      chan struct{}
+	err       error
+}
+
+// Wait blocks until the commit is durable or has failed.
+func (f *CommitFuture) Wait() error {
+	<-f.done
+	return f.err
+}
+
+// Done returns a channel that is closed when the commit completes.
+func (f *CommitFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Sequence returns the sequence number of the commit record.
+func (f *CommitFuture) Sequence() uint64 {
+	return f.sequence
+}
+
+// CommitSequence returns the commit sequence number.
+func (f *CommitFuture) CommitSequence() uint64 {
+	return f.commitSeq
 }
 
-// Commit marks a transaction as committed.
+// complete resolves the future.
+func (f *CommitFuture) complete(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// SetCommitWindow sets how long a group commit waits for other committers
+// before syncing. A window of 0 syncs as soon as the previous sync ends.
+func (w *WriteAheadLog) SetCommitWindow(window time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.commitWindow = window
+}
+
+// Commit marks a transaction as committed and syncs the log, so the
+// transaction survives a crash once Commit returns.
 func (w *WriteAheadLog) Commit(beginSeq uint64) error {
+	future, err := w.CommitAsync(beginSeq)
+	if err != nil {
+		return err
+	}
+	return future.Wait()
+}
+
+// CommitAsync appends a commit record and returns a future that resolves
+// once the record has been synced together with any concurrent commits.
+// Commits are ordered in the log by the order CommitAsync is called.
+func (w *WriteAheadLog) CommitAsync(beginSeq uint64) (*CommitFuture, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	w.commitSeq++
+	if beginSeq != 0 && !w.active[beginSeq] {
+		return nil, ErrWALNotFound
+	}
+
 	record := &WALRecord{
-		Sequence:  w.sequence + 1,
-		Type:      WALRecordCommit,
-		CommitSeq: w.commitSeq,
-		Timestamp: time.Now(),
+		Type:        WALRecordCommit,
+		CommitSeq:   w.commitSeq + 1,
+		Transaction: beginSeq,
+	}
+	if err := w.appendLocked(record); err != nil {
+		return nil, fmt.Errorf("failed to write commit: %w", err)
 	}
-	w.sequence++
 
-	data, err := w.serializeRecord(record)
-	if err != nil {
-		return err
+	w.commitSeq = record.CommitSeq
+	w.commits++
+	delete(w.active, beginSeq)
+
+	future := &CommitFuture{
+		sequence:  record.Sequence,
+		commitSeq: record.CommitSeq,
+		done:      make(chan struct{}),
 	}
+	w.waiters = append(w.waiters, future)
 
-	if _, err := w.file.Write(data); err != nil {
-		return fmt.Errorf("failed to write commit: %w", err)
+	if !w.syncing {
+		w.syncing = true
+		go w.groupCommit(w.commitWindow)
 	}
 
-	w.records = append(w.records, record)
+	return future, nil
+}
 
-	return nil
+// groupCommit syncs batches of commits until no committer is waiting.
+func (w *WriteAheadLog) groupCommit(window time.Duration) {
+	if window > 0 {
+		time.Sleep(window)
+	}
+
+	for {
+		w.mu.Lock()
+		if len(w.waiters) == 0 {
+			w.syncing = false
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Unlock()
+
+		// Commits arriving during this sync form the next batch
+		w.ioMu.Lock()
+		w.syncBuffered(false)
+		w.ioMu.Unlock()
+	}
 }
 
-// Checkpoint marks a checkpoint in the WAL.
-func (w *WriteAheadLog) Checkpoint() error {
+// syncBuffered writes buffered records with a single write and fsyncs,
+// resolving waiting commits. Unless force is set, nothing is synced when
+// there is nothing to write (caller must hold ioMu but not mu).
+func (w *WriteAheadLog) syncBuffered(force bool) error {
 	w.mu.Lock()
-	defer w.mu.Unlock()
+	buf, waiters, file := w.buf, w.waiters, w.file
+	w.buf, w.waiters = nil, nil
+	if len(waiters) > 0 {
+		w.syncBatches++
+	}
+	closed, failed, last := w.closed, w.failed, w.sequence
+	w.mu.Unlock()
 
-	w.sequence++
-	record := &WALRecord{
-		Sequence:  w.sequence,
-		Type:      WALRecordCheckpoint,
-		Timestamp: time.Now(),
+	if failed != nil {
+		for _, future := range waiters {
+			future.complete(failed)
+		}
+		return failed
+	}
+	if closed || (!force && len(buf) == 0 && len(waiters) == 0) {
+		for _, future := range waiters {
+			future.complete(ErrWALClosed)
+		}
+		return nil
 	}
 
-	data, err := w.serializeRecord(record)
+	var err error
+	if len(buf) > 0 {
+		if _, err = file.Write(buf); err != nil {
+			err = fmt.Errorf("failed to write records: %w", err)
+		}
+	}
+	if err == nil {
+		if err = file.Sync(); err != nil {
+			err = fmt.Errorf("failed to sync WAL: %w", err)
+		}
+	}
+
+	w.mu.Lock()
 	if err != nil {
-		return err
+		w.fail(err)
+	} else {
+		w.synced += int64(len(buf))
+		w.syncedSeq = last
 	}
+	w.mu.Unlock()
 
-	if _, err := w.file.Write(data); err != nil {
-		return fmt.Errorf("failed to write checkpoint: %w", err)
+	for _, future := range waiters {
+		future.complete(err)
 	}
+	return err
+}
 
-	w.records = append(w.records, record)
+// fail puts the log in the failed state, dropping records that were not
+// synced and cutting off any part of them that reached the file
+// (caller must hold ioMu and mu).
+func (w *WriteAheadLog) fail(err error) {
+	w.failed = err
 
-	return nil
+	kept := w.records[:0]
+	for _, record := range w.records {
+		if record.Sequence <= w.syncedSeq {
+			kept = append(kept, record)
+		}
+	}
+	clear(w.records[len(kept):])
+	w.records = kept
+	w.buf = nil
+	w.size = w.synced
+
+	// Best effort: a log that cannot be written may not be truncatable
+	// either, and load drops a torn tail anyway
+	w.file.Truncate(w.synced)
+}
+
+// Checkpoint marks a checkpoint in the WAL. Writing a checkpoint asserts
+// that every transaction committed before it has been applied to the
+// device, so Replay skips them.
+func (w *WriteAheadLog) Checkpoint() error {
+	w.mu.Lock()
+	record := &WALRecord{Type: WALRecordCheckpoint}
+	err := w.appendLocked(record)
+	w.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+
+	return w.Flush()
 }
 
 // ReadRecord reads a record by sequence number.
@@ -291,42 +636,111 @@ func (w *WriteAheadLog) GetRecordsSince(seq uint64) []*WALRecord {
 	return result
 }
 
-// GetUncommittedRecords returns records not yet committed.
+// GetCommittedRecords returns block records of committed transactions in
+// commit order.
+func (w *WriteAheadLog) GetCommittedRecords() []*WALRecord {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	committed, _ := w.partition(0)
+	return committed
+}
+
+// GetUncommittedRecords returns block records not yet committed.
 func (w *WriteAheadLog) GetUncommittedRecords() []*WALRecord {
 	w.mu.RLock()
 	defer w.mu.RUnlock()
 
-	// Find the last commit
-	var lastCommit uint64
+	_, uncommitted := w.partition(0)
+	return uncommitted
+}
+
+// partition splits block records into those whose transaction committed
+// after sequence afterSeq, in commit order, and those whose transaction
+// has not committed, in log order (caller must hold lock).
+func (w *WriteAheadLog) partition(afterSeq uint64) (committed, uncommitted []*WALRecord) {
+	pending := make(map[uint64][]*WALRecord)
 	for _, record := range w.records {
-		if record.Type == WALRecordCommit && record.CommitSeq > lastCommit {
-			lastCommit = record.CommitSeq
+		switch record.Type {
+		case WALRecordBlock:
+			pending[record.Transaction] = append(pending[record.Transaction], record)
+		case WALRecordCommit:
+			if record.Sequence > afterSeq {
+				committed = append(committed, pending[record.Transaction]...)
+			}
+			delete(pending, record.Transaction)
+		case WALRecordEnd:
+			delete(pending, record.Transaction)
 		}
 	}
 
-	var result []*WALRecord
-	for _, record := range w.records {
-		if record.Sequence > lastCommit && record.Type == WALRecordBlock {
-			result = append(result, record)
+	for _, records := range pending {
+		uncommitted = append(uncommitted, records...)
+	}
+	sort.Slice(uncommitted, func(i, j int) bool {
+		return uncommitted[i].Sequence < uncommitted[j].Sequence
+	})
+
+	return committed, uncommitted
+}
+
+// checkpointSeq returns the sequence of the last checkpoint record
+// (caller must hold lock).
+func (w *WriteAheadLog) checkpointSeq() uint64 {
+	for i := len(w.records) - 1; i >= 0; i-- {
+		if w.records[i].Type == WALRecordCheckpoint {
+			return w.records[i].Sequence
 		}
 	}
-	return result
+	return 0
+}
+
+// Replay applies every transaction committed since the last checkpoint to
+// device, in commit order, and returns the number of blocks written.
+// Uncommitted and abandoned transactions are skipped.
+func (w *WriteAheadLog) Replay(device BlockDevice) (int, error) {
+	w.mu.RLock()
+	committed, _ := w.partition(w.checkpointSeq())
+	w.mu.RUnlock()
+
+	for i, record := range committed {
+		if len(record.Data) != device.BlockSize() {
+			return i, fmt.Errorf("%w: record %d has %d bytes", ErrInvalidWALEntry, record.Sequence, len(record.Data))
+		}
+		if err := device.Write(record.Block, record.Data); err != nil {
+			return i, fmt.Errorf("failed to replay record %d: %w", record.Sequence, err)
+		}
+	}
+
+	return len(committed), nil
 }
 
 // Flush ensures all records are persisted.
 func (w *WriteAheadLog) Flush() error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+	w.ioMu.Lock()
+	defer w.ioMu.Unlock()
 
-	if w.closed {
+	w.mu.RLock()
+	closed := w.closed
+	w.mu.RUnlock()
+	if closed {
 		return ErrWALClosed
 	}
 
-	return w.file.Sync()
+	return w.syncBuffered(true)
 }
 
-// Truncate removes committed records up to a sequence.
+// Truncate removes records up to a sequence and rewrites the log file.
+// Records of transactions that are still open are kept so they can
+// commit later.
 func (w *WriteAheadLog) Truncate(upToSeq uint64) error {
+	w.ioMu.Lock()
+	defer w.ioMu.Unlock()
+
+	if err := w.syncBuffered(false); err != nil {
+		return err
+	}
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -334,36 +748,102 @@ func (w *WriteAheadLog) Truncate(upToSeq uint64) error {
 		return ErrWALClosed
 	}
 
+	// Records written by WriteBlock after the last Commit(0) are still
+	// waiting for it
+	var implicitCommit uint64
+	for _, record := range w.records {
+		if record.Type == WALRecordCommit && record.Transaction == 0 {
+			implicitCommit = record.Sequence
+		}
+	}
+
 	// Filter records
 	var newRecords []*WALRecord
 	for _, record := range w.records {
-		if record.Sequence > upToSeq {
+		uncommitted := record.Type == WALRecordBlock && record.Transaction == 0 && record.Sequence > implicitCommit
+		if record.Sequence > upToSeq || uncommitted || w.active[record.Sequence] || w.active[record.Transaction] {
 			newRecords = append(newRecords, record)
 		}
 	}
+
+	// Rewrite the file with the remaining records
+	tmpPath := w.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create WAL: %w", err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	writer.Write(w.fileHeader())
+	size := int64(walFileHeaderSize)
+	for _, record := range newRecords {
+		data, err := w.serializeRecord(record)
+		if err == nil {
+			_, err = writer.Write(data)
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to rewrite WAL: %w", err)
+		}
+		size += int64(len(data))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rewrite WAL: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, w.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to reopen WAL: %w", err)
+	}
+	w.file.Close()
+	w.file = file
 	w.records = newRecords
+	w.size, w.synced = size, size
+	w.syncedSeq = w.sequence
+
+	// Records appended since the sync above are in the rewritten file;
+	// commits waiting on them resolve with the next sync
+	w.buf = nil
 
-	// Truncate file (simplified - in production, you'd need to rebuild the file)
 	return nil
 }
 
 // Close closes the WAL.
 func (w *WriteAheadLog) Close() error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+	w.ioMu.Lock()
+	defer w.ioMu.Unlock()
 
-	if w.closed {
+	w.mu.RLock()
+	closed := w.closed
+	w.mu.RUnlock()
+	if closed {
 		return nil
 	}
 
+	err := w.syncBuffered(true)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	w.closed = true
-	w.cond.Broadcast()
 
-	if err := w.file.Sync(); err != nil {
-		return err
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
 	}
-
-	return w.file.Close()
+	return err
 }
 
 // RecoveryInfo contains information for recovery.
@@ -383,22 +863,11 @@ func (w *WriteAheadLog) Recover() (*RecoveryInfo, error) {
 	info := &RecoveryInfo{
 		LastSequence:  w.sequence,
 		LastCommitSeq: w.commitSeq,
-	}
-
-	// Scan all records
-	for _, record := range w.records {
-		switch record.Type {
-		case WALRecordCommit:
-			if record.CommitSeq > info.LastCommitSeq {
-				info.LastCommitSeq = record.CommitSeq
-			}
-		case WALRecordCheckpoint:
-			info.CheckpointSeq = record.Sequence
-		}
+		CheckpointSeq: w.checkpointSeq(),
 	}
 
 	// Get uncommitted records
-	info.Uncommitted = w.GetUncommittedRecords()
+	_, info.Uncommitted = w.partition(0)
 
 	return info, nil
 }
@@ -444,6 +913,9 @@ func (w *WriteAheadLog) serializeRecord(record *WALRecord) ([]byte, error) {
 	if err := binary.Write(buf, binary.BigEndian, record.CommitSeq); err != nil {
 		return nil, err
 	}
+	if err := binary.Write(buf, binary.BigEndian, record.Transaction); err != nil {
+		return nil, err
+	}
 
 	// Write data
 	if _, err := buf.Write(record.Data); err != nil {
@@ -496,19 +968,25 @@ func (w *WriteAheadLog) deserializeRecord(data []byte) (*WALRecord, error) {
 		return nil, err
 	}
 
+	var transaction uint64
+	if err := binary.Read(buf, binary.BigEndian, &transaction); err != nil {
+		return nil, err
+	}
+
 	recordData := make([]byte, dataLen)
 	if _, err := io.ReadFull(buf, recordData); err != nil {
 		return nil, err
 	}
 
 	record := &WALRecord{
-		Sequence:  sequence,
-		Type:      recType,
-		Block:     block,
-		Data:      recordData,
-		Timestamp: time.Unix(0, timestamp),
-		Checksum:  checksum,
-		CommitSeq: commitSeq,
+		Sequence:    sequence,
+		Type:        recType,
+		Block:       block,
+		Data:        recordData,
+		Timestamp:   time.Unix(0, timestamp),
+		Checksum:    checksum,
+		CommitSeq:   commitSeq,
+		Transaction: transaction,
 	}
 
 	// Verify checksum
@@ -519,7 +997,7 @@ func (w *WriteAheadLog) deserializeRecord(data []byte) (*WALRecord, error) {
 	return record, nil
 }
 
-// calculateChecksum computes a checksum for a record.
+// calculateChecksum computes a CRC32C over a record's fields and data.
 func (w *WriteAheadLog) calculateChecksum(record *WALRecord) uint32 {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, record.Sequence)
@@ -527,7 +1005,10 @@ func (w *WriteAheadLog) calculateChecksum(record *WALRecord) uint32 {
 	binary.Write(buf, binary.BigEndian, record.Block)
 	binary.Write(buf, binary.BigEndian, uint32(len(record.Data)))
 	binary.Write(buf, binary.BigEndian, record.Timestamp.UnixNano())
-	return CalculateChecksum(buf.Bytes())
+	binary.Write(buf, binary.BigEndian, record.CommitSeq)
+	binary.Write(buf, binary.BigEndian, record.Transaction)
+	buf.Write(record.Data)
+	return BlockChecksum(buf.Bytes())
 }
 
 // WALStats contains WAL statistics.
@@ -536,6 +1017,9 @@ type WALStats struct {
 	CommitSeq   uint64
 	RecordCount int
 	FileSize    int64
+	Buffered    int    // Bytes awaiting the next sync
+	Commits     uint64 // Commits since open
+	SyncBatches uint64 // Group commit syncs since open
 	Path        string
 }
 
@@ -554,6 +1038,9 @@ func (w *WriteAheadLog) Stats() (*WALStats, error) {
 		CommitSeq:   w.commitSeq,
 		RecordCount: len(w.records),
 		FileSize:    stat.Size(),
+		Buffered:    len(w.buf),
+		Commits:     w.commits,
+		SyncBatches: w.syncBatches,
 		Path:        w.path,
 	}, nil
 }
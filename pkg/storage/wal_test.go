@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestWAL creates a WAL with two committed transactions: block 1 in
+// the first and block 2 in the second.
+func newTestWAL(t *testing.T) (*WriteAheadLog, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, err := NewWriteAheadLog(path, 512, 0)
+	if err != nil {
+		t.Fatalf("NewWriteAheadLog failed: %v", err)
+	}
+	for block := uint64(1); block <= 2; block++ {
+		tx, err := w.BeginTransaction()
+		if err != nil {
+			t.Fatalf("BeginTransaction failed: %v", err)
+		}
+		if err := w.WriteTransactionBlock(tx, block, fill(512, byte('0'+block))); err != nil {
+			t.Fatalf("WriteTransactionBlock failed: %v", err)
+		}
+		if err := w.Commit(tx); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+	}
+	return w, path
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	return stat.Size()
+}
+
+func TestWALReplay(t *testing.T) {
+	w, path := newTestWAL(t)
+
+	// Abandoned and uncommitted transactions are not replayed
+	tx, _ := w.BeginTransaction()
+	w.WriteTransactionBlock(tx, 3, fill(512, 'x'))
+	w.EndTransaction(tx)
+	tx, _ = w.BeginTransaction()
+	w.WriteTransactionBlock(tx, 4, fill(512, 'y'))
+	w.Close()
+
+	reopened, err := OpenWriteAheadLog(path, 512)
+	if err != nil {
+		t.Fatalf("OpenWriteAheadLog failed: %v", err)
+	}
+	defer reopened.Close()
+
+	mem := newMemoryDevice(t, 8, 512)
+	n, err := reopened.Replay(mem)
+	if err != nil || n != 2 {
+		t.Fatalf("Replay wrote %d blocks, %v; expected 2", n, err)
+	}
+	buf := make([]byte, 512)
+	for block, want := range map[uint64]byte{1: '1', 2: '2', 3: 0, 4: 0} {
+		mem.Read(block, buf)
+		if buf[0] != want {
+			t.Errorf("block %d holds %q, expected %q", block, buf[0], want)
+		}
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+	w, path := newTestWAL(t)
+	w.Close()
+	valid := fileSize(t, path)
+
+	// Half of an appended record, as a crash mid-write leaves behind
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	file.Write(make([]byte, walHeaderSize+100))
+	file.Close()
+
+	reopened, err := OpenWriteAheadLog(path, 512)
+	if err != nil {
+		t.Fatalf("OpenWriteAheadLog with a torn tail failed: %v", err)
+	}
+	defer reopened.Close()
+	if size := fileSize(t, path); size != valid {
+		t.Errorf("file size %d after recovery, expected %d", size, valid)
+	}
+	if records := reopened.GetCommittedRecords(); len(records) != 2 {
+		t.Errorf("%d committed records after recovery, expected 2", len(records))
+	}
+}
+
+func TestWALCorruptionBeforeCommit(t *testing.T) {
+	w, path := newTestWAL(t)
+	w.Close()
+	size := fileSize(t, path)
+
+	// Damage the first block record; the second transaction's commit
+	// follows it
+	data, _ := os.ReadFile(path)
+	data[walFileHeaderSize+2*walHeaderSize+10] ^= 0xff
+	os.WriteFile(path, data, 0600)
+
+	if _, err := OpenWriteAheadLog(path, 512); !errors.Is(err, ErrWALCorrupted) {
+		t.Errorf("OpenWriteAheadLog returned %v, expected ErrWALCorrupted", err)
+	}
+	if got := fileSize(t, path); got != size {
+		t.Errorf("corrupt log was truncated from %d to %d bytes", size, got)
+	}
+}
+
+func TestWALHeaderMismatch(t *testing.T) {
+	w, path := newTestWAL(t)
+	w.Close()
+	size := fileSize(t, path)
+
+	if _, err := OpenWriteAheadLog(path, 1024); !errors.Is(err, ErrWALBlockSize) {
+		t.Errorf("OpenWriteAheadLog with another block size returned %v", err)
+	}
+	if got := fileSize(t, path); got != size {
+		t.Errorf("log was truncated from %d to %d bytes", size, got)
+	}
+
+	// A block size of 0 adopts the one in the file
+	adopted, err := OpenWriteAheadLog(path, 0)
+	if err != nil {
+		t.Fatalf("OpenWriteAheadLog failed: %v", err)
+	}
+	if records := adopted.GetCommittedRecords(); len(records) != 2 {
+		t.Errorf("%d committed records, expected 2", len(records))
+	}
+	adopted.Close()
+
+	// Logs without a header are from an older format
+	legacy := filepath.Join(t.TempDir(), "legacy.wal")
+	os.WriteFile(legacy, make([]byte, 200), 0600)
+	if _, err := OpenWriteAheadLog(legacy, 512); !errors.Is(err, ErrWALFormat) {
+		t.Errorf("OpenWriteAheadLog of a headerless log returned %v", err)
+	}
+	if got := fileSize(t, legacy); got != 200 {
+		t.Errorf("headerless log was truncated to %d bytes", got)
+	}
+}
+
+func TestWALTruncateKeepsHeader(t *testing.T) {
+	w, path := newTestWAL(t)
+	if err := w.Truncate(w.GetSequence()); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	w.Close()
+
+	reopened, err := OpenWriteAheadLog(path, 512)
+	if err != nil {
+		t.Fatalf("OpenWriteAheadLog after Truncate failed: %v", err)
+	}
+	reopened.Close()
+}
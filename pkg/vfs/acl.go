@@ -0,0 +1,408 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidACL is returned for malformed ACLs, and for default ACLs on
+// entries that are not directories.
+var ErrInvalidACL = errors.New("vfs: invalid ACL")
+
+// Extended attributes holding ACLs, named as on Linux.
+const (
+	XattrACLAccess  = "system.posix_acl_access"
+	XattrACLDefault = "system.posix_acl_default"
+)
+
+// ACLTag identifies what an ACL entry applies to.
+type ACLTag int
+
+// ACL entry tags, in the order entries are kept.
+const (
+	ACLUserObj  ACLTag = iota // The file's owner
+	ACLUser                   // The user named by ID
+	ACLGroupObj               // The file's group
+	ACLGroup                  // The group named by ID
+	ACLMask                   // Upper bound for everything but the owner and others
+	ACLOther                  // Everyone else
+)
+
+var aclTagNames = [...]string{"user", "user", "group", "group", "mask", "other"}
+
+// ACLEntry grants permissions to one user or group.
+type ACLEntry struct {
+	Tag  ACLTag
+	ID   int         // uid or gid for ACLUser and ACLGroup, otherwise unused
+	Perm os.FileMode // Some of the rwx bits, 0 to 7
+}
+
+// ACL is a POSIX access control list.
+//
+// Every ACL has exactly one ACLUserObj, ACLGroupObj and ACLOther entry,
+// which correspond to the owner, group and other mode bits. An ACL with
+// named users or groups also needs an ACLMask entry, and the group mode
+// bits then hold the mask instead: chmod limits what named entries and
+// the file's group can be granted.
+//
+// ACLs are stored in the XattrACLAccess and XattrACLDefault extended
+// attributes in the text form returned by String. The entries mirrored
+// by the mode bits are always taken from the mode, so the mode remains
+// authoritative even when it is changed without regard for the ACL.
+type ACL []ACLEntry
+
+// ACLFromMode returns the minimal ACL equivalent to mode's permission bits.
+func ACLFromMode(mode os.FileMode) ACL {
+	return ACL{
+		{Tag: ACLUserObj, Perm: mode >> 6 & 7},
+		{Tag: ACLGroupObj, Perm: mode >> 3 & 7},
+		{Tag: ACLOther, Perm: mode & 7},
+	}
+}
+
+// ParseACL parses the text form of an ACL: comma-separated entries such as
+// "user::rw-", "user:1000:r--", "group::r--", "group:100:rw-", "mask::rw-"
+// and "other::---".
+func ParseACL(text string) (ACL, error) {
+	var acl ACL
+	for _, field := range strings.Split(text, ",") {
+		parts := strings.Split(strings.TrimSpace(field), ":")
+		if len(parts) != 3 {
+			return nil, ErrInvalidACL
+		}
+
+		var entry ACLEntry
+		switch parts[0] {
+		case "user":
+			entry.Tag = ACLUserObj
+		case "group":
+			entry.Tag = ACLGroupObj
+		case "mask":
+			entry.Tag = ACLMask
+		case "other":
+			entry.Tag = ACLOther
+		default:
+			return nil, ErrInvalidACL
+		}
+
+		if parts[1] != "" {
+			if entry.Tag != ACLUserObj && entry.Tag != ACLGroupObj {
+				return nil, ErrInvalidACL
+			}
+			id, err := strconv.Atoi(parts[1])
+			if err != nil || id < 0 {
+				return nil, ErrInvalidACL
+			}
+			entry.Tag++
+			entry.ID = id
+		}
+
+		perm, err := parseACLPerm(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		entry.Perm = perm
+		acl = append(acl, entry)
+	}
+
+	acl.sort()
+	if err := acl.Validate(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// parseACLPerm parses permissions written as "rwx" with "-" for unset bits.
+func parseACLPerm(s string) (os.FileMode, error) {
+	if len(s) != 3 {
+		return 0, ErrInvalidACL
+	}
+
+	var perm os.FileMode
+	for i, want := range "rwx" {
+		switch rune(s[i]) {
+		case want:
+			perm |= 4 >> i
+		case '-':
+		default:
+			return 0, ErrInvalidACL
+		}
+	}
+	return perm, nil
+}
+
+// String returns the text form of the ACL understood by ParseACL.
+func (acl ACL) String() string {
+	fields := make([]string, len(acl))
+	for i, entry := range acl {
+		id := ""
+		if entry.Tag == ACLUser || entry.Tag == ACLGroup {
+			id = strconv.Itoa(entry.ID)
+		}
+
+		perm := []byte("---")
+		for bit, c := range "rwx" {
+			if entry.Perm&(4>>bit) != 0 {
+				perm[bit] = byte(c)
+			}
+		}
+		fields[i] = aclTagNames[entry.Tag] + ":" + id + ":" + string(perm)
+	}
+	return strings.Join(fields, ",")
+}
+
+// Validate checks that the ACL is well formed.
+func (acl ACL) Validate() error {
+	counts := make(map[ACLTag]int)
+	users := make(map[int]bool)
+	groups := make(map[int]bool)
+	for _, entry := range acl {
+		if entry.Tag < ACLUserObj || entry.Tag > ACLOther || entry.Perm&^7 != 0 {
+			return ErrInvalidACL
+		}
+		counts[entry.Tag]++
+
+		switch entry.Tag {
+		case ACLUser:
+			if users[entry.ID] {
+				return ErrInvalidACL
+			}
+			users[entry.ID] = true
+		case ACLGroup:
+			if groups[entry.ID] {
+				return ErrInvalidACL
+			}
+			groups[entry.ID] = true
+		}
+	}
+
+	if counts[ACLUserObj] != 1 || counts[ACLGroupObj] != 1 || counts[ACLOther] != 1 || counts[ACLMask] > 1 {
+		return ErrInvalidACL
+	}
+	if counts[ACLMask] == 0 && (counts[ACLUser] > 0 || counts[ACLGroup] > 0) {
+		return ErrInvalidACL
+	}
+	return nil
+}
+
+// sort puts the entries in canonical order.
+func (acl ACL) sort() {
+	slices.SortStableFunc(acl, func(a, b ACLEntry) int {
+		if a.Tag != b.Tag {
+			return int(a.Tag - b.Tag)
+		}
+		return a.ID - b.ID
+	})
+}
+
+// IsMinimal reports whether the ACL says no more than the mode bits.
+func (acl ACL) IsMinimal() bool {
+	return len(acl) == 3
+}
+
+// find returns the index of the first entry with tag, or -1.
+func (acl ACL) find(tag ACLTag) int {
+	return slices.IndexFunc(acl, func(e ACLEntry) bool { return e.Tag == tag })
+}
+
+// Mode returns the permission bits the ACL maps to: the owner, the mask
+// (or the file's group if there is no mask) and others.
+func (acl ACL) Mode() os.FileMode {
+	group := acl.find(ACLMask)
+	if group < 0 {
+		group = acl.find(ACLGroupObj)
+	}
+	return acl[acl.find(ACLUserObj)].Perm<<6 | acl[group].Perm<<3 | acl[acl.find(ACLOther)].Perm
+}
+
+// withMode returns a copy of the ACL with the entries that mirror the mode
+// bits taken from mode.
+func (acl ACL) withMode(mode os.FileMode) ACL {
+	acl = slices.Clone(acl)
+
+	group := acl.find(ACLMask)
+	if group < 0 {
+		group = acl.find(ACLGroupObj)
+	}
+	acl[acl.find(ACLUserObj)].Perm = mode >> 6 & 7
+	acl[group].Perm = mode >> 3 & 7
+	acl[acl.find(ACLOther)].Perm = mode & 7
+	return acl
+}
+
+// allows runs the POSIX access check algorithm for a user with the given
+// groups against a file owned by owner and group.
+func (acl ACL) allows(uid int, gids []int, owner, group int, want os.FileMode) bool {
+	mask := os.FileMode(7)
+	if i := acl.find(ACLMask); i >= 0 {
+		mask = acl[i].Perm
+	}
+
+	if uid == owner {
+		return acl[acl.find(ACLUserObj)].Perm&want == want
+	}
+	for _, entry := range acl {
+		if entry.Tag == ACLUser && entry.ID == uid {
+			return entry.Perm&mask&want == want
+		}
+	}
+
+	// Any matching group entry that grants access is enough; matching a
+	// group entry that does not still denies access to others
+	matched := false
+	for _, entry := range acl {
+		var gid int
+		switch entry.Tag {
+		case ACLGroupObj:
+			gid = group
+		case ACLGroup:
+			gid = entry.ID
+		default:
+			continue
+		}
+		if !slices.Contains(gids, gid) {
+			continue
+		}
+		if entry.Perm&mask&want == want {
+			return true
+		}
+		matched = true
+	}
+	if matched {
+		return false
+	}
+
+	return acl[acl.find(ACLOther)].Perm&want == want
+}
+
+// inherit returns the access ACL given to a new entry created with perm in
+// a directory whose default ACL is def.
+func (def ACL) inherit(perm os.FileMode) ACL {
+	return def.withMode(def.Mode() & perm)
+}
+
+// GetACL returns the access ACL of path. Files without one, and files on
+// filesystems that do not implement XattrFS, have the ACL of their mode.
+func GetACL(fs FileSystem, path string) (ACL, error) {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return accessACL(fs, path, info)
+}
+
+// accessACL returns the access ACL of path, whose info is already known.
+func accessACL(fs FileSystem, path string, info FileInfo) (ACL, error) {
+	acl, err := readACL(fs, path, XattrACLAccess)
+	if err != nil {
+		return nil, err
+	}
+	if acl == nil {
+		return ACLFromMode(info.Mode), nil
+	}
+	return acl.withMode(info.Mode), nil
+}
+
+// readACL reads an ACL attribute, returning nil if it is not set.
+func readACL(fs FileSystem, path, name string) (ACL, error) {
+	xfs, ok := fs.(XattrFS)
+	if !ok {
+		return nil, nil
+	}
+
+	data, err := xfs.Getxattr(path, name)
+	if err == ErrNoAttr || err == ErrNotImplemented {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseACL(string(data))
+}
+
+// SetACL replaces the access ACL of path and updates its mode bits to
+// match. A minimal ACL just sets the mode; other ACLs need a filesystem
+// implementing XattrFS.
+func SetACL(fs FileSystem, path string, acl ACL) error {
+	acl = slices.Clone(acl)
+	acl.sort()
+	if err := acl.Validate(); err != nil {
+		return err
+	}
+
+	info, err := fs.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	xfs, ok := fs.(XattrFS)
+	if acl.IsMinimal() {
+		if ok {
+			if err := xfs.Removexattr(path, XattrACLAccess); err != nil && err != ErrNoAttr && err != ErrNotImplemented {
+				return err
+			}
+		}
+	} else {
+		if !ok {
+			return ErrNotImplemented
+		}
+		if err := xfs.Setxattr(path, XattrACLAccess, []byte(acl.String()), 0); err != nil {
+			return err
+		}
+	}
+
+	special := info.Mode & (os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	return fs.Chmod(path, special|acl.Mode())
+}
+
+// GetDefaultACL returns the default ACL of the directory path, which new
+// entries in it inherit, or nil if it has none.
+func GetDefaultACL(fs FileSystem, path string) (ACL, error) {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir {
+		return nil, nil
+	}
+	return readACL(fs, path, XattrACLDefault)
+}
+
+// SetDefaultACL sets the default ACL of the directory path. A nil ACL
+// removes it.
+//
+// New entries in the directory get the default ACL as their access ACL,
+// limited by the permissions they are created with, instead of having the
+// umask applied. New subdirectories also inherit it as their default ACL.
+// Inheritance is applied by CredentialFS.
+func SetDefaultACL(fs FileSystem, path string, acl ACL) error {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir {
+		return ErrInvalidACL
+	}
+
+	xfs, ok := fs.(XattrFS)
+	if !ok {
+		return ErrNotImplemented
+	}
+
+	if acl == nil {
+		if err := xfs.Removexattr(path, XattrACLDefault); err != nil && err != ErrNoAttr {
+			return err
+		}
+		return nil
+	}
+
+	acl = slices.Clone(acl)
+	acl.sort()
+	if err := acl.Validate(); err != nil {
+		return err
+	}
+	return xfs.Setxattr(path, XattrACLDefault, []byte(acl.String()), 0)
+}
@@ -0,0 +1,170 @@
+package vfs_test
+
+import (
+	"errors"
+	"testing"
+
+	vfs "webos/pkg/vfs"
+	"webos/pkg/vfs/memfs"
+)
+
+// canOpen reports whether user may open path for reading and for writing.
+func canOpen(t *testing.T, user *vfs.CredentialFS, path string) (read, write bool) {
+	t.Helper()
+	check := func(flags int) bool {
+		file, err := user.OpenFile(path, flags, 0)
+		if err == nil {
+			file.Close()
+			return true
+		}
+		if !errors.Is(err, vfs.ErrPermissionDenied) {
+			t.Fatalf("OpenFile(%s) returned %v", path, err)
+		}
+		return false
+	}
+	return check(vfs.O_RDONLY), check(vfs.O_WRONLY)
+}
+
+func TestACLAccess(t *testing.T) {
+	const (
+		masked = "user::rw-,user:2000:rw-,group::r--,group:300:rw-,mask::r--,other::---"
+		open   = "user::rw-,user:2000:rw-,group::r--,group:300:rw-,mask::rw-,other::---"
+	)
+	tests := []struct {
+		name        string
+		acl         string
+		uid         int
+		gids        []int
+		read, write bool
+	}{
+		{"owner", masked, 1000, []int{100}, true, true},
+		{"owner ignores mask", "user::rw-,group::---,mask::---,other::---", 1000, []int{100}, true, true},
+		{"named user", open, 2000, []int{200}, true, true},
+		{"named user masked", masked, 2000, []int{200}, true, false},
+		{"named user before groups", "user::rw-,user:2000:---,group::rw-,mask::rw-,other::rw-", 2000, []int{100}, false, false},
+		{"owning group", open, 3000, []int{100}, true, false},
+		{"named group", open, 3000, []int{300}, true, true},
+		{"named group masked", masked, 3000, []int{300}, true, false},
+		{"any group grants", open, 3000, []int{100, 300}, true, true},
+		{"matched group denies", "user::rw-,group::---,mask::rw-,other::rw-", 3000, []int{100}, false, false},
+		{"other", open, 4000, []int{400}, false, false},
+		{"other ignores mask", "user::rw-,user:2000:---,group::---,mask::---,other::rw-", 4000, []int{400}, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := memfs.New()
+			fs.WriteFile("/file", []byte("data"), 0600)
+			fs.Chown("/file", 1000, 100)
+
+			acl, err := vfs.ParseACL(tt.acl)
+			if err != nil {
+				t.Fatalf("ParseACL failed: %v", err)
+			}
+			if err := vfs.SetACL(fs, "/file", acl); err != nil {
+				t.Fatalf("SetACL failed: %v", err)
+			}
+
+			user := vfs.WithCredentials(fs, tt.uid, tt.gids)
+			read, write := canOpen(t, user, "/file")
+			if read != tt.read || write != tt.write {
+				t.Errorf("read %v, write %v, expected read %v, write %v", read, write, tt.read, tt.write)
+			}
+		})
+	}
+}
+
+func TestACLMaskFollowsChmod(t *testing.T) {
+	fs := memfs.New()
+	fs.WriteFile("/file", nil, 0600)
+	fs.Chown("/file", 1000, 100)
+	acl, _ := vfs.ParseACL("user::rw-,user:2000:rw-,group::r--,mask::rw-,other::---")
+	vfs.SetACL(fs, "/file", acl)
+
+	// The group bits hold the mask, so chmod g-w takes write access from
+	// the named user
+	fs.Chmod("/file", 0640)
+	bob := vfs.WithCredentials(fs, 2000, []int{200})
+	if read, write := canOpen(t, bob, "/file"); !read || write {
+		t.Errorf("after chmod 640 named user has read %v, write %v", read, write)
+	}
+	got, err := vfs.GetACL(fs, "/file")
+	if err != nil {
+		t.Fatalf("GetACL failed: %v", err)
+	}
+	if want := "user::rw-,user:2000:rw-,group::r--,mask::r--,other::---"; got.String() != want {
+		t.Errorf("GetACL = %s, expected %s", got, want)
+	}
+}
+
+func TestACLDefaultInheritance(t *testing.T) {
+	fs := memfs.New()
+	fs.Mkdir("/shared", 0770)
+	fs.Chown("/shared", 1000, 100)
+	def, _ := vfs.ParseACL("user::rwx,user:2000:rwx,group::r-x,mask::rwx,other::---")
+	if err := vfs.SetDefaultACL(fs, "/shared", def); err != nil {
+		t.Fatalf("SetDefaultACL failed: %v", err)
+	}
+	vfs.SetACL(fs, "/shared", def)
+
+	alice := vfs.WithCredentials(fs, 1000, []int{100})
+	bob := vfs.WithCredentials(fs, 2000, []int{200})
+	carol := vfs.WithCredentials(fs, 3000, []int{100})
+	other := vfs.WithCredentials(fs, 4000, []int{400})
+
+	if err := alice.WriteFile("/shared/file", []byte("data"), 0666); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := alice.Mkdir("/shared/dir", 0777); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+
+	// The default ACL replaces the umask and is limited by the create mode
+	tests := []struct {
+		path string
+		acl  string
+	}{
+		{"/shared/file", "user::rw-,user:2000:rwx,group::r-x,mask::rw-,other::---"},
+		{"/shared/dir", "user::rwx,user:2000:rwx,group::r-x,mask::rwx,other::---"},
+	}
+	for _, tt := range tests {
+		got, err := vfs.GetACL(fs, tt.path)
+		if err != nil {
+			t.Fatalf("GetACL(%s) failed: %v", tt.path, err)
+		}
+		if got.String() != tt.acl {
+			t.Errorf("%s has ACL %s, expected %s", tt.path, got, tt.acl)
+		}
+	}
+	if got, _ := vfs.GetDefaultACL(fs, "/shared/dir"); got.String() != def.String() {
+		t.Errorf("subdirectory has default ACL %s, expected %s", got, def)
+	}
+	if got, _ := vfs.GetDefaultACL(fs, "/shared/file"); got != nil {
+		t.Errorf("file has default ACL %s", got)
+	}
+
+	users := []struct {
+		name        string
+		user        *vfs.CredentialFS
+		read, write bool
+	}{
+		{"owner", alice, true, true},
+		{"named user", bob, true, true},
+		{"group", carol, true, false},
+		{"other", other, false, false},
+	}
+	for _, u := range users {
+		read, write := canOpen(t, u.user, "/shared/file")
+		if read != u.read || write != u.write {
+			t.Errorf("%s: read %v, write %v, expected read %v, write %v", u.name, read, write, u.read, u.write)
+		}
+	}
+
+	// Entries in the new subdirectory inherit again
+	if err := bob.WriteFile("/shared/dir/nested", nil, 0644); err != nil {
+		t.Fatalf("WriteFile in inherited directory failed: %v", err)
+	}
+	if got, _ := vfs.GetACL(fs, "/shared/dir/nested"); got.String() != "user::rw-,user:2000:rwx,group::r-x,mask::r--,other::---" {
+		t.Errorf("nested file has ACL %s", got)
+	}
+}
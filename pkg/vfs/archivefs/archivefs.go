@@ -0,0 +1,580 @@
+// Package archivefs provides read-only filesystems over tar and zip
+// archives.
+//
+// Opening an archive reads its headers once to build a directory index;
+// file contents are read from the archive only when a file is read.
+// Entries stored uncompressed, as in a plain tar or a zip entry using the
+// Store method, are read in place at any offset. Compressed entries are
+// decompressed as a stream, so reading backwards restarts the stream.
+//
+// Directories missing from the archive are implied by the paths of the
+// entries within them. Paired with overlayfs, an archive can serve as a
+// shared lower layer:
+//
+//	base, err := archivefs.Open("base.tar.gz")
+//	if err != nil {
+//		return err
+//	}
+//	root := overlayfs.New(memfs.New(), base)
+package archivefs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	vfs "webos/pkg/vfs"
+)
+
+// ErrUnknownFormat is returned by Open for files that are not tar, gzipped
+// tar or zip archives.
+var ErrUnknownFormat = errors.New("archivefs: unknown archive format")
+
+// maxSymlinks bounds the symlinks followed while resolving one path.
+const maxSymlinks = 40
+
+// FS is a read-only view of an archive.
+type FS struct {
+	root   *node
+	closer io.Closer // Host file opened by Open, nil otherwise
+	ino    uint64    // Last inode number assigned while indexing
+}
+
+// node is an entry of the index.
+type node struct {
+	info     vfs.FileInfo
+	target   string           // Destination of a symlink
+	children map[string]*node // Entries of a directory
+
+	// Contents of a regular file. section is set when the data can be read
+	// in place or was kept while indexing; otherwise open starts a stream
+	// of it.
+	section *io.SectionReader
+	open    func() (io.ReadCloser, error)
+}
+
+// Open opens the archive at a host path, recognising tar, gzipped tar and
+// zip archives by their contents. The host file is closed by Close.
+func Open(name string) (*FS, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	fs, err := newFS(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	fs.closer = file
+	return fs, nil
+}
+
+// newFS indexes the archive in r, choosing the reader by its magic number.
+func newFS(r io.ReaderAt, size int64) (*FS, error) {
+	magic := make([]byte, 262)
+	n, _ := r.ReadAt(magic, 0)
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		return NewZip(r, size)
+	case bytes.HasPrefix(magic, gzipMagic):
+		return NewTar(r, size)
+	case len(magic) == 262 && string(magic[257:262]) == "ustar":
+		return NewTar(r, size)
+	}
+	return nil, ErrUnknownFormat
+}
+
+// Close closes the host file of an archive opened with Open. The
+// filesystem cannot be read afterwards.
+func (fs *FS) Close() error {
+	if fs.closer == nil {
+		return nil
+	}
+	return fs.closer.Close()
+}
+
+// newIndex returns a filesystem holding only the root directory.
+func newIndex() *FS {
+	fs := &FS{}
+	fs.root = fs.newNode("/", os.ModeDir|0755, time.Time{}, 0, 0)
+	return fs
+}
+
+// newNode creates an unlinked node with a fresh inode number.
+func (fs *FS) newNode(name string, mode os.FileMode, mtime time.Time, uid, gid int) *node {
+	fs.ino++
+	n := &node{
+		info: vfs.FileInfo{
+			Name:    name,
+			Mode:    mode,
+			ModTime: mtime,
+			IsDir:   mode.IsDir(),
+			Sys: &vfs.Stat{
+				Ino:   fs.ino,
+				Nlink: 1,
+				Uid:   uid,
+				Gid:   gid,
+				Atime: mtime,
+				Ctime: mtime,
+			},
+		},
+	}
+	if n.info.IsDir {
+		n.children = make(map[string]*node)
+	}
+	return n
+}
+
+// insert places n at path, creating missing parent directories. A
+// directory replacing a directory keeps its entries, as when an archive
+// lists a directory after files within it.
+func (fs *FS) insert(path string, n *node) {
+	path = vfs.Clean("/" + path)
+	if path == "/" {
+		if n.info.IsDir {
+			n.info.Name = "/"
+			n.children = fs.root.children
+			fs.root = n
+		}
+		return
+	}
+
+	parent := fs.mkdirs(vfs.Dir(path))
+	name := vfs.Base(path)
+	n.info.Name = name
+	if old := parent.children[name]; old != nil && old.info.IsDir && n.info.IsDir {
+		n.children = old.children
+	}
+	parent.children[name] = n
+}
+
+// mkdirs returns the directory at path, creating it and its parents as
+// needed. Non-directories in the way are replaced.
+func (fs *FS) mkdirs(path string) *node {
+	dir := fs.root
+	if path == "/" {
+		return dir
+	}
+	for _, name := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		child := dir.children[name]
+		if child == nil || !child.info.IsDir {
+			child = fs.newNode(name, os.ModeDir|0755, time.Time{}, 0, 0)
+			dir.children[name] = child
+		}
+		dir = child
+	}
+	return dir
+}
+
+// link makes the node at path share the contents and inode of the node at
+// target, for hard links. Links to missing targets are dropped.
+func (fs *FS) link(path, target string) {
+	n, _, err := fs.resolve("link", vfs.Clean("/"+target), false)
+	if err != nil || n.info.IsDir {
+		return
+	}
+	if st, ok := n.info.Sys.(*vfs.Stat); ok {
+		st.Nlink++
+	}
+	linked := *n
+	fs.insert(path, &linked)
+}
+
+// resolve returns the node at path and its resolved path. Symlinks in
+// parent directories are always followed, and a final symlink only when
+// follow is set.
+func (fs *FS) resolve(op, path string, follow bool) (*node, string, error) {
+	if err := vfs.ValidatePath(path); err != nil {
+		return nil, "", err
+	}
+	orig := path
+	path = vfs.Clean(path)
+
+	hops := 0
+	n := fs.root
+	resolved := "/"
+	rest := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		if name == "" {
+			continue
+		}
+		if !n.info.IsDir {
+			return nil, "", &os.PathError{Op: op, Path: orig, Err: syscall.ENOTDIR}
+		}
+
+		child := n.children[name]
+		if child == nil {
+			return nil, "", vfs.NotExistError(op, orig)
+		}
+		if child.info.Mode&os.ModeSymlink == 0 || (len(rest) == 0 && !follow) {
+			n = child
+			resolved = vfs.Join(resolved, name)
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinks {
+			return nil, "", &os.PathError{Op: op, Path: orig, Err: syscall.ELOOP}
+		}
+		target := child.target
+		if !vfs.IsAbs(target) {
+			target = vfs.Join(resolved, target)
+		}
+		target = vfs.Clean(target)
+
+		// Restart from the root along the target and the remaining names
+		rest = append(strings.Split(strings.TrimPrefix(target, "/"), "/"), rest...)
+		n = fs.root
+		resolved = "/"
+	}
+	return n, resolved, nil
+}
+
+// Open implements vfs.FileSystem.Open.
+func (fs *FS) Open(path string) (vfs.File, error) {
+	return fs.OpenFile(path, vfs.O_RDONLY, 0)
+}
+
+// OpenFile implements vfs.FileSystem.OpenFile. Only reading is allowed.
+func (fs *FS) OpenFile(path string, flags int, perm os.FileMode) (vfs.File, error) {
+	if flags&(vfs.O_WRONLY|vfs.O_RDWR|vfs.O_CREATE|vfs.O_TRUNC|vfs.O_APPEND) != 0 {
+		return nil, vfs.ReadOnlyError("open", path)
+	}
+	n, resolved, err := fs.resolve("open", path, true)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveFile{node: n, path: resolved}, nil
+}
+
+// Stat implements vfs.FileSystem.Stat.
+func (fs *FS) Stat(path string) (vfs.FileInfo, error) {
+	n, _, err := fs.resolve("stat", path, true)
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+	return n.info, nil
+}
+
+// Lstat implements vfs.FileSystem.Lstat.
+func (fs *FS) Lstat(path string) (vfs.FileInfo, error) {
+	n, _, err := fs.resolve("lstat", path, false)
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+	return n.info, nil
+}
+
+// Mkdir implements vfs.FileSystem.Mkdir.
+func (fs *FS) Mkdir(path string, perm os.FileMode) error {
+	return vfs.ReadOnlyError("mkdir", path)
+}
+
+// MkdirAll implements vfs.FileSystem.MkdirAll.
+func (fs *FS) MkdirAll(path string, perm os.FileMode) error {
+	return vfs.ReadOnlyError("mkdir", path)
+}
+
+// Remove implements vfs.FileSystem.Remove.
+func (fs *FS) Remove(path string) error {
+	return vfs.ReadOnlyError("remove", path)
+}
+
+// RemoveAll implements vfs.FileSystem.RemoveAll.
+func (fs *FS) RemoveAll(path string) error {
+	return vfs.ReadOnlyError("removeall", path)
+}
+
+// Rename implements vfs.FileSystem.Rename.
+func (fs *FS) Rename(oldpath, newpath string) error {
+	return vfs.ReadOnlyError("rename", oldpath)
+}
+
+// ReadDir implements vfs.FileSystem.ReadDir. Entries are sorted by name.
+func (fs *FS) ReadDir(path string) ([]vfs.DirEntry, error) {
+	n, _, err := fs.resolve("readdir", path, true)
+	if err != nil {
+		return nil, err
+	}
+	if !n.info.IsDir {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: syscall.ENOTDIR}
+	}
+
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]vfs.DirEntry, len(names))
+	for i, name := range names {
+		entries[i] = vfs.NewDirEntry(n.children[name].info)
+	}
+	return entries, nil
+}
+
+// ReadFile implements vfs.FileSystem.ReadFile.
+func (fs *FS) ReadFile(path string) ([]byte, error) {
+	n, _, err := fs.resolve("read", path, true)
+	if err != nil {
+		return nil, err
+	}
+	if n.info.IsDir {
+		return nil, &os.PathError{Op: "read", Path: path, Err: syscall.EISDIR}
+	}
+
+	f := &archiveFile{node: n, path: path}
+	defer f.Close()
+
+	data := make([]byte, n.info.Size)
+	if _, err := f.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteFile implements vfs.FileSystem.WriteFile.
+func (fs *FS) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return vfs.ReadOnlyError("write", path)
+}
+
+// Create implements vfs.FileSystem.Create.
+func (fs *FS) Create(path string) (vfs.File, error) {
+	return nil, vfs.ReadOnlyError("create", path)
+}
+
+// Symlink implements vfs.FileSystem.Symlink.
+func (fs *FS) Symlink(target, newpath string) error {
+	return vfs.ReadOnlyError("symlink", newpath)
+}
+
+// Readlink implements vfs.FileSystem.Readlink.
+func (fs *FS) Readlink(path string) (string, error) {
+	n, _, err := fs.resolve("readlink", path, false)
+	if err != nil {
+		return "", err
+	}
+	if n.info.Mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: syscall.EINVAL}
+	}
+	return n.target, nil
+}
+
+// Link implements vfs.FileSystem.Link.
+func (fs *FS) Link(oldpath, newpath string) error {
+	return vfs.ReadOnlyError("link", newpath)
+}
+
+// Chmod implements vfs.FileSystem.Chmod.
+func (fs *FS) Chmod(path string, mode os.FileMode) error {
+	return vfs.ReadOnlyError("chmod", path)
+}
+
+// Chown implements vfs.FileSystem.Chown.
+func (fs *FS) Chown(path string, uid, gid int) error {
+	return vfs.ReadOnlyError("chown", path)
+}
+
+// Chtimes implements vfs.FileSystem.Chtimes.
+func (fs *FS) Chtimes(path string, atime, mtime time.Time) error {
+	return vfs.ReadOnlyError("chtimes", path)
+}
+
+// archiveFile is an open entry of an archive.
+type archiveFile struct {
+	node   *node
+	path   string
+	offset int64
+	closed bool
+
+	// Stream of a compressed file and its position
+	stream    io.ReadCloser
+	streamPos int64
+
+	mu sync.Mutex
+}
+
+func (f *archiveFile) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, vfs.ErrClosedFile
+	}
+	n, err := f.readAt(b, f.offset)
+	f.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *archiveFile) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, vfs.ErrClosedFile
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.path, Err: syscall.EINVAL}
+	}
+	return f.readAt(b, off)
+}
+
+// readAt reads up to len(b) bytes at off, returning io.EOF if fewer are
+// read (caller must hold lock).
+func (f *archiveFile) readAt(b []byte, off int64) (int, error) {
+	n := f.node
+	if n.info.IsDir {
+		return 0, &os.PathError{Op: "read", Path: f.path, Err: syscall.EISDIR}
+	}
+	if off >= n.info.Size {
+		return 0, io.EOF
+	}
+	if remaining := n.info.Size - off; int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+
+	var read int
+	var err error
+	switch {
+	case n.section != nil:
+		read, err = n.section.ReadAt(b, off)
+	case n.open != nil:
+		read, err = f.readStream(b, off)
+	default:
+		// Entries without contents, such as device nodes, read as empty
+		return 0, io.EOF
+	}
+	if err == nil && off+int64(read) == n.info.Size {
+		err = io.EOF
+	}
+	return read, err
+}
+
+// readStream reads from the decompressed stream at off, restarting it if
+// off is behind its position (caller must hold lock).
+func (f *archiveFile) readStream(b []byte, off int64) (int, error) {
+	if f.stream == nil || off < f.streamPos {
+		if f.stream != nil {
+			f.stream.Close()
+			f.stream = nil
+		}
+		stream, err := f.node.open()
+		if err != nil {
+			return 0, &os.PathError{Op: "read", Path: f.path, Err: err}
+		}
+		f.stream = stream
+		f.streamPos = 0
+	}
+
+	if skip := off - f.streamPos; skip > 0 {
+		skipped, err := io.CopyN(io.Discard, f.stream, skip)
+		f.streamPos += skipped
+		if err != nil {
+			return 0, &os.PathError{Op: "read", Path: f.path, Err: truncated(err)}
+		}
+	}
+
+	n, err := io.ReadFull(f.stream, b)
+	f.streamPos += int64(n)
+	if err != nil {
+		return n, &os.PathError{Op: "read", Path: f.path, Err: truncated(err)}
+	}
+	return n, nil
+}
+
+// truncated reports an early end of an entry's data, which is shorter
+// than its header claimed, as io.ErrUnexpectedEOF.
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (f *archiveFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, vfs.ErrClosedFile
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.node.info.Size
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.path, Err: syscall.EINVAL}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.path, Err: syscall.EINVAL}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *archiveFile) Write(b []byte) (int, error) {
+	return 0, vfs.ReadOnlyError("write", f.path)
+}
+
+func (f *archiveFile) WriteAt(b []byte, off int64) (int, error) {
+	return 0, vfs.ReadOnlyError("write", f.path)
+}
+
+func (f *archiveFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return vfs.ErrClosedFile
+	}
+	f.closed = true
+	if f.stream != nil {
+		f.stream.Close()
+		f.stream = nil
+	}
+	return nil
+}
+
+func (f *archiveFile) Stat() (vfs.FileInfo, error) {
+	return f.node.info, nil
+}
+
+func (f *archiveFile) Truncate(size int64) error {
+	return vfs.ReadOnlyError("truncate", f.path)
+}
+
+func (f *archiveFile) Sync() error {
+	return nil
+}
+
+func (f *archiveFile) Lock(how vfs.LockMode) error {
+	return vfs.ErrNotImplemented
+}
+
+func (f *archiveFile) Unlock() error {
+	return vfs.ErrNotImplemented
+}
+
+var _ vfs.FileSystem = (*FS)(nil)
@@ -0,0 +1,250 @@
+package archivefs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	vfs "webos/pkg/vfs"
+	"webos/pkg/vfs/memfs"
+	"webos/pkg/vfs/overlayfs"
+)
+
+// buildTar writes a small system image as a tar archive.
+func buildTar(t *testing.T, compress bool) []byte {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+
+	tw := tar.NewWriter(w)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644, Size: 6, Uid: 1000},
+		{Name: "etc/motd", Typeflag: tar.TypeLink, Linkname: "etc/hostname"},
+		{Name: "bin/sh", Typeflag: tar.TypeReg, Mode: 0755, Size: 10},
+		{Name: "usr/bin", Typeflag: tar.TypeSymlink, Linkname: "../bin"},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader failed: %v", err)
+		}
+		switch hdr.Name {
+		case "etc/hostname":
+			tw.Write([]byte("webos\n"))
+		case "bin/sh":
+			tw.Write([]byte("0123456789"))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar Close failed: %v", err)
+	}
+	if gz != nil {
+		gz.Close()
+	}
+	return buf.Bytes()
+}
+
+func TestTar(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		data := buildTar(t, compress)
+		fs, err := NewTar(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("NewTar(gzip=%v) failed: %v", compress, err)
+		}
+
+		entries, err := fs.ReadDir("/")
+		if err != nil {
+			t.Fatalf("ReadDir failed: %v", err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		if strings.Join(names, " ") != "bin etc usr" {
+			t.Errorf("root entries are %v, expected implied directories", names)
+		}
+
+		if data, err := fs.ReadFile("/etc/hostname"); err != nil || string(data) != "webos\n" {
+			t.Errorf("ReadFile returned %q, %v", data, err)
+		}
+		if data, err := fs.ReadFile("/etc/motd"); err != nil || string(data) != "webos\n" {
+			t.Errorf("ReadFile of hard link returned %q, %v", data, err)
+		}
+		if info, _ := fs.Stat("/etc/hostname"); info.Mode != 0644 {
+			t.Errorf("mode is %v, expected 0644", info.Mode)
+		}
+		if st, ok := vfs.StatOf(mustStat(t, fs, "/etc/motd")); !ok || st.Uid != 1000 || st.Nlink != 2 {
+			t.Errorf("hard link stat is %+v", st)
+		}
+
+		// Symlinked directories are followed
+		if data, err := fs.ReadFile("/usr/bin/sh"); err != nil || string(data) != "0123456789" {
+			t.Errorf("ReadFile through symlink returned %q, %v", data, err)
+		}
+		if target, err := fs.Readlink("/usr/bin"); err != nil || target != "../bin" {
+			t.Errorf("Readlink returned %q, %v", target, err)
+		}
+
+		// Reading backwards works whether or not the data is compressed
+		file, err := fs.Open("/bin/sh")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		buf := make([]byte, 3)
+		file.Seek(6, io.SeekStart)
+		io.ReadFull(file, buf)
+		if string(buf) != "678" {
+			t.Errorf("read at 6 returned %q", buf)
+		}
+		file.Seek(1, io.SeekStart)
+		io.ReadFull(file, buf)
+		if string(buf) != "123" {
+			t.Errorf("read at 1 returned %q", buf)
+		}
+		file.Close()
+	}
+}
+
+// countingReader counts the bytes read from an archive.
+type countingReader struct {
+	r    io.ReaderAt
+	read int64
+}
+
+func (c *countingReader) ReadAt(b []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(b, off)
+	c.read += int64(n)
+	return n, err
+}
+
+func TestTarGzipEntries(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	large := bytes.Repeat([]byte("large"), maxCachedEntry/5+1)
+	tw.WriteHeader(&tar.Header{Name: "large", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(large))})
+	tw.Write(large)
+	const count = 200
+	for i := range count {
+		data := bytes.Repeat([]byte{byte(i)}, 1000)
+		tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("small/%d", i), Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))})
+		tw.Write(data)
+	}
+	tw.Close()
+	gz.Close()
+
+	r := &countingReader{r: bytes.NewReader(buf.Bytes())}
+	fs, err := NewTar(r, int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewTar failed: %v", err)
+	}
+	indexed := r.read
+
+	// Small entries are kept while indexing rather than decompressed again
+	for i := range count {
+		data, err := fs.ReadFile(fmt.Sprintf("/small/%d", i))
+		if err != nil || len(data) != 1000 || data[999] != byte(i) {
+			t.Fatalf("ReadFile small/%d returned %d bytes, %v", i, len(data), err)
+		}
+	}
+	if r.read != indexed {
+		t.Errorf("reading small entries read %d more bytes of the archive", r.read-indexed)
+	}
+
+	// Large entries are still streamed from the archive
+	if data, err := fs.ReadFile("/large"); err != nil || !bytes.Equal(data, large) {
+		t.Errorf("ReadFile large returned %d bytes, %v", len(data), err)
+	}
+	if r.read == indexed {
+		t.Error("large entry was kept in memory")
+	}
+}
+
+func mustStat(t *testing.T, fs *FS, path string) vfs.FileInfo {
+	info, err := fs.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat %s failed: %v", path, err)
+	}
+	return info
+}
+
+func TestZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "docs/readme.txt", Method: zip.Deflate})
+	w.Write([]byte("compressed"))
+	w, _ = zw.CreateHeader(&zip.FileHeader{Name: "docs/raw.txt", Method: zip.Store})
+	w.Write([]byte("stored"))
+	zw.Close()
+
+	path := filepath.Join(t.TempDir(), "docs.zip")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	fs, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer fs.Close()
+
+	if data, err := fs.ReadFile("/docs/readme.txt"); err != nil || string(data) != "compressed" {
+		t.Errorf("ReadFile of deflated entry returned %q, %v", data, err)
+	}
+	if data, err := fs.ReadFile("/docs/raw.txt"); err != nil || string(data) != "stored" {
+		t.Errorf("ReadFile of stored entry returned %q, %v", data, err)
+	}
+	if info, err := fs.Stat("/docs"); err != nil || !info.IsDir {
+		t.Errorf("Stat of implied directory returned %+v, %v", info, err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	data := buildTar(t, false)
+	fs, err := NewTar(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("NewTar failed: %v", err)
+	}
+
+	if err := fs.WriteFile("/etc/hostname", nil, 0644); !errors.Is(err, vfs.ErrReadOnlyFS) {
+		t.Errorf("WriteFile returned %v, expected ErrReadOnlyFS", err)
+	}
+	if _, err := fs.OpenFile("/etc/hostname", vfs.O_RDWR, 0); !errors.Is(err, vfs.ErrReadOnlyFS) {
+		t.Errorf("OpenFile for writing returned %v, expected ErrReadOnlyFS", err)
+	}
+	if _, err := fs.Stat("/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat of missing path returned %v, expected ErrNotExist", err)
+	}
+}
+
+func TestOverlayLower(t *testing.T) {
+	data := buildTar(t, true)
+	base, err := NewTar(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("NewTar failed: %v", err)
+	}
+	root := overlayfs.New(memfs.New(), base)
+
+	if err := root.WriteFile("/etc/hostname", []byte("mine\n"), 0644); err != nil {
+		t.Fatalf("WriteFile through overlay failed: %v", err)
+	}
+	if data, _ := root.ReadFile("/etc/hostname"); string(data) != "mine\n" {
+		t.Errorf("overlay reads %q, expected the upper layer", data)
+	}
+	if data, _ := base.ReadFile("/etc/hostname"); string(data) != "webos\n" {
+		t.Errorf("archive reads %q after overlay write", data)
+	}
+	if data, _ := root.ReadFile("/bin/sh"); string(data) != "0123456789" {
+		t.Errorf("overlay reads %q from the lower layer", data)
+	}
+}
@@ -0,0 +1,135 @@
+package archivefs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+)
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Entries that cannot be read in place are kept in memory while indexing
+// when they are at most maxCachedEntry bytes, up to maxCachedTotal bytes
+// per archive, so opening them does not decompress the archive again.
+const (
+	maxCachedEntry = 256 << 10
+	maxCachedTotal = 32 << 20
+)
+
+// NewTar indexes the tar archive of size bytes in r, which may be
+// compressed with gzip. Small entries of a compressed archive are kept
+// decompressed in memory; larger ones are decompressed from the start of
+// the archive each time they are opened.
+func NewTar(r io.ReaderAt, size int64) (*FS, error) {
+	magic := make([]byte, len(gzipMagic))
+	n, _ := r.ReadAt(magic, 0)
+	compressed := n == len(magic) && bytes.Equal(magic, gzipMagic)
+
+	// open starts the archive from its first header
+	open := func() (io.ReadCloser, error) {
+		sr := io.NewSectionReader(r, 0, size)
+		if compressed {
+			return gzip.NewReader(sr)
+		}
+		return io.NopCloser(sr), nil
+	}
+
+	// Uncompressed data is located by the position of the section reader,
+	// which tar.Reader reads exactly up to each entry's data
+	var sr *io.SectionReader
+	var stream io.ReadCloser
+	if compressed {
+		var err error
+		if stream, err = open(); err != nil {
+			return nil, err
+		}
+		defer stream.Close()
+	} else {
+		sr = io.NewSectionReader(r, 0, size)
+		stream = io.NopCloser(sr)
+	}
+
+	fs := newIndex()
+	var cached int64
+	tr := tar.NewReader(stream)
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if hdr.Typeflag == tar.TypeLink {
+			fs.link(hdr.Name, hdr.Linkname)
+			continue
+		}
+
+		info := hdr.FileInfo()
+		n := fs.newNode(info.Name(), info.Mode(), hdr.ModTime, hdr.Uid, hdr.Gid)
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			n.target = hdr.Linkname
+			n.info.Size = int64(len(hdr.Linkname))
+		case tar.TypeReg:
+			n.info.Size = hdr.Size
+			switch {
+			case sr != nil && !sparse(hdr):
+				offset, _ := sr.Seek(0, io.SeekCurrent)
+				n.section = io.NewSectionReader(r, offset, hdr.Size)
+			case hdr.Size <= maxCachedEntry && cached+hdr.Size <= maxCachedTotal:
+				data := make([]byte, hdr.Size)
+				if _, err := io.ReadFull(tr, data); err != nil {
+					return nil, truncated(err)
+				}
+				cached += hdr.Size
+				n.section = io.NewSectionReader(bytes.NewReader(data), 0, hdr.Size)
+			default:
+				n.open = tarEntry(open, index)
+			}
+		}
+		fs.insert(hdr.Name, n)
+	}
+	return fs, nil
+}
+
+// sparse reports whether an entry's data is stored as a sparse map, which
+// cannot be read in place.
+func sparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// tarEntry returns a function streaming the data of the entry at index in
+// the archive started by open.
+func tarEntry(open func() (io.ReadCloser, error), index int) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		stream, err := open()
+		if err != nil {
+			return nil, err
+		}
+
+		tr := tar.NewReader(stream)
+		for i := 0; i <= index; i++ {
+			if _, err := tr.Next(); err != nil {
+				stream.Close()
+				return nil, truncated(err)
+			}
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{tr, stream}, nil
+	}
+}
@@ -0,0 +1,53 @@
+package archivefs
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+)
+
+// maxZipSymlink bounds the size of a symlink target read from a zip entry.
+const maxZipSymlink = 4096
+
+// NewZip indexes the zip archive of size bytes in r.
+func NewZip(r io.ReaderAt, size int64) (*FS, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := newIndex()
+	for _, f := range zr.File {
+		mode := f.Mode()
+		n := fs.newNode(f.FileInfo().Name(), mode, f.Modified, 0, 0)
+
+		switch {
+		case mode&os.ModeSymlink != 0:
+			// The target is stored as the entry's contents
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			target, err := io.ReadAll(io.LimitReader(rc, maxZipSymlink))
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			n.target = string(target)
+			n.info.Size = int64(len(target))
+		case mode.IsRegular():
+			n.info.Size = int64(f.UncompressedSize64)
+			if f.Method == zip.Store {
+				offset, err := f.DataOffset()
+				if err != nil {
+					return nil, err
+				}
+				n.section = io.NewSectionReader(r, offset, n.info.Size)
+			} else {
+				n.open = f.Open
+			}
+		}
+		fs.insert(f.Name, n)
+	}
+	return fs, nil
+}
@@ -0,0 +1,700 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Access bits checked against a file's mode.
+const (
+	accessRead    os.FileMode = 4
+	accessWrite   os.FileMode = 2
+	accessExecute os.FileMode = 1
+)
+
+// DefaultUmask is the umask a CredentialFS starts with.
+const DefaultUmask os.FileMode = 022
+
+// Owner is implemented by FileInfo.Sys values that record file ownership.
+type Owner interface {
+	Owner() (uid, gid int)
+}
+
+// FileOwner returns the owner of a file. It understands Sys values
+// implementing Owner and host stat structures; files without ownership
+// information are reported as owned by root.
+func FileOwner(info FileInfo) (uid, gid int) {
+	if owner, ok := info.Sys.(Owner); ok {
+		return owner.Owner()
+	}
+	if st, ok := sysStat(info.Sys); ok {
+		return st.Uid, st.Gid
+	}
+	return 0, 0
+}
+
+// CredentialFS enforces POSIX permissions on behalf of one user.
+//
+// Every operation is checked against the user's uid and groups before it
+// reaches the underlying filesystem: directories on the path need search
+// (x) permission, reading and writing need r and w on the file, and
+// creating, removing or renaming entries needs w and x on the directory.
+// In a sticky directory only the owner of an entry or of the directory may
+// remove or rename it. Only the owner may change a file's mode, ACLs or
+// times, and only root may give a file away. uid 0 bypasses all checks.
+// Access ACLs stored on the underlying filesystem are honoured; see ACL.
+//
+// New files and directories are created with the umask applied, or with
+// the directory's default ACL if it has one, and are then given to the
+// user and their primary group, or the directory's group if it is setgid.
+// Symlinks always keep the ownership the backend gives them.
+//
+// Ownership is assigned with the backend's Chown, and a failure is
+// ignored so that creation still succeeds. A backend that cannot change
+// ownership, such as a DiskFS whose server does not run as root, therefore
+// leaves every new entry owned by the server's uid, and the permission
+// checks treat it as another user's file. Use such a backend with
+// CredentialFS only when that is acceptable, or use a backend that
+// records ownership itself, such as MemFS.
+type CredentialFS struct {
+	fs    FileSystem
+	uid   int
+	gids  []int
+	umask os.FileMode
+	mu    sync.RWMutex
+}
+
+// WithCredentials wraps fs so that every operation runs as uid with the
+// given groups. The first group is the primary group.
+func WithCredentials(fs FileSystem, uid int, gids []int) *CredentialFS {
+	return &CredentialFS{
+		fs:    fs,
+		uid:   uid,
+		gids:  slices.Clone(gids),
+		umask: DefaultUmask,
+	}
+}
+
+// UID returns the user ID operations run as.
+func (c *CredentialFS) UID() int {
+	return c.uid
+}
+
+// GIDs returns the user's groups, primary group first.
+func (c *CredentialFS) GIDs() []int {
+	return slices.Clone(c.gids)
+}
+
+// Umask sets the umask applied to new files and returns the previous one.
+func (c *CredentialFS) Umask(mask os.FileMode) os.FileMode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old := c.umask
+	c.umask = mask & os.ModePerm
+	return old
+}
+
+// createMode returns the mode to create path with, and the default ACL of
+// its directory if there is one. The umask is not applied when there is.
+func (c *CredentialFS) createMode(path string, perm os.FileMode) (os.FileMode, ACL) {
+	if def, err := GetDefaultACL(c.fs, Dir(Clean(path))); err == nil && def != nil {
+		return perm &^ (os.ModePerm &^ def.Mode()), def
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return perm &^ c.umask, nil
+}
+
+// inheritACL gives a new entry the ACLs it inherits from its directory's
+// default ACL def.
+func (c *CredentialFS) inheritACL(path string, mode os.FileMode, def ACL, isDir bool) {
+	if def == nil {
+		return
+	}
+
+	// Inheritance is best effort, like ownership: the entry has already
+	// been created with no more permissions than the ACL grants
+	SetACL(c.fs, path, def.inherit(mode))
+	if isDir {
+		SetDefaultACL(c.fs, path, def)
+	}
+}
+
+// inGroup reports whether the user belongs to gid.
+func (c *CredentialFS) inGroup(gid int) bool {
+	return slices.Contains(c.gids, gid)
+}
+
+// allowed reports whether the user has the want access bits on path,
+// whose info is already known. Unreadable ACLs deny access.
+func (c *CredentialFS) allowed(path string, info FileInfo, want os.FileMode) bool {
+	if c.uid == 0 {
+		return true
+	}
+
+	acl, err := accessACL(c.fs, path, info)
+	if err != nil {
+		return false
+	}
+	uid, gid := FileOwner(info)
+	return acl.allows(c.uid, c.gids, uid, gid, want)
+}
+
+// owns reports whether the user owns info or is root.
+func (c *CredentialFS) owns(info FileInfo) bool {
+	if c.uid == 0 {
+		return true
+	}
+	uid, _ := FileOwner(info)
+	return uid == c.uid
+}
+
+// denied builds the error returned when a check fails.
+func denied(op, path string) error {
+	return &os.PathError{Op: op, Path: path, Err: ErrPermissionDenied}
+}
+
+// maxCredentialSymlinks bounds the symlinks walk follows.
+const maxCredentialSymlinks = 40
+
+// search checks search permission on every directory traversed to reach
+// path, including those reached through symlinks in its parents.
+func (c *CredentialFS) search(op, path string) error {
+	return c.walk(op, path, false)
+}
+
+// searchFollow is search for operations that follow a final symlink, and
+// so also traverse the directories above its target.
+func (c *CredentialFS) searchFollow(op, path string) error {
+	return c.walk(op, path, true)
+}
+
+// walk resolves path one component at a time as the backend does,
+// checking search permission on each directory before looking up the next
+// component in it. Symlinks are replaced by their targets, so a link
+// cannot lead the backend through a directory the user may not search.
+// The final component is only resolved when follow is set, and need not
+// exist.
+func (c *CredentialFS) walk(op, path string, follow bool) error {
+	if err := ValidatePath(path); err != nil {
+		return err
+	}
+
+	pending := splitComponents(Clean(path))
+	dir := "/"
+	for hops := 0; len(pending) > 0; {
+		if err := c.searchDir(op, dir); err != nil {
+			return err
+		}
+		next := Join(dir, pending[0])
+		pending = pending[1:]
+		if len(pending) == 0 && !follow {
+			return nil
+		}
+
+		info, err := c.fs.Lstat(next)
+		if err != nil {
+			if len(pending) == 0 {
+				return nil
+			}
+			return err
+		}
+		if info.Mode&os.ModeSymlink == 0 {
+			dir = next
+			continue
+		}
+
+		if hops++; hops > maxCredentialSymlinks {
+			return &os.PathError{Op: op, Path: path, Err: ErrSymlinkLoop}
+		}
+		target, err := c.fs.Readlink(next)
+		if err != nil {
+			return err
+		}
+		if !IsAbs(target) {
+			target = Join(dir, target)
+		}
+		pending = append(splitComponents(Clean(target)), pending...)
+		dir = "/"
+	}
+	return nil
+}
+
+// searchDir checks search permission on a single directory.
+func (c *CredentialFS) searchDir(op, dir string) error {
+	info, err := c.fs.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if info.IsDir && !c.allowed(dir, info, accessExecute) {
+		return denied(op, dir)
+	}
+	return nil
+}
+
+// splitComponents splits a clean absolute path into its components.
+func splitComponents(path string) []string {
+	var parts []string
+	for path != "/" {
+		parts = append(parts, Base(path))
+		path = Dir(path)
+	}
+	slices.Reverse(parts)
+	return parts
+}
+
+// checkParent checks that the user may add or remove entries in the
+// directory containing path, returning that directory's info.
+func (c *CredentialFS) checkParent(op, path string) (FileInfo, error) {
+	if err := c.search(op, path); err != nil {
+		return FileInfo{}, err
+	}
+
+	dir := Dir(Clean(path))
+	info, err := c.fs.Stat(dir)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if !c.allowed(dir, info, accessWrite|accessExecute) {
+		return FileInfo{}, denied(op, dir)
+	}
+	return info, nil
+}
+
+// checkSticky enforces the restricted deletion flag of a directory on one
+// of its entries.
+func (c *CredentialFS) checkSticky(op, path string, dir, entry FileInfo) error {
+	if dir.Mode&os.ModeSticky == 0 || c.owns(entry) || c.owns(dir) {
+		return nil
+	}
+	return denied(op, path)
+}
+
+// assignOwner gives a newly created entry to the user.
+func (c *CredentialFS) assignOwner(path string, dir FileInfo) {
+	_, gid := FileOwner(dir)
+	if len(c.gids) > 0 && dir.Mode&os.ModeSetgid == 0 {
+		gid = c.gids[0]
+	}
+
+	// Ownership is best effort; see the CredentialFS documentation
+	c.fs.Chown(path, c.uid, gid)
+}
+
+// Open implements FileSystem.Open.
+func (c *CredentialFS) Open(path string) (File, error) {
+	return c.OpenFile(path, O_RDONLY, 0)
+}
+
+// OpenFile implements FileSystem.OpenFile.
+func (c *CredentialFS) OpenFile(path string, flags int, perm os.FileMode) (File, error) {
+	if err := c.searchFollow("open", path); err != nil {
+		return nil, err
+	}
+
+	info, err := c.fs.Stat(path)
+	if err != nil && flags&O_CREATE != 0 && errors.Is(err, os.ErrNotExist) {
+		var file File
+		if file, err = c.create(path, flags, perm); err == nil || flags&O_EXCL != 0 || !errors.Is(err, os.ErrExist) {
+			return file, err
+		}
+
+		// Another caller created it since the Stat; open it as an
+		// existing file instead
+		info, err = c.fs.Stat(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var want os.FileMode
+	switch flags & (O_RDONLY | O_WRONLY | O_RDWR) {
+	case O_RDONLY:
+		want = accessRead
+	case O_WRONLY:
+		want = accessWrite
+	default:
+		want = accessRead | accessWrite
+	}
+	if flags&O_TRUNC != 0 {
+		want |= accessWrite
+	}
+	if !c.allowed(path, info, want) {
+		return nil, denied("open", path)
+	}
+
+	return c.fs.OpenFile(path, flags, perm)
+}
+
+// create creates a file for OpenFile. It passes O_EXCL to the backend so
+// that a file created by someone else since the permission checks is
+// never opened, and possibly truncated, with only the parent's checks.
+func (c *CredentialFS) create(path string, flags int, perm os.FileMode) (File, error) {
+	dir, err := c.checkParent("open", path)
+	if err != nil {
+		return nil, err
+	}
+	mode, def := c.createMode(path, perm)
+	file, err := c.fs.OpenFile(path, flags|O_EXCL, mode)
+	if err != nil {
+		return nil, err
+	}
+	c.assignOwner(path, dir)
+	c.inheritACL(path, mode, def, false)
+	return file, nil
+}
+
+// Stat implements FileSystem.Stat.
+func (c *CredentialFS) Stat(path string) (FileInfo, error) {
+	if err := c.searchFollow("stat", path); err != nil {
+		return FileInfo{}, err
+	}
+	return c.fs.Stat(path)
+}
+
+// Lstat implements FileSystem.Lstat.
+func (c *CredentialFS) Lstat(path string) (FileInfo, error) {
+	if err := c.search("lstat", path); err != nil {
+		return FileInfo{}, err
+	}
+	return c.fs.Lstat(path)
+}
+
+// Mkdir implements FileSystem.Mkdir.
+func (c *CredentialFS) Mkdir(path string, perm os.FileMode) error {
+	dir, err := c.checkParent("mkdir", path)
+	if err != nil {
+		return err
+	}
+	mode, def := c.createMode(path, perm)
+	if err := c.fs.Mkdir(path, mode); err != nil {
+		return err
+	}
+	c.assignOwner(path, dir)
+	c.inheritACL(path, mode, def, true)
+	return nil
+}
+
+// MkdirAll implements FileSystem.MkdirAll. Each missing directory is
+// created with the same checks as Mkdir.
+func (c *CredentialFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := ValidatePath(path); err != nil {
+		return err
+	}
+
+	current := "/"
+	for _, part := range splitComponents(Clean(path)) {
+		current = Join(current, part)
+
+		info, err := c.Stat(current)
+		if err == nil {
+			if !info.IsDir {
+				return &os.PathError{Op: "mkdir", Path: current, Err: os.ErrExist}
+			}
+			continue
+		}
+		if err := c.Mkdir(current, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove implements FileSystem.Remove.
+func (c *CredentialFS) Remove(path string) error {
+	dir, err := c.checkParent("remove", path)
+	if err != nil {
+		return err
+	}
+
+	info, err := c.fs.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if err := c.checkSticky("remove", path, dir, info); err != nil {
+		return err
+	}
+
+	return c.fs.Remove(path)
+}
+
+// RemoveAll implements FileSystem.RemoveAll. Entries are removed one at a
+// time with the same checks as Remove, stopping at the first denial.
+func (c *CredentialFS) RemoveAll(path string) error {
+	if err := c.search("removeall", path); err != nil {
+		return err
+	}
+
+	info, err := c.fs.Lstat(path)
+	if err != nil {
+		return c.fs.RemoveAll(path)
+	}
+
+	if info.IsDir {
+		if !c.allowed(path, info, accessRead|accessWrite|accessExecute) {
+			return denied("removeall", path)
+		}
+		entries, err := c.fs.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := c.RemoveAll(Join(path, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	if Clean(path) == "/" {
+		return nil
+	}
+	return c.Remove(path)
+}
+
+// Rename implements FileSystem.Rename.
+func (c *CredentialFS) Rename(oldpath, newpath string) error {
+	oldDir, err := c.checkParent("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	newDir, err := c.checkParent("rename", newpath)
+	if err != nil {
+		return err
+	}
+
+	info, err := c.fs.Lstat(oldpath)
+	if err != nil {
+		return err
+	}
+	if err := c.checkSticky("rename", oldpath, oldDir, info); err != nil {
+		return err
+	}
+	if target, err := c.fs.Lstat(newpath); err == nil {
+		if err := c.checkSticky("rename", newpath, newDir, target); err != nil {
+			return err
+		}
+	}
+
+	return c.fs.Rename(oldpath, newpath)
+}
+
+// ReadDir implements FileSystem.ReadDir.
+func (c *CredentialFS) ReadDir(path string) ([]DirEntry, error) {
+	if err := c.searchFollow("readdir", path); err != nil {
+		return nil, err
+	}
+
+	info, err := c.fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !c.allowed(path, info, accessRead) {
+		return nil, denied("readdir", path)
+	}
+
+	return c.fs.ReadDir(path)
+}
+
+// ReadFile implements FileSystem.ReadFile.
+func (c *CredentialFS) ReadFile(path string) ([]byte, error) {
+	if err := c.searchFollow("read", path); err != nil {
+		return nil, err
+	}
+
+	info, err := c.fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !c.allowed(path, info, accessRead) {
+		return nil, denied("read", path)
+	}
+
+	return c.fs.ReadFile(path)
+}
+
+// WriteFile implements FileSystem.WriteFile.
+func (c *CredentialFS) WriteFile(path string, data []byte, perm os.FileMode) error {
+	if err := c.searchFollow("write", path); err != nil {
+		return err
+	}
+
+	info, err := c.fs.Stat(path)
+	if err == nil {
+		if !c.allowed(path, info, accessWrite) {
+			return denied("write", path)
+		}
+		return c.fs.WriteFile(path, data, perm)
+	}
+
+	dir, err := c.checkParent("write", path)
+	if err != nil {
+		return err
+	}
+	mode, def := c.createMode(path, perm)
+	if err := c.fs.WriteFile(path, data, mode); err != nil {
+		return err
+	}
+	c.assignOwner(path, dir)
+	c.inheritACL(path, mode, def, false)
+	return nil
+}
+
+// Create implements FileSystem.Create.
+func (c *CredentialFS) Create(path string) (File, error) {
+	return c.OpenFile(path, O_RDWR|O_CREATE|O_TRUNC, 0666)
+}
+
+// Symlink implements FileSystem.Symlink.
+func (c *CredentialFS) Symlink(target, newpath string) error {
+	if _, err := c.checkParent("symlink", newpath); err != nil {
+		return err
+	}
+	return c.fs.Symlink(target, newpath)
+}
+
+// Readlink implements FileSystem.Readlink.
+func (c *CredentialFS) Readlink(path string) (string, error) {
+	if err := c.search("readlink", path); err != nil {
+		return "", err
+	}
+	return c.fs.Readlink(path)
+}
+
+// Link implements FileSystem.Link. The new entry needs the same directory
+// permissions as creating a file.
+func (c *CredentialFS) Link(oldpath, newpath string) error {
+	if err := c.search("link", oldpath); err != nil {
+		return err
+	}
+	if _, err := c.checkParent("link", newpath); err != nil {
+		return err
+	}
+	return c.fs.Link(oldpath, newpath)
+}
+
+// Chmod implements FileSystem.Chmod. The setgid bit is cleared when a user
+// who is not in the file's group sets it.
+func (c *CredentialFS) Chmod(path string, mode os.FileMode) error {
+	if err := c.searchFollow("chmod", path); err != nil {
+		return err
+	}
+
+	info, err := c.fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !c.owns(info) {
+		return denied("chmod", path)
+	}
+
+	if _, gid := FileOwner(info); c.uid != 0 && !c.inGroup(gid) {
+		mode &^= os.ModeSetgid
+	}
+	return c.fs.Chmod(path, mode)
+}
+
+// Chown implements FileSystem.Chown. A uid or gid of -1 leaves that value
+// unchanged. Only root may change the owner; the owner may change the
+// group to one of their own groups.
+func (c *CredentialFS) Chown(path string, uid, gid int) error {
+	if err := c.searchFollow("chown", path); err != nil {
+		return err
+	}
+
+	info, err := c.fs.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	owner, group := FileOwner(info)
+	if uid == -1 {
+		uid = owner
+	}
+	if gid == -1 {
+		gid = group
+	}
+
+	if c.uid != 0 {
+		if owner != c.uid || uid != owner {
+			return denied("chown", path)
+		}
+		if gid != group && !c.inGroup(gid) {
+			return denied("chown", path)
+		}
+	}
+
+	return c.fs.Chown(path, uid, gid)
+}
+
+// Chtimes implements FileSystem.Chtimes.
+func (c *CredentialFS) Chtimes(path string, atime, mtime time.Time) error {
+	if err := c.searchFollow("chtimes", path); err != nil {
+		return err
+	}
+
+	info, err := c.fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !c.owns(info) {
+		return denied("chtimes", path)
+	}
+
+	return c.fs.Chtimes(path, atime, mtime)
+}
+
+// GetACL returns the access ACL of path.
+func (c *CredentialFS) GetACL(path string) (ACL, error) {
+	if err := c.searchFollow("getfacl", path); err != nil {
+		return nil, err
+	}
+	return GetACL(c.fs, path)
+}
+
+// SetACL replaces the access ACL of path. Only the owner may change it.
+func (c *CredentialFS) SetACL(path string, acl ACL) error {
+	if err := c.checkOwner("setfacl", path); err != nil {
+		return err
+	}
+	return SetACL(c.fs, path, acl)
+}
+
+// GetDefaultACL returns the default ACL of the directory path.
+func (c *CredentialFS) GetDefaultACL(path string) (ACL, error) {
+	if err := c.searchFollow("getfacl", path); err != nil {
+		return nil, err
+	}
+	return GetDefaultACL(c.fs, path)
+}
+
+// SetDefaultACL sets or, given nil, removes the default ACL of the
+// directory path. Only the owner may change it.
+func (c *CredentialFS) SetDefaultACL(path string, acl ACL) error {
+	if err := c.checkOwner("setfacl", path); err != nil {
+		return err
+	}
+	return SetDefaultACL(c.fs, path, acl)
+}
+
+// checkOwner checks that the user may reach path and owns it.
+func (c *CredentialFS) checkOwner(op, path string) error {
+	if err := c.searchFollow(op, path); err != nil {
+		return err
+	}
+
+	info, err := c.fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !c.owns(info) {
+		return denied(op, path)
+	}
+	return nil
+}
+
+var _ FileSystem = (*CredentialFS)(nil)
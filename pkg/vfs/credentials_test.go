@@ -0,0 +1,180 @@
+package vfs_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	vfs "webos/pkg/vfs"
+	"webos/pkg/vfs/diskfs"
+	"webos/pkg/vfs/memfs"
+)
+
+// newHome returns a MemFS with a world-writable sticky /tmp and a home
+// directory owned by uid 1000, and CredentialFS views for root, uid 1000
+// and uid 2000.
+func newHome(t *testing.T) (*memfs.FS, *vfs.CredentialFS, *vfs.CredentialFS, *vfs.CredentialFS) {
+	t.Helper()
+	fs := memfs.New()
+	fs.Mkdir("/tmp", 0777|os.ModeSticky)
+	fs.Chmod("/tmp", 0777|os.ModeSticky)
+	fs.Mkdir("/home", 0755)
+	fs.Chown("/home", 1000, 100)
+	return fs, vfs.WithCredentials(fs, 0, []int{0}),
+		vfs.WithCredentials(fs, 1000, []int{100}),
+		vfs.WithCredentials(fs, 2000, []int{200})
+}
+
+func TestCredentialsCreate(t *testing.T) {
+	fs, _, alice, bob := newHome(t)
+
+	if err := alice.WriteFile("/home/notes", []byte("mine"), 0666); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	info, _ := fs.Stat("/home/notes")
+	if uid, gid := vfs.FileOwner(info); uid != 1000 || gid != 100 {
+		t.Errorf("new file owned by %d:%d, expected 1000:100", uid, gid)
+	}
+	if info.Mode.Perm() != 0644 {
+		t.Errorf("new file mode %v, expected the umask applied", info.Mode.Perm())
+	}
+
+	if err := bob.WriteFile("/home/intruder", nil, 0644); !errors.Is(err, vfs.ErrPermissionDenied) {
+		t.Errorf("create in another user's directory returned %v", err)
+	}
+	if err := bob.WriteFile("/home/notes", []byte("overwritten"), 0644); !errors.Is(err, vfs.ErrPermissionDenied) {
+		t.Errorf("write to a read-only file returned %v", err)
+	}
+	if data, err := bob.ReadFile("/home/notes"); err != nil || string(data) != "mine" {
+		t.Errorf("read of a world-readable file returned %q, %v", data, err)
+	}
+}
+
+// racingFS creates a file as another user between CredentialFS's Stat and
+// its exclusive create, as a concurrent creator would.
+type racingFS struct {
+	vfs.FileSystem
+	path string
+}
+
+func (r *racingFS) OpenFile(path string, flags int, perm os.FileMode) (vfs.File, error) {
+	if path == r.path && flags&vfs.O_EXCL != 0 {
+		r.FileSystem.WriteFile(path, []byte("secret"), 0600)
+		r.FileSystem.Chown(path, 2000, 200)
+		r.path = ""
+	}
+	return r.FileSystem.OpenFile(path, flags, perm)
+}
+
+func TestCredentialsCreateRace(t *testing.T) {
+	fs := memfs.New()
+	fs.Mkdir("/tmp", 0777)
+	racing := &racingFS{FileSystem: fs, path: "/tmp/file"}
+	alice := vfs.WithCredentials(racing, 1000, []int{100})
+
+	// The file appeared after the Stat, so the open must be checked
+	// against it rather than the directory
+	_, err := alice.OpenFile("/tmp/file", vfs.O_CREATE|vfs.O_RDWR|vfs.O_TRUNC, 0644)
+	if !errors.Is(err, vfs.ErrPermissionDenied) {
+		t.Errorf("open of a file created concurrently returned %v", err)
+	}
+	if data, _ := fs.ReadFile("/tmp/file"); string(data) != "secret" {
+		t.Errorf("concurrently created file now holds %q", data)
+	}
+
+	// With O_EXCL the caller asked to create, so the conflict is reported
+	racing.path = "/tmp/other"
+	_, err = alice.OpenFile("/tmp/other", vfs.O_CREATE|vfs.O_EXCL|vfs.O_WRONLY, 0644)
+	if !errors.Is(err, os.ErrExist) {
+		t.Errorf("exclusive create returned %v", err)
+	}
+}
+
+func TestCredentialsSticky(t *testing.T) {
+	_, _, alice, bob := newHome(t)
+
+	alice.WriteFile("/tmp/alice", nil, 0666)
+	alice.Chmod("/tmp/alice", 0666)
+	if err := bob.Remove("/tmp/alice"); !errors.Is(err, vfs.ErrPermissionDenied) {
+		t.Errorf("removing another user's file from a sticky directory returned %v", err)
+	}
+	if err := bob.Rename("/tmp/alice", "/tmp/stolen"); !errors.Is(err, vfs.ErrPermissionDenied) {
+		t.Errorf("renaming another user's file in a sticky directory returned %v", err)
+	}
+	if err := alice.Remove("/tmp/alice"); err != nil {
+		t.Errorf("owner could not remove their file: %v", err)
+	}
+}
+
+func TestCredentialsOwnership(t *testing.T) {
+	fs, root, alice, bob := newHome(t)
+	alice.WriteFile("/home/file", nil, 0644)
+
+	if err := bob.Chmod("/home/file", 0777); !errors.Is(err, vfs.ErrPermissionDenied) {
+		t.Errorf("chmod by a non-owner returned %v", err)
+	}
+	if err := alice.Chown("/home/file", 2000, -1); !errors.Is(err, vfs.ErrPermissionDenied) {
+		t.Errorf("giving a file away returned %v", err)
+	}
+	if err := alice.Chown("/home/file", -1, 200); !errors.Is(err, vfs.ErrPermissionDenied) {
+		t.Errorf("chgrp to a group the owner is not in returned %v", err)
+	}
+	if err := root.Chown("/home/file", 2000, 200); err != nil {
+		t.Errorf("root chown failed: %v", err)
+	}
+	info, _ := fs.Stat("/home/file")
+	if uid, gid := vfs.FileOwner(info); uid != 2000 || gid != 200 {
+		t.Errorf("file owned by %d:%d after chown", uid, gid)
+	}
+
+	// A setgid directory passes its group to new entries
+	root.Mkdir("/shared", 0777)
+	root.Chown("/shared", 0, 300)
+	root.Chmod("/shared", 0777|os.ModeSetgid)
+	alice.WriteFile("/shared/file", nil, 0644)
+	info, _ = fs.Stat("/shared/file")
+	if _, gid := vfs.FileOwner(info); gid != 300 {
+		t.Errorf("file in setgid directory has group %d, expected 300", gid)
+	}
+}
+
+func TestCredentialsSymlinkSearch(t *testing.T) {
+	// DiskFS follows links in the middle of paths as well as at the end
+	fs := diskfs.New(t.TempDir())
+	fs.MkdirAll("/secret/dir", 0755)
+	fs.Chmod("/secret", 0700)
+	fs.WriteFile("/secret/dir/file", []byte("secret"), 0644)
+	fs.Mkdir("/tmp", 0777)
+	fs.Chmod("/tmp", 0777)
+	fs.Symlink("../secret/dir", "/tmp/link")
+	fs.Symlink("../secret/dir/file", "/tmp/file")
+	other := vfs.WithCredentials(fs, os.Getuid()+1000, []int{os.Getgid() + 1000})
+
+	// Links cannot lead through a directory the user may not search
+	for _, path := range []string{"/secret/dir/file", "/tmp/link/file", "/tmp/file"} {
+		if _, err := other.ReadFile(path); !errors.Is(err, vfs.ErrPermissionDenied) {
+			t.Errorf("ReadFile(%s) returned %v", path, err)
+		}
+		if _, err := other.Stat(path); !errors.Is(err, vfs.ErrPermissionDenied) {
+			t.Errorf("Stat(%s) returned %v", path, err)
+		}
+	}
+	if _, err := other.OpenFile("/tmp/link/new", vfs.O_CREATE|vfs.O_WRONLY, 0644); !errors.Is(err, vfs.ErrPermissionDenied) {
+		t.Errorf("OpenFile(O_CREATE) through a link returned %v", err)
+	}
+
+	// The links themselves are still reachable
+	if _, err := other.Lstat("/tmp/file"); err != nil {
+		t.Errorf("Lstat of the link failed: %v", err)
+	}
+	if target, err := other.Readlink("/tmp/link"); err != nil || target != "../secret/dir" {
+		t.Errorf("Readlink returned %q, %v", target, err)
+	}
+
+	// Cycles fail instead of looping
+	fs.Symlink("b", "/tmp/a")
+	fs.Symlink("a", "/tmp/b")
+	if _, err := other.Stat("/tmp/a/file"); !errors.Is(err, vfs.ErrSymlinkLoop) {
+		t.Errorf("Stat through a symlink cycle returned %v", err)
+	}
+}
@@ -0,0 +1,488 @@
+// Package devfs provides a filesystem of character devices, in the manner
+// of /dev.
+//
+// The root holds null, zero, random and urandom, and a pts directory with
+// an entry per registered pseudo-terminal. Reading pts/N reads the input
+// typed at terminal N and writing it writes output to the terminal, as
+// through the slave side of a pty.PTY.
+//
+// Devices can be opened with any flags, including O_CREATE and O_TRUNC, so
+// redirections like "> /dev/null" work. The set of entries cannot be
+// changed through the FileSystem interface.
+package devfs
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"webos/pkg/pty"
+	vfs "webos/pkg/vfs"
+)
+
+// ErrNoPTY is returned when a pseudo-terminal number is not registered.
+var ErrNoPTY = errors.New("devfs: no such pseudo-terminal")
+
+// Device permissions, as on Linux.
+const (
+	devicePerm os.FileMode = 0666
+	ptyPerm    os.FileMode = 0620
+)
+
+// FS is a device filesystem.
+type FS struct {
+	boot time.Time
+	ptys map[int]*pty.PTY
+	mu   sync.RWMutex
+}
+
+// New creates a device filesystem with no pseudo-terminals.
+func New() *FS {
+	return &FS{
+		boot: time.Now(),
+		ptys: make(map[int]*pty.PTY),
+	}
+}
+
+// NewPTY creates a pseudo-terminal and registers it, returning its number.
+func (fs *FS) NewPTY(cols, rows int) (int, *pty.PTY, error) {
+	p, err := pty.NewPTY(cols, rows)
+	if err != nil {
+		return 0, nil, err
+	}
+	return fs.AddPTY(p), p, nil
+}
+
+// AddPTY registers a pseudo-terminal as pts/N, returning N. The lowest
+// free number is used.
+func (fs *FS) AddPTY(p *pty.PTY) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n := 0
+	for fs.ptys[n] != nil {
+		n++
+	}
+	fs.ptys[n] = p
+	return n
+}
+
+// RemovePTY unregisters pts/n. The pseudo-terminal is not closed.
+func (fs *FS) RemovePTY(n int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.ptys[n] == nil {
+		return ErrNoPTY
+	}
+	delete(fs.ptys, n)
+	return nil
+}
+
+// PTY returns the pseudo-terminal registered as pts/n.
+func (fs *FS) PTY(n int) (*pty.PTY, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	p := fs.ptys[n]
+	if p == nil {
+		return nil, ErrNoPTY
+	}
+	return p, nil
+}
+
+// device is a resolved path.
+type device struct {
+	name string
+	path string
+	dir  bool
+	rw   io.ReadWriter // nil for directories
+	// endless devices can never be read to end of file
+	endless bool
+	// stream devices cannot seek
+	stream bool
+}
+
+// devices are the fixed entries of the root.
+var devices = map[string]func() *device{
+	"null": func() *device {
+		return &device{rw: nullDevice{}}
+	},
+	"zero": func() *device {
+		return &device{rw: zeroDevice{}, endless: true}
+	},
+	"random": func() *device {
+		return &device{rw: randomDevice{}, endless: true}
+	},
+	"urandom": func() *device {
+		return &device{rw: randomDevice{}, endless: true}
+	},
+}
+
+// lookup resolves path to a device or directory.
+func (fs *FS) lookup(op, path string) (*device, error) {
+	if err := vfs.ValidatePath(path); err != nil {
+		return nil, err
+	}
+	path = vfs.Clean(path)
+
+	var dev *device
+	switch {
+	case path == "/" || path == "/pts":
+		dev = &device{dir: true}
+	case vfs.Dir(path) == "/" && devices[vfs.Base(path)] != nil:
+		dev = devices[vfs.Base(path)]()
+	case vfs.Dir(path) == "/pts":
+		n, err := strconv.Atoi(vfs.Base(path))
+		if err != nil || strconv.Itoa(n) != vfs.Base(path) {
+			return nil, vfs.NotExistError(op, path)
+		}
+		p, err := fs.PTY(n)
+		if err != nil {
+			return nil, vfs.NotExistError(op, path)
+		}
+		dev = &device{rw: p.Slave(), endless: true, stream: true}
+	default:
+		return nil, vfs.NotExistError(op, path)
+	}
+
+	dev.name = vfs.Base(path)
+	dev.path = path
+	return dev, nil
+}
+
+// info describes a device or directory.
+func (fs *FS) info(dev *device) vfs.FileInfo {
+	info := vfs.FileInfo{Name: dev.name, ModTime: fs.boot}
+	switch {
+	case dev.dir:
+		info.Mode = os.ModeDir | 0755
+		info.IsDir = true
+	case dev.stream:
+		info.Mode = os.ModeDevice | os.ModeCharDevice | ptyPerm
+	default:
+		info.Mode = os.ModeDevice | os.ModeCharDevice | devicePerm
+	}
+	return info
+}
+
+// Open implements vfs.FileSystem.Open.
+func (fs *FS) Open(path string) (vfs.File, error) {
+	return fs.OpenFile(path, vfs.O_RDONLY, 0)
+}
+
+// OpenFile implements vfs.FileSystem.OpenFile. Only existing entries can
+// be opened; O_TRUNC has no effect on devices.
+func (fs *FS) OpenFile(path string, flags int, perm os.FileMode) (vfs.File, error) {
+	dev, err := fs.lookup("open", path)
+	if err != nil {
+		if flags&vfs.O_CREATE != 0 && errors.Is(err, os.ErrNotExist) {
+			return nil, vfs.ReadOnlyError("open", path)
+		}
+		return nil, err
+	}
+	if flags&(vfs.O_CREATE|vfs.O_EXCL) == vfs.O_CREATE|vfs.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrExist}
+	}
+
+	access := flags & (vfs.O_RDONLY | vfs.O_WRONLY | vfs.O_RDWR)
+	if dev.dir && access != vfs.O_RDONLY {
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EISDIR}
+	}
+
+	return &devFile{
+		dev:      dev,
+		info:     fs.info(dev),
+		readable: access != vfs.O_WRONLY,
+		writable: access != vfs.O_RDONLY,
+	}, nil
+}
+
+// Stat implements vfs.FileSystem.Stat.
+func (fs *FS) Stat(path string) (vfs.FileInfo, error) {
+	dev, err := fs.lookup("stat", path)
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+	return fs.info(dev), nil
+}
+
+// Lstat implements vfs.FileSystem.Lstat.
+func (fs *FS) Lstat(path string) (vfs.FileInfo, error) {
+	return fs.Stat(path)
+}
+
+// Mkdir implements vfs.FileSystem.Mkdir.
+func (fs *FS) Mkdir(path string, perm os.FileMode) error {
+	return vfs.ReadOnlyError("mkdir", path)
+}
+
+// MkdirAll implements vfs.FileSystem.MkdirAll. Existing directories are
+// accepted.
+func (fs *FS) MkdirAll(path string, perm os.FileMode) error {
+	if info, err := fs.Stat(path); err == nil && info.IsDir {
+		return nil
+	}
+	return vfs.ReadOnlyError("mkdir", path)
+}
+
+// Remove implements vfs.FileSystem.Remove.
+func (fs *FS) Remove(path string) error {
+	return vfs.ReadOnlyError("remove", path)
+}
+
+// RemoveAll implements vfs.FileSystem.RemoveAll.
+func (fs *FS) RemoveAll(path string) error {
+	return vfs.ReadOnlyError("removeall", path)
+}
+
+// Rename implements vfs.FileSystem.Rename.
+func (fs *FS) Rename(oldpath, newpath string) error {
+	return vfs.ReadOnlyError("rename", oldpath)
+}
+
+// ReadDir implements vfs.FileSystem.ReadDir.
+func (fs *FS) ReadDir(path string) ([]vfs.DirEntry, error) {
+	dev, err := fs.lookup("readdir", path)
+	if err != nil {
+		return nil, err
+	}
+	if !dev.dir {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: syscall.ENOTDIR}
+	}
+
+	var names []string
+	if dev.path == "/" {
+		names = append(names, "pts")
+		for name := range devices {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	} else {
+		fs.mu.RLock()
+		var ns []int
+		for n := range fs.ptys {
+			ns = append(ns, n)
+		}
+		fs.mu.RUnlock()
+
+		sort.Ints(ns)
+		for _, n := range ns {
+			names = append(names, strconv.Itoa(n))
+		}
+	}
+
+	entries := make([]vfs.DirEntry, 0, len(names))
+	for _, name := range names {
+		child, err := fs.lookup("readdir", vfs.Join(dev.path, name))
+		if err != nil {
+			// The pseudo-terminal was removed while listing
+			continue
+		}
+		entries = append(entries, vfs.NewDirEntry(fs.info(child)))
+	}
+	return entries, nil
+}
+
+// ReadFile implements vfs.FileSystem.ReadFile. Only null can be read to
+// end of file; other devices return syscall.EINVAL.
+func (fs *FS) ReadFile(path string) ([]byte, error) {
+	dev, err := fs.lookup("read", path)
+	if err != nil {
+		return nil, err
+	}
+	if dev.dir {
+		return nil, &os.PathError{Op: "read", Path: path, Err: syscall.EISDIR}
+	}
+	if dev.endless {
+		return nil, &os.PathError{Op: "read", Path: path, Err: syscall.EINVAL}
+	}
+	return io.ReadAll(dev.rw)
+}
+
+// WriteFile implements vfs.FileSystem.WriteFile by writing data to the
+// device.
+func (fs *FS) WriteFile(path string, data []byte, perm os.FileMode) error {
+	file, err := fs.OpenFile(path, vfs.O_WRONLY|vfs.O_CREATE|vfs.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(data)
+	return err
+}
+
+// Create implements vfs.FileSystem.Create.
+func (fs *FS) Create(path string) (vfs.File, error) {
+	return fs.OpenFile(path, vfs.O_RDWR|vfs.O_CREATE|vfs.O_TRUNC, 0666)
+}
+
+// Symlink implements vfs.FileSystem.Symlink.
+func (fs *FS) Symlink(target, newpath string) error {
+	return vfs.ReadOnlyError("symlink", newpath)
+}
+
+// Readlink implements vfs.FileSystem.Readlink.
+func (fs *FS) Readlink(path string) (string, error) {
+	if _, err := fs.lookup("readlink", path); err != nil {
+		return "", err
+	}
+	return "", &os.PathError{Op: "readlink", Path: path, Err: syscall.EINVAL}
+}
+
+// Link implements vfs.FileSystem.Link.
+func (fs *FS) Link(oldpath, newpath string) error {
+	return vfs.ReadOnlyError("link", newpath)
+}
+
+// Chmod implements vfs.FileSystem.Chmod.
+func (fs *FS) Chmod(path string, mode os.FileMode) error {
+	return vfs.ReadOnlyError("chmod", path)
+}
+
+// Chown implements vfs.FileSystem.Chown.
+func (fs *FS) Chown(path string, uid, gid int) error {
+	return vfs.ReadOnlyError("chown", path)
+}
+
+// Chtimes implements vfs.FileSystem.Chtimes.
+func (fs *FS) Chtimes(path string, atime, mtime time.Time) error {
+	return vfs.ReadOnlyError("chtimes", path)
+}
+
+// nullDevice discards writes and is always at end of file.
+type nullDevice struct{}
+
+func (nullDevice) Read(b []byte) (int, error)  { return 0, io.EOF }
+func (nullDevice) Write(b []byte) (int, error) { return len(b), nil }
+
+// zeroDevice discards writes and reads as zero bytes.
+type zeroDevice struct{}
+
+func (zeroDevice) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+func (zeroDevice) Write(b []byte) (int, error) { return len(b), nil }
+
+// randomDevice reads from the cryptographic random source and discards
+// writes.
+type randomDevice struct{}
+
+func (randomDevice) Read(b []byte) (int, error)  { return rand.Read(b) }
+func (randomDevice) Write(b []byte) (int, error) { return len(b), nil }
+
+// devFile is an open device or directory.
+type devFile struct {
+	dev      *device
+	info     vfs.FileInfo
+	readable bool
+	writable bool
+	closed   bool
+	mu       sync.Mutex
+}
+
+// check returns an error if the file is closed or lacks the access.
+func (f *devFile) check(write bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case f.closed:
+		return vfs.ErrClosedFile
+	case f.dev.dir:
+		return &os.PathError{Op: "read", Path: f.dev.path, Err: syscall.EISDIR}
+	case write && !f.writable, !write && !f.readable:
+		return vfs.ErrPermissionDenied
+	}
+	return nil
+}
+
+// seekable returns an error for devices that cannot seek.
+func (f *devFile) seekable(op string) error {
+	if f.dev.stream {
+		return &os.PathError{Op: op, Path: f.dev.path, Err: syscall.ESPIPE}
+	}
+	return nil
+}
+
+func (f *devFile) Read(b []byte) (int, error) {
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+	return f.dev.rw.Read(b)
+}
+
+func (f *devFile) Write(b []byte) (int, error) {
+	if err := f.check(true); err != nil {
+		return 0, err
+	}
+	return f.dev.rw.Write(b)
+}
+
+// ReadAt implements io.ReaderAt. Offsets mean nothing to devices that can
+// seek, and devices that cannot return syscall.ESPIPE.
+func (f *devFile) ReadAt(b []byte, off int64) (int, error) {
+	if err := f.seekable("read"); err != nil {
+		return 0, err
+	}
+	return f.Read(b)
+}
+
+// WriteAt implements io.WriterAt like ReadAt.
+func (f *devFile) WriteAt(b []byte, off int64) (int, error) {
+	if err := f.seekable("write"); err != nil {
+		return 0, err
+	}
+	return f.Write(b)
+}
+
+// Seek implements io.Seeker. Devices that can seek stay at offset zero.
+func (f *devFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.seekable("seek"); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+func (f *devFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return vfs.ErrClosedFile
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *devFile) Stat() (vfs.FileInfo, error) {
+	return f.info, nil
+}
+
+// Truncate implements vfs.File.Truncate. It has no effect on devices.
+func (f *devFile) Truncate(size int64) error {
+	return f.check(true)
+}
+
+func (f *devFile) Sync() error {
+	return nil
+}
+
+func (f *devFile) Lock(how vfs.LockMode) error {
+	return vfs.ErrNotImplemented
+}
+
+func (f *devFile) Unlock() error {
+	return vfs.ErrNotImplemented
+}
+
+var _ vfs.FileSystem = (*FS)(nil)
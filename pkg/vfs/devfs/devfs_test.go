@@ -0,0 +1,125 @@
+package devfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	vfs "webos/pkg/vfs"
+)
+
+func TestReadDir(t *testing.T) {
+	fs := New()
+	if _, _, err := fs.NewPTY(80, 24); err != nil {
+		t.Fatalf("NewPTY failed: %v", err)
+	}
+
+	entries, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+		if entry.Name() != "pts" && entry.Type()&os.ModeCharDevice == 0 {
+			t.Errorf("%s has type %v, expected a character device", entry.Name(), entry.Type())
+		}
+	}
+	if strings.Join(names, " ") != "null pts random urandom zero" {
+		t.Errorf("root entries are %v", names)
+	}
+
+	entries, err = fs.ReadDir("/pts")
+	if err != nil {
+		t.Fatalf("ReadDir of pts failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "0" {
+		t.Errorf("pts entries are %v, expected [0]", entries)
+	}
+}
+
+func TestDevices(t *testing.T) {
+	fs := New()
+
+	// Redirecting output to /dev/null opens it for truncation
+	file, err := fs.OpenFile("/null", vfs.O_WRONLY|vfs.O_CREATE|vfs.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile null failed: %v", err)
+	}
+	if n, err := file.Write([]byte("discarded")); err != nil || n != 9 {
+		t.Errorf("Write to null returned %d, %v", n, err)
+	}
+	file.Close()
+
+	if data, err := fs.ReadFile("/null"); err != nil || len(data) != 0 {
+		t.Errorf("ReadFile null returned %q, %v", data, err)
+	}
+
+	file, err = fs.Open("/zero")
+	if err != nil {
+		t.Fatalf("Open zero failed: %v", err)
+	}
+	buf := []byte{1, 2, 3}
+	if _, err := io.ReadFull(file, buf); err != nil || buf[0]|buf[1]|buf[2] != 0 {
+		t.Errorf("read of zero returned %v, %v", buf, err)
+	}
+	if _, err := file.Write(buf); !errors.Is(err, vfs.ErrPermissionDenied) {
+		t.Errorf("Write to read-only handle returned %v, expected ErrPermissionDenied", err)
+	}
+	file.Close()
+
+	if _, err := fs.ReadFile("/urandom"); err == nil {
+		t.Error("ReadFile of urandom succeeded")
+	}
+	if err := fs.WriteFile("/new", nil, 0644); !errors.Is(err, vfs.ErrReadOnlyFS) {
+		t.Errorf("WriteFile of new entry returned %v, expected ErrReadOnlyFS", err)
+	}
+	if err := fs.Remove("/null"); !errors.Is(err, vfs.ErrReadOnlyFS) {
+		t.Errorf("Remove returned %v, expected ErrReadOnlyFS", err)
+	}
+}
+
+func TestPTY(t *testing.T) {
+	fs := New()
+	n, p, err := fs.NewPTY(80, 24)
+	if err != nil {
+		t.Fatalf("NewPTY failed: %v", err)
+	}
+	defer p.Close()
+
+	// Input typed at the terminal is read from pts/N
+	if _, err := p.Master().Write([]byte("ls\n")); err != nil {
+		t.Fatalf("master write failed: %v", err)
+	}
+	file, err := fs.OpenFile("/pts/0", vfs.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile pts/0 failed: %v", err)
+	}
+	defer file.Close()
+
+	buf := make([]byte, 16)
+	if k, err := file.Read(buf); err != nil || string(buf[:k]) != "ls\n" {
+		t.Errorf("read of pts/0 returned %q, %v", buf[:k], err)
+	}
+
+	// Output written to pts/N is read from the master
+	if _, err := file.Write([]byte("ok")); err != nil {
+		t.Fatalf("write to pts/0 failed: %v", err)
+	}
+	if k, err := p.Master().Read(buf); err != nil || string(buf[:k]) != "ok" {
+		t.Errorf("master read returned %q, %v", buf[:k], err)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err == nil {
+		t.Error("Seek on pts succeeded")
+	}
+
+	if err := fs.RemovePTY(n); err != nil {
+		t.Fatalf("RemovePTY failed: %v", err)
+	}
+	if _, err := fs.Stat("/pts/0"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat of removed pty returned %v, expected ErrNotExist", err)
+	}
+}
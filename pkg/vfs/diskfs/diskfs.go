@@ -3,16 +3,32 @@
 package diskfs
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	vfs "webos/pkg/vfs"
 )
 
+// ErrReservedName is returned for paths that name the file holding
+// extended attributes when the host cannot store them.
+var ErrReservedName = fmt.Errorf("diskfs: %s is a reserved name: %w", sidecarName, os.ErrPermission)
+
 // FS represents a disk-based filesystem.
+//
+// Change notifications cover changes made through the FS; changes made to
+// the directory by other programs are not reported.
+//
+// Extended attributes are stored as host user.* attributes where the host
+// filesystem supports them, and otherwise in a sidecar file in the root.
 type FS struct {
-	root string
+	root      string
+	events    vfs.EventHub
+	xattrOnce sync.Once
+	xattrs    *xattrSidecar // nil when the host stores attributes
 }
 
 // New creates a new disk-based filesystem rooted at the given directory.
@@ -20,6 +36,11 @@ func New(root string) *FS {
 	return &FS{root: filepath.Clean(root)}
 }
 
+// Subscribe implements vfs.Notifier.
+func (fs *FS) Subscribe(fn func(vfs.Event)) (cancel func()) {
+	return fs.events.Subscribe(fn)
+}
+
 // Open implements vfs.FileSystem.Open.
 func (fs *FS) Open(path string) (vfs.File, error) {
 	return fs.OpenFile(path, vfs.O_RDONLY, 0)
@@ -27,17 +48,37 @@ func (fs *FS) Open(path string) (vfs.File, error) {
 
 // OpenFile implements vfs.FileSystem.OpenFile.
 func (fs *FS) OpenFile(path string, flags int, perm os.FileMode) (vfs.File, error) {
-	fullPath := fs.fullPath(path)
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	created := false
+	if flags&vfs.O_CREATE != 0 {
+		if _, err := os.Lstat(fullPath); os.IsNotExist(err) {
+			created = true
+		}
+	}
+
 	file, err := os.OpenFile(fullPath, flags, perm)
 	if err != nil {
 		return nil, err
 	}
-	return &diskFile{file: file, path: path}, nil
+
+	if created {
+		fs.events.Emit(vfs.OpCreate, path)
+	} else if flags&vfs.O_TRUNC != 0 && flags&(vfs.O_WRONLY|vfs.O_RDWR) != 0 {
+		fs.events.Emit(vfs.OpWrite, path)
+	}
+	return &diskFile{file: file, path: path, events: &fs.events}, nil
 }
 
 // Stat implements vfs.FileSystem.Stat.
 func (fs *FS) Stat(path string) (vfs.FileInfo, error) {
-	fullPath := fs.fullPath(path)
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
 	info, err := os.Stat(fullPath)
 	if err != nil {
 		return vfs.FileInfo{}, err
@@ -47,7 +88,10 @@ func (fs *FS) Stat(path string) (vfs.FileInfo, error) {
 
 // Lstat implements vfs.FileSystem.Lstat.
 func (fs *FS) Lstat(path string) (vfs.FileInfo, error) {
-	fullPath := fs.fullPath(path)
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
 	info, err := os.Lstat(fullPath)
 	if err != nil {
 		return vfs.FileInfo{}, err
@@ -57,56 +101,133 @@ func (fs *FS) Lstat(path string) (vfs.FileInfo, error) {
 
 // Mkdir implements vfs.FileSystem.Mkdir.
 func (fs *FS) Mkdir(path string, perm os.FileMode) error {
-	fullPath := fs.fullPath(path)
-	return os.Mkdir(fullPath, perm)
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(fullPath, perm); err != nil {
+		return err
+	}
+	fs.events.Emit(vfs.OpCreate, path)
+	return nil
 }
 
 // MkdirAll implements vfs.FileSystem.MkdirAll.
 func (fs *FS) MkdirAll(path string, perm os.FileMode) error {
-	fullPath := fs.fullPath(path)
-	return os.MkdirAll(fullPath, perm)
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return err
+	}
+
+	// Find the missing directories so each can be reported
+	var missing []string
+	for p := vfs.Clean(path); p != "/"; p = vfs.Dir(p) {
+		if _, err := os.Stat(fs.hostPath(p)); err == nil {
+			break
+		}
+		missing = append(missing, p)
+	}
+
+	if err := os.MkdirAll(fullPath, perm); err != nil {
+		return err
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		fs.events.Emit(vfs.OpCreate, missing[i])
+	}
+	return nil
 }
 
 // Remove implements vfs.FileSystem.Remove.
 func (fs *FS) Remove(path string) error {
-	fullPath := fs.fullPath(path)
-	return os.Remove(fullPath)
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fullPath); err != nil {
+		return err
+	}
+	if s := fs.sidecar(); s != nil {
+		s.forget(vfs.Clean(path))
+	}
+	fs.events.Emit(vfs.OpRemove, path)
+	return nil
 }
 
 // RemoveAll implements vfs.FileSystem.RemoveAll.
 func (fs *FS) RemoveAll(path string) error {
-	fullPath := fs.fullPath(path)
-	return os.RemoveAll(fullPath)
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return err
+	}
+	removed := fs.events.CollectTree(fs, path)
+	if err := os.RemoveAll(fullPath); err != nil {
+		// Report what did go before the failure
+		gone := removed[:0]
+		for _, p := range removed {
+			if _, err := os.Lstat(fs.hostPath(p)); os.IsNotExist(err) {
+				gone = append(gone, p)
+			}
+		}
+		fs.events.EmitRemoveTree(gone)
+		return err
+	}
+	if s := fs.sidecar(); s != nil {
+		s.forget(vfs.Clean(path))
+	}
+	fs.events.EmitRemoveTree(removed)
+	return nil
 }
 
 // Rename implements vfs.FileSystem.Rename.
 func (fs *FS) Rename(oldpath, newpath string) error {
-	oldFull := fs.fullPath(oldpath)
-	newFull := fs.fullPath(newpath)
-	return os.Rename(oldFull, newFull)
+	oldFull, err := fs.fullPath(oldpath)
+	if err != nil {
+		return err
+	}
+	newFull, err := fs.fullPath(newpath)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(oldFull, newFull); err != nil {
+		return err
+	}
+	if s := fs.sidecar(); s != nil {
+		s.move(vfs.Clean(oldpath), vfs.Clean(newpath))
+	}
+	fs.events.EmitRename(oldpath, newpath)
+	return nil
 }
 
 // ReadDir implements vfs.FileSystem.ReadDir.
 func (fs *FS) ReadDir(path string) ([]vfs.DirEntry, error) {
-	fullPath := fs.fullPath(path)
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
 	entries, err := os.ReadDir(fullPath)
 	if err != nil {
 		return nil, err
 	}
 
-	result := make([]vfs.DirEntry, len(entries))
-	for i, entry := range entries {
-		result[i] = &diskDirEntry{
+	result := make([]vfs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Name() == sidecarName {
+			continue
+		}
+		result = append(result, &diskDirEntry{
 			name:  entry.Name(),
 			entry: entry,
-		}
+		})
 	}
 	return result, nil
 }
 
 // ReadFile implements vfs.FileSystem.ReadFile.
 func (fs *FS) ReadFile(path string) ([]byte, error) {
-	fullPath := fs.fullPath(path)
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
 
 	// Check if it's a symlink and resolve if needed
 	info, err := os.Lstat(fullPath)
@@ -140,8 +261,19 @@ func (fs *FS) ReadFile(path string) ([]byte, error) {
 
 // WriteFile implements vfs.FileSystem.WriteFile.
 func (fs *FS) WriteFile(path string, data []byte, perm os.FileMode) error {
-	fullPath := fs.fullPath(path)
-	return os.WriteFile(fullPath, data, perm)
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return err
+	}
+	_, statErr := os.Lstat(fullPath)
+	if err := os.WriteFile(fullPath, data, perm); err != nil {
+		return err
+	}
+	if statErr != nil {
+		fs.events.Emit(vfs.OpCreate, path)
+	}
+	fs.events.Emit(vfs.OpWrite, path)
+	return nil
 }
 
 // Create implements vfs.FileSystem.Create.
@@ -151,36 +283,109 @@ func (fs *FS) Create(path string) (vfs.File, error) {
 
 // Symlink implements vfs.FileSystem.Symlink.
 func (fs *FS) Symlink(target, newpath string) error {
-	newFull := fs.fullPath(newpath)
-	return os.Symlink(target, newFull)
+	newFull, err := fs.fullPath(newpath)
+	if err != nil {
+		return err
+	}
+	if reserved(filepath.ToSlash(target)) {
+		// The link would lead to the sidecar file
+		return ErrReservedName
+	}
+	if err := os.Symlink(target, newFull); err != nil {
+		return err
+	}
+	fs.events.Emit(vfs.OpCreate, newpath)
+	return nil
 }
 
 // Readlink implements vfs.FileSystem.Readlink.
 func (fs *FS) Readlink(path string) (string, error) {
-	fullPath := fs.fullPath(path)
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return "", err
+	}
 	return os.Readlink(fullPath)
 }
 
+// Link implements vfs.FileSystem.Link.
+func (fs *FS) Link(oldpath, newpath string) error {
+	oldFull, err := fs.fullPath(oldpath)
+	if err != nil {
+		return err
+	}
+	newFull, err := fs.fullPath(newpath)
+	if err != nil {
+		return err
+	}
+	if err := os.Link(oldFull, newFull); err != nil {
+		return err
+	}
+	fs.events.Emit(vfs.OpCreate, newpath)
+	return nil
+}
+
 // Chmod implements vfs.FileSystem.Chmod.
 func (fs *FS) Chmod(path string, mode os.FileMode) error {
-	fullPath := fs.fullPath(path)
-	return os.Chmod(fullPath, mode)
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(fullPath, mode); err != nil {
+		return err
+	}
+	fs.events.Emit(vfs.OpChmod, path)
+	return nil
 }
 
 // Chown implements vfs.FileSystem.Chown.
 func (fs *FS) Chown(path string, uid, gid int) error {
-	fullPath := fs.fullPath(path)
-	return os.Chown(fullPath, uid, gid)
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(fullPath, uid, gid); err != nil {
+		return err
+	}
+	fs.events.Emit(vfs.OpChmod, path)
+	return nil
 }
 
 // Chtimes implements vfs.FileSystem.Chtimes.
 func (fs *FS) Chtimes(path string, atime, mtime time.Time) error {
-	fullPath := fs.fullPath(path)
-	return os.Chtimes(fullPath, atime, mtime)
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chtimes(fullPath, atime, mtime); err != nil {
+		return err
+	}
+	fs.events.Emit(vfs.OpChmod, path)
+	return nil
+}
+
+// fullPath converts a VFS path to an absolute filesystem path, refusing
+// paths that name the sidecar file.
+func (fs *FS) fullPath(path string) (string, error) {
+	if reserved(path) {
+		return "", ErrReservedName
+	}
+	return fs.hostPath(path), nil
+}
+
+// reserved reports whether any element of path is the sidecar file name.
+// The name is refused in every directory, since a symlink to a directory
+// could otherwise reach the root's sidecar under another path.
+func reserved(path string) bool {
+	for _, part := range strings.Split(path, "/") {
+		if part == sidecarName {
+			return true
+		}
+	}
+	return false
 }
 
-// fullPath converts a VFS path to an absolute filesystem path.
-func (fs *FS) fullPath(path string) string {
+// hostPath converts a VFS path to an absolute filesystem path.
+func (fs *FS) hostPath(path string) string {
 	cleanPath := vfs.Clean(path)
 	if cleanPath == "/" {
 		return fs.root
@@ -204,8 +409,9 @@ func fileInfoFromOS(path string, info os.FileInfo) vfs.FileInfo {
 
 // diskFile wraps an os.File to implement vfs.File.
 type diskFile struct {
-	file *os.File
-	path string
+	file   *os.File
+	path   string
+	events *vfs.EventHub
 }
 
 func (f *diskFile) Read(b []byte) (int, error) {
@@ -213,7 +419,31 @@ func (f *diskFile) Read(b []byte) (int, error) {
 }
 
 func (f *diskFile) Write(b []byte) (int, error) {
-	return f.file.Write(b)
+	n, err := f.file.Write(b)
+	if n > 0 {
+		f.events.Emit(vfs.OpWrite, f.path)
+	}
+	return n, err
+}
+
+func (f *diskFile) ReadAt(b []byte, off int64) (int, error) {
+	return f.file.ReadAt(b, off)
+}
+
+func (f *diskFile) WriteAt(b []byte, off int64) (int, error) {
+	n, err := f.file.WriteAt(b, off)
+	if n > 0 {
+		f.events.Emit(vfs.OpWrite, f.path)
+	}
+	return n, err
+}
+
+func (f *diskFile) Lock(how vfs.LockMode) error {
+	return flock(f.file, how)
+}
+
+func (f *diskFile) Unlock() error {
+	return funlock(f.file)
 }
 
 func (f *diskFile) Seek(offset int64, whence int) (int64, error) {
@@ -233,7 +463,11 @@ func (f *diskFile) Stat() (vfs.FileInfo, error) {
 }
 
 func (f *diskFile) Truncate(size int64) error {
-	return f.file.Truncate(size)
+	if err := f.file.Truncate(size); err != nil {
+		return err
+	}
+	f.events.Emit(vfs.OpWrite, f.path)
+	return nil
 }
 
 func (f *diskFile) Sync() error {
@@ -1,6 +1,7 @@
 package diskfs
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -468,3 +469,144 @@ func TestNestedPaths(t *testing.T) {
 		t.Errorf("got %q, expected %q", string(data), "nested")
 	}
 }
+
+func TestLock(t *testing.T) {
+	fs := New(t.TempDir())
+	fs.WriteFile("/file.txt", []byte("data"), 0644)
+
+	a, _ := fs.Open("/file.txt")
+	defer a.Close()
+	b, _ := fs.Open("/file.txt")
+	defer b.Close()
+
+	if err := a.Lock(vfs.LockExclusive); err != nil {
+		t.Fatalf("exclusive Lock failed: %v", err)
+	}
+	if err := b.Lock(vfs.LockShared | vfs.LockNonBlock); err != vfs.ErrWouldBlock {
+		t.Fatalf("shared Lock returned %v, expected ErrWouldBlock", err)
+	}
+	if err := a.Unlock(); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if err := b.Lock(vfs.LockShared | vfs.LockNonBlock); err != nil {
+		t.Fatalf("shared Lock after Unlock failed: %v", err)
+	}
+}
+
+func TestXattr(t *testing.T) {
+	root := t.TempDir()
+	fs := New(root)
+
+	// Force the sidecar store so the test does not depend on the host
+	fs.xattrOnce.Do(func() {
+		fs.xattrs = &xattrSidecar{path: filepath.Join(root, sidecarName)}
+	})
+
+	fs.MkdirAll("/dir", 0755)
+	fs.WriteFile("/dir/file.txt", []byte("data"), 0644)
+
+	if err := fs.Setxattr("/dir/file.txt", "user.mime_type", []byte("text/plain"), 0); err != nil {
+		t.Fatalf("Setxattr failed: %v", err)
+	}
+	if err := fs.Setxattr("/dir/file.txt", "user.webos.x", nil, 0); err != vfs.ErrInvalidAttrName {
+		t.Errorf("Setxattr with reserved name returned %v, expected ErrInvalidAttrName", err)
+	}
+
+	// The sidecar is hidden and survives reopening
+	entries, _ := fs.ReadDir("/")
+	for _, entry := range entries {
+		if entry.Name() == sidecarName {
+			t.Error("ReadDir listed the sidecar file")
+		}
+	}
+	reopened := New(root)
+	reopened.xattrOnce.Do(func() {
+		reopened.xattrs = &xattrSidecar{path: filepath.Join(root, sidecarName)}
+	})
+	if value, err := reopened.Getxattr("/dir/file.txt", "user.mime_type"); err != nil || string(value) != "text/plain" {
+		t.Errorf("Getxattr after reopen returned %q, %v", value, err)
+	}
+
+	// The sidecar cannot be reached or forged through the FS
+	reservedOps := map[string]func() error{
+		"Open": func() error {
+			_, err := fs.Open("/" + sidecarName)
+			return err
+		},
+		"WriteFile": func() error {
+			return fs.WriteFile("/"+sidecarName, []byte("{}"), 0644)
+		},
+		"Remove":  func() error { return fs.Remove("/" + sidecarName) },
+		"Rename":  func() error { return fs.Rename("/dir/file.txt", "/"+sidecarName) },
+		"Symlink": func() error { return fs.Symlink("../"+sidecarName, "/dir/link") },
+		"Nested":  func() error { return fs.WriteFile("/dir/"+sidecarName, nil, 0644) },
+	}
+	for name, op := range reservedOps {
+		if err := op(); !errors.Is(err, ErrReservedName) || !errors.Is(err, os.ErrPermission) {
+			t.Errorf("%s on the sidecar returned %v, expected ErrReservedName", name, err)
+		}
+	}
+	if _, err := fs.Getxattr("/dir/file.txt", "user.webos.x"); err != vfs.ErrInvalidAttrName {
+		t.Errorf("Getxattr with invalid name returned %v, expected ErrInvalidAttrName", err)
+	}
+
+	// Attributes move with renames and go away with removal
+	fs.Rename("/dir", "/moved")
+	if names, _ := fs.Listxattr("/moved/file.txt"); len(names) != 1 {
+		t.Errorf("attributes after rename are %v", names)
+	}
+	fs.RemoveAll("/moved")
+	fs.MkdirAll("/moved", 0755)
+	fs.WriteFile("/moved/file.txt", nil, 0644)
+	if names, _ := fs.Listxattr("/moved/file.txt"); len(names) != 0 {
+		t.Errorf("recreated file has attributes %v", names)
+	}
+}
+
+// nextEvents reads n events from w, failing the test on a timeout.
+func nextEvents(t *testing.T, w *vfs.Watcher, n int) []vfs.Event {
+	t.Helper()
+	events := make([]vfs.Event, 0, n)
+	for len(events) < n {
+		select {
+		case ev := <-w.Events:
+			events = append(events, ev)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after %d of %d events: %v", len(events), n, events)
+		}
+	}
+	return events
+}
+
+func TestWatcher(t *testing.T) {
+	fs := New(t.TempDir())
+	fs.MkdirAll("/dir/sub", 0755)
+	fs.WriteFile("/dir/sub/b", nil, 0644)
+
+	w, err := vfs.NewWatcher(fs)
+	if err != nil {
+		t.Fatalf("NewWatcher failed: %v", err)
+	}
+	defer w.Close()
+	w.Add("/dir", true)
+
+	fs.WriteFile("/dir/file", []byte("x"), 0644)
+	fs.Chmod("/dir/file", 0600)
+	fs.Rename("/dir/file", "/moved")
+	fs.WriteFile("/outside", nil, 0644)
+	fs.RemoveAll("/dir/sub")
+
+	expected := []vfs.Event{
+		{Op: vfs.OpCreate, Path: "/dir/file"},
+		{Op: vfs.OpWrite, Path: "/dir/file"},
+		{Op: vfs.OpChmod, Path: "/dir/file"},
+		{Op: vfs.OpRename, Path: "/moved", OldPath: "/dir/file"},
+		{Op: vfs.OpRemove, Path: "/dir/sub/b"},
+		{Op: vfs.OpRemove, Path: "/dir/sub"},
+	}
+	for i, ev := range nextEvents(t, w, len(expected)) {
+		if ev != expected[i] {
+			t.Errorf("event %d is %v, expected %v", i, ev, expected[i])
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package diskfs
+
+import (
+	"os"
+
+	vfs "webos/pkg/vfs"
+)
+
+// flock is not supported on this platform.
+func flock(f *os.File, how vfs.LockMode) error {
+	return vfs.ErrNotImplemented
+}
+
+// funlock is not supported on this platform.
+func funlock(f *os.File) error {
+	return vfs.ErrNotImplemented
+}
@@ -0,0 +1,48 @@
+//go:build unix
+
+package diskfs
+
+import (
+	"os"
+	"syscall"
+
+	vfs "webos/pkg/vfs"
+)
+
+// flock applies an advisory lock to f with flock(2).
+func flock(f *os.File, how vfs.LockMode) error {
+	var op int
+	switch {
+	case how&vfs.LockExclusive != 0:
+		op = syscall.LOCK_EX
+	case how&vfs.LockShared != 0:
+		op = syscall.LOCK_SH
+	default:
+		return vfs.ErrInvalidLock
+	}
+	if how&vfs.LockNonBlock != 0 {
+		op |= syscall.LOCK_NB
+	}
+
+	for {
+		err := syscall.Flock(int(f.Fd()), op)
+		switch err {
+		case nil:
+			return nil
+		case syscall.EINTR:
+			continue
+		case syscall.EWOULDBLOCK:
+			return vfs.ErrWouldBlock
+		default:
+			return &os.PathError{Op: "flock", Path: f.Name(), Err: err}
+		}
+	}
+}
+
+// funlock releases the advisory lock on f.
+func funlock(f *os.File) error {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+		return &os.PathError{Op: "flock", Path: f.Name(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package diskfs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	vfs "webos/pkg/vfs"
+)
+
+// hostXattrPrefix is the host namespace holding attributes whose names are
+// not already in the user namespace, which is the only one unprivileged
+// processes may write.
+const hostXattrPrefix = "user.webos."
+
+// sidecarName is the file in the root directory that holds attributes when
+// the host filesystem cannot. It is hidden from ReadDir, and paths naming
+// it are refused with ErrReservedName.
+const sidecarName = ".webos-xattrs.json"
+
+// hostXattrName maps an attribute name into the host user namespace.
+func hostXattrName(name string) string {
+	if strings.HasPrefix(name, "user.") {
+		return name
+	}
+	return hostXattrPrefix + name
+}
+
+// vfsXattrName maps a host attribute name back, reporting false for host
+// attributes outside the user namespace.
+func vfsXattrName(host string) (string, bool) {
+	if strings.HasPrefix(host, hostXattrPrefix) {
+		return host[len(hostXattrPrefix):], true
+	}
+	if strings.HasPrefix(host, "user.") {
+		return host, true
+	}
+	return "", false
+}
+
+// validateXattrName rejects names the host mapping cannot represent.
+func validateXattrName(name string) error {
+	if err := vfs.ValidateXattrName(name); err != nil {
+		return err
+	}
+	if strings.HasPrefix(name, hostXattrPrefix) || len(hostXattrName(name)) > vfs.MaxXattrNameLen {
+		return vfs.ErrInvalidAttrName
+	}
+	return nil
+}
+
+// xattrSidecar stores attributes in a JSON file keyed by path.
+type xattrSidecar struct {
+	path   string
+	attrs  map[string]map[string][]byte
+	loaded bool
+	mu     sync.Mutex
+}
+
+// load reads the sidecar file on first use (caller must hold lock).
+func (s *xattrSidecar) load() error {
+	if s.loaded {
+		return nil
+	}
+
+	s.attrs = make(map[string]map[string][]byte)
+	data, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.attrs); err != nil {
+			return err
+		}
+	}
+
+	s.loaded = true
+	return nil
+}
+
+// save writes the sidecar file atomically (caller must hold lock).
+func (s *xattrSidecar) save() error {
+	data, err := json.Marshal(s.attrs)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// get returns one attribute.
+func (s *xattrSidecar) get(path, name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	value, ok := s.attrs[path][name]
+	if !ok {
+		return nil, vfs.ErrNoAttr
+	}
+	return append([]byte(nil), value...), nil
+}
+
+// set stores one attribute.
+func (s *xattrSidecar) set(path, name string, value []byte, flags int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	_, exists := s.attrs[path][name]
+	if err := vfs.CheckXattrFlags(flags, exists); err != nil {
+		return err
+	}
+
+	if s.attrs[path] == nil {
+		s.attrs[path] = make(map[string][]byte)
+	}
+	s.attrs[path][name] = append([]byte(nil), value...)
+	return s.save()
+}
+
+// list returns the attribute names on path.
+func (s *xattrSidecar) list(path string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(s.attrs[path]))
+	for name := range s.attrs[path] {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// remove deletes one attribute.
+func (s *xattrSidecar) remove(path, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	if _, ok := s.attrs[path][name]; !ok {
+		return vfs.ErrNoAttr
+	}
+
+	delete(s.attrs[path], name)
+	if len(s.attrs[path]) == 0 {
+		delete(s.attrs, path)
+	}
+	return s.save()
+}
+
+// forget drops the attributes of path and everything beneath it.
+func (s *xattrSidecar) forget(path string) error {
+	return s.move(path, "")
+}
+
+// move re-keys the attributes of oldpath and everything beneath it to
+// newpath, or drops them if newpath is empty.
+func (s *xattrSidecar) move(oldpath, newpath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	if newpath != "" {
+		// The renamed entry replaces whatever was at newpath
+		for key := range s.attrs {
+			if key == newpath || strings.HasPrefix(key, newpath+"/") {
+				delete(s.attrs, key)
+			}
+		}
+	}
+
+	under := oldpath + "/"
+	if oldpath == "/" {
+		under = oldpath
+	}
+
+	changed := false
+	for key, attrs := range s.attrs {
+		if key != oldpath && !strings.HasPrefix(key, under) {
+			continue
+		}
+		rest := key[len(oldpath):]
+
+		delete(s.attrs, key)
+		if newpath != "" {
+			s.attrs[vfs.Join(newpath, rest)] = attrs
+		}
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+	return s.save()
+}
+
+// sidecar returns the sidecar store, or nil when the host filesystem
+// stores attributes itself. The choice is made once per FS.
+func (fs *FS) sidecar() *xattrSidecar {
+	fs.xattrOnce.Do(func() {
+		if !hostXattrSupported(fs.root) {
+			fs.xattrs = &xattrSidecar{path: filepath.Join(fs.root, sidecarName)}
+		}
+	})
+	return fs.xattrs
+}
+
+// Getxattr implements vfs.XattrFS.Getxattr.
+func (fs *FS) Getxattr(path, name string) ([]byte, error) {
+	if err := validateXattrName(name); err != nil {
+		return nil, err
+	}
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if s := fs.sidecar(); s != nil {
+		if _, err := os.Stat(fullPath); err != nil {
+			return nil, err
+		}
+		return s.get(vfs.Clean(path), name)
+	}
+	return getxattr(fullPath, hostXattrName(name))
+}
+
+// Setxattr implements vfs.XattrFS.Setxattr. Names beginning with
+// "user.webos." are reserved for the host mapping.
+func (fs *FS) Setxattr(path, name string, value []byte, flags int) error {
+	if err := validateXattrName(name); err != nil {
+		return err
+	}
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return err
+	}
+
+	if s := fs.sidecar(); s != nil {
+		if _, err := os.Stat(fullPath); err != nil {
+			return err
+		}
+		err = s.set(vfs.Clean(path), name, value, flags)
+	} else {
+		err = setxattr(fullPath, hostXattrName(name), value, flags)
+	}
+	if err != nil {
+		return err
+	}
+
+	fs.events.Emit(vfs.OpChmod, path)
+	return nil
+}
+
+// Listxattr implements vfs.XattrFS.Listxattr. Host attributes outside the
+// user namespace, and sidecar entries with invalid names, are not listed.
+func (fs *FS) Listxattr(path string) ([]string, error) {
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	if s := fs.sidecar(); s != nil {
+		if _, err := os.Stat(fullPath); err != nil {
+			return nil, err
+		}
+		list, err := s.list(vfs.Clean(path))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range list {
+			if validateXattrName(name) == nil {
+				names = append(names, name)
+			}
+		}
+	} else {
+		hostNames, err := listxattr(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hostNames {
+			if name, ok := vfsXattrName(host); ok {
+				names = append(names, name)
+			}
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Removexattr implements vfs.XattrFS.Removexattr.
+func (fs *FS) Removexattr(path, name string) error {
+	if err := validateXattrName(name); err != nil {
+		return err
+	}
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return err
+	}
+
+	if s := fs.sidecar(); s != nil {
+		if _, err := os.Stat(fullPath); err != nil {
+			return err
+		}
+		err = s.remove(vfs.Clean(path), name)
+	} else {
+		err = removexattr(fullPath, hostXattrName(name))
+	}
+	if err != nil {
+		return err
+	}
+
+	fs.events.Emit(vfs.OpChmod, path)
+	return nil
+}
+
+var _ vfs.XattrFS = (*FS)(nil)
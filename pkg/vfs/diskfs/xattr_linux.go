@@ -0,0 +1,92 @@
+//go:build linux
+
+package diskfs
+
+import (
+	"os"
+	"strings"
+	"syscall"
+
+	vfs "webos/pkg/vfs"
+)
+
+// hostXattrSupported reports whether the host filesystem holding path
+// stores user extended attributes.
+func hostXattrSupported(path string) bool {
+	_, err := syscall.Listxattr(path, nil)
+	return err != syscall.ENOTSUP && err != syscall.EOPNOTSUPP
+}
+
+// getxattr reads a host attribute.
+func getxattr(path, name string) ([]byte, error) {
+	for {
+		size, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, xattrError("getxattr", path, err)
+		}
+
+		buf := make([]byte, size)
+		n, err := syscall.Getxattr(path, name, buf)
+		if err == syscall.ERANGE {
+			continue // Grew since the size query
+		}
+		if err != nil {
+			return nil, xattrError("getxattr", path, err)
+		}
+		return buf[:n], nil
+	}
+}
+
+// setxattr writes a host attribute.
+func setxattr(path, name string, value []byte, flags int) error {
+	if err := syscall.Setxattr(path, name, value, flags); err != nil {
+		return xattrError("setxattr", path, err)
+	}
+	return nil
+}
+
+// listxattr lists host attribute names.
+func listxattr(path string) ([]string, error) {
+	for {
+		size, err := syscall.Listxattr(path, nil)
+		if err != nil {
+			return nil, xattrError("listxattr", path, err)
+		}
+
+		buf := make([]byte, size)
+		n, err := syscall.Listxattr(path, buf)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, xattrError("listxattr", path, err)
+		}
+
+		var names []string
+		for _, name := range strings.Split(string(buf[:n]), "\x00") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+}
+
+// removexattr removes a host attribute.
+func removexattr(path, name string) error {
+	if err := syscall.Removexattr(path, name); err != nil {
+		return xattrError("removexattr", path, err)
+	}
+	return nil
+}
+
+// xattrError maps host errors to their vfs equivalents.
+func xattrError(op, path string, err error) error {
+	switch err {
+	case syscall.ENODATA:
+		return vfs.ErrNoAttr
+	case syscall.EEXIST:
+		return vfs.ErrAttrExists
+	}
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package diskfs
+
+import vfs "webos/pkg/vfs"
+
+// hostXattrSupported reports whether the host filesystem holding path
+// stores user extended attributes. Only Linux hosts are supported, so
+// other hosts always use the sidecar store.
+func hostXattrSupported(path string) bool {
+	return false
+}
+
+func getxattr(path, name string) ([]byte, error) {
+	return nil, vfs.ErrNotImplemented
+}
+
+func setxattr(path, name string, value []byte, flags int) error {
+	return vfs.ErrNotImplemented
+}
+
+func listxattr(path string) ([]string, error) {
+	return nil, vfs.ErrNotImplemented
+}
+
+func removexattr(path, name string) error {
+	return vfs.ErrNotImplemented
+}
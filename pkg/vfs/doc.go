@@ -8,9 +8,18 @@
 // # Features
 //
 //   - Multiple storage backends: MemFS, DiskFS, OverlayFS
+//   - Read-only tar, gzipped tar and zip archives for base images
+//   - Synthetic filesystems: procfs over the process manager, devfs with
+//     null, zero, random and pty devices
+//   - Mount tables composing backends into per-process namespaces
+//   - Adapters to and from io/fs, and to net/http
+//   - Remote access over the WebOS binary protocol with remotefs
+//   - Per-file version history with restore via versionfs
+//   - Saving in-memory filesystems to images and restoring them
 //   - Path resolution with symlink support
 //   - File locking (advisory and mandatory)
-//   - Permission system
+//   - Permission system with POSIX ACLs
+//   - Per-user and per-group disk quotas
 //   - Crash recovery via journaling
 //
 // # Usage
@@ -20,6 +20,14 @@ var ErrPermissionDenied = errors.New("vfs: permission denied")
 // ErrInvalidSeek is returned for an invalid seek operation.
 var ErrInvalidSeek = errors.New("vfs: invalid seek")
 
+// ErrWouldBlock is returned by a non-blocking Lock that conflicts with a
+// lock held through another open file.
+var ErrWouldBlock = errors.New("vfs: lock would block")
+
+// ErrInvalidLock is returned for a lock mode that is neither shared nor
+// exclusive.
+var ErrInvalidLock = errors.New("vfs: invalid lock mode")
+
 // vfsFile is the concrete implementation of the File interface.
 type vfsFile struct {
 	mu         sync.RWMutex
@@ -30,8 +38,11 @@ type vfsFile struct {
 	data       []byte
 	offset     int64
 	append     bool
+	lock       LockMode // Lock held through this file, 0 if none
 }
 
+var _ File = (*vfsFile)(nil)
+
 // newVFSFile creates a new file instance.
 func newVFSFile(path string, data []byte, fs FileSystem, readOnly bool) *vfsFile {
 	return &vfsFile{
@@ -46,8 +57,8 @@ func newVFSFile(path string, data []byte, fs FileSystem, readOnly bool) *vfsFile
 
 // Read implements the io.Reader interface.
 func (f *vfsFile) Read(b []byte) (int, error) {
-	f.mu.RLock()
-	defer f.mu.RUnlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
 	if f.closed {
 		return 0, ErrClosedFile
@@ -202,6 +213,81 @@ func (f *vfsFile) Sync() error {
 	return nil
 }
 
+// ReadAt implements the io.ReaderAt interface.
+func (f *vfsFile) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.closed {
+		return 0, ErrClosedFile
+	}
+	if off < 0 {
+		return 0, ErrInvalidSeek
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(b, f.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implements the io.WriterAt interface.
+func (f *vfsFile) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, ErrClosedFile
+	}
+	if f.readOnly {
+		return 0, ErrPermissionDenied
+	}
+	if off < 0 {
+		return 0, ErrInvalidSeek
+	}
+
+	if needed := off + int64(len(b)); needed > int64(len(f.data)) {
+		newData := make([]byte, needed)
+		copy(newData, f.data)
+		f.data = newData
+	}
+	return copy(f.data[off:], b), nil
+}
+
+// Lock places an advisory lock on the file. The file's data is private to
+// this handle, so no other open file can conflict and the lock is granted
+// immediately.
+func (f *vfsFile) Lock(how LockMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return ErrClosedFile
+	}
+	switch {
+	case how&LockExclusive != 0:
+		f.lock = LockExclusive
+	case how&LockShared != 0:
+		f.lock = LockShared
+	default:
+		return ErrInvalidLock
+	}
+	return nil
+}
+
+// Unlock releases the lock held through this file, if any.
+func (f *vfsFile) Unlock() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.lock = 0
+	return nil
+}
+
 // fileData returns the underlying file data (for internal use).
 func (f *vfsFile) fileData() []byte {
 	return f.data
@@ -272,6 +358,49 @@ func newDirEntry(name string, isDir bool, info FileInfo) *dirEntry {
 	}
 }
 
+// infoDirEntry is a DirEntry built from the FileInfo it describes. Its type
+// is taken from the file mode.
+type infoDirEntry struct {
+	info FileInfo
+}
+
+// Name returns the base name of the directory entry.
+func (d infoDirEntry) Name() string {
+	return d.info.Name
+}
+
+// IsDir returns true if the entry is a directory.
+func (d infoDirEntry) IsDir() bool {
+	return d.info.IsDir
+}
+
+// Type returns the type bits of the entry's file mode.
+func (d infoDirEntry) Type() os.FileMode {
+	return d.info.Mode.Type()
+}
+
+// Info returns a FileInfo structure describing the entry.
+func (d infoDirEntry) Info() (FileInfo, error) {
+	return d.info, nil
+}
+
+// NewDirEntry returns a DirEntry describing info, for backends that list
+// directories from FileInfo values they already have.
+func NewDirEntry(info FileInfo) DirEntry {
+	return infoDirEntry{info: info}
+}
+
+// NotExistError builds the error backends return for missing paths.
+func NotExistError(op, path string) error {
+	return &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+}
+
+// ReadOnlyError builds the error read-only backends return for
+// modifications.
+func ReadOnlyError(op, path string) error {
+	return &os.PathError{Op: op, Path: path, Err: ErrReadOnlyFS}
+}
+
 // FileModeFromPerm converts permission bits to a FileMode.
 func FileModeFromPerm(perm os.FileMode) os.FileMode {
 	return perm & 0777
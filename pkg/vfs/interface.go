@@ -65,6 +65,10 @@ type FileSystem interface {
 	// Readlink returns the destination of the named symbolic link.
 	Readlink(path string) (string, error)
 
+	// Link creates newpath as a hard link to oldpath, which must not be a
+	// directory.
+	Link(oldpath, newpath string) error
+
 	// Chmod changes the mode of the file at path.
 	Chmod(path string, mode os.FileMode) error
 
@@ -105,6 +109,25 @@ type File interface {
 
 	// Sync commits the current contents of the file to stable storage.
 	Sync() error
+
+	// ReadAt reads len(b) bytes starting at offset off.
+	// It neither uses nor changes the offset used by Read and Write.
+	io.ReaderAt
+
+	// WriteAt writes len(b) bytes starting at offset off.
+	// It neither uses nor changes the offset used by Read and Write.
+	io.WriterAt
+
+	// Lock places an advisory lock on the file, with flock(2) semantics.
+	// Locks belong to the open file: any number of open files may hold a
+	// shared lock, an exclusive lock excludes all others, and requesting
+	// a lock already held converts it. Lock blocks until the lock is
+	// granted unless LockNonBlock is set, in which case it fails with
+	// ErrWouldBlock. Closing the file releases its lock.
+	Lock(how LockMode) error
+
+	// Unlock releases the lock held through this file, if any.
+	Unlock() error
 }
 
 // FileInfo describes a file and is returned by Stat and Lstat.
@@ -117,6 +140,31 @@ type FileInfo struct {
 	Sys     interface{} // Underlying data source (can be nil)
 }
 
+// Stat carries inode metadata. Backends that track inodes return a *Stat
+// as FileInfo.Sys.
+type Stat struct {
+	Ino   uint64    // Inode number, stable for the life of the file
+	Nlink uint64    // Number of hard links
+	Uid   int       // Owner user ID
+	Gid   int       // Owner group ID
+	Atime time.Time // Last access time
+	Ctime time.Time // Last status change time
+}
+
+// Owner implements Owner.
+func (s *Stat) Owner() (uid, gid int) {
+	return s.Uid, s.Gid
+}
+
+// StatOf returns the inode metadata in info. It understands *Stat values
+// and host stat structures, from which times are not carried over.
+func StatOf(info FileInfo) (*Stat, bool) {
+	if st, ok := info.Sys.(*Stat); ok {
+		return st, true
+	}
+	return sysStat(info.Sys)
+}
+
 // DirEntry is an entry read from a directory, similar to os.DirEntry.
 type DirEntry interface {
 	// Name returns the base name of the file or directory.
@@ -151,6 +199,16 @@ const (
 	SEEK_END = io.SeekEnd     // Relative to end of file.
 )
 
+// LockMode selects the kind of lock taken by File.Lock.
+type LockMode int
+
+// Lock modes, matching flock(2) operations.
+const (
+	LockShared    LockMode = 1 << iota // Shared (read) lock
+	LockExclusive                      // Exclusive (write) lock
+	LockNonBlock                       // Fail instead of waiting
+)
+
 // FileMode bit masks for file types and permissions.
 const (
 	ModeDir        = os.ModeDir        // Directory
@@ -0,0 +1,633 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ToIOFS returns an io/fs view of fsys, so it can be used with fs.WalkDir,
+// template.ParseFS, http.FileServerFS and the like.
+//
+// Names follow io/fs conventions: unrooted and slash-separated, with "."
+// naming the root. Errors are *fs.PathError values, and missing files,
+// denied access and closed files match fs.ErrNotExist, fs.ErrPermission
+// and fs.ErrClosed.
+func ToIOFS(fsys FileSystem) fs.FS {
+	return &toIOFS{fsys: fsys}
+}
+
+// toIOFS implements fs.FS over a FileSystem.
+type toIOFS struct {
+	fsys FileSystem
+}
+
+// path converts an io/fs name to an absolute path. Names containing
+// backslashes are rejected, since Clean treats them as separators.
+func (f *toIOFS) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) || strings.Contains(name, "\\") {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return "/", nil
+	}
+	return "/" + name, nil
+}
+
+// ioError wraps err from the operation on name for io/fs callers,
+// translating this package's errors to their io/fs counterparts.
+func ioError(op, name string, err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+
+	switch err {
+	case ErrPermissionDenied:
+		err = fs.ErrPermission
+	case ErrClosedFile:
+		err = fs.ErrClosed
+	case ErrEmptyPath, ErrNotAbsolute, ErrInvalidPath:
+		err = fs.ErrInvalid
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// Open implements fs.FS. Directories are returned as fs.ReadDirFile
+// values.
+func (f *toIOFS) Open(name string) (fs.File, error) {
+	path, err := f.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.fsys.Stat(path)
+	if err != nil {
+		return nil, ioError("open", name, err)
+	}
+	if info.IsDir {
+		return &ioDir{fsys: f.fsys, path: path, name: name, info: info}, nil
+	}
+
+	file, err := f.fsys.Open(path)
+	if err != nil {
+		return nil, ioError("open", name, err)
+	}
+	return &ioFile{file: file, name: name}, nil
+}
+
+// Stat implements fs.StatFS.
+func (f *toIOFS) Stat(name string) (fs.FileInfo, error) {
+	path, err := f.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.fsys.Stat(path)
+	if err != nil {
+		return nil, ioError("stat", name, err)
+	}
+	return ioFileInfo{info}, nil
+}
+
+// Lstat implements fs.ReadLinkFS.
+func (f *toIOFS) Lstat(name string) (fs.FileInfo, error) {
+	path, err := f.path("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.fsys.Lstat(path)
+	if err != nil {
+		return nil, ioError("lstat", name, err)
+	}
+	return ioFileInfo{info}, nil
+}
+
+// ReadLink implements fs.ReadLinkFS.
+func (f *toIOFS) ReadLink(name string) (string, error) {
+	path, err := f.path("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	target, err := f.fsys.Readlink(path)
+	if err != nil {
+		return "", ioError("readlink", name, err)
+	}
+	return target, nil
+}
+
+// ReadDir implements fs.ReadDirFS. Entries are sorted by name.
+func (f *toIOFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	path, err := f.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return readIODir(f.fsys, path, name)
+}
+
+// readIODir lists the directory at path for io/fs callers.
+func readIODir(fsys FileSystem, path, name string) ([]fs.DirEntry, error) {
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		return nil, ioError("readdir", name, err)
+	}
+
+	list := make([]fs.DirEntry, len(entries))
+	for i, entry := range entries {
+		list[i] = ioDirEntry{entry}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name() < list[j].Name()
+	})
+	return list, nil
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (f *toIOFS) ReadFile(name string) ([]byte, error) {
+	path, err := f.path("read", name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := f.fsys.ReadFile(path)
+	if err != nil {
+		return nil, ioError("read", name, err)
+	}
+	return data, nil
+}
+
+// ioFile implements fs.File over an open File. It also implements
+// io.Seeker and io.ReaderAt, as http.FS requires.
+type ioFile struct {
+	file File
+	name string
+}
+
+func (f *ioFile) Read(b []byte) (int, error) {
+	n, err := f.file.Read(b)
+	if err != nil && err != io.EOF {
+		err = ioError("read", f.name, err)
+	}
+	return n, err
+}
+
+func (f *ioFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.file.ReadAt(b, off)
+	if err != nil && err != io.EOF {
+		err = ioError("read", f.name, err)
+	}
+	return n, err
+}
+
+func (f *ioFile) Seek(offset int64, whence int) (int64, error) {
+	n, err := f.file.Seek(offset, whence)
+	if err != nil {
+		err = ioError("seek", f.name, err)
+	}
+	return n, err
+}
+
+func (f *ioFile) Stat() (fs.FileInfo, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return nil, ioError("stat", f.name, err)
+	}
+	return ioFileInfo{info}, nil
+}
+
+func (f *ioFile) Close() error {
+	if err := f.file.Close(); err != nil {
+		return ioError("close", f.name, err)
+	}
+	return nil
+}
+
+// ioDir implements fs.ReadDirFile for a directory. Its entries are listed
+// on the first call to ReadDir.
+type ioDir struct {
+	fsys    FileSystem
+	path    string
+	name    string
+	info    FileInfo
+	entries []fs.DirEntry
+	listed  bool
+	closed  bool
+	mu      sync.Mutex
+}
+
+func (d *ioDir) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+// Seek implements io.Seeker. Seeking to the start restarts ReadDir.
+func (d *ioDir) Seek(offset int64, whence int) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if offset != 0 || whence != io.SeekStart {
+		return 0, &fs.PathError{Op: "seek", Path: d.name, Err: fs.ErrInvalid}
+	}
+	d.entries = nil
+	d.listed = false
+	return 0, nil
+}
+
+func (d *ioDir) Stat() (fs.FileInfo, error) {
+	return ioFileInfo{d.info}, nil
+}
+
+// ReadDir implements fs.ReadDirFile. With n > 0 it returns at most n
+// entries, and io.EOF once none remain; otherwise it returns all remaining
+// entries.
+func (d *ioDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: fs.ErrClosed}
+	}
+	if !d.listed {
+		entries, err := readIODir(d.fsys, d.path, d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		d.listed = true
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *ioDir) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return &fs.PathError{Op: "close", Path: d.name, Err: fs.ErrClosed}
+	}
+	d.closed = true
+	return nil
+}
+
+// ioFileInfo implements fs.FileInfo over a FileInfo.
+type ioFileInfo struct {
+	info FileInfo
+}
+
+func (i ioFileInfo) Name() string       { return i.info.Name }
+func (i ioFileInfo) Size() int64        { return i.info.Size }
+func (i ioFileInfo) ModTime() time.Time { return i.info.ModTime }
+func (i ioFileInfo) IsDir() bool        { return i.info.IsDir }
+func (i ioFileInfo) Sys() interface{}   { return i.info.Sys }
+
+// Mode implements fs.FileInfo. Directories always carry fs.ModeDir, which
+// some backends leave out of FileInfo.Mode.
+func (i ioFileInfo) Mode() fs.FileMode {
+	if i.info.IsDir {
+		return i.info.Mode | fs.ModeDir
+	}
+	return i.info.Mode
+}
+
+// ioDirEntry implements fs.DirEntry over a DirEntry.
+type ioDirEntry struct {
+	entry DirEntry
+}
+
+func (e ioDirEntry) Name() string {
+	return e.entry.Name()
+}
+
+func (e ioDirEntry) IsDir() bool {
+	return e.entry.IsDir()
+}
+
+func (e ioDirEntry) Type() fs.FileMode {
+	if e.entry.IsDir() {
+		return e.entry.Type() | fs.ModeDir
+	}
+	return e.entry.Type()
+}
+
+func (e ioDirEntry) Info() (fs.FileInfo, error) {
+	info, err := e.entry.Info()
+	if err != nil {
+		return nil, ioError("stat", e.entry.Name(), err)
+	}
+	return ioFileInfo{info}, nil
+}
+
+// FromIOFS returns a read-only FileSystem over fsys, such as an embed.FS
+// or the result of os.DirFS. Symlinks are supported when fsys implements
+// fs.ReadLinkFS.
+func FromIOFS(fsys fs.FS) FileSystem {
+	return &fromIOFS{fsys: fsys}
+}
+
+// fromIOFS implements FileSystem over an fs.FS.
+type fromIOFS struct {
+	fsys fs.FS
+}
+
+// name converts an absolute path to an io/fs name.
+func (f *fromIOFS) name(path string) (string, error) {
+	if err := ValidatePath(path); err != nil {
+		return "", err
+	}
+	path = Clean(path)
+	if path == "/" {
+		return ".", nil
+	}
+	return strings.TrimPrefix(path, "/"), nil
+}
+
+// vfsError rewraps err from io/fs with the path this package was given.
+func vfsError(op, path string, err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
+// Open implements FileSystem.Open.
+func (f *fromIOFS) Open(path string) (File, error) {
+	return f.OpenFile(path, O_RDONLY, 0)
+}
+
+// OpenFile implements FileSystem.OpenFile. Only reading is allowed.
+func (f *fromIOFS) OpenFile(path string, flags int, perm os.FileMode) (File, error) {
+	if flags&(O_WRONLY|O_RDWR|O_CREATE|O_TRUNC|O_APPEND) != 0 {
+		return nil, ReadOnlyError("open", path)
+	}
+	name, err := f.name(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil, vfsError("open", path, err)
+	}
+	return &fromIOFile{file: file, path: path}, nil
+}
+
+// Stat implements FileSystem.Stat.
+func (f *fromIOFS) Stat(path string) (FileInfo, error) {
+	name, err := f.name(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := fs.Stat(f.fsys, name)
+	if err != nil {
+		return FileInfo{}, vfsError("stat", path, err)
+	}
+	return fromIOFileInfo(info), nil
+}
+
+// Lstat implements FileSystem.Lstat.
+func (f *fromIOFS) Lstat(path string) (FileInfo, error) {
+	name, err := f.name(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := fs.Lstat(f.fsys, name)
+	if err != nil {
+		return FileInfo{}, vfsError("lstat", path, err)
+	}
+	return fromIOFileInfo(info), nil
+}
+
+// fromIOFileInfo converts an fs.FileInfo to a FileInfo.
+func fromIOFileInfo(info fs.FileInfo) FileInfo {
+	return FileInfo{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+		Sys:     info.Sys(),
+	}
+}
+
+// Mkdir implements FileSystem.Mkdir.
+func (f *fromIOFS) Mkdir(path string, perm os.FileMode) error {
+	return ReadOnlyError("mkdir", path)
+}
+
+// MkdirAll implements FileSystem.MkdirAll.
+func (f *fromIOFS) MkdirAll(path string, perm os.FileMode) error {
+	return ReadOnlyError("mkdir", path)
+}
+
+// Remove implements FileSystem.Remove.
+func (f *fromIOFS) Remove(path string) error {
+	return ReadOnlyError("remove", path)
+}
+
+// RemoveAll implements FileSystem.RemoveAll.
+func (f *fromIOFS) RemoveAll(path string) error {
+	return ReadOnlyError("removeall", path)
+}
+
+// Rename implements FileSystem.Rename.
+func (f *fromIOFS) Rename(oldpath, newpath string) error {
+	return ReadOnlyError("rename", oldpath)
+}
+
+// ReadDir implements FileSystem.ReadDir.
+func (f *fromIOFS) ReadDir(path string) ([]DirEntry, error) {
+	name, err := f.name(path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(f.fsys, name)
+	if err != nil {
+		return nil, vfsError("readdir", path, err)
+	}
+
+	list := make([]DirEntry, len(entries))
+	for i, entry := range entries {
+		list[i] = fromIODirEntry{entry}
+	}
+	return list, nil
+}
+
+// ReadFile implements FileSystem.ReadFile.
+func (f *fromIOFS) ReadFile(path string) ([]byte, error) {
+	name, err := f.name(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fs.ReadFile(f.fsys, name)
+	if err != nil {
+		return nil, vfsError("read", path, err)
+	}
+	return data, nil
+}
+
+// WriteFile implements FileSystem.WriteFile.
+func (f *fromIOFS) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return ReadOnlyError("write", path)
+}
+
+// Create implements FileSystem.Create.
+func (f *fromIOFS) Create(path string) (File, error) {
+	return nil, ReadOnlyError("create", path)
+}
+
+// Symlink implements FileSystem.Symlink.
+func (f *fromIOFS) Symlink(target, newpath string) error {
+	return ReadOnlyError("symlink", newpath)
+}
+
+// Readlink implements FileSystem.Readlink.
+func (f *fromIOFS) Readlink(path string) (string, error) {
+	name, err := f.name(path)
+	if err != nil {
+		return "", err
+	}
+	target, err := fs.ReadLink(f.fsys, name)
+	if err != nil {
+		return "", vfsError("readlink", path, err)
+	}
+	return target, nil
+}
+
+// Link implements FileSystem.Link.
+func (f *fromIOFS) Link(oldpath, newpath string) error {
+	return ReadOnlyError("link", newpath)
+}
+
+// Chmod implements FileSystem.Chmod.
+func (f *fromIOFS) Chmod(path string, mode os.FileMode) error {
+	return ReadOnlyError("chmod", path)
+}
+
+// Chown implements FileSystem.Chown.
+func (f *fromIOFS) Chown(path string, uid, gid int) error {
+	return ReadOnlyError("chown", path)
+}
+
+// Chtimes implements FileSystem.Chtimes.
+func (f *fromIOFS) Chtimes(path string, atime, mtime time.Time) error {
+	return ReadOnlyError("chtimes", path)
+}
+
+// fromIOFile implements File over an fs.File. Seek and ReadAt work when
+// the fs.File supports them, as embed.FS and os.DirFS files do.
+type fromIOFile struct {
+	file fs.File
+	path string
+}
+
+func (f *fromIOFile) Read(b []byte) (int, error) {
+	return f.file.Read(b)
+}
+
+func (f *fromIOFile) ReadAt(b []byte, off int64) (int, error) {
+	r, ok := f.file.(io.ReaderAt)
+	if !ok {
+		return 0, &os.PathError{Op: "read", Path: f.path, Err: ErrNotImplemented}
+	}
+	return r.ReadAt(b, off)
+}
+
+func (f *fromIOFile) Seek(offset int64, whence int) (int64, error) {
+	s, ok := f.file.(io.Seeker)
+	if !ok {
+		return 0, &os.PathError{Op: "seek", Path: f.path, Err: ErrNotImplemented}
+	}
+	return s.Seek(offset, whence)
+}
+
+func (f *fromIOFile) Write(b []byte) (int, error) {
+	return 0, ReadOnlyError("write", f.path)
+}
+
+func (f *fromIOFile) WriteAt(b []byte, off int64) (int, error) {
+	return 0, ReadOnlyError("write", f.path)
+}
+
+func (f *fromIOFile) Close() error {
+	return f.file.Close()
+}
+
+func (f *fromIOFile) Stat() (FileInfo, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return FileInfo{}, vfsError("stat", f.path, err)
+	}
+	return fromIOFileInfo(info), nil
+}
+
+func (f *fromIOFile) Truncate(size int64) error {
+	return ReadOnlyError("truncate", f.path)
+}
+
+func (f *fromIOFile) Sync() error {
+	return nil
+}
+
+func (f *fromIOFile) Lock(how LockMode) error {
+	return ErrNotImplemented
+}
+
+func (f *fromIOFile) Unlock() error {
+	return ErrNotImplemented
+}
+
+// fromIODirEntry implements DirEntry over an fs.DirEntry.
+type fromIODirEntry struct {
+	entry fs.DirEntry
+}
+
+func (e fromIODirEntry) Name() string {
+	return e.entry.Name()
+}
+
+func (e fromIODirEntry) IsDir() bool {
+	return e.entry.IsDir()
+}
+
+func (e fromIODirEntry) Type() os.FileMode {
+	return e.entry.Type()
+}
+
+func (e fromIODirEntry) Info() (FileInfo, error) {
+	info, err := e.entry.Info()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return fromIOFileInfo(info), nil
+}
+
+// HTTPFileSystem returns an http.FileSystem serving fsys, for use with
+// http.FileServer or server.NewStaticFileHandlerFS.
+func HTTPFileSystem(fsys FileSystem) http.FileSystem {
+	return http.FS(ToIOFS(fsys))
+}
+
+var (
+	_ fs.ReadDirFS   = (*toIOFS)(nil)
+	_ fs.StatFS      = (*toIOFS)(nil)
+	_ fs.ReadFileFS  = (*toIOFS)(nil)
+	_ fs.ReadLinkFS  = (*toIOFS)(nil)
+	_ fs.ReadDirFile = (*ioDir)(nil)
+	_ FileSystem     = (*fromIOFS)(nil)
+)
@@ -0,0 +1,459 @@
+package memfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	vfs "webos/pkg/vfs"
+)
+
+// Image format. An image is a header followed by the root directory
+// encoded as a node, with integers in big-endian order:
+//
+//	header:  magic [8]byte "WEBOSMFS" | version u16
+//	node:    ino u64, and unless the inode appeared earlier in the image
+//	         (a hard link): kind u8 | mode u32 | uid i64 | gid i64 |
+//	         atime i64 | mtime i64 | ctime i64 (Unix nanoseconds) |
+//	         xattr count u32 | {name str | value bytes}... | body
+//	body:    file: data bytes; symlink: target str;
+//	         directory: entry count u32 | {name str | node}...
+//	str:     length u32 | bytes
+//	bytes:   length u64 | bytes
+//
+// Link counts are not stored; they follow from the tree.
+const (
+	imageMagic   = "WEBOSMFS"
+	imageVersion = 1
+)
+
+// Node kinds in an image.
+const (
+	kindFile uint8 = iota
+	kindDir
+	kindSymlink
+)
+
+// ErrBadImage is returned by Load for data that is not a valid image.
+var ErrBadImage = errors.New("memfs: invalid image")
+
+// ErrImageVersion is returned by Load for images written by a newer
+// format version.
+var ErrImageVersion = errors.New("memfs: unsupported image version")
+
+// SaveTo writes an image of the filesystem to w. The image holds the
+// directory tree with the contents, modes, owners, times, extended
+// attributes and symlinks of every node, and keeps hard links shared.
+// Locks and open files are not saved. Changes to the tree wait until the
+// image is written, while writes through open files may land in it.
+func (fs *FS) SaveTo(w io.Writer) error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	iw := &imageWriter{w: bufio.NewWriter(w), seen: make(map[uint64]bool)}
+	iw.write([]byte(imageMagic))
+	iw.u16(imageVersion)
+	iw.node(fs.root)
+	if iw.err != nil {
+		return iw.err
+	}
+	return iw.w.Flush()
+}
+
+// Load reads an image written by SaveTo into a new filesystem.
+func Load(r io.Reader) (*FS, error) {
+	ir := &imageReader{r: bufio.NewReader(r), nodes: make(map[uint64]*memNode)}
+
+	magic := ir.read(len(imageMagic))
+	version := ir.u16()
+	if ir.err != nil {
+		return nil, ir.err
+	}
+	if string(magic) != imageMagic {
+		return nil, ErrBadImage
+	}
+	if version != imageVersion {
+		return nil, fmt.Errorf("%w %d", ErrImageVersion, version)
+	}
+
+	root := ir.node()
+	if ir.err != nil {
+		return nil, ir.err
+	}
+	if !root.isDir {
+		return nil, ErrBadImage
+	}
+
+	fs := &FS{root: root}
+	for ino := range ir.nodes {
+		fs.lastIno = max(fs.lastIno, ino)
+	}
+	return fs, nil
+}
+
+// SaveFile writes an image of the filesystem to the host file at path,
+// replacing it only once the image is complete.
+func (fs *FS) SaveFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = fs.SaveTo(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadFile reads an image from the host file at path.
+func LoadFile(path string) (*FS, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Load(f)
+}
+
+// SnapshotEvery saves the filesystem to the host file at path every
+// interval, skipping intervals in which nothing changed. A failed snapshot
+// is retried at the next interval. Calling stop ends the snapshots and
+// takes a final one, returning its error; change events arrive
+// asynchronously, so the last changes may not have been seen yet.
+func (fs *FS) SnapshotEvery(path string, interval time.Duration) (stop func() error) {
+	var dirty atomic.Bool
+	cancel := fs.Subscribe(func(vfs.Event) { dirty.Store(true) })
+
+	var mu sync.Mutex // Serializes saves with the final one
+	save := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !dirty.Swap(false) {
+			return nil
+		}
+		if err := fs.SaveFile(path); err != nil {
+			dirty.Store(true)
+			return err
+		}
+		return nil
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				save()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() error {
+		var err error
+		once.Do(func() {
+			close(done)
+			<-finished
+			cancel()
+			dirty.Store(true)
+			err = save()
+		})
+		return err
+	}
+}
+
+// imageWriter encodes an image, keeping the first error.
+type imageWriter struct {
+	w    *bufio.Writer
+	seen map[uint64]bool
+	buf  [8]byte
+	err  error
+}
+
+func (iw *imageWriter) write(b []byte) {
+	if iw.err == nil {
+		_, iw.err = iw.w.Write(b)
+	}
+}
+
+func (iw *imageWriter) u8(v uint8) {
+	iw.write([]byte{v})
+}
+
+func (iw *imageWriter) u16(v uint16) {
+	binary.BigEndian.PutUint16(iw.buf[:2], v)
+	iw.write(iw.buf[:2])
+}
+
+func (iw *imageWriter) u32(v uint32) {
+	binary.BigEndian.PutUint32(iw.buf[:4], v)
+	iw.write(iw.buf[:4])
+}
+
+func (iw *imageWriter) u64(v uint64) {
+	binary.BigEndian.PutUint64(iw.buf[:], v)
+	iw.write(iw.buf[:])
+}
+
+func (iw *imageWriter) time(t time.Time) {
+	iw.u64(uint64(t.UnixNano()))
+}
+
+func (iw *imageWriter) str(s string) {
+	iw.u32(uint32(len(s)))
+	iw.write([]byte(s))
+}
+
+func (iw *imageWriter) bytes(b []byte) {
+	iw.u64(uint64(len(b)))
+	iw.write(b)
+}
+
+// node encodes n and everything beneath it.
+func (iw *imageWriter) node(n *memNode) {
+	iw.u64(n.ino)
+	if iw.seen[n.ino] {
+		return
+	}
+	iw.seen[n.ino] = true
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	switch {
+	case n.isDir:
+		iw.u8(kindDir)
+	case n.symlink != "":
+		iw.u8(kindSymlink)
+	default:
+		iw.u8(kindFile)
+	}
+	iw.u32(uint32(n.mode))
+	iw.u64(uint64(n.uid))
+	iw.u64(uint64(n.gid))
+	iw.time(n.atime)
+	iw.time(n.mtime)
+	iw.time(n.ctime)
+
+	names := make([]string, 0, len(n.xattrs))
+	for name := range n.xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	iw.u32(uint32(len(names)))
+	for _, name := range names {
+		iw.str(name)
+		iw.bytes(n.xattrs[name])
+	}
+
+	switch {
+	case n.isDir:
+		names := make([]string, 0, len(n.children))
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		iw.u32(uint32(len(names)))
+		for _, name := range names {
+			iw.str(name)
+			iw.node(n.children[name])
+		}
+	case n.symlink != "":
+		iw.str(n.symlink)
+	default:
+		iw.bytes(n.data)
+	}
+}
+
+// imageReader decodes an image, keeping the first error. Truncated images
+// report io.ErrUnexpectedEOF.
+type imageReader struct {
+	r     *bufio.Reader
+	nodes map[uint64]*memNode
+	buf   [8]byte
+	err   error
+}
+
+func (ir *imageReader) fail(err error) {
+	if ir.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		ir.err = err
+	}
+}
+
+// read reads n bytes, which must be small enough to allocate up front.
+func (ir *imageReader) read(n int) []byte {
+	if ir.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(ir.r, b); err != nil {
+		ir.fail(err)
+		return nil
+	}
+	return b
+}
+
+func (ir *imageReader) fixed(n int) []byte {
+	if ir.err != nil {
+		return make([]byte, n)
+	}
+	if _, err := io.ReadFull(ir.r, ir.buf[:n]); err != nil {
+		ir.fail(err)
+	}
+	return ir.buf[:n]
+}
+
+func (ir *imageReader) u8() uint8 {
+	return ir.fixed(1)[0]
+}
+
+func (ir *imageReader) u16() uint16 {
+	return binary.BigEndian.Uint16(ir.fixed(2))
+}
+
+func (ir *imageReader) u32() uint32 {
+	return binary.BigEndian.Uint32(ir.fixed(4))
+}
+
+func (ir *imageReader) u64() uint64 {
+	return binary.BigEndian.Uint64(ir.fixed(8))
+}
+
+func (ir *imageReader) time() time.Time {
+	return time.Unix(0, int64(ir.u64()))
+}
+
+func (ir *imageReader) str() string {
+	n := ir.u32()
+	if n > vfs.MaxPathLength {
+		ir.fail(ErrBadImage)
+	}
+	return string(ir.read(int(n)))
+}
+
+// bytes reads a length-prefixed value, growing the buffer as data arrives
+// so a corrupt length cannot force a huge allocation.
+func (ir *imageReader) bytes() []byte {
+	n := ir.u64()
+	if ir.err != nil || n == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, ir.r, int64(n)); err != nil {
+		ir.fail(err)
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// node decodes a node and everything beneath it. Link counts are rebuilt
+// as entries are added.
+func (ir *imageReader) node() *memNode {
+	ino := ir.u64()
+	if ir.err != nil {
+		return nil
+	}
+	if n, ok := ir.nodes[ino]; ok {
+		if n.isDir {
+			// Directories have a single entry
+			ir.fail(ErrBadImage)
+			return nil
+		}
+		n.nlink++
+		return n
+	}
+	if ino == 0 {
+		ir.fail(ErrBadImage)
+		return nil
+	}
+
+	kind := ir.u8()
+	if kind > kindSymlink {
+		ir.fail(ErrBadImage)
+		return nil
+	}
+	n := &memNode{
+		ino:      ino,
+		isDir:    kind == kindDir,
+		children: make(map[string]*memNode),
+		mode:     os.FileMode(ir.u32()),
+		uid:      int(int64(ir.u64())),
+		gid:      int(int64(ir.u64())),
+		atime:    ir.time(),
+		mtime:    ir.time(),
+		ctime:    ir.time(),
+		nlink:    1,
+	}
+	ir.nodes[ino] = n
+
+	for count := ir.u32(); count > 0 && ir.err == nil; count-- {
+		name := ir.str()
+		value := ir.bytes()
+		if n.xattrs == nil {
+			n.xattrs = make(map[string][]byte)
+		}
+		n.xattrs[name] = value
+	}
+
+	switch kind {
+	case kindDir:
+		n.nlink = 2
+		for count := ir.u32(); count > 0 && ir.err == nil; count-- {
+			name := ir.str()
+			if ir.err == nil && (name == "" || name == "." || name == ".." || strings.Contains(name, "/")) {
+				ir.fail(ErrBadImage)
+			}
+			child := ir.node()
+			if ir.err != nil {
+				break
+			}
+			if _, ok := n.children[name]; ok {
+				ir.fail(ErrBadImage)
+				break
+			}
+			n.children[name] = child
+			if child.isDir {
+				n.nlink++
+			}
+		}
+	case kindSymlink:
+		n.symlink = ir.str()
+		if ir.err == nil && n.symlink == "" {
+			ir.fail(ErrBadImage)
+		}
+	default:
+		n.data = ir.bytes()
+	}
+	return n
+}
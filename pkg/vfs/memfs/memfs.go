@@ -1,10 +1,14 @@
 // Package memfs provides an in-memory filesystem implementation.
 // It is useful for ephemeral storage, testing, or as a temporary cache.
+// Its contents can be saved to an image with FS.SaveTo and restored with
+// Load, to survive restarts.
 package memfs
 
 import (
 	"errors"
+	"io"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -12,11 +16,13 @@ import (
 	vfs "webos/pkg/vfs"
 )
 
-// ErrFileNotFound is returned when a file is not found.
-var ErrFileNotFound = errors.New("memfs: file not found")
+// ErrFileNotFound is returned when a file is not found. It matches
+// os.ErrNotExist.
+var ErrFileNotFound error = &memError{"memfs: file not found", os.ErrNotExist}
 
-// ErrFileExists is returned when a file already exists.
-var ErrFileExists = errors.New("memfs: file already exists")
+// ErrFileExists is returned when a file already exists. It matches
+// os.ErrExist.
+var ErrFileExists error = &memError{"memfs: file already exists", os.ErrExist}
 
 // ErrNotDirectory is returned when a path is not a directory.
 var ErrNotDirectory = errors.New("memfs: not a directory")
@@ -27,6 +33,24 @@ var ErrIsDirectory = errors.New("memfs: is a directory")
 // ErrReadOnly is returned when writing to a read-only filesystem.
 var ErrReadOnly = errors.New("memfs: read-only filesystem")
 
+// ErrWriteAtInAppendMode is returned by WriteAt on a file opened with O_APPEND.
+var ErrWriteAtInAppendMode = errors.New("memfs: invalid use of WriteAt on file opened with O_APPEND")
+
+// memError is an error that also matches a standard os error, so callers
+// can test errors.Is(err, os.ErrNotExist) without knowing the backend.
+type memError struct {
+	msg  string
+	kind error
+}
+
+func (e *memError) Error() string {
+	return e.msg
+}
+
+func (e *memError) Is(target error) bool {
+	return target == e.kind
+}
+
 // memNode represents a node in the filesystem (file or directory).
 type memNode struct {
 	mu       sync.RWMutex
@@ -40,26 +64,163 @@ type memNode struct {
 	mtime    time.Time
 	ctime    time.Time
 	symlink  string // Target if this is a symlink
+	ino      uint64
+	nlink    uint64 // Entries referring to the node, plus subdirectories' ".."
+	xattrs   map[string][]byte
+	locks    nodeLocks
+}
+
+// nodeLocks tracks the advisory locks held on a node by open files.
+type nodeLocks struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	shared    map[*memFile]bool
+	exclusive *memFile
+}
+
+// conflicts reports whether f may not take the lock because of locks held
+// through other files (caller must hold lock).
+func (l *nodeLocks) conflicts(f *memFile, exclusive bool) bool {
+	if l.exclusive != nil && l.exclusive != f {
+		return true
+	}
+	if exclusive {
+		for holder := range l.shared {
+			if holder != f {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acquire takes a shared or exclusive lock for f, converting any lock f
+// already holds.
+func (l *nodeLocks) acquire(f *memFile, exclusive, wait bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mu)
+		l.shared = make(map[*memFile]bool)
+	}
+
+	if l.conflicts(f, exclusive) {
+		if !wait {
+			return vfs.ErrWouldBlock
+		}
+
+		// As with flock, a blocking conversion gives up the old lock
+		// first so two upgrading holders cannot deadlock
+		l.releaseLocked(f)
+		for l.conflicts(f, exclusive) {
+			l.cond.Wait()
+		}
+	}
+
+	l.releaseLocked(f)
+	if exclusive {
+		l.exclusive = f
+	} else {
+		l.shared[f] = true
+	}
+	return nil
+}
+
+// release drops any lock held by f.
+func (l *nodeLocks) release(f *memFile) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked(f)
+}
+
+// releaseLocked drops any lock held by f (caller must hold lock).
+func (l *nodeLocks) releaseLocked(f *memFile) {
+	released := false
+	if l.exclusive == f {
+		l.exclusive = nil
+		released = true
+	}
+	if l.shared[f] {
+		delete(l.shared, f)
+		released = true
+	}
+	if released && l.cond != nil {
+		l.cond.Broadcast()
+	}
 }
 
 // newMemNode creates a new memory node.
 func newMemNode(isDir bool) *memNode {
 	now := time.Now()
+	mode := os.FileMode(0666)
+	nlink := uint64(1)
+	if isDir {
+		mode = 0777
+		nlink = 2
+	}
 	return &memNode{
 		isDir:    isDir,
 		children: make(map[string]*memNode),
-		mode:     0666 &^ umask,
+		mode:     mode &^ umask,
+		nlink:    nlink,
 		atime:    now,
 		mtime:    now,
 		ctime:    now,
 	}
 }
 
+// stat returns the node's inode metadata.
+func (n *memNode) stat() *vfs.Stat {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return &vfs.Stat{
+		Ino:   n.ino,
+		Nlink: n.nlink,
+		Uid:   n.uid,
+		Gid:   n.gid,
+		Atime: n.atime,
+		Ctime: n.ctime,
+	}
+}
+
+// unlinkNode drops the entry in parent referring to node, releasing
+// everything beneath a directory (caller must hold lock). Link counts and
+// change times are updated under each node's own lock, as stat reads them
+// without the filesystem lock.
+func unlinkNode(parent, node *memNode) {
+	now := time.Now()
+	if !node.isDir {
+		node.mu.Lock()
+		node.nlink--
+		node.ctime = now
+		node.mu.Unlock()
+		return
+	}
+
+	parent.mu.Lock()
+	parent.nlink--
+	parent.mu.Unlock()
+	for _, child := range node.children {
+		unlinkNode(node, child)
+	}
+	node.mu.Lock()
+	node.nlink = 0
+	node.ctime = now
+	node.mu.Unlock()
+}
+
 // FS represents an in-memory filesystem.
+//
+// Every node has an inode number that stays the same across renames and
+// is shared by its hard links. FileInfo.Sys is a *vfs.Stat.
 type FS struct {
 	mu       sync.RWMutex
 	root     *memNode
 	readOnly bool
+	lastIno  uint64
+	events   vfs.EventHub
 }
 
 // umask is the default umask for new files.
@@ -67,19 +228,29 @@ var umask os.FileMode = 022
 
 // New creates a new in-memory filesystem.
 func New() *FS {
-	fs := &FS{
-		root: newMemNode(true),
-	}
-	fs.root.isDir = true
+	fs := &FS{}
+	fs.root = fs.newNode(true)
 	return fs
 }
 
 // NewReadOnly creates a new read-only in-memory filesystem.
 func NewReadOnly() *FS {
-	return &FS{
-		root:     newMemNode(true),
-		readOnly: true,
-	}
+	fs := &FS{readOnly: true}
+	fs.root = fs.newNode(true)
+	return fs
+}
+
+// newNode creates a node with the next inode number (caller must hold lock).
+func (fs *FS) newNode(isDir bool) *memNode {
+	fs.lastIno++
+	node := newMemNode(isDir)
+	node.ino = fs.lastIno
+	return node
+}
+
+// Subscribe implements vfs.Notifier.
+func (fs *FS) Subscribe(fn func(vfs.Event)) (cancel func()) {
+	return fs.events.Subscribe(fn)
 }
 
 // nodeFromPath walks the filesystem and returns the node at the given path.
@@ -209,14 +380,18 @@ func (fs *FS) OpenFile(path string, flags int, perm os.FileMode) (vfs.File, erro
 
 		// Handle O_TRUNC
 		if (flags&vfs.O_TRUNC) != 0 && !readOnly {
+			node.mu.Lock()
 			node.data = nil
 			node.mtime = time.Now()
+			node.ctime = node.mtime
+			node.mu.Unlock()
+			fs.events.Emit(vfs.OpWrite, path)
 		}
 
 		// Handle O_APPEND
 		append := (flags & vfs.O_APPEND) != 0
 
-		file := newVFSFileFromNode(path, node, readOnly, append)
+		file := newVFSFileFromNode(path, node, readOnly, append, &fs.events)
 		return file, nil
 	}
 
@@ -241,14 +416,15 @@ func (fs *FS) OpenFile(path string, flags int, perm os.FileMode) (vfs.File, erro
 		return nil, ErrFileExists
 	}
 
-	newNode := newMemNode(false)
+	newNode := fs.newNode(false)
 	newNode.mode = perm & 0777
 	dirNode.children[base] = newNode
+	fs.events.Emit(vfs.OpCreate, path)
 
 	readOnly := (flags & (vfs.O_WRONLY | vfs.O_RDWR)) == 0
 	append := (flags & vfs.O_APPEND) != 0
 
-	file := newVFSFileFromNode(path, newNode, readOnly, append)
+	file := newVFSFileFromNode(path, newNode, readOnly, append, &fs.events)
 	return file, nil
 }
 
@@ -379,12 +555,14 @@ func (fs *FS) mkdir(path string, perm os.FileMode, createParents bool) error {
 			return ErrFileNotFound
 		}
 
-		newDir := newMemNode(true)
+		newDir := fs.newNode(true)
 		newDir.mode = perm & 0777
 
 		current.mu.Lock()
 		current.children[part] = newDir
+		current.nlink++
 		current.mu.Unlock()
+		fs.events.Emit(vfs.OpCreate, joinParts(parts[:i+1]))
 
 		current = newDir
 	}
@@ -440,6 +618,8 @@ func (fs *FS) Remove(path string) error {
 	}
 
 	delete(parent.children, childName)
+	unlinkNode(parent, child)
+	fs.events.Emit(vfs.OpRemove, path)
 	return nil
 }
 
@@ -459,8 +639,14 @@ func (fs *FS) RemoveAll(path string) error {
 	path = vfs.Clean(path)
 
 	if path == "/" {
-		// Remove everything except root
-		fs.root = newMemNode(true)
+		// Remove everything except root, which keeps its inode
+		for name, child := range fs.root.children {
+			unlinkNode(fs.root, child)
+			fs.emitRemoved("/"+name, child)
+		}
+		root := newMemNode(true)
+		root.ino = fs.root.ino
+		fs.root = root
 		return nil
 	}
 
@@ -480,10 +666,23 @@ func (fs *FS) RemoveAll(path string) error {
 		parent = child
 	}
 
-	delete(parent.children, childName)
+	if child, ok := parent.children[childName]; ok {
+		delete(parent.children, childName)
+		unlinkNode(parent, child)
+		fs.emitRemoved(path, child)
+	}
 	return nil
 }
 
+// emitRemoved reports the removal of node at path and of everything
+// beneath it, children first (caller must hold lock).
+func (fs *FS) emitRemoved(path string, node *memNode) {
+	for name, child := range node.children {
+		fs.emitRemoved(vfs.Join(path, name), child)
+	}
+	fs.events.Emit(vfs.OpRemove, path)
+}
+
 // Rename implements vfs.FileSystem.Rename.
 func (fs *FS) Rename(oldpath, newpath string) error {
 	if err := vfs.ValidatePath(oldpath); err != nil {
@@ -529,6 +728,12 @@ func (fs *FS) Rename(oldpath, newpath string) error {
 		return errors.New("memfs: invalid new path")
 	}
 
+	// Renaming one hard link onto another of the same file does nothing
+	target, replacing := destDir.children[newName]
+	if target == srcNode {
+		return nil
+	}
+
 	// Remove from old location
 	oldParts := splitPath(oldpath)
 	oldParent := fs.root
@@ -537,8 +742,24 @@ func (fs *FS) Rename(oldpath, newpath string) error {
 	}
 	delete(oldParent.children, oldParts[len(oldParts)-1])
 
+	if replacing {
+		unlinkNode(destDir, target)
+	}
+
 	// Add to new location
 	destDir.children[newName] = srcNode
+	if srcNode.isDir && oldParent != destDir {
+		oldParent.mu.Lock()
+		oldParent.nlink--
+		oldParent.mu.Unlock()
+		destDir.mu.Lock()
+		destDir.nlink++
+		destDir.mu.Unlock()
+	}
+	srcNode.mu.Lock()
+	srcNode.ctime = time.Now()
+	srcNode.mu.Unlock()
+	fs.events.EmitRename(oldpath, newpath)
 
 	return nil
 }
@@ -630,8 +851,12 @@ func (fs *FS) WriteFile(path string, data []byte, perm os.FileMode) error {
 		if node.isDir {
 			return ErrIsDirectory
 		}
+		node.mu.Lock()
 		node.data = data
 		node.mtime = time.Now()
+		node.ctime = node.mtime
+		node.mu.Unlock()
+		fs.events.Emit(vfs.OpWrite, path)
 		return nil
 	}
 
@@ -646,11 +871,13 @@ func (fs *FS) WriteFile(path string, data []byte, perm os.FileMode) error {
 		return ErrNotDirectory
 	}
 
-	newNode := newMemNode(false)
+	newNode := fs.newNode(false)
 	newNode.data = data
 	newNode.mode = perm & 0777
 
 	dirNode.children[vfs.Base(path)] = newNode
+	fs.events.Emit(vfs.OpCreate, path)
+	fs.events.Emit(vfs.OpWrite, path)
 	return nil
 }
 
@@ -691,11 +918,12 @@ func (fs *FS) Symlink(target, newpath string) error {
 		return ErrNotDirectory
 	}
 
-	link := newMemNode(false)
+	link := fs.newNode(false)
 	link.symlink = target
 	link.mode = 0777 | os.ModeSymlink
 
 	dirNode.children[vfs.Base(newpath)] = link
+	fs.events.Emit(vfs.OpCreate, newpath)
 	return nil
 }
 
@@ -720,6 +948,203 @@ func (fs *FS) Readlink(path string) (string, error) {
 	return node.symlink, nil
 }
 
+// Link implements vfs.FileSystem.Link. A symlink at oldpath is linked
+// itself rather than its target.
+func (fs *FS) Link(oldpath, newpath string) error {
+	if err := vfs.ValidatePath(oldpath); err != nil {
+		return err
+	}
+	if err := vfs.ValidatePath(newpath); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+
+	newpath = vfs.Clean(newpath)
+
+	node, err := fs.nodeFromPath(oldpath)
+	if err != nil {
+		return err
+	}
+	if node.isDir {
+		return ErrIsDirectory
+	}
+
+	if _, err := fs.nodeFromPath(newpath); err == nil {
+		return ErrFileExists
+	}
+
+	dirNode, err := fs.nodeFromPath(vfs.Dir(newpath))
+	if err != nil {
+		return err
+	}
+	if !dirNode.isDir {
+		return ErrNotDirectory
+	}
+
+	dirNode.children[vfs.Base(newpath)] = node
+
+	node.mu.Lock()
+	node.nlink++
+	node.ctime = time.Now()
+	node.mu.Unlock()
+
+	fs.events.Emit(vfs.OpCreate, newpath)
+	return nil
+}
+
+// maxSymlinks bounds the symlinks followNode follows.
+const maxSymlinks = 40
+
+// followNode returns the node at path, following symlinks
+// (caller must hold lock).
+func (fs *FS) followNode(path string) (*memNode, error) {
+	node, err := fs.nodeFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for hops := 0; node.symlink != ""; hops++ {
+		if hops == maxSymlinks {
+			return nil, vfs.ErrSymlinkLoop
+		}
+		target := node.symlink
+		if !vfs.IsAbs(target) {
+			target = vfs.Clean(vfs.Join(vfs.Dir(path), target))
+		}
+		node, err = fs.nodeFromPath(target)
+		if err != nil {
+			return nil, err
+		}
+		path = target
+	}
+
+	return node, nil
+}
+
+// Getxattr implements vfs.XattrFS.Getxattr.
+func (fs *FS) Getxattr(path, name string) ([]byte, error) {
+	if err := vfs.ValidatePath(path); err != nil {
+		return nil, err
+	}
+
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	node, err := fs.followNode(path)
+	if err != nil {
+		return nil, err
+	}
+
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+
+	value, ok := node.xattrs[name]
+	if !ok {
+		return nil, vfs.ErrNoAttr
+	}
+	return append([]byte(nil), value...), nil
+}
+
+// Setxattr implements vfs.XattrFS.Setxattr.
+func (fs *FS) Setxattr(path, name string, value []byte, flags int) error {
+	if err := vfs.ValidatePath(path); err != nil {
+		return err
+	}
+	if err := vfs.ValidateXattrName(name); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+
+	node, err := fs.followNode(path)
+	if err != nil {
+		return err
+	}
+
+	node.mu.Lock()
+	_, exists := node.xattrs[name]
+	if err := vfs.CheckXattrFlags(flags, exists); err != nil {
+		node.mu.Unlock()
+		return err
+	}
+	if node.xattrs == nil {
+		node.xattrs = make(map[string][]byte)
+	}
+	node.xattrs[name] = append([]byte(nil), value...)
+	node.ctime = time.Now()
+	node.mu.Unlock()
+
+	fs.events.Emit(vfs.OpChmod, path)
+	return nil
+}
+
+// Listxattr implements vfs.XattrFS.Listxattr.
+func (fs *FS) Listxattr(path string) ([]string, error) {
+	if err := vfs.ValidatePath(path); err != nil {
+		return nil, err
+	}
+
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	node, err := fs.followNode(path)
+	if err != nil {
+		return nil, err
+	}
+
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+
+	names := make([]string, 0, len(node.xattrs))
+	for name := range node.xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Removexattr implements vfs.XattrFS.Removexattr.
+func (fs *FS) Removexattr(path, name string) error {
+	if err := vfs.ValidatePath(path); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+
+	node, err := fs.followNode(path)
+	if err != nil {
+		return err
+	}
+
+	node.mu.Lock()
+	if _, ok := node.xattrs[name]; !ok {
+		node.mu.Unlock()
+		return vfs.ErrNoAttr
+	}
+	delete(node.xattrs, name)
+	node.ctime = time.Now()
+	node.mu.Unlock()
+
+	fs.events.Emit(vfs.OpChmod, path)
+	return nil
+}
+
 // Chmod implements vfs.FileSystem.Chmod.
 func (fs *FS) Chmod(path string, mode os.FileMode) error {
 	if err := vfs.ValidatePath(path); err != nil {
@@ -738,7 +1163,11 @@ func (fs *FS) Chmod(path string, mode os.FileMode) error {
 		return err
 	}
 
-	node.mode = mode & 0777
+	node.mu.Lock()
+	node.mode = node.mode&os.ModeType | mode&(os.ModePerm|os.ModeSticky|os.ModeSetuid|os.ModeSetgid)
+	node.ctime = time.Now()
+	node.mu.Unlock()
+	fs.events.Emit(vfs.OpChmod, path)
 	return nil
 }
 
@@ -760,8 +1189,12 @@ func (fs *FS) Chown(path string, uid, gid int) error {
 		return err
 	}
 
+	node.mu.Lock()
 	node.uid = uid
 	node.gid = gid
+	node.ctime = time.Now()
+	node.mu.Unlock()
+	fs.events.Emit(vfs.OpChmod, path)
 	return nil
 }
 
@@ -781,6 +1214,8 @@ func (fs *FS) Chtimes(path string, atime, mtime time.Time) error {
 
 	node.atime = atime
 	node.mtime = mtime
+	node.ctime = time.Now()
+	fs.events.Emit(vfs.OpChmod, path)
 	return nil
 }
 
@@ -792,17 +1227,18 @@ func (fs *FS) nodeToFileInfo(path string, node *memNode) vfs.FileInfo {
 		Mode:    node.mode,
 		ModTime: node.mtime,
 		IsDir:   node.isDir,
-		Sys:     node,
+		Sys:     node.stat(),
 	}
 }
 
 // newVFSFileFromNode creates a vfs.File from a memNode.
-func newVFSFileFromNode(path string, node *memNode, readOnly, append bool) vfs.File {
+func newVFSFileFromNode(path string, node *memNode, readOnly, append bool, events *vfs.EventHub) vfs.File {
 	return &memFile{
 		path:     path,
 		node:     node,
 		readOnly: readOnly,
 		append:   append,
+		events:   events,
 	}
 }
 
@@ -813,6 +1249,7 @@ type memFile struct {
 	readOnly bool
 	append   bool
 	offset   int64
+	events   *vfs.EventHub
 }
 
 func (f *memFile) Read(b []byte) (int, error) {
@@ -824,7 +1261,7 @@ func (f *memFile) Read(b []byte) (int, error) {
 	}
 
 	if f.offset >= int64(len(f.node.data)) {
-		return 0, nil
+		return 0, io.EOF
 	}
 
 	n := copy(b, f.node.data[f.offset:])
@@ -844,19 +1281,84 @@ func (f *memFile) Write(b []byte) (int, error) {
 		f.offset = int64(len(f.node.data))
 	}
 
-	n := len(b)
-	needed := f.offset + int64(n)
+	n := f.writeAtLocked(b, f.offset)
+	f.offset += int64(n)
+	return n, nil
+}
 
+// ReadAt implements io.ReaderAt.
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, vfs.ErrInvalidSeek
+	}
+
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(b, f.node.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt.
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	if f.readOnly {
+		return 0, vfs.ErrPermissionDenied
+	}
+	if f.append {
+		return 0, ErrWriteAtInAppendMode
+	}
+	if off < 0 {
+		return 0, vfs.ErrInvalidSeek
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	return f.writeAtLocked(b, off), nil
+}
+
+// writeAtLocked writes b at off, growing the file as needed
+// (caller must hold node lock).
+func (f *memFile) writeAtLocked(b []byte, off int64) int {
+	needed := off + int64(len(b))
 	if needed > int64(len(f.node.data)) {
 		newData := make([]byte, needed)
 		copy(newData, f.node.data)
 		f.node.data = newData
 	}
 
-	copy(f.node.data[f.offset:], b)
-	f.offset += int64(n)
+	n := copy(f.node.data[off:], b)
 	f.node.mtime = time.Now()
-	return n, nil
+	f.node.ctime = f.node.mtime
+	f.events.Emit(vfs.OpWrite, f.path)
+	return n
+}
+
+// Lock implements vfs.File.Lock.
+func (f *memFile) Lock(how vfs.LockMode) error {
+	var exclusive bool
+	switch {
+	case how&vfs.LockExclusive != 0:
+		exclusive = true
+	case how&vfs.LockShared != 0:
+		exclusive = false
+	default:
+		return vfs.ErrInvalidLock
+	}
+	return f.node.locks.acquire(f, exclusive, how&vfs.LockNonBlock == 0)
+}
+
+// Unlock implements vfs.File.Unlock.
+func (f *memFile) Unlock() error {
+	f.node.locks.release(f)
+	return nil
 }
 
 func (f *memFile) Seek(offset int64, whence int) (int64, error) {
@@ -881,6 +1383,7 @@ func (f *memFile) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f *memFile) Close() error {
+	f.node.locks.release(f)
 	return nil
 }
 
@@ -891,6 +1394,7 @@ func (f *memFile) Stat() (vfs.FileInfo, error) {
 		Mode:    f.node.mode,
 		ModTime: f.node.mtime,
 		IsDir:   false,
+		Sys:     f.node.stat(),
 	}, nil
 }
 
@@ -918,6 +1422,9 @@ func (f *memFile) Truncate(size int64) error {
 		f.offset = size
 	}
 
+	f.node.mtime = time.Now()
+	f.node.ctime = f.node.mtime
+	f.events.Emit(vfs.OpWrite, f.path)
 	return nil
 }
 
@@ -965,3 +1472,5 @@ func (e vfsDirEntry) Type() os.FileMode {
 func (e vfsDirEntry) Info() (vfs.FileInfo, error) {
 	return e.info, nil
 }
+
+var _ vfs.XattrFS = (*FS)(nil)
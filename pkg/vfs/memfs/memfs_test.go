@@ -1,8 +1,14 @@
 package memfs
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	iofs "io/fs"
 	"os"
+	"path/filepath"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	vfs "webos/pkg/vfs"
@@ -481,6 +487,232 @@ func TestTruncate(t *testing.T) {
 	}
 }
 
+func TestLink(t *testing.T) {
+	fs := New()
+	fs.MkdirAll("/dir", 0755)
+	fs.WriteFile("/dir/a.txt", []byte("shared"), 0644)
+
+	if err := fs.Link("/dir/a.txt", "/b.txt"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	infoA, _ := fs.Stat("/dir/a.txt")
+	infoB, _ := fs.Stat("/b.txt")
+	statA, okA := vfs.StatOf(infoA)
+	statB, okB := vfs.StatOf(infoB)
+	if !okA || !okB {
+		t.Fatal("Stat did not return inode metadata")
+	}
+	if statA.Ino != statB.Ino {
+		t.Errorf("links have inodes %d and %d, expected the same", statA.Ino, statB.Ino)
+	}
+	if statA.Nlink != 2 {
+		t.Errorf("nlink is %d, expected 2", statA.Nlink)
+	}
+
+	// Writes through one link are visible through the other
+	fs.WriteFile("/b.txt", []byte("changed"), 0644)
+	if data, _ := fs.ReadFile("/dir/a.txt"); string(data) != "changed" {
+		t.Errorf("read %q through other link, expected %q", data, "changed")
+	}
+
+	// Renames keep the inode; removing a link drops the count
+	fs.Rename("/b.txt", "/c.txt")
+	fs.Remove("/dir/a.txt")
+	info, _ := fs.Stat("/c.txt")
+	st, _ := vfs.StatOf(info)
+	if st.Ino != statA.Ino || st.Nlink != 1 {
+		t.Errorf("got ino %d nlink %d, expected ino %d nlink 1", st.Ino, st.Nlink, statA.Ino)
+	}
+
+	// Directories count their subdirectories
+	fs.Mkdir("/dir/sub", 0755)
+	info, _ = fs.Stat("/dir")
+	if st, _ := vfs.StatOf(info); st.Nlink != 3 {
+		t.Errorf("directory nlink is %d, expected 3", st.Nlink)
+	}
+
+	if err := fs.Link("/dir", "/dirlink"); err != ErrIsDirectory {
+		t.Errorf("Link of directory returned %v, expected ErrIsDirectory", err)
+	}
+}
+
+func TestReadAtWriteAt(t *testing.T) {
+	fs := New()
+	fs.WriteFile("/file.txt", []byte("hello world"), 0644)
+
+	file, err := fs.OpenFile("/file.txt", vfs.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteAt([]byte("WORLD"), 6); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	buf := make([]byte, 8)
+	n, err := file.ReadAt(buf, 3)
+	if n != 8 || err != nil {
+		t.Fatalf("ReadAt returned %d, %v", n, err)
+	}
+	if string(buf) != "lo WORLD" {
+		t.Errorf("read %q, expected %q", buf, "lo WORLD")
+	}
+
+	n, err = file.ReadAt(buf, 6)
+	if n != 5 || err != io.EOF {
+		t.Errorf("short ReadAt returned %d, %v, expected 5, EOF", n, err)
+	}
+
+	// The sequential offset is untouched
+	if offset, _ := file.Seek(0, vfs.SEEK_CUR); offset != 0 {
+		t.Errorf("offset is %d, expected 0", offset)
+	}
+}
+
+func TestLock(t *testing.T) {
+	fs := New()
+	fs.WriteFile("/file.txt", []byte("data"), 0644)
+
+	a, _ := fs.Open("/file.txt")
+	b, _ := fs.Open("/file.txt")
+	defer b.Close()
+
+	if err := a.Lock(vfs.LockShared); err != nil {
+		t.Fatalf("shared Lock failed: %v", err)
+	}
+	if err := b.Lock(vfs.LockShared | vfs.LockNonBlock); err != nil {
+		t.Fatalf("second shared Lock failed: %v", err)
+	}
+	if err := b.Lock(vfs.LockExclusive | vfs.LockNonBlock); err != vfs.ErrWouldBlock {
+		t.Fatalf("exclusive Lock returned %v, expected ErrWouldBlock", err)
+	}
+
+	locked := make(chan error)
+	go func() {
+		locked <- b.Lock(vfs.LockExclusive)
+	}()
+
+	// Closing the file releases its lock
+	a.Close()
+
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatalf("blocking Lock failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocking Lock was not granted")
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	fs := New()
+	fs.MkdirAll("/dir/sub", 0755)
+
+	w, err := vfs.NewWatcher(fs)
+	if err != nil {
+		t.Fatalf("NewWatcher failed: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.Add("/dir", false); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	fs.WriteFile("/dir/sub/ignored.txt", []byte("x"), 0644)
+	fs.WriteFile("/dir/file.txt", []byte("x"), 0644)
+	fs.Chmod("/dir/file.txt", 0600)
+	fs.Rename("/dir/file.txt", "/moved.txt")
+
+	expected := []vfs.Event{
+		{Op: vfs.OpCreate, Path: "/dir/file.txt"},
+		{Op: vfs.OpWrite, Path: "/dir/file.txt"},
+		{Op: vfs.OpChmod, Path: "/dir/file.txt"},
+		{Op: vfs.OpRename, Path: "/moved.txt", OldPath: "/dir/file.txt"},
+	}
+	for _, want := range expected {
+		select {
+		case ev := <-w.Events:
+			if ev != want {
+				t.Errorf("got event %v, expected %v", ev, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+}
+
+// nextEvents reads n events from w, failing the test on a timeout.
+func nextEvents(t *testing.T, w *vfs.Watcher, n int) []vfs.Event {
+	t.Helper()
+	events := make([]vfs.Event, 0, n)
+	for len(events) < n {
+		select {
+		case ev := <-w.Events:
+			events = append(events, ev)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after %d of %d events: %v", len(events), n, events)
+		}
+	}
+	return events
+}
+
+func TestWatcherRemoveAll(t *testing.T) {
+	fs := New()
+	fs.MkdirAll("/dir/sub", 0755)
+	fs.WriteFile("/dir/a", nil, 0644)
+	fs.WriteFile("/dir/sub/b", nil, 0644)
+
+	w, err := vfs.NewWatcher(fs)
+	if err != nil {
+		t.Fatalf("NewWatcher failed: %v", err)
+	}
+	defer w.Close()
+	w.Add("/", true)
+
+	fs.RemoveAll("/dir")
+
+	// Every entry is reported, each before its directory
+	events := nextEvents(t, w, 4)
+	seen := make(map[string]int)
+	for i, ev := range events {
+		if ev.Op != vfs.OpRemove {
+			t.Errorf("unexpected event %v", ev)
+		}
+		seen[ev.Path] = i
+	}
+	for _, path := range []string{"/dir", "/dir/a", "/dir/sub", "/dir/sub/b"} {
+		if _, ok := seen[path]; !ok {
+			t.Errorf("no remove event for %s", path)
+		}
+	}
+	if seen["/dir/sub/b"] > seen["/dir/sub"] || seen["/dir/sub"] > seen["/dir"] {
+		t.Errorf("parents reported before children: %v", events)
+	}
+}
+
+func TestSubscriberCallsBack(t *testing.T) {
+	fs := New()
+	stats := make(chan error, 1)
+	cancel := fs.Subscribe(func(ev vfs.Event) {
+		_, err := fs.Stat(ev.Path)
+		stats <- err
+	})
+	defer cancel()
+
+	fs.WriteFile("/file", nil, 0644)
+	select {
+	case err := <-stats:
+		if err != nil {
+			t.Errorf("Stat from the subscriber failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber calling back into the filesystem deadlocked")
+	}
+}
+
 func BenchmarkWrite(b *testing.B) {
 	fs := New()
 	fs.MkdirAll("/test", 0755)
@@ -510,3 +742,203 @@ func BenchmarkRead(b *testing.B) {
 		file.Close()
 	}
 }
+
+func TestXattr(t *testing.T) {
+	fs := New()
+	fs.WriteFile("/file.txt", []byte("data"), 0644)
+	fs.Symlink("/file.txt", "/link")
+
+	if err := fs.Setxattr("/file.txt", "user.mime_type", []byte("text/plain"), 0); err != nil {
+		t.Fatalf("Setxattr failed: %v", err)
+	}
+	fs.Setxattr("/link", "user.author", []byte("root"), 0)
+
+	// Attributes follow symlinks
+	names, err := fs.Listxattr("/file.txt")
+	if err != nil {
+		t.Fatalf("Listxattr failed: %v", err)
+	}
+	if len(names) != 2 || names[0] != "user.author" || names[1] != "user.mime_type" {
+		t.Errorf("Listxattr returned %v", names)
+	}
+	if value, _ := fs.Getxattr("/link", "user.mime_type"); string(value) != "text/plain" {
+		t.Errorf("Getxattr returned %q, expected %q", value, "text/plain")
+	}
+
+	if err := fs.Setxattr("/file.txt", "user.author", nil, vfs.XattrCreate); err != vfs.ErrAttrExists {
+		t.Errorf("Setxattr with XattrCreate returned %v, expected ErrAttrExists", err)
+	}
+	if err := fs.Setxattr("/file.txt", "user.missing", nil, vfs.XattrReplace); err != vfs.ErrNoAttr {
+		t.Errorf("Setxattr with XattrReplace returned %v, expected ErrNoAttr", err)
+	}
+	if err := fs.Setxattr("/file.txt", "", nil, 0); err != vfs.ErrInvalidAttrName {
+		t.Errorf("Setxattr with empty name returned %v, expected ErrInvalidAttrName", err)
+	}
+
+	if err := fs.Removexattr("/file.txt", "user.author"); err != nil {
+		t.Fatalf("Removexattr failed: %v", err)
+	}
+	if _, err := fs.Getxattr("/file.txt", "user.author"); err != vfs.ErrNoAttr {
+		t.Errorf("Getxattr after remove returned %v, expected ErrNoAttr", err)
+	}
+	if _, err := fs.Getxattr("/missing", "user.author"); err != ErrFileNotFound {
+		t.Errorf("Getxattr on missing file returned %v, expected ErrFileNotFound", err)
+	}
+
+	// A symlink cycle fails instead of hanging
+	fs.Symlink("/b", "/a")
+	fs.Symlink("/a", "/b")
+	if _, err := fs.Getxattr("/a", "user.author"); err != vfs.ErrSymlinkLoop {
+		t.Errorf("Getxattr on a symlink cycle returned %v, expected ErrSymlinkLoop", err)
+	}
+	if err := fs.Setxattr("/a", "user.author", nil, 0); err != vfs.ErrSymlinkLoop {
+		t.Errorf("Setxattr on a symlink cycle returned %v, expected ErrSymlinkLoop", err)
+	}
+	if err := fs.Removexattr("/b", "user.author"); err != vfs.ErrSymlinkLoop {
+		t.Errorf("Removexattr on a symlink cycle returned %v, expected ErrSymlinkLoop", err)
+	}
+}
+
+func TestIOFS(t *testing.T) {
+	fs := New()
+	fs.MkdirAll("/site/css", 0755)
+	fs.WriteFile("/site/index.html", []byte("<h1>home</h1>"), 0644)
+	fs.WriteFile("/site/css/main.css", []byte("body {}"), 0644)
+
+	if err := fstest.TestFS(vfs.ToIOFS(fs), "site/index.html", "site/css/main.css"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := iofs.Stat(vfs.ToIOFS(fs), "missing"); !errors.Is(err, iofs.ErrNotExist) {
+		t.Errorf("Stat of missing file returned %v, expected fs.ErrNotExist", err)
+	}
+
+	// Going back through io/fs gives a read-only view of the same files
+	back := vfs.FromIOFS(vfs.ToIOFS(fs))
+	if data, err := back.ReadFile("/site/css/main.css"); err != nil || string(data) != "body {}" {
+		t.Errorf("ReadFile returned %q, %v", data, err)
+	}
+	if entries, err := back.ReadDir("/site"); err != nil || len(entries) != 2 {
+		t.Errorf("ReadDir returned %v, %v", entries, err)
+	}
+	if err := back.WriteFile("/site/new", nil, 0644); !errors.Is(err, vfs.ErrReadOnlyFS) {
+		t.Errorf("WriteFile returned %v, expected ErrReadOnlyFS", err)
+	}
+}
+
+func TestImage(t *testing.T) {
+	fs := New()
+	fs.MkdirAll("/home/alice/docs", 0750)
+	fs.WriteFile("/home/alice/docs/notes.txt", []byte("notes"), 0600)
+	fs.WriteFile("/home/alice/empty", nil, 0644)
+	fs.Link("/home/alice/docs/notes.txt", "/home/alice/hardlink")
+	fs.Symlink("docs/notes.txt", "/home/alice/symlink")
+	fs.Chown("/home/alice", 1000, 100)
+	fs.Setxattr("/home/alice/docs/notes.txt", "user.tag", []byte("draft"), 0)
+	mtime := time.Date(2024, 5, 6, 7, 8, 9, 10, time.UTC)
+	fs.Chtimes("/home/alice/docs/notes.txt", mtime, mtime)
+
+	var buf bytes.Buffer
+	if err := fs.SaveTo(&buf); err != nil {
+		t.Fatalf("SaveTo failed: %v", err)
+	}
+	image := buf.Bytes()
+
+	loaded, err := Load(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	// Saving the loaded filesystem unchanged gives the same image
+	var again bytes.Buffer
+	loaded.SaveTo(&again)
+	if !bytes.Equal(again.Bytes(), image) {
+		t.Error("saving the loaded filesystem gave a different image")
+	}
+
+	if data, err := loaded.ReadFile("/home/alice/symlink"); err != nil || string(data) != "notes" {
+		t.Errorf("ReadFile through symlink returned %q, %v", data, err)
+	}
+	if target, _ := loaded.Readlink("/home/alice/symlink"); target != "docs/notes.txt" {
+		t.Errorf("symlink target is %q, expected %q", target, "docs/notes.txt")
+	}
+	if value, _ := loaded.Getxattr("/home/alice/docs/notes.txt", "user.tag"); string(value) != "draft" {
+		t.Errorf("xattr is %q, expected %q", value, "draft")
+	}
+	if data, err := loaded.ReadFile("/home/alice/empty"); err != nil || len(data) != 0 {
+		t.Errorf("ReadFile of empty file returned %q, %v", data, err)
+	}
+
+	info, _ := loaded.Stat("/home/alice/docs/notes.txt")
+	st, _ := vfs.StatOf(info)
+	if info.Mode.Perm() != 0600 || !info.ModTime.Equal(mtime) || st.Nlink != 2 {
+		t.Errorf("got mode %v mtime %v nlink %d", info.Mode, info.ModTime, st.Nlink)
+	}
+	info, _ = loaded.Stat("/home/alice")
+	st, _ = vfs.StatOf(info)
+	if st.Uid != 1000 || st.Gid != 100 || st.Nlink != 3 || info.Mode.Perm() != 0750 {
+		t.Errorf("got uid %d gid %d nlink %d mode %v", st.Uid, st.Gid, st.Nlink, info.Mode)
+	}
+
+	// Hard links still share their contents, and new inodes do not clash
+	loaded.WriteFile("/home/alice/hardlink", []byte("changed"), 0600)
+	if data, _ := loaded.ReadFile("/home/alice/docs/notes.txt"); string(data) != "changed" {
+		t.Errorf("read %q through other link, expected %q", data, "changed")
+	}
+	loaded.WriteFile("/new", nil, 0644)
+	info, _ = loaded.Stat("/new")
+	newSt, _ := vfs.StatOf(info)
+	info, _ = loaded.Stat("/home/alice/empty")
+	if st, _ := vfs.StatOf(info); newSt.Ino == st.Ino {
+		t.Errorf("new file reused inode %d", st.Ino)
+	}
+
+	if _, err := Load(bytes.NewReader(image[:len(image)-3])); err != io.ErrUnexpectedEOF {
+		t.Errorf("Load of truncated image returned %v, expected io.ErrUnexpectedEOF", err)
+	}
+	if _, err := Load(bytes.NewReader([]byte("NOTANIMAGE"))); err != ErrBadImage {
+		t.Errorf("Load of bad magic returned %v, expected ErrBadImage", err)
+	}
+	future := append([]byte(nil), image...)
+	future[len(imageMagic)+1] = 99
+	if _, err := Load(bytes.NewReader(future)); !errors.Is(err, ErrImageVersion) {
+		t.Errorf("Load of newer version returned %v, expected ErrImageVersion", err)
+	}
+}
+
+func TestSnapshotEvery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scratch.img")
+	fs := New()
+	stop := fs.SnapshotEvery(path, 10*time.Millisecond)
+
+	fs.WriteFile("/first", []byte("1"), 0644)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if loaded, err := LoadFile(path); err == nil {
+			if _, err := loaded.Stat("/first"); err == nil {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for snapshot")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Stopping takes a final snapshot of changes since the last one
+	fs.WriteFile("/second", []byte("2"), 0644)
+	if err := stop(); err != nil {
+		t.Fatalf("stop failed: %v", err)
+	}
+	loaded, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if data, _ := loaded.ReadFile("/second"); string(data) != "2" {
+		t.Errorf("ReadFile returned %q, expected %q", data, "2")
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("snapshot directory has %d entries, expected 1", len(entries))
+	}
+}
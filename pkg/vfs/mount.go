@@ -0,0 +1,662 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Mount-related errors.
+var (
+	ErrNotMounted     = errors.New("vfs: not a mount point")
+	ErrAlreadyMounted = errors.New("vfs: mount point already in use")
+	ErrMountBusy      = errors.New("vfs: mount point busy")
+	ErrReadOnlyFS     = errors.New("vfs: read-only file system")
+
+	// ErrCrossDevice is returned when a rename spans two mounts. It is
+	// syscall.EXDEV so callers can match it the same way as errors from
+	// the host filesystem.
+	ErrCrossDevice error = syscall.EXDEV
+)
+
+// MountFlag modifies how a filesystem is mounted.
+type MountFlag int
+
+const (
+	// MountReadOnly rejects every operation that would modify the mount.
+	MountReadOnly MountFlag = 1 << iota
+)
+
+// MountInfo describes an entry in a MountTable.
+type MountInfo struct {
+	Path     string // Mount point
+	Type     string // Go type of the mounted filesystem
+	Source   string // Bind source, empty for regular mounts
+	ReadOnly bool
+}
+
+// mount is a filesystem attached at a path.
+type mount struct {
+	path   string
+	fs     FileSystem
+	source string
+	flags  MountFlag
+}
+
+// readOnly reports whether the mount rejects modifications.
+func (m *mount) readOnly() bool {
+	return m.flags&MountReadOnly != 0
+}
+
+// MountTable composes filesystems into a single namespace.
+//
+// Each path is routed to the mounted filesystem with the longest matching
+// mount point, with the remainder of the path passed to it as an absolute
+// path. MountTable implements FileSystem itself, so a table can be mounted
+// in another table, and Clone gives each process its own namespace that
+// shares the underlying filesystems.
+type MountTable struct {
+	mu     sync.RWMutex
+	mounts []*mount // Sorted by descending path length
+}
+
+// NewMountTable creates a mount table with root mounted at "/".
+func NewMountTable(root FileSystem) *MountTable {
+	return &MountTable{
+		mounts: []*mount{{path: "/", fs: root}},
+	}
+}
+
+// Mount attaches fs at path. The mount point does not need to exist in
+// the parent filesystem; it is listed by ReadDir either way.
+func (mt *MountTable) Mount(path string, fs FileSystem, flags MountFlag) error {
+	if err := ValidatePath(path); err != nil {
+		return err
+	}
+	return mt.add(&mount{path: Clean(path), fs: fs, flags: flags})
+}
+
+// Bind makes the subtree at source also visible at target, like a bind
+// mount. The source is resolved through the table at the time of the call.
+func (mt *MountTable) Bind(source, target string, flags MountFlag) error {
+	if err := ValidatePath(source); err != nil {
+		return err
+	}
+	if err := ValidatePath(target); err != nil {
+		return err
+	}
+
+	m, rel, err := mt.resolve(source)
+	if err != nil {
+		return err
+	}
+
+	info, err := m.fs.Stat(rel)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir {
+		return fmt.Errorf("vfs: bind source %s is not a directory", source)
+	}
+
+	// A bind of a read-only mount stays read-only
+	flags |= m.flags & MountReadOnly
+
+	var fs FileSystem = m.fs
+	if rel != "/" {
+		fs = &subFS{fs: m.fs, root: rel}
+	}
+	return mt.add(&mount{path: Clean(target), fs: fs, source: Clean(source), flags: flags})
+}
+
+// add inserts a mount, keeping the table sorted.
+func (mt *MountTable) add(m *mount) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	for _, existing := range mt.mounts {
+		if existing.path == m.path {
+			return ErrAlreadyMounted
+		}
+	}
+
+	mt.mounts = append(mt.mounts, m)
+	sort.SliceStable(mt.mounts, func(i, j int) bool {
+		return len(mt.mounts[i].path) > len(mt.mounts[j].path)
+	})
+	return nil
+}
+
+// Unmount detaches the filesystem at path. A mount with other mounts
+// beneath it is busy and cannot be detached, nor can the root.
+func (mt *MountTable) Unmount(path string) error {
+	path = Clean(path)
+	if path == "/" {
+		return ErrMountBusy
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	index := -1
+	for i, m := range mt.mounts {
+		if m.path == path {
+			index = i
+		} else if hasPathPrefix(m.path, path) {
+			return ErrMountBusy
+		}
+	}
+	if index < 0 {
+		return ErrNotMounted
+	}
+
+	mt.mounts = append(mt.mounts[:index], mt.mounts[index+1:]...)
+	return nil
+}
+
+// Mounts lists the mounts, shortest mount point first.
+func (mt *MountTable) Mounts() []MountInfo {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	infos := make([]MountInfo, 0, len(mt.mounts))
+	for i := len(mt.mounts) - 1; i >= 0; i-- {
+		m := mt.mounts[i]
+		infos = append(infos, MountInfo{
+			Path:     m.path,
+			Type:     fmt.Sprintf("%T", m.fs),
+			Source:   m.source,
+			ReadOnly: m.readOnly(),
+		})
+	}
+	return infos
+}
+
+// Clone returns a new table with the same mounts. Later mounts and
+// unmounts in either table do not affect the other.
+func (mt *MountTable) Clone() *MountTable {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	mounts := make([]*mount, len(mt.mounts))
+	for i, m := range mt.mounts {
+		copied := *m
+		mounts[i] = &copied
+	}
+	return &MountTable{mounts: mounts}
+}
+
+// resolve finds the mount for path and the path within that mount.
+func (mt *MountTable) resolve(path string) (*mount, string, error) {
+	if err := ValidatePath(path); err != nil {
+		return nil, "", err
+	}
+	path = Clean(path)
+
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	for _, m := range mt.mounts {
+		if m.path == "/" {
+			return m, path, nil
+		}
+		if path == m.path {
+			return m, "/", nil
+		}
+		if hasPathPrefix(path, m.path) {
+			return m, path[len(m.path):], nil
+		}
+	}
+	return nil, "", ErrNotMounted
+}
+
+// resolveWritable resolves path and rejects read-only mounts.
+func (mt *MountTable) resolveWritable(path string) (*mount, string, error) {
+	m, rel, err := mt.resolve(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if m.readOnly() {
+		return nil, "", ErrReadOnlyFS
+	}
+	return m, rel, nil
+}
+
+// isMountPoint reports whether path is a mount point.
+func (mt *MountTable) isMountPoint(path string) bool {
+	path = Clean(path)
+
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	for _, m := range mt.mounts {
+		if m.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPathPrefix reports whether path lies strictly beneath dir.
+func hasPathPrefix(path, dir string) bool {
+	if dir == "/" {
+		return path != "/"
+	}
+	return strings.HasPrefix(path, dir+"/")
+}
+
+// Open implements FileSystem.Open.
+func (mt *MountTable) Open(path string) (File, error) {
+	return mt.OpenFile(path, O_RDONLY, 0)
+}
+
+// OpenFile implements FileSystem.OpenFile.
+func (mt *MountTable) OpenFile(path string, flags int, perm os.FileMode) (File, error) {
+	m, rel, err := mt.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if m.readOnly() && flags&(O_WRONLY|O_RDWR|O_CREATE|O_TRUNC|O_APPEND) != 0 {
+		return nil, ErrReadOnlyFS
+	}
+	return m.fs.OpenFile(rel, flags, perm)
+}
+
+// Stat implements FileSystem.Stat.
+func (mt *MountTable) Stat(path string) (FileInfo, error) {
+	m, rel, err := mt.resolve(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return m.fs.Stat(rel)
+}
+
+// Lstat implements FileSystem.Lstat.
+func (mt *MountTable) Lstat(path string) (FileInfo, error) {
+	m, rel, err := mt.resolve(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return m.fs.Lstat(rel)
+}
+
+// Mkdir implements FileSystem.Mkdir.
+func (mt *MountTable) Mkdir(path string, perm os.FileMode) error {
+	m, rel, err := mt.resolveWritable(path)
+	if err != nil {
+		return err
+	}
+	return m.fs.Mkdir(rel, perm)
+}
+
+// MkdirAll implements FileSystem.MkdirAll.
+func (mt *MountTable) MkdirAll(path string, perm os.FileMode) error {
+	m, rel, err := mt.resolveWritable(path)
+	if err != nil {
+		return err
+	}
+	return m.fs.MkdirAll(rel, perm)
+}
+
+// Remove implements FileSystem.Remove. Mount points cannot be removed.
+func (mt *MountTable) Remove(path string) error {
+	if mt.isMountPoint(path) {
+		return ErrMountBusy
+	}
+	m, rel, err := mt.resolveWritable(path)
+	if err != nil {
+		return err
+	}
+	return m.fs.Remove(rel)
+}
+
+// RemoveAll implements FileSystem.RemoveAll. It removes only what belongs
+// to the mount containing path; filesystems mounted beneath it are left
+// untouched.
+func (mt *MountTable) RemoveAll(path string) error {
+	if mt.isMountPoint(path) {
+		return ErrMountBusy
+	}
+	m, rel, err := mt.resolveWritable(path)
+	if err != nil {
+		return err
+	}
+	return m.fs.RemoveAll(rel)
+}
+
+// Rename implements FileSystem.Rename. Renames between different mounts
+// fail with an *os.LinkError wrapping ErrCrossDevice; callers fall back to
+// copy and remove, as with rename(2).
+func (mt *MountTable) Rename(oldpath, newpath string) error {
+	if mt.isMountPoint(oldpath) || mt.isMountPoint(newpath) {
+		return ErrMountBusy
+	}
+
+	oldMount, oldRel, err := mt.resolveWritable(oldpath)
+	if err != nil {
+		return err
+	}
+	newMount, newRel, err := mt.resolveWritable(newpath)
+	if err != nil {
+		return err
+	}
+
+	if oldMount != newMount {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: ErrCrossDevice}
+	}
+	return oldMount.fs.Rename(oldRel, newRel)
+}
+
+// ReadDir implements FileSystem.ReadDir. Mount points directly beneath
+// path are listed even if the parent filesystem has no such directory.
+func (mt *MountTable) ReadDir(path string) ([]DirEntry, error) {
+	m, rel, err := mt.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := m.fs.ReadDir(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := Clean(path)
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		seen[entry.Name()] = true
+	}
+
+	mt.mu.RLock()
+	var children []*mount
+	for _, child := range mt.mounts {
+		if child.path != dir && hasPathPrefix(child.path, dir) && Dir(child.path) == dir {
+			children = append(children, child)
+		}
+	}
+	mt.mu.RUnlock()
+
+	for _, child := range children {
+		name := Base(child.path)
+		if seen[name] {
+			continue
+		}
+		info, err := child.fs.Stat("/")
+		if err != nil {
+			continue
+		}
+		info.Name = name
+		entries = append(entries, newDirEntry(name, true, info))
+	}
+
+	return entries, nil
+}
+
+// ReadFile implements FileSystem.ReadFile.
+func (mt *MountTable) ReadFile(path string) ([]byte, error) {
+	m, rel, err := mt.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	return m.fs.ReadFile(rel)
+}
+
+// WriteFile implements FileSystem.WriteFile.
+func (mt *MountTable) WriteFile(path string, data []byte, perm os.FileMode) error {
+	m, rel, err := mt.resolveWritable(path)
+	if err != nil {
+		return err
+	}
+	return m.fs.WriteFile(rel, data, perm)
+}
+
+// Create implements FileSystem.Create.
+func (mt *MountTable) Create(path string) (File, error) {
+	return mt.OpenFile(path, O_RDWR|O_CREATE|O_TRUNC, 0666)
+}
+
+// Symlink implements FileSystem.Symlink. The target is stored as given and
+// is interpreted by the filesystem holding the link.
+func (mt *MountTable) Symlink(target, newpath string) error {
+	m, rel, err := mt.resolveWritable(newpath)
+	if err != nil {
+		return err
+	}
+	return m.fs.Symlink(target, rel)
+}
+
+// Readlink implements FileSystem.Readlink.
+func (mt *MountTable) Readlink(path string) (string, error) {
+	m, rel, err := mt.resolve(path)
+	if err != nil {
+		return "", err
+	}
+	return m.fs.Readlink(rel)
+}
+
+// Link implements FileSystem.Link. Like Rename, it fails with
+// ErrCrossDevice when the paths are on different mounts.
+func (mt *MountTable) Link(oldpath, newpath string) error {
+	if mt.isMountPoint(newpath) {
+		return ErrMountBusy
+	}
+
+	oldMount, oldRel, err := mt.resolve(oldpath)
+	if err != nil {
+		return err
+	}
+	newMount, newRel, err := mt.resolveWritable(newpath)
+	if err != nil {
+		return err
+	}
+
+	if oldMount != newMount {
+		return &os.LinkError{Op: "link", Old: oldpath, New: newpath, Err: ErrCrossDevice}
+	}
+	return oldMount.fs.Link(oldRel, newRel)
+}
+
+// Chmod implements FileSystem.Chmod.
+func (mt *MountTable) Chmod(path string, mode os.FileMode) error {
+	m, rel, err := mt.resolveWritable(path)
+	if err != nil {
+		return err
+	}
+	return m.fs.Chmod(rel, mode)
+}
+
+// Chown implements FileSystem.Chown.
+func (mt *MountTable) Chown(path string, uid, gid int) error {
+	m, rel, err := mt.resolveWritable(path)
+	if err != nil {
+		return err
+	}
+	return m.fs.Chown(rel, uid, gid)
+}
+
+// Chtimes implements FileSystem.Chtimes.
+func (mt *MountTable) Chtimes(path string, atime, mtime time.Time) error {
+	m, rel, err := mt.resolveWritable(path)
+	if err != nil {
+		return err
+	}
+	return m.fs.Chtimes(rel, atime, mtime)
+}
+
+// Getxattr implements XattrFS.Getxattr for mounts that support it.
+func (mt *MountTable) Getxattr(path, name string) ([]byte, error) {
+	m, rel, err := mt.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	xfs, ok := m.fs.(XattrFS)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	return xfs.Getxattr(rel, name)
+}
+
+// Setxattr implements XattrFS.Setxattr for mounts that support it.
+func (mt *MountTable) Setxattr(path, name string, value []byte, flags int) error {
+	m, rel, err := mt.resolveWritable(path)
+	if err != nil {
+		return err
+	}
+	xfs, ok := m.fs.(XattrFS)
+	if !ok {
+		return ErrNotImplemented
+	}
+	return xfs.Setxattr(rel, name, value, flags)
+}
+
+// Listxattr implements XattrFS.Listxattr for mounts that support it.
+func (mt *MountTable) Listxattr(path string) ([]string, error) {
+	m, rel, err := mt.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	xfs, ok := m.fs.(XattrFS)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	return xfs.Listxattr(rel)
+}
+
+// Removexattr implements XattrFS.Removexattr for mounts that support it.
+func (mt *MountTable) Removexattr(path, name string) error {
+	m, rel, err := mt.resolveWritable(path)
+	if err != nil {
+		return err
+	}
+	xfs, ok := m.fs.(XattrFS)
+	if !ok {
+		return ErrNotImplemented
+	}
+	return xfs.Removexattr(rel, name)
+}
+
+// subFS exposes a subdirectory of a filesystem as its root. It backs bind
+// mounts of directories other than a mount's root.
+type subFS struct {
+	fs   FileSystem
+	root string
+}
+
+// path maps a path in the subtree to the underlying filesystem.
+func (s *subFS) path(p string) string {
+	return Join(s.root, Clean(p))
+}
+
+func (s *subFS) Open(p string) (File, error) {
+	return s.fs.Open(s.path(p))
+}
+
+func (s *subFS) OpenFile(p string, flags int, perm os.FileMode) (File, error) {
+	return s.fs.OpenFile(s.path(p), flags, perm)
+}
+
+func (s *subFS) Stat(p string) (FileInfo, error) {
+	return s.fs.Stat(s.path(p))
+}
+
+func (s *subFS) Lstat(p string) (FileInfo, error) {
+	return s.fs.Lstat(s.path(p))
+}
+
+func (s *subFS) Mkdir(p string, perm os.FileMode) error {
+	return s.fs.Mkdir(s.path(p), perm)
+}
+
+func (s *subFS) MkdirAll(p string, perm os.FileMode) error {
+	return s.fs.MkdirAll(s.path(p), perm)
+}
+
+func (s *subFS) Remove(p string) error {
+	return s.fs.Remove(s.path(p))
+}
+
+func (s *subFS) RemoveAll(p string) error {
+	return s.fs.RemoveAll(s.path(p))
+}
+
+func (s *subFS) Rename(oldpath, newpath string) error {
+	return s.fs.Rename(s.path(oldpath), s.path(newpath))
+}
+
+func (s *subFS) ReadDir(p string) ([]DirEntry, error) {
+	return s.fs.ReadDir(s.path(p))
+}
+
+func (s *subFS) ReadFile(p string) ([]byte, error) {
+	return s.fs.ReadFile(s.path(p))
+}
+
+func (s *subFS) WriteFile(p string, data []byte, perm os.FileMode) error {
+	return s.fs.WriteFile(s.path(p), data, perm)
+}
+
+func (s *subFS) Create(p string) (File, error) {
+	return s.fs.Create(s.path(p))
+}
+
+func (s *subFS) Symlink(target, newpath string) error {
+	return s.fs.Symlink(target, s.path(newpath))
+}
+
+func (s *subFS) Readlink(p string) (string, error) {
+	return s.fs.Readlink(s.path(p))
+}
+
+func (s *subFS) Link(oldpath, newpath string) error {
+	return s.fs.Link(s.path(oldpath), s.path(newpath))
+}
+
+func (s *subFS) Chmod(p string, mode os.FileMode) error {
+	return s.fs.Chmod(s.path(p), mode)
+}
+
+func (s *subFS) Chown(p string, uid, gid int) error {
+	return s.fs.Chown(s.path(p), uid, gid)
+}
+
+func (s *subFS) Chtimes(p string, atime, mtime time.Time) error {
+	return s.fs.Chtimes(s.path(p), atime, mtime)
+}
+
+func (s *subFS) Getxattr(p, name string) ([]byte, error) {
+	xfs, ok := s.fs.(XattrFS)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	return xfs.Getxattr(s.path(p), name)
+}
+
+func (s *subFS) Setxattr(p, name string, value []byte, flags int) error {
+	xfs, ok := s.fs.(XattrFS)
+	if !ok {
+		return ErrNotImplemented
+	}
+	return xfs.Setxattr(s.path(p), name, value, flags)
+}
+
+func (s *subFS) Listxattr(p string) ([]string, error) {
+	xfs, ok := s.fs.(XattrFS)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	return xfs.Listxattr(s.path(p))
+}
+
+func (s *subFS) Removexattr(p, name string) error {
+	xfs, ok := s.fs.(XattrFS)
+	if !ok {
+		return ErrNotImplemented
+	}
+	return xfs.Removexattr(s.path(p), name)
+}
+
+var _ XattrFS = (*MountTable)(nil)
@@ -0,0 +1,217 @@
+package vfs_test
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	vfs "webos/pkg/vfs"
+	"webos/pkg/vfs/memfs"
+)
+
+// newMountTable returns a table with /data and /data/cache mounted over a
+// root filesystem, each holding a file naming the filesystem.
+func newMountTable(t *testing.T) (*vfs.MountTable, map[string]*memfs.FS) {
+	t.Helper()
+	filesystems := map[string]*memfs.FS{"/": memfs.New(), "/data": memfs.New(), "/data/cache": memfs.New()}
+	mt := vfs.NewMountTable(filesystems["/"])
+	for _, path := range []string{"/data", "/data/cache"} {
+		if err := mt.Mount(path, filesystems[path], 0); err != nil {
+			t.Fatalf("Mount(%s) failed: %v", path, err)
+		}
+	}
+	for path, fs := range filesystems {
+		if err := fs.WriteFile("/owner", []byte(path), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	return mt, filesystems
+}
+
+func readString(t *testing.T, fs vfs.FileSystem, path string) string {
+	t.Helper()
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile(%s) failed: %v", path, err)
+	}
+	return string(data)
+}
+
+func TestMountRouting(t *testing.T) {
+	mt, filesystems := newMountTable(t)
+
+	tests := []struct {
+		path  string
+		owner string
+	}{
+		{"/owner", "/"},
+		{"/data/owner", "/data"},
+		{"/data/cache/owner", "/data/cache"},
+		{"/data/./cache/../cache/owner", "/data/cache"},
+	}
+	for _, tt := range tests {
+		if got := readString(t, mt, tt.path); got != tt.owner {
+			t.Errorf("%s routed to %s, expected %s", tt.path, got, tt.owner)
+		}
+	}
+
+	// A path sharing only a string prefix with a mount stays on the parent
+	mt.WriteFile("/database", []byte("x"), 0644)
+	if _, err := filesystems["/"].Stat("/database"); err != nil {
+		t.Errorf("/database was not written to the root: %v", err)
+	}
+
+	// Mount points appear in their parent's listing
+	entries, err := mt.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	var found bool
+	for _, entry := range entries {
+		if entry.Name() == "data" && entry.IsDir() {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("mount point /data missing from ReadDir(\"/\")")
+	}
+
+	if err := mt.Mount("/data", memfs.New(), 0); !errors.Is(err, vfs.ErrAlreadyMounted) {
+		t.Errorf("second Mount(/data) returned %v", err)
+	}
+	if err := mt.Unmount("/data"); !errors.Is(err, vfs.ErrMountBusy) {
+		t.Errorf("Unmount of a mount with submounts returned %v", err)
+	}
+	if err := mt.Unmount("/data/cache"); err != nil {
+		t.Fatalf("Unmount failed: %v", err)
+	}
+	if _, err := mt.Stat("/data/cache/owner"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("unmounted file still visible: %v", err)
+	}
+}
+
+func TestMountBind(t *testing.T) {
+	mt, filesystems := newMountTable(t)
+	filesystems["/data"].MkdirAll("/shared/sub", 0755)
+	filesystems["/data"].WriteFile("/shared/sub/file", []byte("bound"), 0644)
+
+	if err := mt.Bind("/data/shared", "/mnt", 0); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if got := readString(t, mt, "/mnt/sub/file"); got != "bound" {
+		t.Errorf("bind reads %q", got)
+	}
+
+	// Writes through the bind land in the source filesystem
+	mt.WriteFile("/mnt/new", []byte("via bind"), 0644)
+	if got := readString(t, filesystems["/data"], "/shared/new"); got != "via bind" {
+		t.Errorf("source reads %q", got)
+	}
+
+	if err := mt.Bind("/data/owner", "/file", 0); err == nil {
+		t.Error("Bind of a regular file succeeded")
+	}
+
+	var info vfs.MountInfo
+	for _, m := range mt.Mounts() {
+		if m.Path == "/mnt" {
+			info = m
+		}
+	}
+	if info.Source != "/data/shared" {
+		t.Errorf("bind mount info %+v", info)
+	}
+}
+
+func TestMountReadOnly(t *testing.T) {
+	root := memfs.New()
+	ro := memfs.New()
+	ro.WriteFile("/file", []byte("data"), 0644)
+
+	mt := vfs.NewMountTable(root)
+	if err := mt.Mount("/ro", ro, vfs.MountReadOnly); err != nil {
+		t.Fatalf("Mount failed: %v", err)
+	}
+
+	if got := readString(t, mt, "/ro/file"); got != "data" {
+		t.Errorf("read-only mount reads %q", got)
+	}
+
+	writes := map[string]func() error{
+		"WriteFile": func() error { return mt.WriteFile("/ro/new", nil, 0644) },
+		"OpenFile":  func() error { _, err := mt.OpenFile("/ro/file", vfs.O_RDWR, 0); return err },
+		"Mkdir":     func() error { return mt.Mkdir("/ro/dir", 0755) },
+		"Remove":    func() error { return mt.Remove("/ro/file") },
+		"Chmod":     func() error { return mt.Chmod("/ro/file", 0600) },
+		"Rename":    func() error { return mt.Rename("/ro/file", "/ro/moved") },
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, vfs.ErrReadOnlyFS) {
+			t.Errorf("%s on a read-only mount returned %v", name, err)
+		}
+	}
+
+	// Binding a read-only mount cannot make it writable
+	ro.Mkdir("/sub", 0755)
+	if err := mt.Bind("/ro/sub", "/rw", 0); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := mt.WriteFile("/rw/new", nil, 0644); !errors.Is(err, vfs.ErrReadOnlyFS) {
+		t.Errorf("write through a bind of a read-only mount returned %v", err)
+	}
+}
+
+func TestMountClone(t *testing.T) {
+	mt, _ := newMountTable(t)
+	clone := mt.Clone()
+
+	if err := clone.Mount("/private", memfs.New(), 0); err != nil {
+		t.Fatalf("Mount failed: %v", err)
+	}
+	if err := clone.Unmount("/data/cache"); err != nil {
+		t.Fatalf("Unmount failed: %v", err)
+	}
+
+	if len(mt.Mounts()) != 3 {
+		t.Errorf("original table has %d mounts, expected 3", len(mt.Mounts()))
+	}
+	if got := readString(t, mt, "/data/cache/owner"); got != "/data/cache" {
+		t.Errorf("original routes to %s", got)
+	}
+	if _, err := mt.Stat("/private"); err == nil {
+		t.Error("mount in the clone is visible in the original")
+	}
+
+	// The filesystems themselves are shared
+	clone.WriteFile("/data/shared", []byte("x"), 0644)
+	if _, err := mt.Stat("/data/shared"); err != nil {
+		t.Errorf("write through the clone not visible: %v", err)
+	}
+}
+
+func TestMountCrossDevice(t *testing.T) {
+	mt, _ := newMountTable(t)
+
+	var linkErr *os.LinkError
+	err := mt.Rename("/owner", "/data/moved")
+	if !errors.Is(err, syscall.EXDEV) || !errors.As(err, &linkErr) || linkErr.Op != "rename" {
+		t.Errorf("cross-mount Rename returned %v", err)
+	}
+	err = mt.Link("/data/owner", "/data/cache/linked")
+	if !errors.Is(err, vfs.ErrCrossDevice) || !errors.As(err, &linkErr) || linkErr.Op != "link" {
+		t.Errorf("cross-mount Link returned %v", err)
+	}
+
+	// Within one mount both work
+	if err := mt.Rename("/data/owner", "/data/renamed"); err != nil {
+		t.Errorf("Rename within a mount failed: %v", err)
+	}
+	if err := mt.Link("/data/renamed", "/data/linked"); err != nil {
+		t.Errorf("Link within a mount failed: %v", err)
+	}
+
+	if err := mt.Rename("/data/cache", "/elsewhere"); !errors.Is(err, vfs.ErrMountBusy) {
+		t.Errorf("Rename of a mount point returned %v", err)
+	}
+}
@@ -16,9 +16,13 @@ import (
 var ErrNotSupported = errors.New("overlayfs: operation not supported")
 
 // FS represents a layered filesystem with lower (read-only) and upper (read-write) layers.
+//
+// Change notifications cover changes made through the overlay, reported by
+// their overlay paths; changes made directly to either layer are not.
 type FS struct {
-	upper vfs.FileSystem
-	lower vfs.FileSystem
+	upper  vfs.FileSystem
+	lower  vfs.FileSystem
+	events vfs.EventHub
 }
 
 // New creates a new overlay filesystem with the given upper and lower layers.
@@ -30,6 +34,11 @@ func New(upper, lower vfs.FileSystem) *FS {
 	}
 }
 
+// Subscribe implements vfs.Notifier.
+func (fs *FS) Subscribe(fn func(vfs.Event)) (cancel func()) {
+	return fs.events.Subscribe(fn)
+}
+
 // Open implements vfs.FileSystem.Open.
 func (fs *FS) Open(path string) (vfs.File, error) {
 	return fs.OpenFile(path, vfs.O_RDONLY, 0)
@@ -45,7 +54,7 @@ func (fs *FS) OpenFile(path string, flags int, perm os.FileMode) (vfs.File, erro
 
 	// Check if file exists in upper layer
 	if existsUpper {
-		return fs.upper.OpenFile(path, flags, perm)
+		return fs.openUpper(path, flags, perm, false)
 	}
 
 	// Check if file exists in lower layer
@@ -61,7 +70,10 @@ func (fs *FS) OpenFile(path string, flags int, perm os.FileMode) (vfs.File, erro
 		}
 
 		// Create in upper layer
-		return fs.upper.OpenFile(path, flags|vfs.O_CREATE, perm)
+		if err := fs.copyUpParent(path); err != nil {
+			return nil, err
+		}
+		return fs.openUpper(path, flags|vfs.O_CREATE, perm, true)
 	}
 
 	// File exists in lower layer but not upper
@@ -75,7 +87,28 @@ func (fs *FS) OpenFile(path string, flags int, perm os.FileMode) (vfs.File, erro
 		return nil, err
 	}
 
-	return fs.upper.OpenFile(path, flags, perm)
+	return fs.openUpper(path, flags, perm, false)
+}
+
+// openUpper opens a file in the upper layer, reporting its creation or
+// truncation and wrapping writable files so their writes are reported.
+func (fs *FS) openUpper(path string, flags int, perm os.FileMode, created bool) (vfs.File, error) {
+	file, err := fs.upper.OpenFile(path, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	writable := (flags & (vfs.O_WRONLY | vfs.O_RDWR)) != 0
+	if created {
+		fs.events.Emit(vfs.OpCreate, path)
+	} else if writable && (flags&vfs.O_TRUNC) != 0 {
+		fs.events.Emit(vfs.OpWrite, path)
+	}
+
+	if !writable {
+		return file, nil
+	}
+	return &overlayFile{File: file, path: path, events: &fs.events}, nil
 }
 
 // Stat implements vfs.FileSystem.Stat.
@@ -122,13 +155,32 @@ func (fs *FS) Lstat(path string) (vfs.FileInfo, error) {
 // Mkdir implements vfs.FileSystem.Mkdir.
 func (fs *FS) Mkdir(path string, perm os.FileMode) error {
 	// Create in upper layer
-	return fs.upper.Mkdir(path, perm)
+	if err := fs.upper.Mkdir(path, perm); err != nil {
+		return err
+	}
+	fs.events.Emit(vfs.OpCreate, path)
+	return nil
 }
 
 // MkdirAll implements vfs.FileSystem.MkdirAll.
 func (fs *FS) MkdirAll(path string, perm os.FileMode) error {
+	// Find the missing directories so each can be reported
+	var missing []string
+	for p := vfs.Clean(path); p != "/"; p = vfs.Dir(p) {
+		if _, err := fs.Stat(p); err == nil {
+			break
+		}
+		missing = append(missing, p)
+	}
+
 	// Create in upper layer
-	return fs.upper.MkdirAll(path, perm)
+	if err := fs.upper.MkdirAll(path, perm); err != nil {
+		return err
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		fs.events.Emit(vfs.OpCreate, missing[i])
+	}
+	return nil
 }
 
 // Remove implements vfs.FileSystem.Remove.
@@ -136,11 +188,12 @@ func (fs *FS) Remove(path string) error {
 	// Try to remove from upper layer
 	err := fs.upper.Remove(path)
 	if err == nil {
+		fs.events.Emit(vfs.OpRemove, path)
 		return nil
 	}
 
 	// If error is not "not exist", return it
-	if err != os.ErrNotExist && err.Error() != "memfs: file not found" {
+	if !isNotExist(err) {
 		return err
 	}
 
@@ -152,25 +205,39 @@ func (fs *FS) Remove(path string) error {
 	}
 
 	// Create whiteout file in upper layer to hide lower file
-	return fs.createWhiteout(path)
+	if err := fs.createWhiteout(path); err != nil {
+		return err
+	}
+	fs.events.Emit(vfs.OpRemove, path)
+	return nil
 }
 
 // RemoveAll implements vfs.FileSystem.RemoveAll.
 func (fs *FS) RemoveAll(path string) error {
+	var removed []string
+	if !fs.isWhiteout(path) {
+		removed = fs.events.CollectTree(fs, path)
+	}
+
 	// Try upper first
 	fs.upper.RemoveAll(path)
 
 	// Check if path exists in lower
 	_, err := fs.lower.Stat(path)
 	if err != nil {
-		if err == os.ErrNotExist || err.Error() == "memfs: file not found" {
+		if isNotExist(err) {
+			fs.events.EmitRemoveTree(removed)
 			return nil // Doesn't exist in lower
 		}
 		return err
 	}
 
 	// Create whiteout for the path
-	return fs.createWhiteout(path)
+	if err := fs.createWhiteout(path); err != nil {
+		return err
+	}
+	fs.events.EmitRemoveTree(removed)
+	return nil
 }
 
 // Rename implements vfs.FileSystem.Rename.
@@ -178,6 +245,7 @@ func (fs *FS) Rename(oldpath, newpath string) error {
 	// Try to rename in upper layer first
 	err := fs.upper.Rename(oldpath, newpath)
 	if err == nil {
+		fs.events.EmitRename(oldpath, newpath)
 		return nil
 	}
 
@@ -204,7 +272,11 @@ func (fs *FS) Rename(oldpath, newpath string) error {
 	}
 
 	// Create whiteout for oldpath to hide lower-layer file
-	return fs.createWhiteout(oldpath)
+	if err := fs.createWhiteout(oldpath); err != nil {
+		return err
+	}
+	fs.events.EmitRename(oldpath, newpath)
+	return nil
 }
 
 // ReadDir implements vfs.FileSystem.ReadDir.
@@ -274,7 +346,18 @@ func (fs *FS) ReadFile(path string) ([]byte, error) {
 
 // WriteFile implements vfs.FileSystem.WriteFile.
 func (fs *FS) WriteFile(path string, data []byte, perm os.FileMode) error {
-	return fs.upper.WriteFile(path, data, perm)
+	_, statErr := fs.Stat(path)
+	if err := fs.copyUpParent(path); err != nil {
+		return err
+	}
+	if err := fs.upper.WriteFile(path, data, perm); err != nil {
+		return err
+	}
+	if statErr != nil {
+		fs.events.Emit(vfs.OpCreate, path)
+	}
+	fs.events.Emit(vfs.OpWrite, path)
+	return nil
 }
 
 // Create implements vfs.FileSystem.Create.
@@ -284,7 +367,11 @@ func (fs *FS) Create(path string) (vfs.File, error) {
 
 // Symlink implements vfs.FileSystem.Symlink.
 func (fs *FS) Symlink(target, newpath string) error {
-	return fs.upper.Symlink(target, newpath)
+	if err := fs.upper.Symlink(target, newpath); err != nil {
+		return err
+	}
+	fs.events.Emit(vfs.OpCreate, newpath)
+	return nil
 }
 
 // Readlink implements vfs.FileSystem.Readlink.
@@ -299,52 +386,163 @@ func (fs *FS) Readlink(path string) (string, error) {
 	return fs.lower.Readlink(path)
 }
 
+// Link implements vfs.FileSystem.Link. A file only in the lower layer is
+// copied up first, so the link shares the upper-layer copy.
+func (fs *FS) Link(oldpath, newpath string) error {
+	existsUpper, err := fs.existsInUpper(oldpath)
+	if err != nil {
+		return err
+	}
+	if !existsUpper {
+		if err := fs.copyUp(oldpath); err != nil {
+			return err
+		}
+	}
+
+	if err := fs.upper.Link(oldpath, newpath); err != nil {
+		return err
+	}
+	fs.events.Emit(vfs.OpCreate, newpath)
+	return nil
+}
+
 // Chmod implements vfs.FileSystem.Chmod.
 func (fs *FS) Chmod(path string, mode os.FileMode) error {
 	// Check if exists in upper
 	_, err := fs.upper.Stat(path)
-	if err == nil {
-		return fs.upper.Chmod(path, mode)
+	if err != nil {
+		// Copy up and modify
+		if err := fs.copyUp(path); err != nil {
+			return err
+		}
 	}
 
-	// Copy up and modify
-	if err := fs.copyUp(path); err != nil {
+	if err := fs.upper.Chmod(path, mode); err != nil {
 		return err
 	}
-
-	return fs.upper.Chmod(path, mode)
+	fs.events.Emit(vfs.OpChmod, path)
+	return nil
 }
 
 // Chown implements vfs.FileSystem.Chown.
 func (fs *FS) Chown(path string, uid, gid int) error {
 	// Check if exists in upper
 	_, err := fs.upper.Stat(path)
-	if err == nil {
-		return fs.upper.Chown(path, uid, gid)
+	if err != nil {
+		// Copy up and modify
+		if err := fs.copyUp(path); err != nil {
+			return err
+		}
 	}
 
-	// Copy up and modify
-	if err := fs.copyUp(path); err != nil {
+	if err := fs.upper.Chown(path, uid, gid); err != nil {
 		return err
 	}
-
-	return fs.upper.Chown(path, uid, gid)
+	fs.events.Emit(vfs.OpChmod, path)
+	return nil
 }
 
 // Chtimes implements vfs.FileSystem.Chtimes.
 func (fs *FS) Chtimes(path string, atime, mtime time.Time) error {
 	// Check if exists in upper
 	_, err := fs.upper.Stat(path)
-	if err == nil {
-		return fs.upper.Chtimes(path, atime, mtime)
+	if err != nil {
+		// Copy up and modify
+		if err := fs.copyUp(path); err != nil {
+			return err
+		}
 	}
 
-	// Copy up and modify
-	if err := fs.copyUp(path); err != nil {
+	if err := fs.upper.Chtimes(path, atime, mtime); err != nil {
 		return err
 	}
+	fs.events.Emit(vfs.OpChmod, path)
+	return nil
+}
 
-	return fs.upper.Chtimes(path, atime, mtime)
+// Getxattr implements vfs.XattrFS.Getxattr.
+func (fs *FS) Getxattr(path, name string) ([]byte, error) {
+	layer, err := fs.xattrLayer(path)
+	if err != nil {
+		return nil, err
+	}
+	return layer.Getxattr(path, name)
+}
+
+// Setxattr implements vfs.XattrFS.Setxattr.
+func (fs *FS) Setxattr(path, name string, value []byte, flags int) error {
+	upper, err := fs.xattrUpper(path)
+	if err != nil {
+		return err
+	}
+
+	if err := upper.Setxattr(path, name, value, flags); err != nil {
+		return err
+	}
+	fs.events.Emit(vfs.OpChmod, path)
+	return nil
+}
+
+// Listxattr implements vfs.XattrFS.Listxattr.
+func (fs *FS) Listxattr(path string) ([]string, error) {
+	layer, err := fs.xattrLayer(path)
+	if err != nil {
+		return nil, err
+	}
+	return layer.Listxattr(path)
+}
+
+// Removexattr implements vfs.XattrFS.Removexattr.
+func (fs *FS) Removexattr(path, name string) error {
+	upper, err := fs.xattrUpper(path)
+	if err != nil {
+		return err
+	}
+
+	if err := upper.Removexattr(path, name); err != nil {
+		return err
+	}
+	fs.events.Emit(vfs.OpChmod, path)
+	return nil
+}
+
+// xattrLayer returns the layer holding the attributes of path.
+func (fs *FS) xattrLayer(path string) (vfs.XattrFS, error) {
+	if _, err := fs.Stat(path); err != nil {
+		return nil, err
+	}
+
+	var layer vfs.FileSystem = fs.lower
+	if inUpper, err := fs.existsInUpper(path); err != nil {
+		return nil, err
+	} else if inUpper {
+		layer = fs.upper
+	}
+
+	xfs, ok := layer.(vfs.XattrFS)
+	if !ok {
+		return nil, vfs.ErrNotImplemented
+	}
+	return xfs, nil
+}
+
+// xattrUpper copies path up if needed and returns the upper layer for
+// changing its attributes.
+func (fs *FS) xattrUpper(path string) (vfs.XattrFS, error) {
+	upper, ok := fs.upper.(vfs.XattrFS)
+	if !ok {
+		return nil, vfs.ErrNotImplemented
+	}
+
+	if _, err := fs.Stat(path); err != nil {
+		return nil, err
+	}
+	if _, err := fs.upper.Stat(path); err != nil {
+		if err := fs.copyUp(path); err != nil {
+			return nil, err
+		}
+	}
+	return upper, nil
 }
 
 // existsInUpper checks if a path exists in the upper layer.
@@ -353,8 +551,7 @@ func (fs *FS) existsInUpper(path string) (bool, error) {
 	if err == nil {
 		return true, nil
 	}
-	// Check for file not found (could be ErrNotExist or MemFS's ErrFileNotFound)
-	if err == os.ErrNotExist || err.Error() == "memfs: file not found" {
+	if isNotExist(err) {
 		return false, nil
 	}
 	return false, err
@@ -366,15 +563,45 @@ func (fs *FS) existsInLower(path string) (bool, error) {
 	if err == nil {
 		return true, nil
 	}
-	// Check for file not found
-	if err == os.ErrNotExist || err.Error() == "memfs: file not found" {
+	if isNotExist(err) {
 		return false, nil
 	}
 	return false, err
 }
 
-// copyUp copies a file from the lower layer to the upper layer.
+// isNotExist reports whether err means a path is missing from a layer,
+// which could be os.ErrNotExist, possibly wrapped, or MemFS's
+// ErrFileNotFound.
+func isNotExist(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || err.Error() == "memfs: file not found"
+}
+
+// copyUpParent creates the parent directory of path in the upper layer
+// when only the lower layer has it, so new files can be created there.
+func (fs *FS) copyUpParent(path string) error {
+	dir := vfs.Dir(path)
+	existsUpper, err := fs.existsInUpper(dir)
+	if err != nil || existsUpper {
+		return err
+	}
+	existsLower, err := fs.existsInLower(dir)
+	if err != nil || !existsLower {
+		return err
+	}
+	return fs.copyUp(dir)
+}
+
+// copyUp copies a file from the lower layer to the upper layer, along
+// with its extended attributes when both layers support them.
 func (fs *FS) copyUp(path string) error {
+	if err := fs.copyUpData(path); err != nil {
+		return err
+	}
+	return fs.copyUpXattrs(path)
+}
+
+// copyUpData copies the contents of a lower-layer entry to the upper layer.
+func (fs *FS) copyUpData(path string) error {
 	// Get file info from lower
 	info, err := fs.lower.Stat(path)
 	if err != nil {
@@ -410,6 +637,34 @@ func (fs *FS) copyUp(path string) error {
 	return fs.upper.WriteFile(path, data, info.Mode)
 }
 
+// copyUpXattrs copies extended attributes from the lower layer to the
+// upper layer.
+func (fs *FS) copyUpXattrs(path string) error {
+	lower, ok := fs.lower.(vfs.XattrFS)
+	if !ok {
+		return nil
+	}
+	upper, ok := fs.upper.(vfs.XattrFS)
+	if !ok {
+		return nil
+	}
+
+	names, err := lower.Listxattr(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		value, err := lower.Getxattr(path, name)
+		if err != nil {
+			return err
+		}
+		if err := upper.Setxattr(path, name, value, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // createWhiteout creates a whiteout file to hide a lower layer entry.
 func (fs *FS) createWhiteout(path string) error {
 	// Whiteout files are named ".wh.<name>"
@@ -429,3 +684,36 @@ func (fs *FS) createWhiteout(path string) error {
 
 // whiteoutPrefix is the prefix used for whiteout files.
 const whiteoutPrefix = ".wh."
+
+// overlayFile wraps a writable upper-layer file to report its writes.
+type overlayFile struct {
+	vfs.File
+	path   string
+	events *vfs.EventHub
+}
+
+func (f *overlayFile) Write(b []byte) (int, error) {
+	n, err := f.File.Write(b)
+	if n > 0 {
+		f.events.Emit(vfs.OpWrite, f.path)
+	}
+	return n, err
+}
+
+func (f *overlayFile) WriteAt(b []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(b, off)
+	if n > 0 {
+		f.events.Emit(vfs.OpWrite, f.path)
+	}
+	return n, err
+}
+
+func (f *overlayFile) Truncate(size int64) error {
+	if err := f.File.Truncate(size); err != nil {
+		return err
+	}
+	f.events.Emit(vfs.OpWrite, f.path)
+	return nil
+}
+
+var _ vfs.XattrFS = (*FS)(nil)
@@ -3,7 +3,9 @@ package overlayfs
 import (
 	"os"
 	"testing"
+	"time"
 
+	vfs "webos/pkg/vfs"
 	"webos/pkg/vfs/memfs"
 )
 
@@ -405,3 +407,87 @@ func TestLstat(t *testing.T) {
 		t.Error("should be a symlink")
 	}
 }
+
+func TestXattrCopyUp(t *testing.T) {
+	upper := memfs.New()
+	lower := memfs.New()
+
+	lower.WriteFile("/file.txt", []byte("content"), 0644)
+	lower.Setxattr("/file.txt", "user.origin", []byte("lower"), 0)
+
+	fs := New(upper, lower)
+
+	// Reads come from the lower layer without copying up
+	if value, err := fs.Getxattr("/file.txt", "user.origin"); err != nil || string(value) != "lower" {
+		t.Errorf("Getxattr returned %q, %v", value, err)
+	}
+	if _, err := upper.Stat("/file.txt"); err == nil {
+		t.Error("Getxattr copied the file up")
+	}
+
+	// Writes copy the file and its attributes up
+	if err := fs.Setxattr("/file.txt", "user.tag", []byte("new"), 0); err != nil {
+		t.Fatalf("Setxattr failed: %v", err)
+	}
+	names, err := upper.Listxattr("/file.txt")
+	if err != nil {
+		t.Fatalf("Listxattr in upper failed: %v", err)
+	}
+	if len(names) != 2 || names[0] != "user.origin" || names[1] != "user.tag" {
+		t.Errorf("upper attributes are %v", names)
+	}
+	if _, err := lower.Getxattr("/file.txt", "user.tag"); err == nil {
+		t.Error("Setxattr modified the lower layer")
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	upper := memfs.New()
+	lower := memfs.New()
+	lower.MkdirAll("/dir/sub", 0755)
+	lower.WriteFile("/dir/sub/lower", nil, 0644)
+	fs := New(upper, lower)
+	fs.WriteFile("/dir/upper", nil, 0644)
+
+	w, err := vfs.NewWatcher(fs)
+	if err != nil {
+		t.Fatalf("NewWatcher failed: %v", err)
+	}
+	defer w.Close()
+	w.Add("/", true)
+
+	fs.WriteFile("/dir/sub/lower", []byte("copied up"), 0644)
+	fs.RemoveAll("/dir")
+
+	// The write, then one remove for each merged entry, children first
+	expected := []vfs.Event{
+		{Op: vfs.OpWrite, Path: "/dir/sub/lower"},
+	}
+	events := make([]vfs.Event, 0, 5)
+	for len(events) < 5 {
+		select {
+		case ev := <-w.Events:
+			events = append(events, ev)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after events %v", events)
+		}
+	}
+	if events[0] != expected[0] {
+		t.Errorf("first event %v, expected %v", events[0], expected[0])
+	}
+	removed := make(map[string]int)
+	for i, ev := range events[1:] {
+		if ev.Op != vfs.OpRemove {
+			t.Errorf("unexpected event %v", ev)
+		}
+		removed[ev.Path] = i
+	}
+	for _, path := range []string{"/dir", "/dir/upper", "/dir/sub", "/dir/sub/lower"} {
+		if _, ok := removed[path]; !ok {
+			t.Errorf("no remove event for %s", path)
+		}
+	}
+	if removed["/dir/sub/lower"] > removed["/dir/sub"] || removed["/dir"] != 3 {
+		t.Errorf("parents reported before children: %v", events[1:])
+	}
+}
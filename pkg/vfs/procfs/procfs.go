@@ -0,0 +1,608 @@
+// Package procfs provides a read-only filesystem that renders the state of
+// a process.ProcessManager as files, in the manner of /proc.
+//
+// The root holds uptime, meminfo and a directory per process named by its
+// PID. Each process directory holds:
+//
+//	status   "Key:\tvalue" lines describing the process
+//	cmdline  the command and its arguments, each terminated by a NUL byte
+//	environ  the environment, each variable terminated by a NUL byte
+//	cwd      a symlink to the working directory
+//	fd/      a symlink per open file descriptor, pointing at its name
+//	limits   the resource limits applied by the manager's Enforcer
+//	stat     one line of space-separated fields, described below
+//
+// The fields of stat are the PID, the command in parentheses, a one-letter
+// state (R running or ready, S waiting, T stopped, Z zombie), the parent
+// PID, the priority, the CPU time used in clock ticks, the memory used in
+// bytes, and the start time in clock ticks since boot. There are
+// ClockTicks ticks per second.
+//
+// Contents are rendered when a file is opened, so an open file reads a
+// consistent snapshot.
+package procfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"webos/pkg/process"
+	vfs "webos/pkg/vfs"
+)
+
+// ClockTicks is the number of clock ticks per second used in stat files.
+const ClockTicks = 100
+
+// FS is a read-only view of a process manager.
+type FS struct {
+	pm   *process.ProcessManager
+	boot time.Time
+}
+
+// New creates a filesystem for pm. Uptime is counted from now.
+func New(pm *process.ProcessManager) *FS {
+	return &FS{pm: pm, boot: time.Now()}
+}
+
+// Entry kinds.
+const (
+	kindFile = iota
+	kindDir
+	kindLink
+)
+
+// entry is a resolved path.
+type entry struct {
+	name string
+	kind int
+	proc *process.Process // Owning process, nil for top-level entries
+	path string           // Clean path within the filesystem
+}
+
+// processFiles are the entries of a process directory.
+var processFiles = []struct {
+	name string
+	kind int
+}{
+	{"cmdline", kindFile},
+	{"cwd", kindLink},
+	{"environ", kindFile},
+	{"fd", kindDir},
+	{"limits", kindFile},
+	{"stat", kindFile},
+	{"status", kindFile},
+}
+
+// lookup resolves path to an entry.
+func (fs *FS) lookup(op, path string) (*entry, error) {
+	if err := vfs.ValidatePath(path); err != nil {
+		return nil, err
+	}
+	path = vfs.Clean(path)
+
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if path == "/" {
+		return &entry{name: "/", kind: kindDir, path: path}, nil
+	}
+
+	if len(parts) == 1 && (parts[0] == "uptime" || parts[0] == "meminfo") {
+		return &entry{name: parts[0], kind: kindFile, path: path}, nil
+	}
+
+	p := fs.process(parts[0])
+	if p == nil {
+		return nil, vfs.NotExistError(op, path)
+	}
+	if len(parts) == 1 {
+		return &entry{name: parts[0], kind: kindDir, proc: p, path: path}, nil
+	}
+
+	if len(parts) == 2 {
+		for _, f := range processFiles {
+			if f.name == parts[1] {
+				return &entry{name: f.name, kind: f.kind, proc: p, path: path}, nil
+			}
+		}
+	}
+
+	if len(parts) == 3 && parts[1] == "fd" {
+		if _, ok := openFile(p, parts[2]); ok {
+			return &entry{name: parts[2], kind: kindLink, proc: p, path: path}, nil
+		}
+	}
+
+	return nil, vfs.NotExistError(op, path)
+}
+
+// process returns the process named by a PID path component.
+func (fs *FS) process(name string) *process.Process {
+	pid, err := strconv.Atoi(name)
+	if err != nil || strconv.Itoa(pid) != name {
+		return nil
+	}
+	p, err := fs.pm.GetProcess(pid)
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+// openFile returns the open file with the descriptor named by a path
+// component.
+func openFile(p *process.Process, name string) (process.File, bool) {
+	fd, err := strconv.Atoi(name)
+	if err != nil || strconv.Itoa(fd) != name {
+		return process.File{}, false
+	}
+	for _, f := range p.Info().Files {
+		if f.FD == fd {
+			return f, true
+		}
+	}
+	return process.File{}, false
+}
+
+// info describes an entry. Files are rendered to report their size.
+func (fs *FS) info(e *entry) vfs.FileInfo {
+	info := vfs.FileInfo{Name: e.name, ModTime: fs.boot}
+	if e.proc != nil {
+		info.ModTime = e.proc.Info().CreatedAt
+	}
+
+	switch e.kind {
+	case kindDir:
+		info.Mode = os.ModeDir | 0555
+		info.IsDir = true
+	case kindLink:
+		info.Mode = os.ModeSymlink | 0777
+	default:
+		info.Mode = 0444
+		if data, err := fs.render(e); err == nil {
+			info.Size = int64(len(data))
+		}
+	}
+	return info
+}
+
+// children lists the names in a directory entry.
+func (fs *FS) children(e *entry) []string {
+	switch {
+	case e.path == "/":
+		var pids []int
+		for _, p := range fs.pm.GetProcesses() {
+			pids = append(pids, p.PID)
+		}
+		sort.Ints(pids)
+
+		names := []string{"meminfo", "uptime"}
+		for _, pid := range pids {
+			names = append(names, strconv.Itoa(pid))
+		}
+		return names
+	case e.name == "fd":
+		var fds []int
+		for _, f := range e.proc.Info().Files {
+			fds = append(fds, f.FD)
+		}
+		sort.Ints(fds)
+
+		names := make([]string, len(fds))
+		for i, fd := range fds {
+			names[i] = strconv.Itoa(fd)
+		}
+		return names
+	default:
+		names := make([]string, len(processFiles))
+		for i, f := range processFiles {
+			names[i] = f.name
+		}
+		return names
+	}
+}
+
+// target returns the destination of a symlink entry.
+func (fs *FS) target(e *entry) string {
+	if e.name == "cwd" {
+		return e.proc.Info().Cwd
+	}
+	if f, ok := openFile(e.proc, e.name); ok {
+		return f.Name
+	}
+	return ""
+}
+
+// render produces the contents of a file entry.
+func (fs *FS) render(e *entry) ([]byte, error) {
+	var buf bytes.Buffer
+
+	switch e.path {
+	case "/uptime":
+		fs.renderUptime(&buf)
+		return buf.Bytes(), nil
+	case "/meminfo":
+		fs.renderMeminfo(&buf)
+		return buf.Bytes(), nil
+	}
+
+	info := e.proc.Info()
+	switch e.name {
+	case "cmdline":
+		for _, arg := range append([]string{info.Command}, info.Args...) {
+			buf.WriteString(arg)
+			buf.WriteByte(0)
+		}
+	case "environ":
+		for _, env := range info.Env {
+			buf.WriteString(env)
+			buf.WriteByte(0)
+		}
+	case "status":
+		fs.renderStatus(&buf, &info)
+	case "limits":
+		fs.renderLimits(&buf, &info)
+	case "stat":
+		fs.renderStat(&buf, &info)
+	}
+	return buf.Bytes(), nil
+}
+
+// stateLetter returns the one-letter code for a process state.
+func stateLetter(state process.ProcessState) string {
+	switch state {
+	case process.StateWaiting:
+		return "S"
+	case process.StateStopped:
+		return "T"
+	case process.StateZombie:
+		return "Z"
+	default:
+		return "R"
+	}
+}
+
+// ticks converts a duration to clock ticks.
+func ticks(d time.Duration) int64 {
+	return int64(d / (time.Second / ClockTicks))
+}
+
+func (fs *FS) renderUptime(buf *bytes.Buffer) {
+	uptime := time.Since(fs.boot)
+
+	var busy time.Duration
+	for _, p := range fs.pm.GetProcesses() {
+		cpu, _ := fs.pm.GetCPUUsage(p.PID)
+		busy += cpu
+	}
+	idle := max(uptime-busy, 0)
+
+	fmt.Fprintf(buf, "%.2f %.2f\n", uptime.Seconds(), idle.Seconds())
+}
+
+func (fs *FS) renderMeminfo(buf *bytes.Buffer) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	total := int64(stats.Sys)
+
+	var used int64
+	processes := fs.pm.GetProcesses()
+	for _, p := range processes {
+		mem, _ := fs.pm.GetMemoryUsage(p.PID)
+		used += mem
+	}
+
+	fmt.Fprintf(buf, "MemTotal:  %12d kB\n", total/1024)
+	fmt.Fprintf(buf, "MemFree:   %12d kB\n", max(total-used, 0)/1024)
+	fmt.Fprintf(buf, "MemUsed:   %12d kB\n", used/1024)
+	fmt.Fprintf(buf, "HeapAlloc: %12d kB\n", stats.HeapAlloc/1024)
+	fmt.Fprintf(buf, "Processes: %12d\n", len(processes))
+}
+
+func (fs *FS) renderStatus(buf *bytes.Buffer, info *process.ProcessInfo) {
+	mem, _ := fs.pm.GetMemoryUsage(info.PID)
+
+	fmt.Fprintf(buf, "Name:\t%s\n", info.Command)
+	fmt.Fprintf(buf, "State:\t%s (%s)\n", stateLetter(info.State), info.State)
+	fmt.Fprintf(buf, "Pid:\t%d\n", info.PID)
+	fmt.Fprintf(buf, "PPid:\t%d\n", info.ParentPID)
+	fmt.Fprintf(buf, "Priority:\t%d\n", info.Priority)
+	fmt.Fprintf(buf, "FDSize:\t%d\n", len(info.Files))
+	fmt.Fprintf(buf, "VmRSS:\t%d kB\n", mem/1024)
+	if info.State == process.StateZombie {
+		fmt.Fprintf(buf, "ExitCode:\t%d\n", info.ExitCode)
+	}
+}
+
+// renderLimits writes the limits file. Soft limits are the process's own;
+// hard limits are those the Enforcer applies, and are unlimited when it
+// has none for the process.
+func (fs *FS) renderLimits(buf *bytes.Buffer, info *process.ProcessInfo) {
+	hard, err := fs.pm.Enforcer.GetLimits(info.PID)
+	if err != nil {
+		hard = nil
+	}
+	soft := info.Limits
+	if soft == nil {
+		soft = hard
+	}
+	if soft == nil {
+		soft = &process.ResourceLimits{}
+	}
+
+	// Zero means unlimited, except for core dumps where it disables them
+	value := func(n int64, zero string) string {
+		if n == 0 {
+			return zero
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	hardValue := func(n func(*process.ResourceLimits) int64, zero string) string {
+		if hard == nil {
+			return "unlimited"
+		}
+		return value(n(hard), zero)
+	}
+
+	fmt.Fprintf(buf, "%-26s%-21s%-21s%s\n", "Limit", "Soft Limit", "Hard Limit", "Units")
+	for _, row := range []struct {
+		name  string
+		limit func(*process.ResourceLimits) int64
+		zero  string
+		units string
+	}{
+		{"Max cpu time", func(l *process.ResourceLimits) int64 { return int64(l.CPUTime / time.Second) }, "unlimited", "seconds"},
+		{"Max data size", func(l *process.ResourceLimits) int64 { return l.MaxDataSize }, "unlimited", "bytes"},
+		{"Max stack size", func(l *process.ResourceLimits) int64 { return l.MaxStackSize }, "unlimited", "bytes"},
+		{"Max core file size", func(l *process.ResourceLimits) int64 { return l.MaxCoreSize }, "0", "bytes"},
+		{"Max resident set", func(l *process.ResourceLimits) int64 { return l.MaxResidentSet }, "unlimited", "bytes"},
+		{"Max open files", func(l *process.ResourceLimits) int64 { return int64(l.MaxFiles) }, "unlimited", "files"},
+		{"Max address space", func(l *process.ResourceLimits) int64 { return l.MaxMemory }, "unlimited", "bytes"},
+	} {
+		fmt.Fprintf(buf, "%-26s%-21s%-21s%s\n", row.name, value(row.limit(soft), row.zero), hardValue(row.limit, row.zero), row.units)
+	}
+}
+
+func (fs *FS) renderStat(buf *bytes.Buffer, info *process.ProcessInfo) {
+	cpu, _ := fs.pm.GetCPUUsage(info.PID)
+	mem, _ := fs.pm.GetMemoryUsage(info.PID)
+
+	fmt.Fprintf(buf, "%d (%s) %s %d %d %d %d %d\n",
+		info.PID, info.Command, stateLetter(info.State), info.ParentPID,
+		info.Priority, ticks(cpu), mem, ticks(info.CreatedAt.Sub(fs.boot)))
+}
+
+// Open implements vfs.FileSystem.Open.
+func (fs *FS) Open(path string) (vfs.File, error) {
+	return fs.OpenFile(path, vfs.O_RDONLY, 0)
+}
+
+// OpenFile implements vfs.FileSystem.OpenFile. Only reading is allowed.
+func (fs *FS) OpenFile(path string, flags int, perm os.FileMode) (vfs.File, error) {
+	if flags&(vfs.O_WRONLY|vfs.O_RDWR|vfs.O_CREATE|vfs.O_TRUNC|vfs.O_APPEND) != 0 {
+		return nil, vfs.ReadOnlyError("open", path)
+	}
+
+	e, err := fs.follow("open", path)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	if e.kind == kindFile {
+		if data, err = fs.render(e); err != nil {
+			return nil, err
+		}
+	}
+
+	info := fs.info(e)
+	info.Size = int64(len(data))
+	return &procFile{Reader: bytes.NewReader(data), info: info, path: e.path}, nil
+}
+
+// follow resolves path like lookup for operations that follow symlinks.
+// Every symlink here points outside this filesystem, so none resolve.
+func (fs *FS) follow(op, path string) (*entry, error) {
+	e, err := fs.lookup(op, path)
+	if err != nil {
+		return nil, err
+	}
+	if e.kind == kindLink {
+		return nil, vfs.NotExistError(op, path)
+	}
+	return e, nil
+}
+
+// Stat implements vfs.FileSystem.Stat. Symlinks point outside this
+// filesystem, so they are described themselves.
+func (fs *FS) Stat(path string) (vfs.FileInfo, error) {
+	return fs.Lstat(path)
+}
+
+// Lstat implements vfs.FileSystem.Lstat.
+func (fs *FS) Lstat(path string) (vfs.FileInfo, error) {
+	e, err := fs.lookup("lstat", path)
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+	return fs.info(e), nil
+}
+
+// Mkdir implements vfs.FileSystem.Mkdir.
+func (fs *FS) Mkdir(path string, perm os.FileMode) error {
+	return vfs.ReadOnlyError("mkdir", path)
+}
+
+// MkdirAll implements vfs.FileSystem.MkdirAll.
+func (fs *FS) MkdirAll(path string, perm os.FileMode) error {
+	return vfs.ReadOnlyError("mkdir", path)
+}
+
+// Remove implements vfs.FileSystem.Remove.
+func (fs *FS) Remove(path string) error {
+	return vfs.ReadOnlyError("remove", path)
+}
+
+// RemoveAll implements vfs.FileSystem.RemoveAll.
+func (fs *FS) RemoveAll(path string) error {
+	return vfs.ReadOnlyError("removeall", path)
+}
+
+// Rename implements vfs.FileSystem.Rename.
+func (fs *FS) Rename(oldpath, newpath string) error {
+	return vfs.ReadOnlyError("rename", oldpath)
+}
+
+// ReadDir implements vfs.FileSystem.ReadDir.
+func (fs *FS) ReadDir(path string) ([]vfs.DirEntry, error) {
+	e, err := fs.lookup("readdir", path)
+	if err != nil {
+		return nil, err
+	}
+	if e.kind != kindDir {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: syscall.ENOTDIR}
+	}
+
+	names := fs.children(e)
+	entries := make([]vfs.DirEntry, 0, len(names))
+	for _, name := range names {
+		child, err := fs.lookup("readdir", vfs.Join(e.path, name))
+		if err != nil {
+			// The process or descriptor went away while listing
+			continue
+		}
+		entries = append(entries, vfs.NewDirEntry(fs.info(child)))
+	}
+	return entries, nil
+}
+
+// ReadFile implements vfs.FileSystem.ReadFile.
+func (fs *FS) ReadFile(path string) ([]byte, error) {
+	e, err := fs.follow("read", path)
+	if err != nil {
+		return nil, err
+	}
+	if e.kind == kindDir {
+		return nil, &os.PathError{Op: "read", Path: path, Err: syscall.EISDIR}
+	}
+	return fs.render(e)
+}
+
+// WriteFile implements vfs.FileSystem.WriteFile.
+func (fs *FS) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return vfs.ReadOnlyError("write", path)
+}
+
+// Create implements vfs.FileSystem.Create.
+func (fs *FS) Create(path string) (vfs.File, error) {
+	return nil, vfs.ReadOnlyError("create", path)
+}
+
+// Symlink implements vfs.FileSystem.Symlink.
+func (fs *FS) Symlink(target, newpath string) error {
+	return vfs.ReadOnlyError("symlink", newpath)
+}
+
+// Readlink implements vfs.FileSystem.Readlink.
+func (fs *FS) Readlink(path string) (string, error) {
+	e, err := fs.lookup("readlink", path)
+	if err != nil {
+		return "", err
+	}
+	if e.kind != kindLink {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: syscall.EINVAL}
+	}
+	return fs.target(e), nil
+}
+
+// Link implements vfs.FileSystem.Link.
+func (fs *FS) Link(oldpath, newpath string) error {
+	return vfs.ReadOnlyError("link", newpath)
+}
+
+// Chmod implements vfs.FileSystem.Chmod.
+func (fs *FS) Chmod(path string, mode os.FileMode) error {
+	return vfs.ReadOnlyError("chmod", path)
+}
+
+// Chown implements vfs.FileSystem.Chown.
+func (fs *FS) Chown(path string, uid, gid int) error {
+	return vfs.ReadOnlyError("chown", path)
+}
+
+// Chtimes implements vfs.FileSystem.Chtimes.
+func (fs *FS) Chtimes(path string, atime, mtime time.Time) error {
+	return vfs.ReadOnlyError("chtimes", path)
+}
+
+// procFile is an open snapshot of a file's contents.
+type procFile struct {
+	*bytes.Reader
+	info   vfs.FileInfo
+	path   string
+	closed bool
+}
+
+func (f *procFile) Read(b []byte) (int, error) {
+	if f.closed {
+		return 0, vfs.ErrClosedFile
+	}
+	return f.Reader.Read(b)
+}
+
+func (f *procFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, vfs.ErrClosedFile
+	}
+	return f.Reader.ReadAt(b, off)
+}
+
+func (f *procFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, vfs.ErrClosedFile
+	}
+	return f.Reader.Seek(offset, whence)
+}
+
+func (f *procFile) Write(b []byte) (int, error) {
+	return 0, vfs.ReadOnlyError("write", f.path)
+}
+
+func (f *procFile) WriteAt(b []byte, off int64) (int, error) {
+	return 0, vfs.ReadOnlyError("write", f.path)
+}
+
+func (f *procFile) Close() error {
+	if f.closed {
+		return vfs.ErrClosedFile
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *procFile) Stat() (vfs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *procFile) Truncate(size int64) error {
+	return vfs.ReadOnlyError("truncate", f.path)
+}
+
+func (f *procFile) Sync() error {
+	return nil
+}
+
+func (f *procFile) Lock(how vfs.LockMode) error {
+	return vfs.ErrNotImplemented
+}
+
+func (f *procFile) Unlock() error {
+	return vfs.ErrNotImplemented
+}
+
+var _ vfs.FileSystem = (*FS)(nil)
@@ -0,0 +1,186 @@
+package procfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"webos/pkg/process"
+	vfs "webos/pkg/vfs"
+)
+
+func newTestFS(t *testing.T) (*FS, *process.Process) {
+	pm := process.NewProcessManager(nil)
+	p, err := pm.CreateProcess(&process.CreateConfig{
+		Command: "sh",
+		Args:    []string{"-c", "true"},
+		Env:     []string{"HOME=/root", "TERM=xterm"},
+		Cwd:     "/home/user",
+	})
+	if err != nil {
+		t.Fatalf("CreateProcess failed: %v", err)
+	}
+	p.AddFile(process.NewFile(0, "/dev/tty"))
+	return New(pm), p
+}
+
+func TestReadDir(t *testing.T) {
+	fs, p := newTestFS(t)
+
+	entries, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	want := "meminfo uptime " + strconv.Itoa(p.PID)
+	if strings.Join(names, " ") != want {
+		t.Errorf("root entries are %v, expected %s", names, want)
+	}
+
+	entries, err = fs.ReadDir("/" + strconv.Itoa(p.PID))
+	if err != nil {
+		t.Fatalf("ReadDir of process failed: %v", err)
+	}
+	if len(entries) != len(processFiles) {
+		t.Errorf("process directory has %d entries, expected %d", len(entries), len(processFiles))
+	}
+}
+
+func TestProcessFiles(t *testing.T) {
+	fs, p := newTestFS(t)
+	dir := "/" + strconv.Itoa(p.PID)
+
+	data, err := fs.ReadFile(dir + "/cmdline")
+	if err != nil {
+		t.Fatalf("ReadFile cmdline failed: %v", err)
+	}
+	if string(data) != "sh\x00-c\x00true\x00" {
+		t.Errorf("cmdline is %q", data)
+	}
+
+	data, _ = fs.ReadFile(dir + "/environ")
+	if string(data) != "HOME=/root\x00TERM=xterm\x00" {
+		t.Errorf("environ is %q", data)
+	}
+
+	data, _ = fs.ReadFile(dir + "/status")
+	if !strings.Contains(string(data), "Name:\tsh\n") || !strings.Contains(string(data), "Pid:\t"+strconv.Itoa(p.PID)+"\n") {
+		t.Errorf("status is %q", data)
+	}
+
+	data, _ = fs.ReadFile(dir + "/stat")
+	if !strings.HasPrefix(string(data), strconv.Itoa(p.PID)+" (sh) R 0 ") {
+		t.Errorf("stat is %q", data)
+	}
+
+	data, _ = fs.ReadFile(dir + "/limits")
+	if !strings.Contains(string(data), "Max open files") || !strings.Contains(string(data), "1024") {
+		t.Errorf("limits is %q", data)
+	}
+
+	if target, err := fs.Readlink(dir + "/cwd"); err != nil || target != "/home/user" {
+		t.Errorf("Readlink cwd returned %q, %v", target, err)
+	}
+	if target, err := fs.Readlink(dir + "/fd/0"); err != nil || target != "/dev/tty" {
+		t.Errorf("Readlink fd/0 returned %q, %v", target, err)
+	}
+}
+
+func TestDescriptors(t *testing.T) {
+	fs, p := newTestFS(t)
+	dir := "/" + strconv.Itoa(p.PID) + "/fd"
+
+	// Descriptors are named by number, not by their place in the table
+	p.AddFile(process.NewFile(7, "/tmp/log"))
+	p.AddFile(process.NewFile(3, "/etc/passwd"))
+	p.RemoveFile(0)
+
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, " ") != "3 7" {
+		t.Errorf("fd lists %v, expected [3 7]", names)
+	}
+	if target, err := fs.Readlink(dir + "/7"); err != nil || target != "/tmp/log" {
+		t.Errorf("Readlink fd/7 returned %q, %v", target, err)
+	}
+	for _, name := range []string{"0", "1", "03"} {
+		if _, err := fs.Lstat(dir + "/" + name); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Lstat fd/%s returned %v, expected ErrNotExist", name, err)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	fs, p := newTestFS(t)
+	path := "/" + strconv.Itoa(p.PID) + "/limits"
+
+	// The process may lower its own limits below what the Enforcer allows
+	info := p.Info()
+	info.Limits.MaxFiles = 64
+	if p.Info().Limits.MaxFiles == 64 {
+		t.Fatal("Info shares its Limits with the process")
+	}
+	soft := *p.Limits
+	soft.MaxFiles = 64
+	p.Limits = &soft
+
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	var row []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "Max open files") {
+			row = strings.Fields(strings.TrimPrefix(line, "Max open files"))
+		}
+	}
+	if strings.Join(row, " ") != "64 1024 files" {
+		t.Errorf("Max open files row is %q, expected soft 64 and hard 1024", row)
+	}
+}
+
+func TestOpenSnapshot(t *testing.T) {
+	fs, p := newTestFS(t)
+
+	file, err := fs.Open("/" + strconv.Itoa(p.PID) + "/environ")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer file.Close()
+
+	// Changes after opening are not seen by the open file
+	p.SetEnvironment(nil)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if len(data) == 0 {
+		t.Error("open file lost its snapshot")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	fs, p := newTestFS(t)
+
+	if err := fs.WriteFile("/uptime", nil, 0644); !errors.Is(err, vfs.ErrReadOnlyFS) {
+		t.Errorf("WriteFile returned %v, expected ErrReadOnlyFS", err)
+	}
+	if _, err := fs.OpenFile("/"+strconv.Itoa(p.PID)+"/status", vfs.O_RDWR, 0); !errors.Is(err, vfs.ErrReadOnlyFS) {
+		t.Errorf("OpenFile for writing returned %v, expected ErrReadOnlyFS", err)
+	}
+	if _, err := fs.Stat("/99999"); err == nil {
+		t.Error("Stat of missing process succeeded")
+	}
+}
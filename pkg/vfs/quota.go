@@ -0,0 +1,834 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned, wrapped in a *QuotaError, when an
+// operation would take a user or group over their quota.
+var ErrQuotaExceeded = errors.New("vfs: disk quota exceeded")
+
+// QuotaBlockSize is the size of the blocks quotas are counted in. Each
+// file is charged for its size rounded up to whole blocks.
+const QuotaBlockSize = 1024
+
+// DefaultQuotaGrace is how long usage may stay over a soft limit before
+// the soft limit is enforced, unless changed with SetGrace.
+const DefaultQuotaGrace = 7 * 24 * time.Hour
+
+// QuotaKind says whether a quota applies to a user or a group.
+type QuotaKind int
+
+const (
+	QuotaUser QuotaKind = iota
+	QuotaGroup
+)
+
+// String returns "user" or "group".
+func (k QuotaKind) String() string {
+	if k == QuotaGroup {
+		return "group"
+	}
+	return "user"
+}
+
+// QuotaLimits are the limits for one user or group. Zero means no limit.
+//
+// Usage may exceed a soft limit for the grace period, after which the soft
+// limit is enforced like a hard limit until usage drops below it again.
+// Usage may never exceed a hard limit.
+type QuotaLimits struct {
+	BlockSoft int64 // Blocks of QuotaBlockSize bytes
+	BlockHard int64
+	InodeSoft int64 // Files, directories and symlinks
+	InodeHard int64
+}
+
+// QuotaError describes an operation refused by a quota.
+type QuotaError struct {
+	Op     string
+	Path   string
+	Kind   QuotaKind
+	ID     int    // uid or gid
+	Limit  string // "block" or "inode"
+	Expiry bool   // Refused by a soft limit whose grace period expired
+}
+
+func (e *QuotaError) Error() string {
+	limit := "hard"
+	if e.Expiry {
+		limit = "soft"
+	}
+	return fmt.Sprintf("%s %s: %v (%s %d %s %s limit)", e.Op, e.Path, ErrQuotaExceeded, e.Kind, e.ID, e.Limit, limit)
+}
+
+// Unwrap returns ErrQuotaExceeded.
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// QuotaReport is the usage and limits of one user or group.
+type QuotaReport struct {
+	Kind   QuotaKind
+	ID     int
+	Blocks int64 // Blocks in use
+	Inodes int64 // Inodes in use
+	QuotaLimits
+
+	// BlockGrace and InodeGrace are when the soft limits start being
+	// enforced, or zero when usage is within them.
+	BlockGrace time.Time
+	InodeGrace time.Time
+}
+
+// quotaUsage is the running usage of one user or group.
+type quotaUsage struct {
+	blocks, inodes         int64
+	limits                 QuotaLimits
+	blockGrace, inodeGrace time.Time
+}
+
+// quotaEntry is the charge for one inode, shared by its hard links.
+type quotaEntry struct {
+	uid, gid int
+	blocks   int64
+	links    int
+}
+
+// Quota tracks disk usage by user and group on a filesystem and enforces
+// limits on it. Operations are only counted and checked when they go
+// through a QuotaFS view from FS.
+//
+// Usage is counted when the Quota is created and kept up to date from
+// then on, so the filesystem should not be changed other than through the
+// Quota's views while it is in use.
+type Quota struct {
+	fs         FileSystem
+	users      map[int]*quotaUsage
+	groups     map[int]*quotaUsage
+	files      map[string]*quotaEntry // Clean path -> charge
+	blockGrace time.Duration
+	inodeGrace time.Duration
+	mu         sync.Mutex
+}
+
+// NewQuota counts the current usage of fs, charging each entry to its
+// owner as reported by FileOwner.
+func NewQuota(fs FileSystem) (*Quota, error) {
+	q := &Quota{
+		fs:         fs,
+		users:      make(map[int]*quotaUsage),
+		groups:     make(map[int]*quotaUsage),
+		files:      make(map[string]*quotaEntry),
+		blockGrace: DefaultQuotaGrace,
+		inodeGrace: DefaultQuotaGrace,
+	}
+	if err := q.scan("/", make(map[uint64]*quotaEntry)); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// scan charges everything beneath dir, sharing the charge of hard links
+// when the backend reports inode numbers.
+func (q *Quota) scan(dir string, inodes map[uint64]*quotaEntry) error {
+	entries, err := q.fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := Join(dir, entry.Name())
+		info, err := q.fs.Lstat(path)
+		if err != nil {
+			return err
+		}
+
+		st, ok := StatOf(info)
+		if ok && st.Ino != 0 && !info.IsDir {
+			if e := inodes[st.Ino]; e != nil {
+				e.links++
+				q.files[path] = e
+				continue
+			}
+		}
+
+		uid, gid := FileOwner(info)
+		e := &quotaEntry{uid: uid, gid: gid, blocks: entryBlocks(info), links: 1}
+		q.files[path] = e
+		q.usage(QuotaUser, uid).blocks += e.blocks
+		q.usage(QuotaUser, uid).inodes++
+		q.usage(QuotaGroup, gid).blocks += e.blocks
+		q.usage(QuotaGroup, gid).inodes++
+		if ok && st.Ino != 0 && !info.IsDir {
+			inodes[st.Ino] = e
+		}
+
+		if info.IsDir {
+			if err := q.scan(path, inodes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// blocks returns the number of quota blocks size bytes take up.
+func blocks(size int64) int64 {
+	return (size + QuotaBlockSize - 1) / QuotaBlockSize
+}
+
+// entryBlocks returns the blocks charged for an entry. Only regular files
+// are charged for blocks.
+func entryBlocks(info FileInfo) int64 {
+	if !info.Mode.IsRegular() || info.IsDir {
+		return 0
+	}
+	return blocks(info.Size)
+}
+
+// usage returns the usage record for a user or group, creating it if
+// needed (caller must hold lock).
+func (q *Quota) usage(kind QuotaKind, id int) *quotaUsage {
+	m := q.users
+	if kind == QuotaGroup {
+		m = q.groups
+	}
+	u := m[id]
+	if u == nil {
+		u = &quotaUsage{}
+		m[id] = u
+	}
+	return u
+}
+
+// SetLimits sets the limits for a user or group.
+func (q *Quota) SetLimits(kind QuotaKind, id int, limits QuotaLimits) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.usage(kind, id)
+	u.limits = limits
+	u.updateGrace(time.Now(), q.blockGrace, q.inodeGrace)
+}
+
+// Limits returns the limits for a user or group.
+func (q *Quota) Limits(kind QuotaKind, id int) QuotaLimits {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.usage(kind, id).limits
+}
+
+// SetGrace sets the grace periods for block and inode soft limits. Grace
+// periods already running are not changed.
+func (q *Quota) SetGrace(block, inode time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.blockGrace = block
+	q.inodeGrace = inode
+}
+
+// Report returns the usage and limits of every user and group that has
+// usage or limits, users first, each ordered by ID.
+func (q *Quota) Report() []QuotaReport {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var reports []QuotaReport
+	for _, kind := range []QuotaKind{QuotaUser, QuotaGroup} {
+		m := q.users
+		if kind == QuotaGroup {
+			m = q.groups
+		}
+
+		start := len(reports)
+		for id, u := range m {
+			if u.blocks == 0 && u.inodes == 0 && u.limits == (QuotaLimits{}) {
+				continue
+			}
+			reports = append(reports, QuotaReport{
+				Kind:        kind,
+				ID:          id,
+				Blocks:      u.blocks,
+				Inodes:      u.inodes,
+				QuotaLimits: u.limits,
+				BlockGrace:  u.blockGrace,
+				InodeGrace:  u.inodeGrace,
+			})
+		}
+		slices.SortFunc(reports[start:], func(a, b QuotaReport) int {
+			return a.ID - b.ID
+		})
+	}
+	return reports
+}
+
+// Usage returns the blocks and inodes used by path and everything beneath
+// it, for utilities like du. Hard links are counted once.
+func (q *Quota) Usage(path string) (blocks, inodes int64) {
+	path = Clean(path)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	seen := make(map[*quotaEntry]bool)
+	for p, e := range q.files {
+		if seen[e] || (p != path && !hasPathPrefix(p, path)) {
+			continue
+		}
+		seen[e] = true
+		blocks += e.blocks
+		inodes++
+	}
+	return blocks, inodes
+}
+
+// FS returns a view of the filesystem for a user and their primary group,
+// which are charged for the entries the view creates.
+func (q *Quota) FS(uid, gid int) *QuotaFS {
+	return &QuotaFS{q: q, uid: uid, gid: gid}
+}
+
+// updateGrace starts or clears grace periods after usage or limits change.
+func (u *quotaUsage) updateGrace(now time.Time, blockGrace, inodeGrace time.Duration) {
+	switch {
+	case u.limits.BlockSoft == 0 || u.blocks <= u.limits.BlockSoft:
+		u.blockGrace = time.Time{}
+	case u.blockGrace.IsZero():
+		u.blockGrace = now.Add(blockGrace)
+	}
+
+	switch {
+	case u.limits.InodeSoft == 0 || u.inodes <= u.limits.InodeSoft:
+		u.inodeGrace = time.Time{}
+	case u.inodeGrace.IsZero():
+		u.inodeGrace = now.Add(inodeGrace)
+	}
+}
+
+// check reports which limit, if any, adding blocks and inodes would break.
+func (u *quotaUsage) check(now time.Time, blocks, inodes int64) (limit string, expiry, ok bool) {
+	if blocks > 0 {
+		used := u.blocks + blocks
+		if u.limits.BlockHard > 0 && used > u.limits.BlockHard {
+			return "block", false, false
+		}
+		if u.limits.BlockSoft > 0 && used > u.limits.BlockSoft && !u.blockGrace.IsZero() && now.After(u.blockGrace) {
+			return "block", true, false
+		}
+	}
+	if inodes > 0 {
+		used := u.inodes + inodes
+		if u.limits.InodeHard > 0 && used > u.limits.InodeHard {
+			return "inode", false, false
+		}
+		if u.limits.InodeSoft > 0 && used > u.limits.InodeSoft && !u.inodeGrace.IsZero() && now.After(u.inodeGrace) {
+			return "inode", true, false
+		}
+	}
+	return "", false, true
+}
+
+// charge adds blocks and inodes to a user and group, failing without
+// charging anything if that would break a limit (caller must hold lock).
+func (q *Quota) charge(op, path string, uid, gid int, blocks, inodes int64) error {
+	now := time.Now()
+	user := q.usage(QuotaUser, uid)
+	group := q.usage(QuotaGroup, gid)
+
+	if limit, expiry, ok := user.check(now, blocks, inodes); !ok {
+		return &QuotaError{Op: op, Path: path, Kind: QuotaUser, ID: uid, Limit: limit, Expiry: expiry}
+	}
+	if limit, expiry, ok := group.check(now, blocks, inodes); !ok {
+		return &QuotaError{Op: op, Path: path, Kind: QuotaGroup, ID: gid, Limit: limit, Expiry: expiry}
+	}
+
+	q.adjust(uid, gid, blocks, inodes)
+	return nil
+}
+
+// adjust changes usage without checking limits (caller must hold lock).
+func (q *Quota) adjust(uid, gid int, blocks, inodes int64) {
+	now := time.Now()
+	for _, u := range []*quotaUsage{q.usage(QuotaUser, uid), q.usage(QuotaGroup, gid)} {
+		u.blocks += blocks
+		u.inodes += inodes
+		u.updateGrace(now, q.blockGrace, q.inodeGrace)
+	}
+}
+
+// resize charges an entry for growing to size bytes, or credits it for
+// shrinking. Growth past a limit fails without charging anything.
+func (q *Quota) resize(op, path string, e *quotaEntry, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if e.links == 0 {
+		// Unlinked files no longer count against anyone
+		return nil
+	}
+
+	delta := blocks(size) - e.blocks
+	if delta > 0 {
+		if err := q.charge(op, path, e.uid, e.gid, delta, 0); err != nil {
+			return err
+		}
+	} else {
+		q.adjust(e.uid, e.gid, delta, 0)
+	}
+	e.blocks += delta
+	return nil
+}
+
+// settle brings an entry's charge in line with the size it ended up with
+// after an operation, whatever the limits.
+func (q *Quota) settle(e *quotaEntry, size int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if e.links == 0 {
+		return
+	}
+	delta := blocks(size) - e.blocks
+	q.adjust(e.uid, e.gid, delta, 0)
+	e.blocks += delta
+}
+
+// entry returns the charge for path, if it is tracked.
+func (q *Quota) entry(path string) *quotaEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.files[Clean(path)]
+}
+
+// unlink drops path and everything beneath it (caller must hold lock).
+func (q *Quota) unlink(path string) {
+	for p, e := range q.files {
+		if p != path && !hasPathPrefix(p, path) {
+			continue
+		}
+		delete(q.files, p)
+		e.links--
+		if e.links == 0 {
+			q.adjust(e.uid, e.gid, -e.blocks, -1)
+		}
+	}
+}
+
+// QuotaFS is one user's view of a filesystem with quotas. New entries are
+// charged to the view's user and group, or to the directory's group if it
+// is setgid, and are given to them where the backend allows. Writes and
+// truncations are charged to the owner of the file.
+//
+// Wrap a QuotaFS with WithCredentials to enforce permissions as well.
+type QuotaFS struct {
+	q        *Quota
+	uid, gid int
+}
+
+// create charges a new entry at path to the view's user before it is
+// created by fn, and records it if fn succeeds.
+func (qfs *QuotaFS) create(op, path string, size int64, fn func() error) error {
+	path = Clean(path)
+	gid := qfs.gid
+	if dir, err := qfs.q.fs.Stat(Dir(path)); err == nil && dir.Mode&os.ModeSetgid != 0 {
+		_, gid = FileOwner(dir)
+	}
+
+	q := qfs.q
+	q.mu.Lock()
+	err := q.charge(op, path, qfs.uid, gid, blocks(size), 1)
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		q.mu.Lock()
+		q.adjust(qfs.uid, gid, -blocks(size), -1)
+		q.mu.Unlock()
+		return err
+	}
+
+	q.mu.Lock()
+	q.unlink(path)
+	q.files[path] = &quotaEntry{uid: qfs.uid, gid: gid, blocks: blocks(size), links: 1}
+	q.mu.Unlock()
+
+	// Ownership is best effort, as with CredentialFS
+	q.fs.Chown(path, qfs.uid, gid)
+	return nil
+}
+
+// Open implements FileSystem.Open.
+func (qfs *QuotaFS) Open(path string) (File, error) {
+	return qfs.OpenFile(path, O_RDONLY, 0)
+}
+
+// OpenFile implements FileSystem.OpenFile. Creating a file needs an inode.
+func (qfs *QuotaFS) OpenFile(path string, flags int, perm os.FileMode) (File, error) {
+	q := qfs.q
+
+	var file File
+	if _, err := q.fs.Stat(path); err != nil && flags&O_CREATE != 0 {
+		err := qfs.create("open", path, 0, func() error {
+			var err error
+			file, err = q.fs.OpenFile(path, flags, perm)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		file, err = q.fs.OpenFile(path, flags, perm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	e := q.entry(path)
+	if e == nil {
+		return file, nil
+	}
+	if flags&O_TRUNC != 0 {
+		if info, err := file.Stat(); err == nil {
+			q.settle(e, info.Size)
+		}
+	}
+	return &quotaFile{File: file, q: q, entry: e, path: path, append: flags&O_APPEND != 0}, nil
+}
+
+// Stat implements FileSystem.Stat.
+func (qfs *QuotaFS) Stat(path string) (FileInfo, error) {
+	return qfs.q.fs.Stat(path)
+}
+
+// Lstat implements FileSystem.Lstat.
+func (qfs *QuotaFS) Lstat(path string) (FileInfo, error) {
+	return qfs.q.fs.Lstat(path)
+}
+
+// Mkdir implements FileSystem.Mkdir.
+func (qfs *QuotaFS) Mkdir(path string, perm os.FileMode) error {
+	return qfs.create("mkdir", path, 0, func() error {
+		return qfs.q.fs.Mkdir(path, perm)
+	})
+}
+
+// MkdirAll implements FileSystem.MkdirAll. Each missing directory needs an
+// inode.
+func (qfs *QuotaFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := ValidatePath(path); err != nil {
+		return err
+	}
+
+	current := "/"
+	for _, part := range splitComponents(Clean(path)) {
+		current = Join(current, part)
+
+		info, err := qfs.q.fs.Stat(current)
+		if err == nil {
+			if !info.IsDir {
+				return &os.PathError{Op: "mkdir", Path: current, Err: os.ErrExist}
+			}
+			continue
+		}
+		if err := qfs.Mkdir(current, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove implements FileSystem.Remove.
+func (qfs *QuotaFS) Remove(path string) error {
+	if err := qfs.q.fs.Remove(path); err != nil {
+		return err
+	}
+
+	qfs.q.mu.Lock()
+	qfs.q.unlink(Clean(path))
+	qfs.q.mu.Unlock()
+	return nil
+}
+
+// RemoveAll implements FileSystem.RemoveAll.
+func (qfs *QuotaFS) RemoveAll(path string) error {
+	err := qfs.q.fs.RemoveAll(path)
+
+	// Entries removed before a failure still need to be credited
+	qfs.q.mu.Lock()
+	defer qfs.q.mu.Unlock()
+	for p := range qfs.q.files {
+		if p == Clean(path) || hasPathPrefix(p, Clean(path)) {
+			if _, statErr := qfs.q.fs.Lstat(p); statErr != nil {
+				qfs.q.unlink(p)
+			}
+		}
+	}
+	return err
+}
+
+// Rename implements FileSystem.Rename. Renaming over an entry credits it.
+func (qfs *QuotaFS) Rename(oldpath, newpath string) error {
+	if err := qfs.q.fs.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	oldpath, newpath = Clean(oldpath), Clean(newpath)
+	if oldpath == newpath {
+		return nil
+	}
+
+	q := qfs.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	moved := make(map[string]*quotaEntry)
+	for p, e := range q.files {
+		if p == oldpath || hasPathPrefix(p, oldpath) {
+			moved[newpath+strings.TrimPrefix(p, oldpath)] = e
+			delete(q.files, p)
+		}
+	}
+	q.unlink(newpath)
+	for p, e := range moved {
+		q.files[p] = e
+	}
+	return nil
+}
+
+// ReadDir implements FileSystem.ReadDir.
+func (qfs *QuotaFS) ReadDir(path string) ([]DirEntry, error) {
+	return qfs.q.fs.ReadDir(path)
+}
+
+// ReadFile implements FileSystem.ReadFile.
+func (qfs *QuotaFS) ReadFile(path string) ([]byte, error) {
+	return qfs.q.fs.ReadFile(path)
+}
+
+// WriteFile implements FileSystem.WriteFile. The file's owner is charged
+// for the new contents, or the view's user if the file is created.
+func (qfs *QuotaFS) WriteFile(path string, data []byte, perm os.FileMode) error {
+	q := qfs.q
+	size := int64(len(data))
+
+	if _, err := q.fs.Stat(path); err != nil {
+		return qfs.create("write", path, size, func() error {
+			return q.fs.WriteFile(path, data, perm)
+		})
+	}
+
+	e := q.entry(path)
+	if e == nil {
+		return q.fs.WriteFile(path, data, perm)
+	}
+	if err := q.resize("write", path, e, size); err != nil {
+		return err
+	}
+
+	err := q.fs.WriteFile(path, data, perm)
+	if err != nil {
+		if info, statErr := q.fs.Stat(path); statErr == nil {
+			q.settle(e, info.Size)
+		}
+	}
+	return err
+}
+
+// Create implements FileSystem.Create.
+func (qfs *QuotaFS) Create(path string) (File, error) {
+	return qfs.OpenFile(path, O_RDWR|O_CREATE|O_TRUNC, 0666)
+}
+
+// Symlink implements FileSystem.Symlink.
+func (qfs *QuotaFS) Symlink(target, newpath string) error {
+	return qfs.create("symlink", newpath, 0, func() error {
+		return qfs.q.fs.Symlink(target, newpath)
+	})
+}
+
+// Readlink implements FileSystem.Readlink.
+func (qfs *QuotaFS) Readlink(path string) (string, error) {
+	return qfs.q.fs.Readlink(path)
+}
+
+// Link implements FileSystem.Link. Hard links share their file's charge.
+func (qfs *QuotaFS) Link(oldpath, newpath string) error {
+	if err := qfs.q.fs.Link(oldpath, newpath); err != nil {
+		return err
+	}
+
+	q := qfs.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if e := q.files[Clean(oldpath)]; e != nil {
+		e.links++
+		q.files[Clean(newpath)] = e
+	}
+	return nil
+}
+
+// Chmod implements FileSystem.Chmod.
+func (qfs *QuotaFS) Chmod(path string, mode os.FileMode) error {
+	return qfs.q.fs.Chmod(path, mode)
+}
+
+// Chown implements FileSystem.Chown. The file's usage moves to its new
+// owner and group without regard for their limits, as only privileged
+// users can give files away. A file with several hard links is one entry,
+// so its usage moves once whichever link is named, and Chown through a
+// symlink moves the usage of the file it leads to.
+func (qfs *QuotaFS) Chown(path string, uid, gid int) error {
+	q := qfs.q
+	if err := q.fs.Chown(path, uid, gid); err != nil {
+		return err
+	}
+	path = qfs.resolve(path)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e := q.files[path]
+	if e == nil || e.links == 0 {
+		return nil
+	}
+	if uid == -1 {
+		uid = e.uid
+	}
+	if gid == -1 {
+		gid = e.gid
+	}
+	if uid == e.uid && gid == e.gid {
+		return nil
+	}
+	q.adjust(e.uid, e.gid, -e.blocks, -1)
+	q.adjust(uid, gid, e.blocks, 1)
+	e.uid, e.gid = uid, gid
+	return nil
+}
+
+// maxQuotaSymlinks bounds the symlinks resolve follows.
+const maxQuotaSymlinks = 40
+
+// resolve returns the clean path of the entry path leads to once final
+// symlinks are followed, or path itself if they cannot be.
+func (qfs *QuotaFS) resolve(path string) string {
+	path = Clean(path)
+	for range maxQuotaSymlinks {
+		info, err := qfs.q.fs.Lstat(path)
+		if err != nil || info.Mode&os.ModeSymlink == 0 {
+			return path
+		}
+		target, err := qfs.q.fs.Readlink(path)
+		if err != nil {
+			return path
+		}
+		if !strings.HasPrefix(target, "/") {
+			target = Join(Dir(path), target)
+		}
+		path = Clean(target)
+	}
+	return path
+}
+
+// Chtimes implements FileSystem.Chtimes.
+func (qfs *QuotaFS) Chtimes(path string, atime, mtime time.Time) error {
+	return qfs.q.fs.Chtimes(path, atime, mtime)
+}
+
+// quotaFile charges writes through an open file to the file's owner.
+type quotaFile struct {
+	File
+	q      *Quota
+	entry  *quotaEntry
+	path   string
+	append bool
+	mu     sync.Mutex
+}
+
+// grow charges the file for being at least size bytes long.
+func (f *quotaFile) grow(op string, size int64) error {
+	info, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	if size <= info.Size {
+		return nil
+	}
+	return f.q.resize(op, f.path, f.entry, size)
+}
+
+// settle corrects the charge after a write or truncation.
+func (f *quotaFile) settle() {
+	if info, err := f.File.Stat(); err == nil {
+		f.q.settle(f.entry, info.Size)
+	}
+}
+
+// Write implements io.Writer, failing without writing anything if the
+// file's owner would go over quota.
+func (f *quotaFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var offset int64
+	if f.append {
+		info, err := f.File.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset = info.Size
+	} else {
+		var err error
+		if offset, err = f.File.Seek(0, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := f.grow("write", offset+int64(len(b))); err != nil {
+		return 0, err
+	}
+	n, err := f.File.Write(b)
+	f.settle()
+	return n, err
+}
+
+// WriteAt implements io.WriterAt.
+func (f *quotaFile) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.grow("write", off+int64(len(b))); err != nil {
+		return 0, err
+	}
+	n, err := f.File.WriteAt(b, off)
+	f.settle()
+	return n, err
+}
+
+// Truncate implements File.Truncate.
+func (f *quotaFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.grow("truncate", size); err != nil {
+		return err
+	}
+	err := f.File.Truncate(size)
+	f.settle()
+	return err
+}
+
+var _ FileSystem = (*QuotaFS)(nil)
@@ -0,0 +1,224 @@
+package vfs_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	vfs "webos/pkg/vfs"
+	"webos/pkg/vfs/memfs"
+)
+
+// newQuota returns a Quota over a MemFS with a world-writable /data, and
+// uid 1000's view of it.
+func newQuota(t *testing.T) (*memfs.FS, *vfs.Quota, *vfs.QuotaFS) {
+	t.Helper()
+	fs := memfs.New()
+	fs.Mkdir("/data", 0777)
+	q, err := vfs.NewQuota(fs)
+	if err != nil {
+		t.Fatalf("NewQuota failed: %v", err)
+	}
+	return fs, q, q.FS(1000, 100)
+}
+
+// report returns the usage of a user or group.
+func report(q *vfs.Quota, kind vfs.QuotaKind, id int) vfs.QuotaReport {
+	for _, r := range q.Report() {
+		if r.Kind == kind && r.ID == id {
+			return r
+		}
+	}
+	return vfs.QuotaReport{Kind: kind, ID: id}
+}
+
+// quotaError returns the *QuotaError in err, failing the test if there is
+// none.
+func quotaError(t *testing.T, err error) *vfs.QuotaError {
+	t.Helper()
+	var qerr *vfs.QuotaError
+	if !errors.Is(err, vfs.ErrQuotaExceeded) || !errors.As(err, &qerr) {
+		t.Fatalf("returned %v, expected a quota error", err)
+	}
+	return qerr
+}
+
+func TestQuotaHardLimits(t *testing.T) {
+	_, q, qfs := newQuota(t)
+	q.SetLimits(vfs.QuotaUser, 1000, vfs.QuotaLimits{BlockHard: 2, InodeHard: 2})
+
+	if err := qfs.WriteFile("/data/a", make([]byte, 2*vfs.QuotaBlockSize), 0644); err != nil {
+		t.Fatalf("WriteFile within the limit failed: %v", err)
+	}
+	qerr := quotaError(t, qfs.WriteFile("/data/a", make([]byte, 2*vfs.QuotaBlockSize+1), 0644))
+	if qerr.Kind != vfs.QuotaUser || qerr.ID != 1000 || qerr.Limit != "block" || qerr.Expiry {
+		t.Errorf("quota error is %+v", qerr)
+	}
+	if data, _ := qfs.ReadFile("/data/a"); len(data) != 2*vfs.QuotaBlockSize {
+		t.Errorf("refused write left %d bytes", len(data))
+	}
+
+	if err := qfs.Mkdir("/data/dir", 0755); err != nil {
+		t.Fatalf("Mkdir within the limit failed: %v", err)
+	}
+	qerr = quotaError(t, qfs.WriteFile("/data/b", nil, 0644))
+	if qerr.Limit != "inode" {
+		t.Errorf("quota error is %+v, expected the inode limit", qerr)
+	}
+	if _, err := qfs.OpenFile("/data/c", vfs.O_CREATE|vfs.O_WRONLY, 0644); !errors.Is(err, vfs.ErrQuotaExceeded) {
+		t.Errorf("OpenFile(O_CREATE) over the inode limit returned %v", err)
+	}
+	if _, err := qfs.Stat("/data/b"); err == nil {
+		t.Error("refused create left the file behind")
+	}
+
+	// Group limits apply to everyone in the group
+	q.SetLimits(vfs.QuotaGroup, 200, vfs.QuotaLimits{InodeHard: 1})
+	bob := q.FS(2000, 200)
+	if err := bob.WriteFile("/data/bob", nil, 0644); err != nil {
+		t.Fatalf("WriteFile within the group limit failed: %v", err)
+	}
+	qerr = quotaError(t, q.FS(2001, 200).WriteFile("/data/carol", nil, 0644))
+	if qerr.Kind != vfs.QuotaGroup || qerr.ID != 200 {
+		t.Errorf("quota error is %+v, expected group 200", qerr)
+	}
+}
+
+func TestQuotaSoftLimitGrace(t *testing.T) {
+	_, q, qfs := newQuota(t)
+	q.SetGrace(50*time.Millisecond, time.Hour)
+	q.SetLimits(vfs.QuotaUser, 1000, vfs.QuotaLimits{BlockSoft: 1, BlockHard: 10})
+
+	// Going over the soft limit starts the grace period
+	if err := qfs.WriteFile("/data/a", make([]byte, 2*vfs.QuotaBlockSize), 0644); err != nil {
+		t.Fatalf("WriteFile over the soft limit failed: %v", err)
+	}
+	r := report(q, vfs.QuotaUser, 1000)
+	if r.BlockGrace.IsZero() || r.Blocks != 2 {
+		t.Fatalf("report after going over the soft limit is %+v", r)
+	}
+	if err := qfs.WriteFile("/data/b", make([]byte, vfs.QuotaBlockSize), 0644); err != nil {
+		t.Fatalf("WriteFile during the grace period failed: %v", err)
+	}
+
+	// Once it expires the soft limit is enforced
+	time.Sleep(time.Until(r.BlockGrace) + 10*time.Millisecond)
+	qerr := quotaError(t, qfs.WriteFile("/data/c", make([]byte, vfs.QuotaBlockSize), 0644))
+	if qerr.Limit != "block" || !qerr.Expiry {
+		t.Errorf("quota error is %+v, expected an expired soft limit", qerr)
+	}
+
+	// Dropping back under it clears the grace period
+	qfs.Remove("/data/a")
+	qfs.Remove("/data/b")
+	if r := report(q, vfs.QuotaUser, 1000); !r.BlockGrace.IsZero() || r.Blocks != 0 {
+		t.Errorf("report after dropping under the soft limit is %+v", r)
+	}
+	if err := qfs.WriteFile("/data/c", make([]byte, 2*vfs.QuotaBlockSize), 0644); err != nil {
+		t.Errorf("WriteFile after the grace period was reset failed: %v", err)
+	}
+}
+
+func TestQuotaFileWrite(t *testing.T) {
+	_, q, qfs := newQuota(t)
+	q.SetLimits(vfs.QuotaUser, 1000, vfs.QuotaLimits{BlockHard: 2})
+
+	file, err := qfs.Create("/data/file")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer file.Close()
+
+	if n, err := file.Write(make([]byte, 2*vfs.QuotaBlockSize)); err != nil || n != 2*vfs.QuotaBlockSize {
+		t.Fatalf("Write within the limit returned %d, %v", n, err)
+	}
+	n, err := file.Write([]byte("x"))
+	quotaError(t, err)
+	if n != 0 {
+		t.Errorf("refused Write wrote %d bytes", n)
+	}
+	if _, err := file.WriteAt([]byte("x"), 2*vfs.QuotaBlockSize); !errors.Is(err, vfs.ErrQuotaExceeded) {
+		t.Errorf("WriteAt past the limit returned %v", err)
+	}
+	if err := file.Truncate(3 * vfs.QuotaBlockSize); !errors.Is(err, vfs.ErrQuotaExceeded) {
+		t.Errorf("Truncate past the limit returned %v", err)
+	}
+	if info, _ := file.Stat(); info.Size != 2*vfs.QuotaBlockSize {
+		t.Errorf("file size after refused writes is %d", info.Size)
+	}
+
+	// Shrinking the file frees blocks for writes
+	if err := file.Truncate(vfs.QuotaBlockSize); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if r := report(q, vfs.QuotaUser, 1000); r.Blocks != 1 {
+		t.Errorf("usage after Truncate is %d blocks, expected 1", r.Blocks)
+	}
+	if _, err := file.WriteAt([]byte("x"), vfs.QuotaBlockSize); err != nil {
+		t.Errorf("WriteAt after Truncate failed: %v", err)
+	}
+}
+
+func TestQuotaRenameAndLink(t *testing.T) {
+	_, q, qfs := newQuota(t)
+
+	qfs.WriteFile("/data/a", make([]byte, 3*vfs.QuotaBlockSize), 0644)
+	qfs.WriteFile("/data/b", make([]byte, vfs.QuotaBlockSize), 0644)
+	if err := qfs.Link("/data/a", "/data/link"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	// A hard link shares its file's charge
+	if r := report(q, vfs.QuotaUser, 1000); r.Blocks != 4 || r.Inodes != 2 {
+		t.Errorf("usage after Link is %d blocks, %d inodes, expected 4 and 2", r.Blocks, r.Inodes)
+	}
+	if blocks, inodes := q.Usage("/data"); blocks != 4 || inodes != 3 {
+		t.Errorf("Usage(/data) = %d, %d, expected 4 and 3", blocks, inodes)
+	}
+
+	// Renaming over a file credits it, unless it has other links
+	if err := qfs.Rename("/data/b", "/data/a"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if r := report(q, vfs.QuotaUser, 1000); r.Blocks != 4 || r.Inodes != 2 {
+		t.Errorf("usage after renaming over a linked file is %d blocks, %d inodes, expected 4 and 2", r.Blocks, r.Inodes)
+	}
+	qfs.Mkdir("/data/dir", 0755)
+	if err := qfs.Rename("/data/a", "/data/dir/a"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if blocks, inodes := q.Usage("/data/dir"); blocks != 1 || inodes != 2 {
+		t.Errorf("Usage(/data/dir) = %d, %d, expected 1 and 2", blocks, inodes)
+	}
+
+	// The last link going releases the charge
+	qfs.Remove("/data/link")
+	if r := report(q, vfs.QuotaUser, 1000); r.Blocks != 1 || r.Inodes != 2 {
+		t.Errorf("usage after removing the last link is %d blocks, %d inodes, expected 1 and 2", r.Blocks, r.Inodes)
+	}
+}
+
+func TestQuotaChownHardLink(t *testing.T) {
+	fs, q, qfs := newQuota(t)
+
+	qfs.WriteFile("/data/a", make([]byte, 2*vfs.QuotaBlockSize), 0644)
+	qfs.Link("/data/a", "/data/b")
+	fs.Symlink("/data/b", "/data/sym")
+
+	// Naming each link moves the file's usage once
+	root := q.FS(0, 0)
+	for _, path := range []string{"/data/a", "/data/b", "/data/sym"} {
+		if err := root.Chown(path, 2000, 200); err != nil {
+			t.Fatalf("Chown(%s) failed: %v", path, err)
+		}
+	}
+	if r := report(q, vfs.QuotaUser, 1000); r.Blocks != 0 || r.Inodes != 0 {
+		t.Errorf("old owner still has %d blocks, %d inodes", r.Blocks, r.Inodes)
+	}
+	if r := report(q, vfs.QuotaUser, 2000); r.Blocks != 2 || r.Inodes != 1 {
+		t.Errorf("new owner has %d blocks, %d inodes, expected 2 and 1", r.Blocks, r.Inodes)
+	}
+	if r := report(q, vfs.QuotaGroup, 200); r.Blocks != 2 || r.Inodes != 1 {
+		t.Errorf("new group has %d blocks, %d inodes, expected 2 and 1", r.Blocks, r.Inodes)
+	}
+}
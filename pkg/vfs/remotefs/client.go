@@ -0,0 +1,565 @@
+package remotefs
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"webos/pkg/protocol"
+	vfs "webos/pkg/vfs"
+	"webos/pkg/websocket"
+)
+
+// Client errors.
+var (
+	ErrTimeout = errors.New("remotefs: request timed out")
+	ErrClosed  = errors.New("remotefs: filesystem is closed")
+)
+
+// DefaultTimeout bounds the wait for a response.
+const DefaultTimeout = 30 * time.Second
+
+// FS is a filesystem served by a remote Server.
+type FS struct {
+	conn    *websocket.Connection
+	timeout time.Duration
+	events  vfs.EventHub
+
+	pending  map[uint32]chan reply
+	next     uint32 // Last request ID used
+	watch    uint32 // Watch feeding events, if watching
+	watching bool
+	closed   bool
+	mu       sync.Mutex
+}
+
+// reply is a response to a request.
+type reply struct {
+	results *decoder
+	err     error
+}
+
+// New creates a filesystem sending requests over conn and installs its
+// Handle as the connection's message handler. The caller starts the
+// connection's read loop.
+func New(conn *websocket.Connection) *FS {
+	fs := &FS{
+		conn:    conn,
+		timeout: DefaultTimeout,
+		pending: make(map[uint32]chan reply),
+	}
+	conn.OnMessage(fs.Handle)
+	return fs
+}
+
+// SetTimeout sets how long to wait for a response before failing with
+// ErrTimeout. Zero waits forever.
+func (fs *FS) SetTimeout(d time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.timeout = d
+}
+
+// Handle delivers responses and events. It is a websocket.MessageHandler,
+// for connections whose messages are dispatched by the caller.
+func (fs *FS) Handle(conn *websocket.Connection, msg *protocol.Message) error {
+	if msg.Opcode != protocol.OpcodeFileSystem {
+		return protocol.ErrInvalidOpcode
+	}
+
+	d := newDecoder(msg.Payload)
+	op := Op(d.u8())
+	id := d.u32()
+
+	switch {
+	case d.err != nil:
+		return d.err
+
+	case op == OpEvent:
+		evOp, path, oldpath := vfs.Op(d.u32()), d.str(), d.str()
+		if d.err != nil {
+			return d.err
+		}
+		// Events may overtake the response to OpWatch, so any watch is
+		// taken to be ours
+		if evOp == vfs.OpRename {
+			fs.events.EmitRename(oldpath, path)
+		} else {
+			fs.events.Emit(evOp, path)
+		}
+		return nil
+
+	case op&OpResponse != 0:
+		r := reply{results: d}
+		if code := Code(d.u8()); code != CodeOK {
+			r.err = &Error{Code: code, Message: d.str()}
+		}
+		if d.err != nil {
+			r.err = d.err
+		}
+
+		fs.mu.Lock()
+		ch, ok := fs.pending[id]
+		delete(fs.pending, id)
+		fs.mu.Unlock()
+		if ok {
+			ch <- r
+		}
+		return nil
+	}
+
+	return errMalformed
+}
+
+// Close fails outstanding and later requests with ErrClosed and stops
+// the watch feeding Subscribe. It leaves the connection open.
+func (fs *FS) Close() error {
+	fs.mu.Lock()
+	watch, watching := fs.watch, fs.watching
+	fs.mu.Unlock()
+
+	if watching {
+		req := fs.request(OpUnwatch)
+		req.u32(watch)
+		fs.call(req)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.closed = true
+	fs.watching = false
+	for id, ch := range fs.pending {
+		ch <- reply{err: ErrClosed}
+		delete(fs.pending, id)
+	}
+	return nil
+}
+
+// Subscribe implements vfs.Notifier. The first subscription starts a
+// recursive watch of the root, which lasts until Close.
+func (fs *FS) Subscribe(fn func(vfs.Event)) (cancel func()) {
+	cancel = fs.events.Subscribe(fn)
+
+	fs.mu.Lock()
+	start := !fs.watching && !fs.closed
+	fs.watching = true
+	fs.mu.Unlock()
+
+	if start {
+		req := fs.request(OpWatch)
+		req.str("/")
+		req.bool(true)
+		results, err := fs.call(req)
+		if err == nil {
+			id := results.u32()
+			fs.mu.Lock()
+			fs.watch = id
+			fs.mu.Unlock()
+		} else {
+			// Let a later subscription try again
+			fs.mu.Lock()
+			fs.watching = false
+			fs.mu.Unlock()
+		}
+	}
+	return cancel
+}
+
+// request starts a request payload. call fills in its ID.
+func (fs *FS) request(op Op) *encoder {
+	return newPayload(op, 0)
+}
+
+// call sends a request and waits for its response.
+func (fs *FS) call(req *encoder) (*decoder, error) {
+	ch := make(chan reply, 1)
+
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return nil, ErrClosed
+	}
+	fs.next++
+	id := fs.next
+	fs.pending[id] = ch
+	timeout := fs.timeout
+	fs.mu.Unlock()
+
+	binary.BigEndian.PutUint32(req.buf[1:5], id)
+	if err := fs.conn.WriteMessage(message(req)); err != nil {
+		fs.forget(id)
+		return nil, err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case r := <-ch:
+		return r.results, r.err
+	case <-expired:
+		fs.forget(id)
+		return nil, ErrTimeout
+	}
+}
+
+// forget drops a request that will not be waited for.
+func (fs *FS) forget(id uint32) {
+	fs.mu.Lock()
+	delete(fs.pending, id)
+	fs.mu.Unlock()
+}
+
+// pathCall sends a request about path, reporting errors as
+// *os.PathError.
+func (fs *FS) pathCall(op, name string, req *encoder) (*decoder, error) {
+	results, err := fs.call(req)
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return results, nil
+}
+
+// linkCall sends a request about two paths, reporting errors as
+// *os.LinkError.
+func (fs *FS) linkCall(op, oldname, newname string, req *encoder) error {
+	if _, err := fs.call(req); err != nil {
+		return &os.LinkError{Op: op, Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+// Open implements vfs.FileSystem.
+func (fs *FS) Open(path string) (vfs.File, error) {
+	return fs.OpenFile(path, vfs.O_RDONLY, 0)
+}
+
+// OpenFile implements vfs.FileSystem.
+func (fs *FS) OpenFile(path string, flags int, perm os.FileMode) (vfs.File, error) {
+	req := fs.request(OpOpen)
+	req.str(path)
+	req.u32(uint32(flags))
+	req.u32(uint32(perm))
+	results, err := fs.pathCall("open", path, req)
+	if err != nil {
+		return nil, err
+	}
+	return &file{fs: fs, name: path, handle: results.u32()}, nil
+}
+
+// Create implements vfs.FileSystem.
+func (fs *FS) Create(path string) (vfs.File, error) {
+	return fs.OpenFile(path, vfs.O_RDWR|vfs.O_CREATE|vfs.O_TRUNC, 0666)
+}
+
+// Stat implements vfs.FileSystem.
+func (fs *FS) Stat(path string) (vfs.FileInfo, error) {
+	return fs.stat(OpStat, "stat", path)
+}
+
+// Lstat implements vfs.FileSystem.
+func (fs *FS) Lstat(path string) (vfs.FileInfo, error) {
+	return fs.stat(OpLstat, "lstat", path)
+}
+
+func (fs *FS) stat(op Op, name, path string) (vfs.FileInfo, error) {
+	req := fs.request(op)
+	req.str(path)
+	results, err := fs.pathCall(name, path, req)
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+	return results.info(), nil
+}
+
+// ReadDir implements vfs.FileSystem.
+func (fs *FS) ReadDir(path string) ([]vfs.DirEntry, error) {
+	req := fs.request(OpReadDir)
+	req.str(path)
+	results, err := fs.pathCall("readdir", path, req)
+	if err != nil {
+		return nil, err
+	}
+
+	n := results.u32()
+	var entries []vfs.DirEntry
+	for i := uint32(0); i < n && results.err == nil; i++ {
+		entries = append(entries, vfs.NewDirEntry(results.info()))
+	}
+	if results.err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: results.err}
+	}
+	return entries, nil
+}
+
+// Mkdir implements vfs.FileSystem.
+func (fs *FS) Mkdir(path string, perm os.FileMode) error {
+	req := fs.request(OpMkdir)
+	req.str(path)
+	req.u32(uint32(perm))
+	_, err := fs.pathCall("mkdir", path, req)
+	return err
+}
+
+// MkdirAll implements vfs.FileSystem.
+func (fs *FS) MkdirAll(path string, perm os.FileMode) error {
+	req := fs.request(OpMkdirAll)
+	req.str(path)
+	req.u32(uint32(perm))
+	_, err := fs.pathCall("mkdir", path, req)
+	return err
+}
+
+// Remove implements vfs.FileSystem.
+func (fs *FS) Remove(path string) error {
+	req := fs.request(OpRemove)
+	req.str(path)
+	_, err := fs.pathCall("remove", path, req)
+	return err
+}
+
+// RemoveAll implements vfs.FileSystem.
+func (fs *FS) RemoveAll(path string) error {
+	req := fs.request(OpRemoveAll)
+	req.str(path)
+	_, err := fs.pathCall("removeall", path, req)
+	return err
+}
+
+// Rename implements vfs.FileSystem.
+func (fs *FS) Rename(oldpath, newpath string) error {
+	req := fs.request(OpRename)
+	req.str(oldpath)
+	req.str(newpath)
+	return fs.linkCall("rename", oldpath, newpath, req)
+}
+
+// Symlink implements vfs.FileSystem.
+func (fs *FS) Symlink(target, newpath string) error {
+	req := fs.request(OpSymlink)
+	req.str(target)
+	req.str(newpath)
+	return fs.linkCall("symlink", target, newpath, req)
+}
+
+// Readlink implements vfs.FileSystem.
+func (fs *FS) Readlink(path string) (string, error) {
+	req := fs.request(OpReadlink)
+	req.str(path)
+	results, err := fs.pathCall("readlink", path, req)
+	if err != nil {
+		return "", err
+	}
+	return results.str(), nil
+}
+
+// Link implements vfs.FileSystem.
+func (fs *FS) Link(oldpath, newpath string) error {
+	req := fs.request(OpLink)
+	req.str(oldpath)
+	req.str(newpath)
+	return fs.linkCall("link", oldpath, newpath, req)
+}
+
+// Chmod implements vfs.FileSystem.
+func (fs *FS) Chmod(path string, mode os.FileMode) error {
+	req := fs.request(OpChmod)
+	req.str(path)
+	req.u32(uint32(mode))
+	_, err := fs.pathCall("chmod", path, req)
+	return err
+}
+
+// Chown implements vfs.FileSystem.
+func (fs *FS) Chown(path string, uid, gid int) error {
+	req := fs.request(OpChown)
+	req.str(path)
+	req.u32(uint32(int32(uid)))
+	req.u32(uint32(int32(gid)))
+	_, err := fs.pathCall("chown", path, req)
+	return err
+}
+
+// Chtimes implements vfs.FileSystem.
+func (fs *FS) Chtimes(path string, atime, mtime time.Time) error {
+	req := fs.request(OpChtimes)
+	req.str(path)
+	req.time(atime)
+	req.time(mtime)
+	_, err := fs.pathCall("chtimes", path, req)
+	return err
+}
+
+// ReadFile implements vfs.FileSystem.
+func (fs *FS) ReadFile(path string) ([]byte, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// WriteFile implements vfs.FileSystem.
+func (fs *FS) WriteFile(path string, data []byte, perm os.FileMode) error {
+	f, err := fs.OpenFile(path, vfs.O_WRONLY|vfs.O_CREATE|vfs.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// file is a file opened on the server.
+type file struct {
+	fs     *FS
+	name   string
+	handle uint32
+}
+
+// call sends a request about the file, reporting errors as
+// *os.PathError.
+func (f *file) call(op Op, name string, args func(req *encoder)) (*decoder, error) {
+	req := f.fs.request(op)
+	req.u32(f.handle)
+	if args != nil {
+		args(req)
+	}
+	return f.fs.pathCall(name, f.name, req)
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	return f.read(b, -1)
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: vfs.ErrInvalidSeek}
+	}
+	// ReadAt fills b unless it reaches the end of the file
+	n := 0
+	for n < len(b) {
+		m, err := f.read(b[n:], off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// read makes one read request, at the file's offset if off is negative.
+func (f *file) read(b []byte, off int64) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	results, err := f.call(OpRead, "read", func(req *encoder) {
+		req.i64(off)
+		req.u32(uint32(min(len(b), MaxChunk)))
+	})
+	if errors.Is(err, io.EOF) {
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, results.bytes()), nil
+}
+
+func (f *file) Write(b []byte) (int, error) {
+	return f.write(b, -1)
+}
+
+func (f *file) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: vfs.ErrInvalidSeek}
+	}
+	return f.write(b, off)
+}
+
+// write sends b in chunks, at the file's offset if off is negative.
+func (f *file) write(b []byte, off int64) (int, error) {
+	n := 0
+	for n < len(b) {
+		chunk := b[n:min(len(b), n+MaxChunk)]
+		chunkOff := off
+		if off >= 0 {
+			chunkOff = off + int64(n)
+		}
+		results, err := f.call(OpWrite, "write", func(req *encoder) {
+			req.i64(chunkOff)
+			req.bytes(chunk)
+		})
+		if err != nil {
+			return n, err
+		}
+		written := int(results.u32())
+		if written == 0 {
+			return n, &os.PathError{Op: "write", Path: f.name, Err: io.ErrShortWrite}
+		}
+		n += written
+	}
+	return n, nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	results, err := f.call(OpSeek, "seek", func(req *encoder) {
+		req.i64(offset)
+		req.u8(uint8(whence))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return results.i64(), nil
+}
+
+func (f *file) Close() error {
+	_, err := f.call(OpClose, "close", nil)
+	return err
+}
+
+func (f *file) Stat() (vfs.FileInfo, error) {
+	results, err := f.call(OpFstat, "stat", nil)
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+	return results.info(), nil
+}
+
+func (f *file) Truncate(size int64) error {
+	_, err := f.call(OpTruncate, "truncate", func(req *encoder) {
+		req.i64(size)
+	})
+	return err
+}
+
+func (f *file) Sync() error {
+	_, err := f.call(OpSync, "sync", nil)
+	return err
+}
+
+// Lock is not carried over the connection, as a blocking lock would stall
+// every other request on it.
+func (f *file) Lock(how vfs.LockMode) error {
+	return vfs.ErrNotImplemented
+}
+
+func (f *file) Unlock() error {
+	return vfs.ErrNotImplemented
+}
+
+var (
+	_ vfs.FileSystem = (*FS)(nil)
+	_ vfs.Notifier   = (*FS)(nil)
+)
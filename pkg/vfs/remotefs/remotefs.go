@@ -0,0 +1,416 @@
+// Package remotefs carries filesystem operations over the WebOS binary
+// protocol, so that the browser client and other Go nodes can work on a
+// session's files remotely.
+//
+// A Server answers requests by dispatching them to the vfs.FileSystem of
+// the connection's session. FS is a vfs.FileSystem whose operations are
+// requests sent over a websocket.Connection:
+//
+//	// Server
+//	files := remotefs.NewServer(func(s *websocket.Session) (vfs.FileSystem, error) {
+//		return homes.Get(s.UserID)
+//	})
+//	ws.SetHandler(files.Handle)
+//	ws.Pool().OnDisconnect(files.Disconnect)
+//
+//	// Client
+//	fs := remotefs.New(conn)
+//	conn.StartReadLoop()
+//	data, err := fs.ReadFile("/notes.txt")
+//
+// # Messages
+//
+// Requests, responses and events are the payloads of protocol.OpcodeFileSystem
+// messages. Integers are big-endian, signed integers are two's complement,
+// strings are null-terminated UTF-8 and byte strings are a uint32 length
+// followed by the bytes. Every payload starts with an operation byte and a
+// uint32 ID:
+//
+//	request:  op u8 | id u32 | arguments
+//	response: op|0x80 u8 | id u32 | code u8 | results, or message string if code != 0
+//	event:    0x40 u8 | watch u32 | op u32 | path string | oldpath string
+//
+// The client picks request IDs and the server echoes them in responses,
+// so several requests may be outstanding. The arguments and results of
+// each operation are:
+//
+//	OpOpen       path string, flags u32, perm u32    -> handle u32
+//	OpClose      handle u32                          ->
+//	OpRead       handle u32, offset i64, count u32   -> data bytes
+//	OpWrite      handle u32, offset i64, data bytes  -> count u32
+//	OpSeek       handle u32, offset i64, whence u8   -> offset i64
+//	OpFstat      handle u32                          -> info
+//	OpTruncate   handle u32, size i64                ->
+//	OpSync       handle u32                          ->
+//	OpStat       path string                         -> info
+//	OpLstat      path string                         -> info
+//	OpReadDir    path string                         -> count u32, info × count
+//	OpMkdir      path string, perm u32               ->
+//	OpMkdirAll   path string, perm u32               ->
+//	OpRemove     path string                         ->
+//	OpRemoveAll  path string                         ->
+//	OpRename     oldpath string, newpath string      ->
+//	OpSymlink    target string, newpath string       ->
+//	OpReadlink   path string                         -> target string
+//	OpLink       oldpath string, newpath string      ->
+//	OpChmod      path string, mode u32               ->
+//	OpChown      path string, uid i32, gid i32       ->
+//	OpChtimes    path string, atime i64, mtime i64   ->
+//	OpWatch      path string, recursive u8           -> watch u32
+//	OpUnwatch    watch u32                           ->
+//
+// A read or write at offset -1 uses and advances the file's offset, like
+// Read and Write; other offsets behave like ReadAt and WriteAt. Reads and
+// writes move at most MaxChunk bytes, and a read at the end of the file
+// fails with CodeEOF. Flags, modes and permissions use the values of the
+// Go os package, and times are Unix nanoseconds. A file info is encoded
+// as:
+//
+//	name string | size i64 | mode u32 | mtime i64 | dir u8 | stat u8
+//	[ino u64 | nlink u64 | uid i32 | gid i32 | atime i64 | ctime i64]
+//
+// where the bracketed inode metadata is present when stat is 1.
+//
+// Watches report changes as events, with the op of a vfs.Event, until
+// they are removed or the connection goes away; they need a filesystem
+// implementing vfs.Notifier.
+package remotefs
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+
+	"webos/pkg/protocol"
+	vfs "webos/pkg/vfs"
+)
+
+// Op identifies a filesystem operation.
+type Op uint8
+
+// Operations.
+const (
+	OpOpen Op = iota + 1
+	OpClose
+	OpRead
+	OpWrite
+	OpSeek
+	OpFstat
+	OpTruncate
+	OpSync
+	OpStat
+	OpLstat
+	OpReadDir
+	OpMkdir
+	OpMkdirAll
+	OpRemove
+	OpRemoveAll
+	OpRename
+	OpSymlink
+	OpReadlink
+	OpLink
+	OpChmod
+	OpChown
+	OpChtimes
+	OpWatch
+	OpUnwatch
+
+	// OpEvent marks an event delivered for a watch.
+	OpEvent Op = 0x40
+	// OpResponse is set in the operation byte of responses.
+	OpResponse Op = 0x80
+)
+
+// MaxChunk is the most data moved by one read or write.
+const MaxChunk = 1 << 20
+
+// Code is the status of a response.
+type Code uint8
+
+// Response codes.
+const (
+	CodeOK Code = iota
+	CodeNotExist
+	CodeExist
+	CodePermission
+	CodeNotDir
+	CodeIsDir
+	CodeNotEmpty
+	CodeInvalid
+	CodeEOF
+	CodeReadOnly
+	CodeClosed
+	CodeNotImplemented
+	CodeQuota
+	CodeLoop
+	CodeNotWatched
+
+	// CodeOther reports an error without a code of its own.
+	CodeOther Code = 0xff
+)
+
+// errMalformed is reported for requests that cannot be decoded.
+var errMalformed = errors.New("remotefs: malformed message")
+
+// codes lists the errors reported with each code. The server sends the
+// first code matching an error; ENOTEMPTY matches fs.ErrExist too, so it
+// comes first.
+var codes = []struct {
+	code Code
+	errs []error
+}{
+	{CodeNotEmpty, []error{syscall.ENOTEMPTY}},
+	{CodeNotExist, []error{fs.ErrNotExist}},
+	{CodeExist, []error{fs.ErrExist}},
+	{CodePermission, []error{vfs.ErrPermissionDenied, fs.ErrPermission}},
+	{CodeNotDir, []error{syscall.ENOTDIR}},
+	{CodeIsDir, []error{syscall.EISDIR}},
+	{CodeInvalid, []error{syscall.EINVAL, vfs.ErrInvalidPath, vfs.ErrEmptyPath,
+		vfs.ErrNotAbsolute, vfs.ErrInvalidSeek, errMalformed}},
+	{CodeEOF, []error{io.EOF}},
+	{CodeReadOnly, []error{vfs.ErrReadOnlyFS}},
+	{CodeClosed, []error{vfs.ErrClosedFile, fs.ErrClosed}},
+	{CodeNotImplemented, []error{vfs.ErrNotImplemented}},
+	{CodeQuota, []error{vfs.ErrQuotaExceeded}},
+	{CodeLoop, []error{vfs.ErrSymlinkLoop, syscall.ELOOP}},
+	{CodeNotWatched, []error{vfs.ErrNotWatched}},
+}
+
+// codeOf returns the code reporting err.
+func codeOf(err error) Code {
+	for _, c := range codes {
+		for _, target := range c.errs {
+			if errors.Is(err, target) {
+				return c.code
+			}
+		}
+	}
+	return CodeOther
+}
+
+// Error is an error reported by the server.
+type Error struct {
+	Code    Code
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is reports whether the error's code stands for target, so that
+// errors.Is(err, fs.ErrNotExist) and the like work across the connection.
+func (e *Error) Is(target error) bool {
+	for _, c := range codes {
+		if c.code != e.Code {
+			continue
+		}
+		for _, err := range c.errs {
+			if err != errMalformed && errors.Is(err, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// errorMessage returns the message sent for err, leaving out the
+// operation and path the client already knows.
+func errorMessage(err error) string {
+	var pathErr *os.PathError
+	var linkErr *os.LinkError
+	switch {
+	case errors.As(err, &pathErr):
+		err = pathErr.Err
+	case errors.As(err, &linkErr):
+		err = linkErr.Err
+	}
+	return err.Error()
+}
+
+// encoder builds a payload.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) u8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) u64(v uint64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, v)
+}
+
+func (e *encoder) i64(v int64) {
+	e.u64(uint64(v))
+}
+
+func (e *encoder) time(t time.Time) {
+	if t.IsZero() {
+		e.i64(0)
+		return
+	}
+	e.i64(t.UnixNano())
+}
+
+func (e *encoder) str(s string) {
+	e.buf = append(e.buf, s...)
+	e.buf = append(e.buf, 0)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.u32(uint32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.u8(1)
+	} else {
+		e.u8(0)
+	}
+}
+
+func (e *encoder) info(info vfs.FileInfo) {
+	e.str(info.Name)
+	e.i64(info.Size)
+	e.u32(uint32(info.Mode))
+	e.time(info.ModTime)
+	e.bool(info.IsDir)
+
+	st, ok := vfs.StatOf(info)
+	e.bool(ok)
+	if ok {
+		e.u64(st.Ino)
+		e.u64(st.Nlink)
+		e.u32(uint32(int32(st.Uid)))
+		e.u32(uint32(int32(st.Gid)))
+		e.time(st.Atime)
+		e.time(st.Ctime)
+	}
+}
+
+// decoder reads a payload. The first failure is kept in err, after which
+// reads return zero values.
+type decoder struct {
+	c   *protocol.Codec
+	err error
+}
+
+func newDecoder(payload []byte) *decoder {
+	return &decoder{c: protocol.NewCodec(payload)}
+}
+
+func (d *decoder) fail(err error) {
+	if err != nil && d.err == nil {
+		d.err = errMalformed
+	}
+}
+
+func (d *decoder) u8() uint8 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := d.c.ReadByte()
+	d.fail(err)
+	return v
+}
+
+func (d *decoder) u32() uint32 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := d.c.ReadUint32()
+	d.fail(err)
+	return v
+}
+
+func (d *decoder) u64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := d.c.ReadUint64()
+	d.fail(err)
+	return v
+}
+
+func (d *decoder) i64() int64 {
+	return int64(d.u64())
+}
+
+func (d *decoder) time() time.Time {
+	ns := d.i64()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+func (d *decoder) str() string {
+	if d.err != nil {
+		return ""
+	}
+	s, err := d.c.ReadString()
+	d.fail(err)
+	return s
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.u32()
+	if d.err != nil {
+		return nil
+	}
+	if int64(n) > int64(d.c.Remaining()) {
+		d.fail(io.ErrUnexpectedEOF)
+		return nil
+	}
+	b, err := d.c.ReadBytes(int(n))
+	d.fail(err)
+	return b
+}
+
+func (d *decoder) bool() bool {
+	return d.u8() != 0
+}
+
+func (d *decoder) info() vfs.FileInfo {
+	info := vfs.FileInfo{
+		Name:    d.str(),
+		Size:    d.i64(),
+		Mode:    os.FileMode(d.u32()),
+		ModTime: d.time(),
+		IsDir:   d.bool(),
+	}
+	if d.bool() {
+		info.Sys = &vfs.Stat{
+			Ino:   d.u64(),
+			Nlink: d.u64(),
+			Uid:   int(int32(d.u32())),
+			Gid:   int(int32(d.u32())),
+			Atime: d.time(),
+			Ctime: d.time(),
+		}
+	}
+	return info
+}
+
+// newPayload starts a payload with an operation and ID.
+func newPayload(op Op, id uint32) *encoder {
+	e := &encoder{}
+	e.u8(uint8(op))
+	e.u32(id)
+	return e
+}
+
+// message wraps a payload in a protocol message.
+func message(e *encoder) *protocol.Message {
+	return protocol.NewMessage(protocol.OpcodeFileSystem, e.buf)
+}
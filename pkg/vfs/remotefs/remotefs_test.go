@@ -0,0 +1,197 @@
+package remotefs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"testing"
+	"time"
+
+	vfs "webos/pkg/vfs"
+	"webos/pkg/vfs/memfs"
+	"webos/pkg/websocket"
+)
+
+// connect serves backend over an in-memory connection and returns the
+// client side.
+func connect(t *testing.T, backend vfs.FileSystem, session bool) *FS {
+	t.Helper()
+	serverSide, clientSide := net.Pipe()
+	t.Cleanup(func() {
+		serverSide.Close()
+		clientSide.Close()
+	})
+
+	server := NewServer(func(*websocket.Session) (vfs.FileSystem, error) {
+		return backend, nil
+	})
+	serverConn := websocket.NewConnection("server", serverSide)
+	serverConn.SetReadTimeout(0)
+	if session {
+		serverConn.SetSession(websocket.NewSession("session", "alice", nil))
+	}
+	serverConn.OnMessage(server.Handle)
+	serverConn.StartReadLoop()
+	t.Cleanup(func() { server.Disconnect(serverConn) })
+
+	clientConn := websocket.NewConnection("client", clientSide)
+	clientConn.SetReadTimeout(0)
+	client := New(clientConn)
+	client.SetTimeout(5 * time.Second)
+	clientConn.StartReadLoop()
+	return client
+}
+
+func TestFiles(t *testing.T) {
+	backend := memfs.New()
+	client := connect(t, backend, true)
+
+	if err := client.MkdirAll("/home/alice", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	if err := client.WriteFile("/home/alice/notes.txt", []byte("hello world"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if data, err := backend.ReadFile("/home/alice/notes.txt"); err != nil || string(data) != "hello world" {
+		t.Errorf("backend has %q, %v", data, err)
+	}
+
+	data, err := client.ReadFile("/home/alice/notes.txt")
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("ReadFile = %q, %v", data, err)
+	}
+
+	f, err := client.OpenFile("/home/alice/notes.txt", vfs.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if pos, err := f.Seek(6, io.SeekStart); err != nil || pos != 6 {
+		t.Errorf("Seek = %d, %v", pos, err)
+	}
+	if _, err := f.Write([]byte("there")); err != nil {
+		t.Errorf("Write failed: %v", err)
+	}
+	buf := make([]byte, 5)
+	if n, err := f.ReadAt(buf, 0); err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("ReadAt = %q, %v", buf[:n], err)
+	}
+	if _, err := f.Read(buf); err != io.EOF {
+		t.Errorf("Read at end = %v, want io.EOF", err)
+	}
+	if info, err := f.Stat(); err != nil || info.Size != 11 {
+		t.Errorf("Stat = %+v, %v", info, err)
+	}
+	if err := f.Truncate(5); err != nil {
+		t.Errorf("Truncate failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if err := f.Close(); !errors.Is(err, vfs.ErrClosedFile) {
+		t.Errorf("second Close = %v, want closed file error", err)
+	}
+
+	big := make([]byte, MaxChunk+100)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	if err := client.WriteFile("/big", big, 0644); err != nil {
+		t.Fatalf("WriteFile of %d bytes failed: %v", len(big), err)
+	}
+	if data, err := client.ReadFile("/big"); err != nil || len(data) != len(big) || data[MaxChunk] != big[MaxChunk] {
+		t.Errorf("ReadFile of %d bytes = %d bytes, %v", len(big), len(data), err)
+	}
+
+	if err := client.Rename("/home/alice/notes.txt", "/home/alice/renamed.txt"); err != nil {
+		t.Errorf("Rename failed: %v", err)
+	}
+	if err := client.Symlink("renamed.txt", "/home/alice/link"); err != nil {
+		t.Errorf("Symlink failed: %v", err)
+	}
+	if target, err := client.Readlink("/home/alice/link"); err != nil || target != "renamed.txt" {
+		t.Errorf("Readlink = %q, %v", target, err)
+	}
+	if info, err := client.Lstat("/home/alice/link"); err != nil || info.Mode&vfs.ModeSymlink == 0 {
+		t.Errorf("Lstat = %+v, %v", info, err)
+	}
+
+	entries, err := client.ReadDir("/home/alice")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	names := map[string]bool{}
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+	if len(entries) != 2 || !names["renamed.txt"] || !names["link"] {
+		t.Errorf("ReadDir = %v", names)
+	}
+
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := client.Chtimes("/home/alice/renamed.txt", mtime, mtime); err != nil {
+		t.Errorf("Chtimes failed: %v", err)
+	}
+	if info, err := client.Stat("/home/alice/renamed.txt"); err != nil || !info.ModTime.Equal(mtime) || info.Size != 5 {
+		t.Errorf("Stat = %+v, %v", info, err)
+	}
+
+	if err := client.RemoveAll("/home"); err != nil {
+		t.Errorf("RemoveAll failed: %v", err)
+	}
+	if _, err := backend.Stat("/home"); err == nil {
+		t.Error("backend still has /home")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	client := connect(t, memfs.New(), true)
+
+	_, err := client.Stat("/missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of missing file = %v, want not exist", err)
+	}
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) || pathErr.Path != "/missing" {
+		t.Errorf("Stat error = %#v, want a path error for /missing", err)
+	}
+
+	client.WriteFile("/file", nil, 0644)
+	if _, err := client.OpenFile("/file", vfs.O_WRONLY|vfs.O_CREATE|vfs.O_EXCL, 0644); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("exclusive create of existing file = %v, want exists", err)
+	}
+
+	unauthenticated := connect(t, memfs.New(), false)
+	if _, err := unauthenticated.Stat("/"); err == nil {
+		t.Error("expected connection without a session to be refused")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	backend := memfs.New()
+	client := connect(t, backend, true)
+
+	w, err := vfs.NewWatcher(client)
+	if err != nil {
+		t.Fatalf("NewWatcher failed: %v", err)
+	}
+	defer w.Close()
+	if err := w.Add("/docs", false); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	backend.Mkdir("/docs", 0755)
+	backend.WriteFile("/docs/a.txt", []byte("a"), 0644)
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-w.Events:
+			if ev.Path == "/docs/a.txt" && ev.Op == vfs.OpCreate {
+				return
+			}
+		case <-deadline:
+			t.Fatal("timed out waiting for event")
+		}
+	}
+}
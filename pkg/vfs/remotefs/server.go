@@ -0,0 +1,445 @@
+package remotefs
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"webos/pkg/protocol"
+	vfs "webos/pkg/vfs"
+	"webos/pkg/websocket"
+)
+
+// ErrNoSession is reported for requests on a connection without a
+// session.
+var ErrNoSession = errors.New("remotefs: connection has no session")
+
+// FileSystemFunc returns the filesystem served to a session.
+type FileSystemFunc func(session *websocket.Session) (vfs.FileSystem, error)
+
+// Server answers filesystem requests from websocket connections.
+type Server struct {
+	fs    FileSystemFunc
+	peers map[*websocket.Connection]*peer
+	mu    sync.Mutex
+}
+
+// peer is the state kept for one connection.
+type peer struct {
+	conn    *websocket.Connection
+	fs      vfs.FileSystem
+	files   map[uint32]vfs.File
+	watches map[uint32]*vfs.Watcher
+	next    uint32 // Last handle or watch ID assigned
+	mu      sync.Mutex
+}
+
+// NewServer creates a server giving each session the filesystem returned
+// by fs, which is called once per connection.
+func NewServer(fs FileSystemFunc) *Server {
+	return &Server{
+		fs:    fs,
+		peers: make(map[*websocket.Connection]*peer),
+	}
+}
+
+// Handle answers a request. It is a websocket.MessageHandler, and returns
+// protocol.ErrInvalidOpcode for messages other than
+// protocol.OpcodeFileSystem. Requests are answered in the order they
+// arrive.
+func (s *Server) Handle(conn *websocket.Connection, msg *protocol.Message) error {
+	if msg.Opcode != protocol.OpcodeFileSystem {
+		return protocol.ErrInvalidOpcode
+	}
+
+	d := newDecoder(msg.Payload)
+	op := Op(d.u8())
+	id := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	if op&(OpResponse|OpEvent) != 0 {
+		// Responses and events are for clients
+		return errMalformed
+	}
+
+	results := &encoder{}
+	p, err := s.peer(conn)
+	if err == nil {
+		err = p.serve(op, d, results)
+	}
+
+	resp := newPayload(op|OpResponse, id)
+	if err != nil {
+		resp.u8(uint8(codeOf(err)))
+		resp.str(errorMessage(err))
+	} else {
+		resp.u8(uint8(CodeOK))
+		resp.buf = append(resp.buf, results.buf...)
+	}
+	return conn.WriteMessage(message(resp))
+}
+
+// Disconnect closes the files and watches opened through conn. It suits
+// websocket.Pool.OnDisconnect.
+func (s *Server) Disconnect(conn *websocket.Connection) {
+	s.mu.Lock()
+	p, ok := s.peers[conn]
+	delete(s.peers, conn)
+	s.mu.Unlock()
+
+	if ok {
+		p.close()
+	}
+}
+
+// peer returns the state for conn, resolving its filesystem on first use.
+func (s *Server) peer(conn *websocket.Connection) (*peer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.peers[conn]; ok {
+		return p, nil
+	}
+
+	session := conn.GetSession()
+	if session == nil {
+		return nil, ErrNoSession
+	}
+	fs, err := s.fs(session)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &peer{
+		conn:    conn,
+		fs:      fs,
+		files:   make(map[uint32]vfs.File),
+		watches: make(map[uint32]*vfs.Watcher),
+	}
+	s.peers[conn] = p
+	return p, nil
+}
+
+// serve performs a request, encoding its results into out.
+func (p *peer) serve(op Op, d *decoder, out *encoder) error {
+	switch op {
+	case OpOpen:
+		path, flags, perm := d.str(), int(d.u32()), os.FileMode(d.u32())
+		if d.err != nil {
+			return d.err
+		}
+		f, err := p.fs.OpenFile(path, flags, perm)
+		if err != nil {
+			return err
+		}
+		out.u32(p.add(f))
+		return nil
+
+	case OpClose:
+		handle := d.u32()
+		if d.err != nil {
+			return d.err
+		}
+		p.mu.Lock()
+		f, ok := p.files[handle]
+		delete(p.files, handle)
+		p.mu.Unlock()
+		if !ok {
+			return vfs.ErrClosedFile
+		}
+		return f.Close()
+
+	case OpRead:
+		f, off, count := p.file(d), d.i64(), d.u32()
+		if d.err != nil {
+			return d.err
+		}
+		if f == nil {
+			return vfs.ErrClosedFile
+		}
+		buf := make([]byte, min(count, MaxChunk))
+		var n int
+		var err error
+		if off < 0 {
+			n, err = f.Read(buf)
+		} else {
+			n, err = f.ReadAt(buf, off)
+		}
+		if n == 0 && err != nil {
+			return err
+		}
+		out.bytes(buf[:n])
+		return nil
+
+	case OpWrite:
+		f, off, data := p.file(d), d.i64(), d.bytes()
+		if d.err != nil {
+			return d.err
+		}
+		if f == nil {
+			return vfs.ErrClosedFile
+		}
+		var n int
+		var err error
+		if off < 0 {
+			n, err = f.Write(data)
+		} else {
+			n, err = f.WriteAt(data, off)
+		}
+		if err != nil {
+			return err
+		}
+		out.u32(uint32(n))
+		return nil
+
+	case OpSeek:
+		f, off, whence := p.file(d), d.i64(), int(d.u8())
+		if d.err != nil {
+			return d.err
+		}
+		if f == nil {
+			return vfs.ErrClosedFile
+		}
+		pos, err := f.Seek(off, whence)
+		if err != nil {
+			return err
+		}
+		out.i64(pos)
+		return nil
+
+	case OpFstat:
+		f := p.file(d)
+		if d.err != nil {
+			return d.err
+		}
+		if f == nil {
+			return vfs.ErrClosedFile
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		out.info(info)
+		return nil
+
+	case OpTruncate:
+		f, size := p.file(d), d.i64()
+		if d.err != nil {
+			return d.err
+		}
+		if f == nil {
+			return vfs.ErrClosedFile
+		}
+		return f.Truncate(size)
+
+	case OpSync:
+		f := p.file(d)
+		if d.err != nil {
+			return d.err
+		}
+		if f == nil {
+			return vfs.ErrClosedFile
+		}
+		return f.Sync()
+
+	case OpStat, OpLstat:
+		path := d.str()
+		if d.err != nil {
+			return d.err
+		}
+		stat := p.fs.Stat
+		if op == OpLstat {
+			stat = p.fs.Lstat
+		}
+		info, err := stat(path)
+		if err != nil {
+			return err
+		}
+		out.info(info)
+		return nil
+
+	case OpReadDir:
+		path := d.str()
+		if d.err != nil {
+			return d.err
+		}
+		entries, err := p.fs.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		infos := make([]vfs.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			// Entries removed while listing are left out
+			if info, err := entry.Info(); err == nil {
+				infos = append(infos, info)
+			}
+		}
+		out.u32(uint32(len(infos)))
+		for _, info := range infos {
+			out.info(info)
+		}
+		return nil
+
+	case OpMkdir, OpMkdirAll:
+		path, perm := d.str(), os.FileMode(d.u32())
+		if d.err != nil {
+			return d.err
+		}
+		if op == OpMkdirAll {
+			return p.fs.MkdirAll(path, perm)
+		}
+		return p.fs.Mkdir(path, perm)
+
+	case OpRemove, OpRemoveAll:
+		path := d.str()
+		if d.err != nil {
+			return d.err
+		}
+		if op == OpRemoveAll {
+			return p.fs.RemoveAll(path)
+		}
+		return p.fs.Remove(path)
+
+	case OpRename, OpSymlink, OpLink:
+		from, to := d.str(), d.str()
+		if d.err != nil {
+			return d.err
+		}
+		switch op {
+		case OpRename:
+			return p.fs.Rename(from, to)
+		case OpSymlink:
+			return p.fs.Symlink(from, to)
+		}
+		return p.fs.Link(from, to)
+
+	case OpReadlink:
+		path := d.str()
+		if d.err != nil {
+			return d.err
+		}
+		target, err := p.fs.Readlink(path)
+		if err != nil {
+			return err
+		}
+		out.str(target)
+		return nil
+
+	case OpChmod:
+		path, mode := d.str(), os.FileMode(d.u32())
+		if d.err != nil {
+			return d.err
+		}
+		return p.fs.Chmod(path, mode)
+
+	case OpChown:
+		path, uid, gid := d.str(), int(int32(d.u32())), int(int32(d.u32()))
+		if d.err != nil {
+			return d.err
+		}
+		return p.fs.Chown(path, uid, gid)
+
+	case OpChtimes:
+		path, atime, mtime := d.str(), d.time(), d.time()
+		if d.err != nil {
+			return d.err
+		}
+		return p.fs.Chtimes(path, atime, mtime)
+
+	case OpWatch:
+		path, recursive := d.str(), d.bool()
+		if d.err != nil {
+			return d.err
+		}
+		id, err := p.watch(path, recursive)
+		if err != nil {
+			return err
+		}
+		out.u32(id)
+		return nil
+
+	case OpUnwatch:
+		id := d.u32()
+		if d.err != nil {
+			return d.err
+		}
+		p.mu.Lock()
+		w, ok := p.watches[id]
+		delete(p.watches, id)
+		p.mu.Unlock()
+		if !ok {
+			return vfs.ErrNotWatched
+		}
+		return w.Close()
+	}
+
+	return vfs.ErrNotImplemented
+}
+
+// add registers an open file and returns its handle.
+func (p *peer) add(f vfs.File) uint32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.next++
+	p.files[p.next] = f
+	return p.next
+}
+
+// file decodes a handle and returns its file, or nil if it is not open.
+func (p *peer) file(d *decoder) vfs.File {
+	handle := d.u32()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.files[handle]
+}
+
+// watch starts forwarding events for path.
+func (p *peer) watch(path string, recursive bool) (uint32, error) {
+	w, err := vfs.NewWatcher(p.fs)
+	if err != nil {
+		return 0, err
+	}
+	if err := w.Add(path, recursive); err != nil {
+		w.Close()
+		return 0, err
+	}
+
+	p.mu.Lock()
+	p.next++
+	id := p.next
+	p.watches[id] = w
+	p.mu.Unlock()
+
+	go p.forward(id, w)
+	return id, nil
+}
+
+// forward sends the events of a watch until it is closed.
+func (p *peer) forward(id uint32, w *vfs.Watcher) {
+	for ev := range w.Events {
+		e := newPayload(OpEvent, id)
+		e.u32(uint32(ev.Op))
+		e.str(ev.Path)
+		e.str(ev.OldPath)
+		// Failures mean the connection is gone, and Disconnect cleans up
+		p.conn.WriteMessage(message(e))
+	}
+}
+
+// close releases everything opened through the connection.
+func (p *peer) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for handle, f := range p.files {
+		f.Close()
+		delete(p.files, handle)
+	}
+	for id, w := range p.watches {
+		w.Close()
+		delete(p.watches, id)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package vfs
+
+// sysStat converts a host stat structure. Hosts without POSIX stat
+// structures report none.
+func sysStat(sys interface{}) (*Stat, bool) {
+	return nil, false
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package vfs
+
+import "syscall"
+
+// sysStat converts a host stat structure. Only the inode number, link
+// count and ownership are carried over.
+func sysStat(sys interface{}) (*Stat, bool) {
+	st, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return nil, false
+	}
+	return &Stat{
+		Ino:   uint64(st.Ino),
+		Nlink: uint64(st.Nlink),
+		Uid:   int(st.Uid),
+		Gid:   int(st.Gid),
+	}, true
+}
@@ -0,0 +1,533 @@
+// Package versionfs keeps earlier versions of files, so that users can go
+// back after overwriting them.
+//
+// FS wraps a filesystem and records a version of a file each time it is
+// closed after being written, and each time it is written by WriteFile.
+// Before an existing file is first changed through FS, its contents are
+// recorded too, so nothing written before the wrapper was in place is lost.
+// Removing a file keeps its history, so a removed file can be restored.
+//
+// Versions live on a separate store filesystem. Contents are stored once
+// per SHA-256 digest, so versions with identical contents, in one file or
+// across files, share storage:
+//
+//	/objects/ab/ab12…    contents, named by digest
+//	/history/cd34….json  versions of one path, named by its digest
+//
+// A Retention policy bounds how many versions are kept and for how long.
+// The newest version of a file is always kept.
+package versionfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	vfs "webos/pkg/vfs"
+)
+
+// ErrNoVersion is returned for a version that does not exist.
+var ErrNoVersion = errors.New("versionfs: no such version")
+
+// Retention limits the versions kept for each file. Zero values mean no
+// limit.
+type Retention struct {
+	MaxVersions int           // Most versions kept per file
+	MaxAge      time.Duration // Age after which versions are dropped
+}
+
+// Version describes a recorded version of a file.
+type Version struct {
+	ID      int         `json:"id"`      // Increasing for each file, never reused
+	Hash    string      `json:"hash"`    // SHA-256 of the contents, in hex
+	Size    int64       `json:"size"`    // Length of the contents
+	Mode    os.FileMode `json:"mode"`    // Permissions when recorded
+	ModTime time.Time   `json:"modTime"` // Modification time of the contents
+	Created time.Time   `json:"created"` // When the version was recorded
+}
+
+// history is the persisted list of versions of one path.
+type history struct {
+	Path     string    `json:"path"`
+	LastID   int       `json:"lastId"`
+	Versions []Version `json:"versions"` // Oldest first
+}
+
+// FS is a filesystem that keeps the history of its files.
+type FS struct {
+	vfs.FileSystem
+
+	store     vfs.FileSystem
+	retention Retention
+	histories map[string]*history // By path
+	refs      map[string]int      // Versions referring to each object
+	mu        sync.Mutex
+}
+
+// New wraps base, keeping versions on store under the retention policy.
+// Histories already on store are loaded.
+func New(base, store vfs.FileSystem, retention Retention) (*FS, error) {
+	fs := &FS{
+		FileSystem: base,
+		store:      store,
+		retention:  retention,
+		histories:  make(map[string]*history),
+		refs:       make(map[string]int),
+	}
+	if err := fs.load(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// load reads the histories on the store.
+func (fs *FS) load() error {
+	entries, err := fs.store.ReadDir("/history")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := fs.store.ReadFile("/history/" + entry.Name())
+		if err != nil {
+			return err
+		}
+		var h history
+		if err := json.Unmarshal(data, &h); err != nil {
+			return &os.PathError{Op: "load", Path: "/history/" + entry.Name(), Err: err}
+		}
+		fs.histories[h.Path] = &h
+		for _, v := range h.Versions {
+			fs.refs[v.Hash]++
+		}
+	}
+	return fs.collect()
+}
+
+// collect removes the objects no history refers to, left behind when the
+// store failed or the process stopped between writing an object and
+// saving the history that refers to it.
+func (fs *FS) collect() error {
+	dirs, err := fs.store.ReadDir("/objects")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		entries, err := fs.store.ReadDir("/objects/" + dir.Name())
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if fs.refs[entry.Name()] == 0 {
+				fs.store.Remove("/objects/" + dir.Name() + "/" + entry.Name())
+			}
+		}
+	}
+	return nil
+}
+
+// digest returns the SHA-256 of data in hex.
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// objectPath returns where contents with hash are stored.
+func objectPath(hash string) string {
+	return "/objects/" + hash[:2] + "/" + hash
+}
+
+// historyPath returns where the history of path is stored.
+func historyPath(path string) string {
+	return "/history/" + digest([]byte(path)) + ".json"
+}
+
+// Versions returns the recorded versions of the file at path, oldest
+// first.
+func (fs *FS) Versions(path string) ([]Version, error) {
+	if err := vfs.ValidatePath(path); err != nil {
+		return nil, &os.PathError{Op: "versions", Path: path, Err: err}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	h := fs.histories[vfs.Clean(path)]
+	if h == nil {
+		return nil, nil
+	}
+	return append([]Version(nil), h.Versions...), nil
+}
+
+// ReadVersion returns the contents of a version of the file at path.
+func (fs *FS) ReadVersion(path string, id int) ([]byte, error) {
+	_, data, err := fs.read("readversion", path, id)
+	return data, err
+}
+
+// Restore makes a version the current contents of the file at path,
+// recreating the file if it was removed. The current contents remain
+// available as a version, and the restored contents become the newest.
+func (fs *FS) Restore(path string, id int) error {
+	v, data, err := fs.read("restore", path, id)
+	if err != nil {
+		return err
+	}
+	return fs.WriteFile(path, data, v.Mode.Perm())
+}
+
+// read looks up a version of path and reads its contents. The object is
+// read under fs.mu, so the version cannot be pruned and its object
+// removed in between.
+func (fs *FS) read(op, path string, id int) (Version, []byte, error) {
+	if err := vfs.ValidatePath(path); err != nil {
+		return Version{}, nil, &os.PathError{Op: op, Path: path, Err: err}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if h := fs.histories[vfs.Clean(path)]; h != nil {
+		for _, v := range h.Versions {
+			if v.ID != id {
+				continue
+			}
+			data, err := fs.store.ReadFile(objectPath(v.Hash))
+			if err != nil {
+				return Version{}, nil, &os.PathError{Op: op, Path: path, Err: err}
+			}
+			return v, data, nil
+		}
+	}
+	return Version{}, nil, &os.PathError{Op: op, Path: path, Err: ErrNoVersion}
+}
+
+// Prune applies the retention policy to every history now. Versions are
+// otherwise only pruned when a file gains a new version.
+func (fs *FS) Prune() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	now := time.Now()
+	for _, h := range fs.histories {
+		prev := h.snapshot()
+		if dropped := fs.prune(h, now); len(dropped) > 0 {
+			if err := fs.commit(h, prev, dropped); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// preserve records the current contents of the regular file at path
+// unless they are already its newest version.
+func (fs *FS) preserve(path string) error {
+	info, err := fs.FileSystem.Stat(path)
+	if err != nil || info.IsDir || info.Mode.Type() != 0 {
+		return nil
+	}
+
+	fs.mu.Lock()
+	h := fs.histories[path]
+	if h != nil && len(h.Versions) > 0 {
+		newest := h.Versions[len(h.Versions)-1]
+		if newest.Size == info.Size && newest.ModTime.Equal(info.ModTime) {
+			fs.mu.Unlock()
+			return nil
+		}
+	}
+	fs.mu.Unlock()
+
+	return fs.record(path)
+}
+
+// record adds the current contents of the file at path as its newest
+// version.
+func (fs *FS) record(path string) error {
+	data, err := fs.FileSystem.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	info, err := fs.FileSystem.Stat(path)
+	if err != nil {
+		return err
+	}
+	hash := digest(data)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	h := fs.histories[path]
+	if h == nil {
+		h = &history{Path: path}
+		fs.histories[path] = h
+	}
+	prev := h.snapshot()
+
+	// Rewriting the same contents does not make a new version
+	if n := len(h.Versions); n > 0 && h.Versions[n-1].Hash == hash {
+		h.Versions[n-1].ModTime = info.ModTime
+		h.Versions[n-1].Mode = info.Mode
+		return fs.commit(h, prev, nil)
+	}
+
+	if fs.refs[hash] == 0 {
+		if err := fs.store.MkdirAll(vfs.Dir(objectPath(hash)), 0755); err != nil {
+			return err
+		}
+		if err := fs.store.WriteFile(objectPath(hash), data, 0644); err != nil {
+			return err
+		}
+	}
+	fs.refs[hash]++
+
+	now := time.Now()
+	h.LastID++
+	h.Versions = append(h.Versions, Version{
+		ID:      h.LastID,
+		Hash:    hash,
+		Size:    int64(len(data)),
+		Mode:    info.Mode,
+		ModTime: info.ModTime,
+		Created: now,
+	})
+	if err := fs.commit(h, prev, fs.prune(h, now)); err != nil {
+		// The object is no longer referred to by the version that failed
+		// to save
+		fs.release(hash)
+		return err
+	}
+	return nil
+}
+
+// snapshot returns a copy of h to roll back to.
+func (h *history) snapshot() history {
+	prev := *h
+	prev.Versions = append([]Version(nil), h.Versions...)
+	return prev
+}
+
+// commit saves h and then releases the objects of the versions dropped
+// from it. If saving fails h is rolled back to prev, which is still what
+// the store holds, and the dropped versions are kept. The caller must
+// hold fs.mu.
+func (fs *FS) commit(h *history, prev history, dropped []Version) error {
+	if err := fs.save(h); err != nil {
+		*h = prev
+		if len(h.Versions) == 0 {
+			delete(fs.histories, h.Path)
+		}
+		return err
+	}
+	for _, v := range dropped {
+		fs.release(v.Hash)
+	}
+	return nil
+}
+
+// prune drops the versions of h outside the retention policy, returning
+// those dropped. Their objects stay referenced until the caller releases
+// them. The caller must hold fs.mu.
+func (fs *FS) prune(h *history, now time.Time) []Version {
+	var keep, dropped []Version
+	for i, v := range h.Versions {
+		newest := i == len(h.Versions)-1
+		tooMany := fs.retention.MaxVersions > 0 && len(h.Versions)-i > fs.retention.MaxVersions
+		tooOld := fs.retention.MaxAge > 0 && now.Sub(v.Created) > fs.retention.MaxAge
+		if !newest && (tooMany || tooOld) {
+			dropped = append(dropped, v)
+			continue
+		}
+		keep = append(keep, v)
+	}
+	h.Versions = keep
+	return dropped
+}
+
+// release drops a reference to an object, removing it when unused. The
+// caller must hold fs.mu.
+func (fs *FS) release(hash string) {
+	fs.refs[hash]--
+	if fs.refs[hash] <= 0 {
+		delete(fs.refs, hash)
+		fs.store.Remove(objectPath(hash))
+	}
+}
+
+// save writes h to the store, or removes it if it has no versions. The
+// caller must hold fs.mu.
+func (fs *FS) save(h *history) error {
+	if len(h.Versions) == 0 {
+		delete(fs.histories, h.Path)
+		err := fs.store.Remove(historyPath(h.Path))
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		return err
+	}
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if err := fs.store.MkdirAll("/history", 0755); err != nil {
+		return err
+	}
+	return fs.store.WriteFile(historyPath(h.Path), data, 0644)
+}
+
+// Open implements vfs.FileSystem.
+func (fs *FS) Open(path string) (vfs.File, error) {
+	return fs.OpenFile(path, vfs.O_RDONLY, 0)
+}
+
+// Create implements vfs.FileSystem.
+func (fs *FS) Create(path string) (vfs.File, error) {
+	return fs.OpenFile(path, vfs.O_RDWR|vfs.O_CREATE|vfs.O_TRUNC, 0666)
+}
+
+// OpenFile implements vfs.FileSystem. Files opened for writing record a
+// version when closed after a change.
+func (fs *FS) OpenFile(path string, flags int, perm os.FileMode) (vfs.File, error) {
+	writable := flags&(vfs.O_WRONLY|vfs.O_RDWR) != 0 || flags&vfs.O_TRUNC != 0
+	if !writable {
+		return fs.FileSystem.OpenFile(path, flags, perm)
+	}
+
+	path = vfs.Clean(path)
+	if err := fs.preserve(path); err != nil {
+		return nil, err
+	}
+	f, err := fs.FileSystem.OpenFile(path, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &file{File: f, fs: fs, path: path, changed: flags&vfs.O_TRUNC != 0}, nil
+}
+
+// WriteFile implements vfs.FileSystem.
+func (fs *FS) WriteFile(path string, data []byte, perm os.FileMode) error {
+	path = vfs.Clean(path)
+	if err := fs.preserve(path); err != nil {
+		return err
+	}
+	if err := fs.FileSystem.WriteFile(path, data, perm); err != nil {
+		return err
+	}
+	return fs.record(path)
+}
+
+// Rename implements vfs.FileSystem. Histories move with the files; a
+// replaced file's history continues with the versions of the file that
+// replaced it.
+func (fs *FS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = vfs.Clean(oldpath), vfs.Clean(newpath)
+	if err := fs.preserve(newpath); err != nil {
+		return err
+	}
+	if err := fs.FileSystem.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var moved []*history
+	for path, h := range fs.histories {
+		if path == oldpath || strings.HasPrefix(path, oldpath+"/") {
+			moved = append(moved, h)
+		}
+	}
+	for _, h := range moved {
+		delete(fs.histories, h.Path)
+		if err := fs.store.Remove(historyPath(h.Path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		h.Path = newpath + strings.TrimPrefix(h.Path, oldpath)
+		var dropped []Version
+		if dest := fs.histories[h.Path]; dest != nil {
+			for _, v := range h.Versions {
+				dest.LastID++
+				v.ID = dest.LastID
+				dest.Versions = append(dest.Versions, v)
+			}
+			h = dest
+			dropped = fs.prune(h, time.Now())
+		}
+		fs.histories[h.Path] = h
+		if err := fs.save(h); err != nil {
+			return err
+		}
+		for _, v := range dropped {
+			fs.release(v.Hash)
+		}
+	}
+	return nil
+}
+
+// file records a version when closed after a change.
+type file struct {
+	vfs.File
+	fs      *FS
+	path    string
+	changed bool
+	mu      sync.Mutex
+}
+
+func (f *file) Write(b []byte) (int, error) {
+	f.touch()
+	return f.File.Write(b)
+}
+
+func (f *file) WriteAt(b []byte, off int64) (int, error) {
+	f.touch()
+	return f.File.WriteAt(b, off)
+}
+
+func (f *file) Truncate(size int64) error {
+	f.touch()
+	return f.File.Truncate(size)
+}
+
+// touch notes that the file has changed.
+func (f *file) touch() {
+	f.mu.Lock()
+	f.changed = true
+	f.mu.Unlock()
+}
+
+// Close closes the file and records its contents if it changed.
+func (f *file) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	changed := f.changed
+	f.changed = false
+	f.mu.Unlock()
+
+	if !changed {
+		return nil
+	}
+	return f.fs.record(f.path)
+}
+
+var _ vfs.FileSystem = (*FS)(nil)
@@ -0,0 +1,247 @@
+package versionfs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	vfs "webos/pkg/vfs"
+	"webos/pkg/vfs/memfs"
+)
+
+func contents(t *testing.T, fs *FS, path string) []string {
+	t.Helper()
+	versions, err := fs.Versions(path)
+	if err != nil {
+		t.Fatalf("Versions(%s) failed: %v", path, err)
+	}
+	var got []string
+	for _, v := range versions {
+		data, err := fs.ReadVersion(path, v.ID)
+		if err != nil {
+			t.Fatalf("ReadVersion(%s, %d) failed: %v", path, v.ID, err)
+		}
+		got = append(got, string(data))
+	}
+	return got
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// objects counts the stored contents.
+func objects(t *testing.T, store vfs.FileSystem) int {
+	t.Helper()
+	dirs, err := store.ReadDir("/objects")
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, dir := range dirs {
+		entries, err := store.ReadDir("/objects/" + dir.Name())
+		if err != nil {
+			t.Fatalf("ReadDir failed: %v", err)
+		}
+		n += len(entries)
+	}
+	return n
+}
+
+func TestVersions(t *testing.T) {
+	base := memfs.New()
+	base.WriteFile("/doc.txt", []byte("original"), 0644)
+
+	fs, err := New(base, memfs.New(), Retention{})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	if err := fs.WriteFile("/doc.txt", []byte("second"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	f, err := fs.OpenFile("/doc.txt", vfs.O_WRONLY|vfs.O_TRUNC, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	f.Write([]byte("third"))
+	f.Close()
+
+	// Opening for writing without writing records nothing
+	f, _ = fs.OpenFile("/doc.txt", vfs.O_RDWR, 0)
+	f.Close()
+	f, _ = fs.Open("/doc.txt")
+	f.Close()
+
+	want := []string{"original", "second", "third"}
+	if got := contents(t, fs, "/doc.txt"); !equal(got, want) {
+		t.Errorf("versions = %q, want %q", got, want)
+	}
+
+	versions, _ := fs.Versions("/doc.txt")
+	if err := fs.Restore("/doc.txt", versions[0].ID); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if data, _ := fs.ReadFile("/doc.txt"); string(data) != "original" {
+		t.Errorf("restored contents = %q, want %q", data, "original")
+	}
+	want = append(want, "original")
+	if got := contents(t, fs, "/doc.txt"); !equal(got, want) {
+		t.Errorf("versions after restore = %q, want %q", got, want)
+	}
+
+	if _, err := fs.ReadVersion("/doc.txt", 99); !errors.Is(err, ErrNoVersion) {
+		t.Errorf("ReadVersion of missing version = %v, want ErrNoVersion", err)
+	}
+
+	// Removed files can be restored
+	fs.Remove("/doc.txt")
+	if err := fs.Restore("/doc.txt", versions[1].ID); err != nil {
+		t.Fatalf("Restore of removed file failed: %v", err)
+	}
+	if data, _ := fs.ReadFile("/doc.txt"); string(data) != "second" {
+		t.Errorf("restored contents = %q, want %q", data, "second")
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	store := memfs.New()
+	fs, err := New(memfs.New(), store, Retention{})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	fs.WriteFile("/a.txt", []byte("same"), 0644)
+	fs.WriteFile("/b.txt", []byte("same"), 0644)
+	fs.WriteFile("/a.txt", []byte("other"), 0644)
+	fs.WriteFile("/a.txt", []byte("same"), 0644)
+	fs.WriteFile("/a.txt", []byte("same"), 0644)
+
+	if got := contents(t, fs, "/a.txt"); !equal(got, []string{"same", "other", "same"}) {
+		t.Errorf("versions = %q", got)
+	}
+	if n := objects(t, store); n != 2 {
+		t.Errorf("stored %d objects, want 2", n)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	store := memfs.New()
+	fs, err := New(memfs.New(), store, Retention{MaxVersions: 2})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	for _, s := range []string{"one", "two", "three", "four"} {
+		fs.WriteFile("/f", []byte(s), 0644)
+	}
+	if got := contents(t, fs, "/f"); !equal(got, []string{"three", "four"}) {
+		t.Errorf("versions = %q, want the newest two", got)
+	}
+	if n := objects(t, store); n != 2 {
+		t.Errorf("stored %d objects, want 2", n)
+	}
+
+	fs.retention = Retention{MaxAge: time.Nanosecond}
+	time.Sleep(time.Millisecond)
+	if err := fs.Prune(); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if got := contents(t, fs, "/f"); !equal(got, []string{"four"}) {
+		t.Errorf("versions after Prune = %q, want only the newest", got)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	base, store := memfs.New(), memfs.New()
+	fs, _ := New(base, store, Retention{})
+	fs.WriteFile("/dir/f", []byte("one"), 0644)
+	fs.MkdirAll("/dir", 0755)
+	fs.WriteFile("/dir/f", []byte("one"), 0644)
+	fs.WriteFile("/dir/f", []byte("two"), 0644)
+
+	if err := fs.Rename("/dir", "/moved"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if versions, _ := fs.Versions("/dir/f"); len(versions) != 0 {
+		t.Errorf("old path still has %d versions", len(versions))
+	}
+
+	reopened, err := New(base, store, Retention{})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if got := contents(t, reopened, "/moved/f"); !equal(got, []string{"one", "two"}) {
+		t.Errorf("versions after reopening = %q", got)
+	}
+
+	reopened.WriteFile("/moved/f", []byte("three"), 0644)
+	versions, _ := reopened.Versions("/moved/f")
+	if versions[len(versions)-1].ID != 3 {
+		t.Errorf("newest ID = %d, want 3", versions[len(versions)-1].ID)
+	}
+}
+
+// failingStore fails writes of histories while fail is set.
+type failingStore struct {
+	vfs.FileSystem
+	fail bool
+}
+
+var errStore = errors.New("store failed")
+
+func (s *failingStore) WriteFile(path string, data []byte, perm os.FileMode) error {
+	if s.fail && strings.HasPrefix(path, "/history/") {
+		return errStore
+	}
+	return s.FileSystem.WriteFile(path, data, perm)
+}
+
+func TestFailedSave(t *testing.T) {
+	base := memfs.New()
+	store := &failingStore{FileSystem: memfs.New()}
+	fs, err := New(base, store, Retention{MaxVersions: 1})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	fs.WriteFile("/f", []byte("one"), 0644)
+
+	// A version that fails to save is rolled back with its object, and
+	// the version it would have pruned is kept
+	store.fail = true
+	if err := fs.WriteFile("/f", []byte("two"), 0644); !errors.Is(err, errStore) {
+		t.Fatalf("WriteFile returned %v, want the store error", err)
+	}
+	if got := contents(t, fs, "/f"); !equal(got, []string{"one"}) {
+		t.Errorf("versions after failed save = %q, want %q", got, []string{"one"})
+	}
+	if n := objects(t, store); n != 1 {
+		t.Errorf("stored %d objects after failed save, want 1", n)
+	}
+
+	// Objects left without a history are removed when the store is loaded
+	store.fail = false
+	orphan := objectPath(digest([]byte("orphan")))
+	store.MkdirAll(vfs.Dir(orphan), 0755)
+	store.WriteFile(orphan, []byte("orphan"), 0644)
+	reopened, err := New(base, store, Retention{})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if n := objects(t, store); n != 1 {
+		t.Errorf("stored %d objects after reopening, want 1", n)
+	}
+	if got := contents(t, reopened, "/f"); !equal(got, []string{"one"}) {
+		t.Errorf("versions after reopening = %q", got)
+	}
+}
@@ -0,0 +1,357 @@
+package vfs
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Watch errors.
+var (
+	ErrWatcherClosed = errors.New("vfs: watcher is closed")
+	ErrNotWatched    = errors.New("vfs: path is not watched")
+)
+
+// Op describes the kind of change reported by an Event.
+type Op uint32
+
+const (
+	OpCreate Op = 1 << iota // A file, directory or symlink was created
+	OpWrite                 // File contents were written or truncated
+	OpRemove                // An entry was removed
+	OpRename                // An entry was renamed; OldPath holds its former path
+	OpChmod                 // Mode, ownership or times changed
+)
+
+// String returns the names of the set bits, separated by "|".
+func (op Op) String() string {
+	var names []string
+	for _, bit := range []struct {
+		op   Op
+		name string
+	}{
+		{OpCreate, "CREATE"},
+		{OpWrite, "WRITE"},
+		{OpRemove, "REMOVE"},
+		{OpRename, "RENAME"},
+		{OpChmod, "CHMOD"},
+	} {
+		if op&bit.op != 0 {
+			names = append(names, bit.name)
+		}
+	}
+	if len(names) == 0 {
+		return "NONE"
+	}
+	return strings.Join(names, "|")
+}
+
+// Event describes a change to the filesystem.
+type Event struct {
+	Op      Op
+	Path    string // Affected path; the new path for renames
+	OldPath string // Former path for renames
+}
+
+// Notifier is implemented by filesystems that report their changes.
+type Notifier interface {
+	// Subscribe calls fn for every change until cancel is called. fn is
+	// called after the change has been made, one event at a time and in
+	// order, from a goroutine that holds no filesystem locks, so it may
+	// call back into the filesystem. A slow fn delays later events. An
+	// event already being delivered may still reach fn after cancel.
+	Subscribe(fn func(Event)) (cancel func())
+}
+
+// EventHub fans events out to subscribers. Backends embed it to implement
+// Notifier.
+//
+// Emit only queues the event, so backends may call it while holding their
+// own locks; a delivery goroutine, started when events are queued and
+// exiting once the queue is empty, calls the subscribers.
+type EventHub struct {
+	mu         sync.Mutex
+	subs       map[int]func(Event)
+	next       int
+	queue      []Event
+	delivering bool
+}
+
+// Subscribe implements Notifier.
+func (h *EventHub) Subscribe(fn func(Event)) (cancel func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subs == nil {
+		h.subs = make(map[int]func(Event))
+	}
+	id := h.next
+	h.next++
+	h.subs[id] = fn
+
+	return func() {
+		h.mu.Lock()
+		delete(h.subs, id)
+		h.mu.Unlock()
+	}
+}
+
+// Emit delivers an event for path to all subscribers.
+func (h *EventHub) Emit(op Op, path string) {
+	h.emit(Event{Op: op, Path: Clean(path)})
+}
+
+// EmitRename delivers a rename event to all subscribers.
+func (h *EventHub) EmitRename(oldpath, newpath string) {
+	h.emit(Event{Op: OpRename, Path: Clean(newpath), OldPath: Clean(oldpath)})
+}
+
+// CollectTree returns path and everything beneath it, parents first, for
+// a later EmitRemoveTree. It must be called before the tree is removed
+// and without holding locks fs needs. It returns nil when nobody is
+// subscribed.
+func (h *EventHub) CollectTree(fs FileSystem, path string) []string {
+	if !h.active() {
+		return nil
+	}
+
+	info, err := fs.Lstat(path)
+	if err != nil {
+		return nil
+	}
+	root := Clean(path)
+	paths := []string{root}
+	if !info.IsDir {
+		return paths
+	}
+
+	Walk(fs, root, func(p string, info FileInfo, err error) error {
+		if err == nil && p != root {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	return paths
+}
+
+// EmitRemoveTree delivers remove events for paths collected by
+// CollectTree, children before their parents.
+func (h *EventHub) EmitRemoveTree(paths []string) {
+	for i := len(paths) - 1; i >= 0; i-- {
+		h.Emit(OpRemove, paths[i])
+	}
+}
+
+// active reports whether anyone is subscribed.
+func (h *EventHub) active() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs) > 0
+}
+
+// emit queues an event and starts delivery if it is not running.
+func (h *EventHub) emit(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.subs) == 0 {
+		return
+	}
+	h.queue = append(h.queue, ev)
+	if !h.delivering {
+		h.delivering = true
+		go h.deliver()
+	}
+}
+
+// deliver calls the subscribers for queued events until none are left.
+func (h *EventHub) deliver() {
+	for {
+		h.mu.Lock()
+		if len(h.queue) == 0 {
+			h.delivering = false
+			h.mu.Unlock()
+			return
+		}
+		ev := h.queue[0]
+		h.queue[0] = Event{}
+		h.queue = h.queue[1:]
+		subs := make([]func(Event), 0, len(h.subs))
+		for _, fn := range h.subs {
+			subs = append(subs, fn)
+		}
+		h.mu.Unlock()
+
+		for _, fn := range subs {
+			fn(ev)
+		}
+	}
+}
+
+// Watcher delivers filesystem events for watched paths over a channel.
+//
+// A watch on a directory reports changes to the directory and its direct
+// entries, or to everything beneath it when recursive. A watch on a file
+// reports changes to that file. Renames are reported to watches covering
+// either the old or the new path. Events are queued without limit, so a
+// slow reader never stalls the filesystem.
+type Watcher struct {
+	// Events receives matching events. It is closed by Close.
+	Events chan Event
+
+	cancel  func()
+	watches map[string]bool // Path -> recursive
+	queue   []Event
+	wake    chan struct{}
+	done    chan struct{}
+	closed  bool
+	mu      sync.Mutex
+}
+
+// NewWatcher creates a watcher for fs, which must implement Notifier.
+func NewWatcher(fs FileSystem) (*Watcher, error) {
+	notifier, ok := fs.(Notifier)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+
+	w := &Watcher{
+		Events:  make(chan Event),
+		watches: make(map[string]bool),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	w.cancel = notifier.Subscribe(w.handle)
+	go w.deliver()
+	return w, nil
+}
+
+// Add watches path, including everything beneath it if recursive. Adding
+// a watched path again replaces its recursive setting.
+func (w *Watcher) Add(path string, recursive bool) error {
+	if err := ValidatePath(path); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrWatcherClosed
+	}
+	w.watches[Clean(path)] = recursive
+	return nil
+}
+
+// Remove stops watching path.
+func (w *Watcher) Remove(path string) error {
+	path = Clean(path)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrWatcherClosed
+	}
+	if _, ok := w.watches[path]; !ok {
+		return ErrNotWatched
+	}
+	delete(w.watches, path)
+	return nil
+}
+
+// WatchList returns the watched paths.
+func (w *Watcher) WatchList() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	paths := make([]string, 0, len(w.watches))
+	for path := range w.watches {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// Close stops the watcher and closes Events. Undelivered events are
+// discarded.
+func (w *Watcher) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.queue = nil
+	w.mu.Unlock()
+
+	w.cancel()
+	close(w.done)
+	return nil
+}
+
+// handle queues an event if it matches a watch.
+func (w *Watcher) handle(ev Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed || !w.matches(ev) {
+		return
+	}
+	w.queue = append(w.queue, ev)
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// matches reports whether ev falls under any watch (caller must hold lock).
+func (w *Watcher) matches(ev Event) bool {
+	for path, recursive := range w.watches {
+		if watchCovers(path, recursive, ev.Path) {
+			return true
+		}
+		if ev.OldPath != "" && watchCovers(path, recursive, ev.OldPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchCovers reports whether a watch on dir covers path.
+func watchCovers(dir string, recursive bool, path string) bool {
+	if path == dir {
+		return true
+	}
+	if recursive {
+		return hasPathPrefix(path, dir)
+	}
+	return path != "/" && Dir(path) == dir
+}
+
+// deliver sends queued events until the watcher is closed.
+func (w *Watcher) deliver() {
+	defer close(w.Events)
+
+	for {
+		w.mu.Lock()
+		if len(w.queue) == 0 {
+			w.mu.Unlock()
+			select {
+			case <-w.wake:
+				continue
+			case <-w.done:
+				return
+			}
+		}
+		ev := w.queue[0]
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+
+		select {
+		case w.Events <- ev:
+		case <-w.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package vfs
+
+import (
+	"errors"
+	"strings"
+)
+
+// Extended attribute errors.
+var (
+	ErrNoAttr          = errors.New("vfs: no such attribute")
+	ErrAttrExists      = errors.New("vfs: attribute already exists")
+	ErrInvalidAttrName = errors.New("vfs: invalid attribute name")
+)
+
+// Flags for Setxattr, matching setxattr(2).
+const (
+	XattrCreate  = 1 // Fail with ErrAttrExists if the attribute exists
+	XattrReplace = 2 // Fail with ErrNoAttr if the attribute does not exist
+)
+
+// MaxXattrNameLen is the longest attribute name accepted.
+const MaxXattrNameLen = 255
+
+// XattrFS is implemented by filesystems that store extended attributes.
+//
+// Attribute names are conventionally namespaced, as in "user.mime_type"
+// or "security.label". Attributes follow symlinks, like getxattr(2).
+type XattrFS interface {
+	FileSystem
+
+	// Getxattr returns the value of the named attribute.
+	Getxattr(path, name string) ([]byte, error)
+
+	// Setxattr sets the named attribute. flags is 0, XattrCreate or
+	// XattrReplace.
+	Setxattr(path, name string, value []byte, flags int) error
+
+	// Listxattr returns the names of all attributes on path.
+	Listxattr(path string) ([]string, error)
+
+	// Removexattr removes the named attribute.
+	Removexattr(path, name string) error
+}
+
+// ValidateXattrName checks that name can be used as an attribute name.
+func ValidateXattrName(name string) error {
+	if name == "" || len(name) > MaxXattrNameLen || strings.IndexByte(name, 0) >= 0 {
+		return ErrInvalidAttrName
+	}
+	return nil
+}
+
+// CheckXattrFlags applies the XattrCreate and XattrReplace flags given
+// whether the attribute already exists.
+func CheckXattrFlags(flags int, exists bool) error {
+	if flags&XattrCreate != 0 && exists {
+		return ErrAttrExists
+	}
+	if flags&XattrReplace != 0 && !exists {
+		return ErrNoAttr
+	}
+	return nil
+}
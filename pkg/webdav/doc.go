@@ -0,0 +1,38 @@
+/*
+Package webdav serves virtual filesystems over WebDAV (RFC 4918), so that
+desktop operating systems can mount a user's files and the browser file
+manager can browse them with the same API.
+
+# Routing
+
+A Handler serves every path below its prefix. Register adds a route for
+each WebDAV method to a router.Router:
+
+	h := webdav.New("/dav", authenticator, func(u *auth.User) (vfs.FileSystem, error) {
+		return homes.Get(u.Username)
+	})
+	r := router.New()
+	h.Register(r)
+
+# Authentication
+
+Every request must carry an auth.Authenticator session, as a bearer token
+in the Authorization header or in the SessionCookie cookie. Clients that
+only speak HTTP Basic authentication, as most desktop WebDAV clients do,
+may send a username and password instead; the handler logs them in and
+reuses the session on later requests. MFA-enabled accounts must use a
+session.
+
+# Properties and locks
+
+PROPFIND reports the live properties resourcetype, displayname,
+getcontentlength, getcontenttype, getetag, getlastmodified, supportedlock
+and lockdiscovery. PROPPATCH stores other properties as extended
+attributes, so it needs a filesystem implementing vfs.XattrFS.
+
+LOCK and UNLOCK provide exclusive and shared write locks, held in memory
+for each user, or for each namespace set with SetLockNamespace.
+Requests that change a locked resource must submit the lock token in an
+If header, and tokens are only accepted from the user who took the lock.
+*/
+package webdav
@@ -0,0 +1,322 @@
+package webdav
+
+import (
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTimeout bounds the lifetime clients may request for a lock.
+const maxTimeout = 7 * 24 * time.Hour
+
+// lock is a write lock on a resource.
+type lock struct {
+	token     string
+	root      string
+	infinite  bool   // Depth infinity, covering every member of root
+	exclusive bool   // Otherwise shared
+	owner     string // Raw XML supplied by the client
+	user      string // ID of the user who took the lock
+	timeout   time.Duration
+	expires   time.Time
+}
+
+// covers reports whether the lock applies to the resource at p.
+func (l *lock) covers(p string) bool {
+	return p == l.root || (l.infinite && hasPathPrefix(p, l.root))
+}
+
+// lockSystem holds the locks of one namespace. A lock token is only
+// accepted from the user who took the lock.
+type lockSystem struct {
+	mu    sync.Mutex
+	locks map[string]*lock // By token
+}
+
+func newLockSystem() *lockSystem {
+	return &lockSystem{locks: make(map[string]*lock)}
+}
+
+// prune drops expired locks. The caller must hold ls.mu.
+func (ls *lockSystem) prune() {
+	now := time.Now()
+	for token, l := range ls.locks {
+		if now.After(l.expires) {
+			delete(ls.locks, token)
+		}
+	}
+}
+
+// covering returns copies of the locks that apply to the resource at p.
+func (ls *lockSystem) covering(p string) []*lock {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.prune()
+
+	var locks []*lock
+	for _, l := range ls.locks {
+		if l.covers(p) {
+			c := *l
+			locks = append(locks, &c)
+		}
+	}
+	return locks
+}
+
+// create adds a lock on root, reporting false if it conflicts with an
+// existing one.
+func (ls *lockSystem) create(root string, infinite, exclusive bool, owner, user string, timeout time.Duration) (*lock, bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.prune()
+
+	n := &lock{root: root, infinite: infinite, exclusive: exclusive}
+	for _, l := range ls.locks {
+		if (l.covers(root) || n.covers(l.root)) && (l.exclusive || exclusive) {
+			return nil, false
+		}
+	}
+
+	n.token = newToken()
+	n.owner = owner
+	n.user = user
+	n.timeout = timeout
+	n.expires = time.Now().Add(timeout)
+	ls.locks[n.token] = n
+	c := *n
+	return &c, true
+}
+
+// refresh restarts the timeout of the first lock among tokens that
+// applies to p and was taken by user.
+func (ls *lockSystem) refresh(p string, tokens []string, user string, timeout time.Duration) *lock {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.prune()
+
+	for _, token := range tokens {
+		if l, ok := ls.locks[token]; ok && l.covers(p) && l.user == user {
+			l.timeout = timeout
+			l.expires = time.Now().Add(timeout)
+			c := *l
+			return &c
+		}
+	}
+	return nil
+}
+
+// unlock removes the lock with token if it applies to p and was taken by
+// user.
+func (ls *lockSystem) unlock(token, p, user string) bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	l, ok := ls.locks[token]
+	if !ok || !l.covers(p) || l.user != user {
+		return false
+	}
+	delete(ls.locks, token)
+	return true
+}
+
+// removeTree drops the locks rooted at p or below it, after the
+// resources they protect have gone.
+func (ls *lockSystem) removeTree(p string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	for token, l := range ls.locks {
+		if l.root == p || hasPathPrefix(l.root, p) {
+			delete(ls.locks, token)
+		}
+	}
+}
+
+// newToken returns a unique lock token.
+func newToken() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // Version 4
+	b[8] = b[8]&0x3f | 0x80 // Variant 10
+	return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// ifTokens returns the state tokens listed in an If header. Resource tags
+// and entity tags are not evaluated; a request may change a resource when
+// it submits the token of every lock covering it.
+func ifTokens(header string) []string {
+	var tokens []string
+	for {
+		start := strings.IndexByte(header, '<')
+		if start < 0 {
+			return tokens
+		}
+		end := strings.IndexByte(header[start:], '>')
+		if end < 0 {
+			return tokens
+		}
+		tokens = append(tokens, header[start+1:start+end])
+		header = header[start+end+1:]
+	}
+}
+
+// checkLocks returns 423 Locked unless the request submits the token of
+// every lock covering p and, if recursive, every lock below p, each taken
+// by the requesting user.
+func (r *request) checkLocks(p string, recursive bool) int {
+	tokens := ifTokens(r.Header.Get("If"))
+
+	r.locks.mu.Lock()
+	defer r.locks.mu.Unlock()
+	r.locks.prune()
+
+	for token, l := range r.locks.locks {
+		if !l.covers(p) && !(recursive && hasPathPrefix(l.root, p)) {
+			continue
+		}
+		submitted := false
+		for _, t := range tokens {
+			if t == token && l.user == r.user.ID {
+				submitted = true
+				break
+			}
+		}
+		if !submitted {
+			return http.StatusLocked
+		}
+	}
+	return 0
+}
+
+// parseTimeout returns the first usable lock lifetime in a Timeout
+// header, capped at maxTimeout.
+func parseTimeout(header string) time.Duration {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if strings.EqualFold(value, "Infinite") {
+			return maxTimeout
+		}
+		if s, ok := strings.CutPrefix(value, "Second-"); ok {
+			if n, err := strconv.ParseUint(s, 10, 32); err == nil && n > 0 {
+				return min(time.Duration(n)*time.Second, maxTimeout)
+			}
+		}
+	}
+	return maxTimeout
+}
+
+// lockDiscovery renders the activelock elements describing locks.
+func (h *Handler) lockDiscovery(locks []*lock) string {
+	var b strings.Builder
+	for _, l := range locks {
+		scope, depth := "shared", "0"
+		if l.exclusive {
+			scope = "exclusive"
+		}
+		if l.infinite {
+			depth = "infinity"
+		}
+		fmt.Fprintf(&b, "<D:activelock><D:locktype><D:write/></D:locktype><D:lockscope><D:%s/></D:lockscope><D:depth>%s</D:depth>", scope, depth)
+		if l.owner != "" {
+			fmt.Fprintf(&b, "<D:owner>%s</D:owner>", l.owner)
+		}
+		fmt.Fprintf(&b, "<D:timeout>Second-%d</D:timeout>", int64(l.timeout/time.Second))
+		fmt.Fprintf(&b, "<D:locktoken><D:href>%s</D:href></D:locktoken>", escape(l.token))
+		fmt.Fprintf(&b, "<D:lockroot><D:href>%s</D:href></D:lockroot></D:activelock>", escape(h.href(l.root, false)))
+	}
+	return b.String()
+}
+
+type lockInfo struct {
+	XMLName xml.Name `xml:"DAV: lockinfo"`
+	Scope   struct {
+		Exclusive *struct{} `xml:"DAV: exclusive"`
+		Shared    *struct{} `xml:"DAV: shared"`
+	} `xml:"DAV: lockscope"`
+	Type struct {
+		Write *struct{} `xml:"DAV: write"`
+	} `xml:"DAV: locktype"`
+	Owner *struct {
+		Inner string `xml:",innerxml"`
+	} `xml:"DAV: owner"`
+}
+
+// handleLock creates a lock or, given no body, refreshes the lock named
+// in the If header. Locking a missing resource creates an empty file.
+func (h *Handler) handleLock(w http.ResponseWriter, r *request) int {
+	timeout := parseTimeout(r.Header.Get("Timeout"))
+
+	var info lockInfo
+	empty, err := readXML(r, &info)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+
+	var l *lock
+	code := http.StatusOK
+	if empty {
+		l = r.locks.refresh(r.path, ifTokens(r.Header.Get("If")), r.user.ID, timeout)
+		if l == nil {
+			return http.StatusPreconditionFailed
+		}
+	} else {
+		exclusive := info.Scope.Exclusive != nil
+		if info.Type.Write == nil || exclusive == (info.Scope.Shared != nil) {
+			return http.StatusBadRequest
+		}
+		var infinite bool
+		switch depth := r.Header.Get("Depth"); {
+		case depth == "" || strings.EqualFold(depth, "infinity"):
+			infinite = true
+		case depth == "0":
+		default:
+			return http.StatusBadRequest
+		}
+		owner := ""
+		if info.Owner != nil {
+			owner = info.Owner.Inner
+		}
+
+		var ok bool
+		if l, ok = r.locks.create(r.path, infinite, exclusive, owner, r.user.ID, timeout); !ok {
+			return http.StatusLocked
+		}
+		if _, err := r.fs.Stat(r.path); err != nil {
+			if !parentExists(r.fs, r.path) {
+				r.locks.unlock(l.token, r.path, r.user.ID)
+				return http.StatusConflict
+			}
+			if err := r.fs.WriteFile(r.path, nil, 0644); err != nil {
+				r.locks.unlock(l.token, r.path, r.user.ID)
+				return status(err)
+			}
+			code = http.StatusCreated
+		}
+		w.Header().Set("Lock-Token", "<"+l.token+">")
+	}
+
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+
+		`<D:prop xmlns:D="DAV:"><D:lockdiscovery>%s</D:lockdiscovery></D:prop>`+"\n",
+		h.lockDiscovery([]*lock{l}))
+	return 0
+}
+
+// handleUnlock removes the lock named in the Lock-Token header.
+func (h *Handler) handleUnlock(w http.ResponseWriter, r *request) int {
+	token := strings.TrimSuffix(strings.TrimPrefix(r.Header.Get("Lock-Token"), "<"), ">")
+	if token == "" {
+		return http.StatusBadRequest
+	}
+	if !r.locks.unlock(token, r.path, r.user.ID) {
+		return http.StatusConflict
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return 0
+}
@@ -0,0 +1,433 @@
+package webdav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"webos/pkg/vfs"
+)
+
+// xattrPrefix starts the extended attributes holding dead properties.
+// The rest of the name is the property's namespace in braces followed by
+// its local name.
+const xattrPrefix = "user.webdav."
+
+// maxBody bounds the XML request bodies read.
+const maxBody = 1 << 20
+
+// live lists the properties computed from the filesystem, which
+// PROPPATCH cannot change.
+var live = []string{
+	"creationdate", "displayname", "getcontentlanguage", "getcontentlength",
+	"getcontenttype", "getetag", "getlastmodified", "lockdiscovery",
+	"resourcetype", "supportedlock",
+}
+
+// isLive reports whether name is a live property.
+func isLive(name xml.Name) bool {
+	if name.Space != "DAV:" {
+		return false
+	}
+	for _, l := range live {
+		if name.Local == l {
+			return true
+		}
+	}
+	return false
+}
+
+// property is a property name with its value as raw XML.
+type property struct {
+	XMLName xml.Name
+	Inner   []byte `xml:",innerxml"`
+}
+
+type propfindBody struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	Allprop  *struct{} `xml:"DAV: allprop"`
+	Propname *struct{} `xml:"DAV: propname"`
+	Prop     *struct {
+		Props []property `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+type propertyUpdateBody struct {
+	XMLName xml.Name `xml:"DAV: propertyupdate"`
+	Ops     []struct {
+		XMLName xml.Name
+		Prop    struct {
+			Props []property `xml:",any"`
+		} `xml:"DAV: prop"`
+	} `xml:",any"`
+}
+
+// readXML decodes an XML request body into v, reporting whether the body
+// was empty.
+func readXML(r *request, v interface{}) (empty bool, err error) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
+	if err != nil {
+		return false, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return true, nil
+	}
+	return false, xml.Unmarshal(data, v)
+}
+
+// xattrName returns the attribute holding a dead property.
+func xattrName(name xml.Name) string {
+	return xattrPrefix + "{" + name.Space + "}" + name.Local
+}
+
+// propName parses the property named by an attribute, if it holds one.
+func propName(attr string) (xml.Name, bool) {
+	rest, ok := strings.CutPrefix(attr, xattrPrefix+"{")
+	if !ok {
+		return xml.Name{}, false
+	}
+	space, local, ok := strings.Cut(rest, "}")
+	if !ok || local == "" {
+		return xml.Name{}, false
+	}
+	return xml.Name{Space: space, Local: local}, true
+}
+
+// deadProps returns the names of the dead properties stored on p.
+func deadProps(fs vfs.FileSystem, p string) []xml.Name {
+	xfs, ok := fs.(vfs.XattrFS)
+	if !ok {
+		return nil
+	}
+	attrs, err := xfs.Listxattr(p)
+	if err != nil {
+		return nil
+	}
+	var names []xml.Name
+	for _, attr := range attrs {
+		if name, ok := propName(attr); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// copyProps copies the dead properties of src to dst. Failures are
+// ignored, as the properties are not essential to the copy.
+func copyProps(fs vfs.FileSystem, src, dst string) {
+	xfs, ok := fs.(vfs.XattrFS)
+	if !ok {
+		return
+	}
+	for _, name := range deadProps(fs, src) {
+		if value, err := xfs.Getxattr(src, xattrName(name)); err == nil {
+			xfs.Setxattr(dst, xattrName(name), value, 0)
+		}
+	}
+}
+
+// propstat groups properties of a resource by status.
+type propstat struct {
+	status int
+	props  []string // Rendered property elements
+}
+
+// multistatus renders a 207 Multi-Status response.
+type multistatus struct {
+	buf bytes.Buffer
+}
+
+func newMultistatus() *multistatus {
+	m := &multistatus{}
+	m.buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	m.buf.WriteString(`<D:multistatus xmlns:D="DAV:">`)
+	return m
+}
+
+// add appends a response for href with its property groups.
+func (m *multistatus) add(href string, stats []propstat) {
+	m.buf.WriteString("<D:response><D:href>")
+	xml.EscapeText(&m.buf, []byte(href))
+	m.buf.WriteString("</D:href>")
+	for _, stat := range stats {
+		if len(stat.props) == 0 {
+			continue
+		}
+		m.buf.WriteString("<D:propstat><D:prop>")
+		for _, prop := range stat.props {
+			m.buf.WriteString(prop)
+		}
+		fmt.Fprintf(&m.buf, "</D:prop><D:status>HTTP/1.1 %d %s</D:status></D:propstat>",
+			stat.status, http.StatusText(stat.status))
+	}
+	m.buf.WriteString("</D:response>")
+}
+
+// write sends the response.
+func (m *multistatus) write(w http.ResponseWriter) {
+	m.buf.WriteString("</D:multistatus>\n")
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write(m.buf.Bytes())
+}
+
+// element renders a property element with raw inner XML.
+func element(name xml.Name, inner string) string {
+	var b strings.Builder
+	if name.Space == "DAV:" {
+		fmt.Fprintf(&b, "<D:%s>%s</D:%s>", name.Local, inner, name.Local)
+		return b.String()
+	}
+	b.WriteString("<")
+	b.WriteString(name.Local)
+	b.WriteString(` xmlns="`)
+	xml.EscapeText(&b, []byte(name.Space))
+	fmt.Fprintf(&b, `">%s</%s>`, inner, name.Local)
+	return b.String()
+}
+
+// escape escapes text for XML content.
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// liveValue renders the value of a live property of the resource at p,
+// and false if the resource does not have it.
+func (h *Handler) liveValue(r *request, p string, info vfs.FileInfo, name string) (string, bool) {
+	switch name {
+	case "resourcetype":
+		if info.IsDir {
+			return "<D:collection/>", true
+		}
+		return "", true
+	case "displayname":
+		if p == "/" {
+			return "", true
+		}
+		return escape(vfs.Base(p)), true
+	case "getlastmodified":
+		return info.ModTime.UTC().Format(http.TimeFormat), true
+	case "supportedlock":
+		return "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>" +
+			"<D:lockentry><D:lockscope><D:shared/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>", true
+	case "lockdiscovery":
+		return h.lockDiscovery(r.locks.covering(p)), true
+	}
+	if info.IsDir {
+		return "", false
+	}
+	switch name {
+	case "getcontentlength":
+		return fmt.Sprint(info.Size), true
+	case "getcontenttype":
+		return escape(contentType(p)), true
+	case "getetag":
+		return escape(etag(info)), true
+	}
+	return "", false
+}
+
+// liveNames lists the live properties of a resource.
+func liveNames(info vfs.FileInfo) []string {
+	names := []string{"resourcetype", "displayname", "getlastmodified", "supportedlock", "lockdiscovery"}
+	if !info.IsDir {
+		names = append(names, "getcontentlength", "getcontenttype", "getetag")
+	}
+	return names
+}
+
+// handlePropfind reports properties of a resource and, depending on the
+// Depth header, its members.
+func (h *Handler) handlePropfind(w http.ResponseWriter, r *request) int {
+	info, err := r.fs.Stat(r.path)
+	if err != nil {
+		return status(err)
+	}
+
+	var body propfindBody
+	empty, err := readXML(r, &body)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	if !empty && body.Allprop == nil && body.Propname == nil && body.Prop == nil {
+		return http.StatusBadRequest
+	}
+
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" && depth != "" && !strings.EqualFold(depth, "infinity") {
+		return http.StatusBadRequest
+	}
+
+	ms := newMultistatus()
+	var visit func(p string, info vfs.FileInfo, level int) error
+	visit = func(p string, info vfs.FileInfo, level int) error {
+		var stats []propstat
+		switch {
+		case body.Propname != nil:
+			stats = h.propNames(r, p, info)
+		case body.Prop != nil:
+			stats = h.findProps(r, p, info, body.Prop.Props)
+		default:
+			stats = h.allProps(r, p, info)
+		}
+		ms.add(h.href(p, info.IsDir), stats)
+
+		if !info.IsDir || depth == "0" || (depth == "1" && level == 1) {
+			return nil
+		}
+		entries, err := r.fs.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			child := vfs.Join(p, entry.Name())
+			childInfo, err := r.fs.Stat(child)
+			if err != nil {
+				// Dangling symlinks are described themselves
+				if childInfo, err = r.fs.Lstat(child); err != nil {
+					continue
+				}
+			}
+			if err := visit(child, childInfo, level+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(r.path, info, 0); err != nil {
+		return status(err)
+	}
+
+	ms.write(w)
+	return 0
+}
+
+// allProps renders every live and dead property of a resource.
+func (h *Handler) allProps(r *request, p string, info vfs.FileInfo) []propstat {
+	ok := propstat{status: http.StatusOK}
+	for _, name := range liveNames(info) {
+		value, _ := h.liveValue(r, p, info, name)
+		ok.props = append(ok.props, element(xml.Name{Space: "DAV:", Local: name}, value))
+	}
+	if xfs, isXattr := r.fs.(vfs.XattrFS); isXattr {
+		for _, name := range deadProps(r.fs, p) {
+			if value, err := xfs.Getxattr(p, xattrName(name)); err == nil {
+				ok.props = append(ok.props, element(name, string(value)))
+			}
+		}
+	}
+	return []propstat{ok}
+}
+
+// propNames renders the names of every property of a resource.
+func (h *Handler) propNames(r *request, p string, info vfs.FileInfo) []propstat {
+	ok := propstat{status: http.StatusOK}
+	for _, name := range liveNames(info) {
+		ok.props = append(ok.props, element(xml.Name{Space: "DAV:", Local: name}, ""))
+	}
+	for _, name := range deadProps(r.fs, p) {
+		ok.props = append(ok.props, element(name, ""))
+	}
+	return []propstat{ok}
+}
+
+// findProps renders the requested properties of a resource, reporting
+// missing ones as not found.
+func (h *Handler) findProps(r *request, p string, info vfs.FileInfo, props []property) []propstat {
+	ok := propstat{status: http.StatusOK}
+	missing := propstat{status: http.StatusNotFound}
+	xfs, isXattr := r.fs.(vfs.XattrFS)
+
+	for _, prop := range props {
+		name := prop.XMLName
+		if name.Space == "DAV:" {
+			if value, found := h.liveValue(r, p, info, name.Local); found {
+				ok.props = append(ok.props, element(name, value))
+				continue
+			}
+		}
+		if isXattr {
+			if value, err := xfs.Getxattr(p, xattrName(name)); err == nil {
+				ok.props = append(ok.props, element(name, string(value)))
+				continue
+			}
+		}
+		missing.props = append(missing.props, element(name, ""))
+	}
+	return []propstat{ok, missing}
+}
+
+// handleProppatch sets and removes dead properties. Either every change
+// is made or none is.
+func (h *Handler) handleProppatch(w http.ResponseWriter, r *request) int {
+	if code := r.checkLocks(r.path, false); code != 0 {
+		return code
+	}
+	info, err := r.fs.Stat(r.path)
+	if err != nil {
+		return status(err)
+	}
+
+	var body propertyUpdateBody
+	if empty, err := readXML(r, &body); err != nil || empty {
+		return http.StatusBadRequest
+	}
+
+	// Check every change before making any
+	xfs, isXattr := r.fs.(vfs.XattrFS)
+	failed := propstat{status: http.StatusForbidden}
+	var names []xml.Name
+	for _, op := range body.Ops {
+		if op.XMLName.Space != "DAV:" || (op.XMLName.Local != "set" && op.XMLName.Local != "remove") {
+			return http.StatusBadRequest
+		}
+		for _, prop := range op.Prop.Props {
+			names = append(names, prop.XMLName)
+			if isLive(prop.XMLName) || !isXattr {
+				failed.props = append(failed.props, element(prop.XMLName, ""))
+			}
+		}
+	}
+
+	ms := newMultistatus()
+	href := h.href(r.path, info.IsDir)
+	if len(failed.props) > 0 {
+		dependency := propstat{status: http.StatusFailedDependency}
+		for _, name := range names {
+			if !isLive(name) && isXattr {
+				dependency.props = append(dependency.props, element(name, ""))
+			}
+		}
+		ms.add(href, []propstat{failed, dependency})
+		ms.write(w)
+		return 0
+	}
+
+	for _, op := range body.Ops {
+		for _, prop := range op.Prop.Props {
+			name := xattrName(prop.XMLName)
+			if op.XMLName.Local == "set" {
+				err = xfs.Setxattr(r.path, name, prop.Inner, 0)
+			} else if err = xfs.Removexattr(r.path, name); errors.Is(err, vfs.ErrNoAttr) {
+				err = nil
+			}
+			if err != nil {
+				return status(err)
+			}
+		}
+	}
+
+	ok := propstat{status: http.StatusOK}
+	for _, name := range names {
+		ok.props = append(ok.props, element(name, ""))
+	}
+	ms.add(href, []propstat{ok})
+	ms.write(w)
+	return 0
+}
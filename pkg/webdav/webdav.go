@@ -0,0 +1,544 @@
+package webdav
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"webos/pkg/auth"
+	"webos/pkg/router"
+	"webos/pkg/vfs"
+)
+
+// SessionCookie is the cookie carrying a session token.
+const SessionCookie = "webos_session"
+
+// Methods lists the HTTP methods served.
+var Methods = []string{
+	http.MethodOptions, http.MethodGet, http.MethodHead, http.MethodPut,
+	http.MethodDelete, "MKCOL", "COPY", "MOVE", "PROPFIND", "PROPPATCH",
+	"LOCK", "UNLOCK",
+}
+
+// FileSystemFunc returns the filesystem served to an authenticated user.
+type FileSystemFunc func(user *auth.User) (vfs.FileSystem, error)
+
+// LockNamespaceFunc returns the namespace holding the locks that apply to
+// a user's requests. Users served the same files must share a namespace so
+// that their locks conflict.
+type LockNamespaceFunc func(user *auth.User) string
+
+// Handler serves WebDAV requests.
+type Handler struct {
+	prefix string
+	auth   *auth.Authenticator
+	fs     FileSystemFunc
+
+	// Session tokens by a digest of Basic credentials
+	basic sync.Map
+
+	// Lock systems by namespace, or by user ID without a namespace func
+	namespace LockNamespaceFunc
+	locks     sync.Map
+}
+
+// New creates a handler serving the filesystem returned by fs for each
+// user below the URL path prefix, such as "/dav".
+func New(prefix string, authenticator *auth.Authenticator, fs FileSystemFunc) *Handler {
+	return &Handler{
+		prefix: strings.TrimSuffix(prefix, "/"),
+		auth:   authenticator,
+		fs:     fs,
+	}
+}
+
+// SetLockNamespace keeps locks in the namespaces fn returns. By default
+// each user has their own namespace, so users served a shared filesystem
+// need a namespace func for their locks to conflict. It must be called
+// before serving requests.
+func (h *Handler) SetLockNamespace(fn LockNamespaceFunc) {
+	h.namespace = fn
+}
+
+// lockSystem returns the lock system for a user's requests.
+func (h *Handler) lockSystem(user *auth.User) *lockSystem {
+	key := user.ID
+	if h.namespace != nil {
+		key = h.namespace(user)
+	}
+	if locks, ok := h.locks.Load(key); ok {
+		return locks.(*lockSystem)
+	}
+	locks, _ := h.locks.LoadOrStore(key, newLockSystem())
+	return locks.(*lockSystem)
+}
+
+// Register adds routes for every method in Methods under the handler's
+// prefix to r.
+func (h *Handler) Register(r *router.Router) {
+	for _, method := range Methods {
+		if h.prefix != "" {
+			r.AddRoute(method, h.prefix, h)
+		}
+		r.AddRoute(method, h.prefix+"/*", h)
+	}
+}
+
+// request is a request being served.
+type request struct {
+	*http.Request
+	user  *auth.User
+	fs    vfs.FileSystem
+	path  string // Path within the filesystem
+	locks *lockSystem
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, err := h.authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="webos", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	p, ok := h.path(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	fs, err := h.fs(user)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	req := &request{Request: r, user: user, fs: fs, path: p, locks: h.lockSystem(user)}
+
+	var status int
+	switch r.Method {
+	case http.MethodOptions:
+		status = h.handleOptions(w, req)
+	case http.MethodGet, http.MethodHead:
+		status = h.handleGet(w, req)
+	case http.MethodPut:
+		status = h.handlePut(w, req)
+	case http.MethodDelete:
+		status = h.handleDelete(w, req)
+	case "MKCOL":
+		status = h.handleMkcol(w, req)
+	case "COPY", "MOVE":
+		status = h.handleCopyMove(w, req)
+	case "PROPFIND":
+		status = h.handlePropfind(w, req)
+	case "PROPPATCH":
+		status = h.handleProppatch(w, req)
+	case "LOCK":
+		status = h.handleLock(w, req)
+	case "UNLOCK":
+		status = h.handleUnlock(w, req)
+	default:
+		status = http.StatusMethodNotAllowed
+	}
+
+	// Handlers that wrote a response return 0
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+// authenticate returns the user whose session the request carries.
+func (h *Handler) authenticate(r *http.Request) (*auth.User, error) {
+	var session *auth.Session
+	var err error
+
+	authorization := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(authorization, "Bearer "); ok {
+		session, err = h.auth.ValidateSession(token)
+	} else if username, password, ok := r.BasicAuth(); ok {
+		session, err = h.basicSession(username, password)
+	} else if cookie, cookieErr := r.Cookie(SessionCookie); cookieErr == nil {
+		session, err = h.auth.ValidateSession(cookie.Value)
+	} else {
+		return nil, auth.ErrSessionRequired
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user := h.auth.GetUserByID(session.UserID)
+	if user == nil || !user.Active {
+		return nil, auth.ErrUserNotFound
+	}
+	return user, nil
+}
+
+// basicSession returns a session for Basic credentials, logging in when
+// no session for them is still valid.
+func (h *Handler) basicSession(username, password string) (*auth.Session, error) {
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	if token, ok := h.basic.Load(key); ok {
+		if session, err := h.auth.ValidateSession(token.(string)); err == nil {
+			return session, nil
+		}
+		h.basic.Delete(key)
+	}
+
+	session, err := h.auth.Authenticate(username, password)
+	if err != nil {
+		return nil, err
+	}
+	h.basic.Store(key, session.Token)
+	return session, nil
+}
+
+// path returns the filesystem path for a URL path, and false if it is
+// outside the prefix.
+func (h *Handler) path(urlPath string) (string, bool) {
+	rest, ok := strings.CutPrefix(urlPath, h.prefix)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return "", false
+	}
+	return vfs.Clean(rest), true
+}
+
+// href returns the escaped URL path for a filesystem path.
+func (h *Handler) href(p string, dir bool) string {
+	href := h.prefix + p
+	if dir && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+	return (&url.URL{Path: href}).EscapedPath()
+}
+
+// status maps a filesystem error to an HTTP status.
+func status(err error) int {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, os.ErrExist):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, os.ErrPermission), errors.Is(err, vfs.ErrPermissionDenied),
+		errors.Is(err, vfs.ErrReadOnlyFS):
+		return http.StatusForbidden
+	case errors.Is(err, vfs.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, syscall.ENOTDIR):
+		return http.StatusConflict
+	case errors.Is(err, vfs.ErrInvalidPath), errors.Is(err, vfs.ErrPathTooLong):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// etag returns the entity tag of a file, derived from its modification
+// time and size.
+func etag(info vfs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime.UnixNano(), info.Size)
+}
+
+// contentType returns the MIME type of a file, guessed from its name.
+func contentType(name string) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// parentExists reports whether the directory containing p exists.
+func parentExists(fs vfs.FileSystem, p string) bool {
+	info, err := fs.Stat(vfs.Dir(p))
+	return err == nil && info.IsDir
+}
+
+func (h *Handler) handleOptions(w http.ResponseWriter, r *request) int {
+	w.Header().Set("Allow", strings.Join(Methods, ", "))
+	w.Header().Set("DAV", "1, 2")
+	w.Header().Set("MS-Author-Via", "DAV")
+	w.WriteHeader(http.StatusOK)
+	return 0
+}
+
+// handleGet serves a file, or a listing of a collection for browsers.
+func (h *Handler) handleGet(w http.ResponseWriter, r *request) int {
+	info, err := r.fs.Stat(r.path)
+	if err != nil {
+		return status(err)
+	}
+
+	if info.IsDir {
+		entries, err := r.fs.ReadDir(r.path)
+		if err != nil {
+			return status(err)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodHead {
+			return 0
+		}
+		fmt.Fprintf(w, "<!doctype html>\n<title>%s</title>\n<ul>\n", html.EscapeString(r.path))
+		for _, entry := range entries {
+			href := h.href(vfs.Join(r.path, entry.Name()), entry.IsDir())
+			fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(entry.Name()))
+		}
+		fmt.Fprint(w, "</ul>\n")
+		return 0
+	}
+
+	file, err := r.fs.Open(r.path)
+	if err != nil {
+		return status(err)
+	}
+	defer file.Close()
+
+	w.Header().Set("ETag", etag(info))
+	w.Header().Set("Content-Type", contentType(r.path))
+	http.ServeContent(w, r.Request, info.Name, info.ModTime, file)
+	return 0
+}
+
+// handlePut creates or replaces a file with the request body.
+func (h *Handler) handlePut(w http.ResponseWriter, r *request) int {
+	if code := r.checkLocks(r.path, false); code != 0 {
+		return code
+	}
+
+	info, err := r.fs.Stat(r.path)
+	created := err != nil
+	if err == nil && info.IsDir {
+		return http.StatusMethodNotAllowed
+	}
+	if created && !parentExists(r.fs, r.path) {
+		return http.StatusConflict
+	}
+
+	file, err := r.fs.OpenFile(r.path, vfs.O_WRONLY|vfs.O_CREATE|vfs.O_TRUNC, 0644)
+	if err != nil {
+		return status(err)
+	}
+	_, copyErr := io.Copy(file, r.Body)
+	closeErr := file.Close()
+	if copyErr != nil {
+		return status(copyErr)
+	}
+	if closeErr != nil {
+		return status(closeErr)
+	}
+
+	if info, err := r.fs.Stat(r.path); err == nil {
+		w.Header().Set("ETag", etag(info))
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return 0
+}
+
+// handleDelete removes a file or collection.
+func (h *Handler) handleDelete(w http.ResponseWriter, r *request) int {
+	if r.path == "/" {
+		return http.StatusForbidden
+	}
+	if code := r.checkLocks(r.path, true); code != 0 {
+		return code
+	}
+	if _, err := r.fs.Lstat(r.path); err != nil {
+		return status(err)
+	}
+	if err := r.fs.RemoveAll(r.path); err != nil {
+		return status(err)
+	}
+
+	r.locks.removeTree(r.path)
+	w.WriteHeader(http.StatusNoContent)
+	return 0
+}
+
+// handleMkcol creates a collection.
+func (h *Handler) handleMkcol(w http.ResponseWriter, r *request) int {
+	if r.ContentLength > 0 {
+		return http.StatusUnsupportedMediaType
+	}
+	if code := r.checkLocks(r.path, false); code != 0 {
+		return code
+	}
+	if _, err := r.fs.Lstat(r.path); err == nil {
+		return http.StatusMethodNotAllowed
+	}
+	if !parentExists(r.fs, r.path) {
+		return http.StatusConflict
+	}
+	if err := r.fs.Mkdir(r.path, 0755); err != nil {
+		return status(err)
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	return 0
+}
+
+// handleCopyMove copies or moves a resource to the Destination header.
+func (h *Handler) handleCopyMove(w http.ResponseWriter, r *request) int {
+	dest, code := h.destination(r)
+	if code != 0 {
+		return code
+	}
+	if dest == r.path || hasPathPrefix(dest, r.path) {
+		return http.StatusForbidden
+	}
+
+	move := r.Method == "MOVE"
+	if move {
+		if code := r.checkLocks(r.path, true); code != 0 {
+			return code
+		}
+	}
+	if code := r.checkLocks(dest, true); code != 0 {
+		return code
+	}
+
+	info, err := r.fs.Lstat(r.path)
+	if err != nil {
+		return status(err)
+	}
+
+	depth := r.Header.Get("Depth")
+	switch {
+	case depth == "" || strings.EqualFold(depth, "infinity"):
+		depth = "infinity"
+	case depth == "0" && !move:
+	default:
+		return http.StatusBadRequest
+	}
+
+	if !parentExists(r.fs, dest) {
+		return http.StatusConflict
+	}
+	_, err = r.fs.Lstat(dest)
+	exists := err == nil
+	if exists {
+		if r.Header.Get("Overwrite") == "F" {
+			return http.StatusPreconditionFailed
+		}
+		if err := r.fs.RemoveAll(dest); err != nil {
+			return status(err)
+		}
+		r.locks.removeTree(dest)
+	}
+
+	if move {
+		err = r.fs.Rename(r.path, dest)
+		if err == nil {
+			r.locks.removeTree(r.path)
+		}
+	} else {
+		err = copyTree(r.fs, r.path, dest, info, depth == "infinity")
+	}
+	if err != nil {
+		return status(err)
+	}
+
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return 0
+}
+
+// destination returns the filesystem path named by the Destination
+// header.
+func (h *Handler) destination(r *request) (string, int) {
+	header := r.Header.Get("Destination")
+	if header == "" {
+		return "", http.StatusBadRequest
+	}
+	u, err := url.Parse(header)
+	if err != nil {
+		return "", http.StatusBadRequest
+	}
+	if u.Host != "" && u.Host != r.Host {
+		return "", http.StatusBadGateway
+	}
+	dest, ok := h.path(u.Path)
+	if !ok {
+		return "", http.StatusBadGateway
+	}
+	return dest, 0
+}
+
+// hasPathPrefix reports whether p is below dir.
+func hasPathPrefix(p, dir string) bool {
+	return dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// copyTree copies the resource at src to dst, including the members of a
+// collection when recursive is set, and its dead properties.
+func copyTree(fs vfs.FileSystem, src, dst string, info vfs.FileInfo, recursive bool) error {
+	switch {
+	case info.Mode&os.ModeSymlink != 0:
+		target, err := fs.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return fs.Symlink(target, dst)
+	case info.IsDir:
+		if err := fs.Mkdir(dst, info.Mode.Perm()); err != nil {
+			return err
+		}
+	default:
+		if err := copyFile(fs, src, dst, info); err != nil {
+			return err
+		}
+	}
+	copyProps(fs, src, dst)
+
+	if !info.IsDir || !recursive {
+		return nil
+	}
+	entries, err := fs.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		child, err := fs.Lstat(vfs.Join(src, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := copyTree(fs, vfs.Join(src, entry.Name()), vfs.Join(dst, entry.Name()), child, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the contents of a file.
+func copyFile(fs vfs.FileSystem, src, dst string, info vfs.FileInfo) error {
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fs.OpenFile(dst, vfs.O_WRONLY|vfs.O_CREATE|vfs.O_TRUNC, info.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,344 @@
+package webdav
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"webos/pkg/auth"
+	"webos/pkg/router"
+	"webos/pkg/vfs"
+	"webos/pkg/vfs/memfs"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, *memfs.FS, string) {
+	t.Helper()
+	a := auth.NewAuthenticator()
+	if _, err := a.RegisterUser("u1", "alice", "alice@example.com", "Secret#Pass123"); err != nil {
+		t.Fatalf("RegisterUser failed: %v", err)
+	}
+	session, err := a.Authenticate("alice", "Secret#Pass123")
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+
+	fs := memfs.New()
+	h := New("/dav", a, func(*auth.User) (vfs.FileSystem, error) { return fs, nil })
+	r := router.New()
+	h.Register(r)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv, fs, session.Token
+}
+
+func do(t *testing.T, srv *httptest.Server, token, method, path, body string, header map[string]string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp, string(data)
+}
+
+func TestAuthentication(t *testing.T) {
+	srv, _, token := newTestServer(t)
+
+	resp, _ := do(t, srv, "", "PROPFIND", "/dav/", "", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unauthenticated status = %d, want 401", resp.StatusCode)
+	}
+	if resp.Header.Get("WWW-Authenticate") == "" {
+		t.Error("expected WWW-Authenticate header")
+	}
+
+	resp, _ = do(t, srv, "bogus", "GET", "/dav/", "", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("bad token status = %d, want 401", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/dav/", nil)
+	req.SetBasicAuth("alice", "Secret#Pass123")
+	basic, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	basic.Body.Close()
+	if basic.StatusCode != http.StatusOK {
+		t.Errorf("basic auth status = %d, want 200", basic.StatusCode)
+	}
+
+	req, _ = http.NewRequest("GET", srv.URL+"/dav/", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: token})
+	cookie, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	cookie.Body.Close()
+	if cookie.StatusCode != http.StatusOK {
+		t.Errorf("cookie status = %d, want 200", cookie.StatusCode)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	srv, fs, token := newTestServer(t)
+
+	resp, _ := do(t, srv, token, "MKCOL", "/dav/docs", "", nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("MKCOL status = %d, want 201", resp.StatusCode)
+	}
+	resp, _ = do(t, srv, token, "MKCOL", "/dav/a/b", "", nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("MKCOL without parent status = %d, want 409", resp.StatusCode)
+	}
+
+	resp, _ = do(t, srv, token, "PUT", "/dav/docs/hello.txt", "hello world", nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT status = %d, want 201", resp.StatusCode)
+	}
+	resp, _ = do(t, srv, token, "PUT", "/dav/docs/hello.txt", "hello again", nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("PUT overwrite status = %d, want 204", resp.StatusCode)
+	}
+	resp, body := do(t, srv, token, "GET", "/dav/docs/hello.txt", "", nil)
+	if resp.StatusCode != http.StatusOK || body != "hello again" {
+		t.Errorf("GET = %d %q, want 200 %q", resp.StatusCode, body, "hello again")
+	}
+
+	resp, _ = do(t, srv, token, "COPY", "/dav/docs", "", map[string]string{"Destination": srv.URL + "/dav/copy"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("COPY status = %d, want 201", resp.StatusCode)
+	}
+	if data, err := fs.ReadFile("/copy/hello.txt"); err != nil || string(data) != "hello again" {
+		t.Errorf("copied file = %q, %v", data, err)
+	}
+
+	resp, _ = do(t, srv, token, "MOVE", "/dav/copy/hello.txt", "", map[string]string{
+		"Destination": "/dav/docs/hello.txt",
+		"Overwrite":   "F",
+	})
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("MOVE without overwrite status = %d, want 412", resp.StatusCode)
+	}
+	resp, _ = do(t, srv, token, "MOVE", "/dav/copy/hello.txt", "", map[string]string{"Destination": "/dav/moved.txt"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("MOVE status = %d, want 201", resp.StatusCode)
+	}
+	if _, err := fs.Stat("/copy/hello.txt"); err == nil {
+		t.Error("moved file still exists")
+	}
+
+	resp, _ = do(t, srv, token, "DELETE", "/dav/copy", "", nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE status = %d, want 204", resp.StatusCode)
+	}
+	resp, _ = do(t, srv, token, "GET", "/dav/copy", "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET deleted status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestPropfind(t *testing.T) {
+	srv, fs, token := newTestServer(t)
+	fs.MkdirAll("/docs/sub", 0755)
+	fs.WriteFile("/docs/a.txt", []byte("abc"), 0644)
+	fs.WriteFile("/docs/sub/deep.txt", []byte("x"), 0644)
+
+	resp, body := do(t, srv, token, "PROPFIND", "/dav/docs", "", map[string]string{"Depth": "1"})
+	if resp.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND status = %d, want 207", resp.StatusCode)
+	}
+	for _, want := range []string{
+		"<D:href>/dav/docs/</D:href>",
+		"<D:href>/dav/docs/a.txt</D:href>",
+		"<D:href>/dav/docs/sub/</D:href>",
+		"<D:getcontentlength>3</D:getcontentlength>",
+		"<D:collection/>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("PROPFIND response missing %s:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "deep.txt") {
+		t.Error("Depth 1 PROPFIND listed a grandchild")
+	}
+
+	propfind := `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/><D:nonexistent/></D:prop></D:propfind>`
+	resp, body = do(t, srv, token, "PROPFIND", "/dav/docs/a.txt", propfind, map[string]string{"Depth": "0"})
+	if resp.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND status = %d, want 207", resp.StatusCode)
+	}
+	if !strings.Contains(body, "HTTP/1.1 404 Not Found") || !strings.Contains(body, "<D:nonexistent>") {
+		t.Errorf("expected missing property to be reported as 404:\n%s", body)
+	}
+
+	resp, _ = do(t, srv, token, "PROPFIND", "/dav/missing", "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("PROPFIND missing status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestProppatch(t *testing.T) {
+	srv, fs, token := newTestServer(t)
+	fs.WriteFile("/a.txt", []byte("abc"), 0644)
+
+	patch := `<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:example">` +
+		`<D:set><D:prop><Z:author>Alice</Z:author></D:prop></D:set></D:propertyupdate>`
+	resp, body := do(t, srv, token, "PROPPATCH", "/dav/a.txt", patch, nil)
+	if resp.StatusCode != http.StatusMultiStatus || !strings.Contains(body, "HTTP/1.1 200 OK") {
+		t.Fatalf("PROPPATCH = %d:\n%s", resp.StatusCode, body)
+	}
+
+	propfind := `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><Z:author xmlns:Z="urn:example"/></D:prop></D:propfind>`
+	_, body = do(t, srv, token, "PROPFIND", "/dav/a.txt", propfind, map[string]string{"Depth": "0"})
+	if !strings.Contains(body, `<author xmlns="urn:example">Alice</author>`) {
+		t.Errorf("dead property not returned:\n%s", body)
+	}
+
+	live := `<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:">` +
+		`<D:set><D:prop><D:getcontentlength>9</D:getcontentlength></D:prop></D:set></D:propertyupdate>`
+	_, body = do(t, srv, token, "PROPPATCH", "/dav/a.txt", live, nil)
+	if !strings.Contains(body, "HTTP/1.1 403 Forbidden") {
+		t.Errorf("expected live property to be protected:\n%s", body)
+	}
+}
+
+func TestLock(t *testing.T) {
+	srv, _, token := newTestServer(t)
+
+	lockinfo := `<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope>` +
+		`<D:locktype><D:write/></D:locktype><D:owner><D:href>alice</D:href></D:owner></D:lockinfo>`
+	resp, body := do(t, srv, token, "LOCK", "/dav/locked.txt", lockinfo, map[string]string{"Timeout": "Second-600"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("LOCK status = %d, want 201", resp.StatusCode)
+	}
+	lockToken := resp.Header.Get("Lock-Token")
+	if !strings.HasPrefix(lockToken, "<opaquelocktoken:") {
+		t.Fatalf("Lock-Token = %q", lockToken)
+	}
+	if !strings.Contains(body, "<D:timeout>Second-600</D:timeout>") {
+		t.Errorf("LOCK response missing timeout:\n%s", body)
+	}
+
+	resp, _ = do(t, srv, token, "LOCK", "/dav/locked.txt", lockinfo, nil)
+	if resp.StatusCode != http.StatusLocked {
+		t.Errorf("conflicting LOCK status = %d, want 423", resp.StatusCode)
+	}
+	resp, _ = do(t, srv, token, "PUT", "/dav/locked.txt", "data", nil)
+	if resp.StatusCode != http.StatusLocked {
+		t.Errorf("PUT without token status = %d, want 423", resp.StatusCode)
+	}
+	resp, _ = do(t, srv, token, "PUT", "/dav/locked.txt", "data", map[string]string{"If": "(" + lockToken + ")"})
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("PUT with token status = %d, want 204", resp.StatusCode)
+	}
+
+	resp, _ = do(t, srv, token, "LOCK", "/dav/locked.txt", "", map[string]string{"If": "(" + lockToken + ")"})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("LOCK refresh status = %d, want 200", resp.StatusCode)
+	}
+
+	resp, _ = do(t, srv, token, "UNLOCK", "/dav/locked.txt", "", map[string]string{"Lock-Token": lockToken})
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("UNLOCK status = %d, want 204", resp.StatusCode)
+	}
+	resp, _ = do(t, srv, token, "UNLOCK", "/dav/locked.txt", "", map[string]string{"Lock-Token": lockToken})
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("second UNLOCK status = %d, want 409", resp.StatusCode)
+	}
+	resp, _ = do(t, srv, token, "DELETE", "/dav/locked.txt", "", nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE after UNLOCK status = %d, want 204", resp.StatusCode)
+	}
+}
+
+// wrappedFS is a new value for each request, as filesystems wrapped per
+// user are.
+type wrappedFS struct {
+	vfs.FileSystem
+}
+
+func TestLockNamespace(t *testing.T) {
+	a := auth.NewAuthenticator()
+	var tokens []string
+	for _, u := range []struct{ id, name string }{{"u1", "alice"}, {"u2", "bob"}} {
+		if _, err := a.RegisterUser(u.id, u.name, u.name+"@example.com", "Secret#Pass123"); err != nil {
+			t.Fatalf("RegisterUser failed: %v", err)
+		}
+		session, err := a.Authenticate(u.name, "Secret#Pass123")
+		if err != nil {
+			t.Fatalf("Authenticate failed: %v", err)
+		}
+		tokens = append(tokens, session.Token)
+	}
+	alice, bob := tokens[0], tokens[1]
+
+	lockinfo := `<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope>` +
+		`<D:locktype><D:write/></D:locktype></D:lockinfo>`
+	shared := memfs.New()
+	serve := func(h *Handler) *httptest.Server {
+		r := router.New()
+		h.Register(r)
+		return httptest.NewServer(r)
+	}
+	wrap := func(*auth.User) (vfs.FileSystem, error) { return &wrappedFS{shared}, nil }
+
+	// By default each user has their own locks, which last across requests
+	// to filesystems wrapped anew each time
+	h := New("/dav", a, wrap)
+	srv := serve(h)
+	resp, _ := do(t, srv, alice, "LOCK", "/dav/own.txt", lockinfo, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("LOCK status = %d, want 201", resp.StatusCode)
+	}
+	if resp, _ := do(t, srv, alice, "PUT", "/dav/own.txt", "data", nil); resp.StatusCode != http.StatusLocked {
+		t.Errorf("PUT without token status = %d, want 423", resp.StatusCode)
+	}
+	namespaces := 0
+	h.locks.Range(func(any, any) bool { namespaces++; return true })
+	if namespaces != 1 {
+		t.Errorf("handler holds %d lock namespaces, want 1", namespaces)
+	}
+	srv.Close()
+
+	// Users sharing a namespace share locks
+	h = New("/dav", a, wrap)
+	h.SetLockNamespace(func(*auth.User) string { return "shared" })
+	srv = serve(h)
+	defer srv.Close()
+
+	path := "/dav/shared.txt"
+	resp, _ = do(t, srv, alice, "LOCK", path, lockinfo, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("LOCK status = %d, want 201", resp.StatusCode)
+	}
+	lockToken := resp.Header.Get("Lock-Token")
+	withToken := map[string]string{"If": "(" + lockToken + ")"}
+
+	// Another user can neither take the lock nor use its token
+	if resp, _ := do(t, srv, bob, "LOCK", path, lockinfo, nil); resp.StatusCode != http.StatusLocked {
+		t.Errorf("other user's LOCK status = %d, want 423", resp.StatusCode)
+	}
+	if resp, _ := do(t, srv, bob, "PUT", path, "data", withToken); resp.StatusCode != http.StatusLocked {
+		t.Errorf("other user's PUT with token status = %d, want 423", resp.StatusCode)
+	}
+	if resp, _ := do(t, srv, bob, "UNLOCK", path, "", map[string]string{"Lock-Token": lockToken}); resp.StatusCode != http.StatusConflict {
+		t.Errorf("other user's UNLOCK status = %d, want 409", resp.StatusCode)
+	}
+	if resp, _ := do(t, srv, alice, "PUT", path, "data", withToken); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("PUT with token status = %d, want 204", resp.StatusCode)
+	}
+}
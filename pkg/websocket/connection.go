@@ -28,8 +28,10 @@ type Connection struct {
 	CreatedAt time.Time
 	// LastPing is the time of the last ping.
 	LastPing time.Time
-	// mu protects concurrent access to the connection.
+	// mu protects concurrent access to the connection and serializes writes.
 	mu sync.Mutex
+	// readMu serializes reads, so that writes need not wait for one.
+	readMu sync.Mutex
 
 	// reader is the frame reader.
 	reader *FrameReader
@@ -99,19 +101,28 @@ func (c *Connection) OnMessage(fn func(*Connection, *protocol.Message) error) {
 
 // ReadFrame reads a frame from the connection.
 func (c *Connection) ReadFrame() (*Frame, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
 
-	// Set read deadline
-	if c.readTimeout > 0 {
-		if err := c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
-			return nil, err
-		}
+	if err := c.setReadDeadline(); err != nil {
+		return nil, err
 	}
 
 	return c.reader.ReadFrame()
 }
 
+// setReadDeadline applies the read timeout to the next read.
+func (c *Connection) setReadDeadline() error {
+	c.mu.Lock()
+	timeout := c.readTimeout
+	c.mu.Unlock()
+
+	if timeout > 0 {
+		return c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	return nil
+}
+
 // WriteFrame writes a frame to the connection.
 func (c *Connection) WriteFrame(frame *Frame) error {
 	c.mu.Lock()
@@ -259,18 +270,8 @@ func CloseReason(payload []byte) string {
 
 // ReadMessage reads a complete protocol message from the connection.
 func (c *Connection) ReadMessage() (*protocol.Message, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	// Set read deadline
-	if c.readTimeout > 0 {
-		if err := c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
-			return nil, err
-		}
-	}
-
 	// Read frame
-	frame, err := c.reader.ReadFrame()
+	frame, err := c.ReadFrame()
 	if err != nil {
 		return nil, err
 	}
@@ -280,10 +281,12 @@ func (c *Connection) ReadMessage() (*protocol.Message, error) {
 	case OpcodeClose:
 		return nil, ErrConnectionClosed
 	case OpcodePing:
-		c.writer.WritePong(frame.Payload)
+		c.WritePong(frame.Payload)
 		return nil, nil
 	case OpcodePong:
+		c.mu.Lock()
 		c.LastPing = time.Now()
+		c.mu.Unlock()
 		return nil, nil
 	}
 
@@ -313,11 +316,13 @@ func (c *Connection) StartReadLoop() {
 				continue
 			}
 
+			// The handler runs unlocked so that it can reply
 			c.mu.Lock()
-			if c.onMessage != nil {
-				c.onMessage(c, msg)
-			}
+			onMessage := c.onMessage
 			c.mu.Unlock()
+			if onMessage != nil {
+				onMessage(c, msg)
+			}
 		}
 	}()
 }
@@ -12,7 +12,6 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
-	"time"
 )
 
 // Handshake errors.
@@ -87,11 +86,7 @@ func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, connID string
 	}
 
 	// Create WebSocket connection
-	wsConn := &Connection{
-		ID:        connID,
-		Conn:      conn,
-		CreatedAt: time.Now(),
-	}
+	wsConn := NewConnection(connID, conn)
 
 	return wsConn, nil
 }